@@ -22,6 +22,7 @@ type Config struct {
 	Stitch         StitchConfig   `yaml:"stitch"`
 	SPA            SPAConfig      `yaml:"-"`
 	Inc            IncConfig      `yaml:"node"`
+	Webhooks       WebhookConfig  `yaml:"webhooks"`
 }
 
 type HttpConfig struct {
@@ -72,6 +73,13 @@ type StitchConfig struct {
 	ShardsLocation string `yaml:"shards_location"`
 }
 
+// WebhookConfig is the configuration for the delivery of webhooks
+type WebhookConfig struct {
+	// Networks in CIDR notation that webhooks may be delivered to even though
+	// they are not public, such as the one of an internal receiver
+	AllowedNetworks []string `yaml:"allowed_networks"`
+}
+
 type IncConfig struct {
 	ServerName string `yaml:"server_name"`
 	HostName   string `yaml:"host_name"`
@@ -2,6 +2,7 @@ package controller
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"encoding/json"
@@ -10,21 +11,26 @@ import (
 	"io"
 	"mime"
 	"mime/multipart"
+	"net"
 	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/OhanaFS/ohana/config"
 	"github.com/OhanaFS/ohana/controller/inc"
 	"github.com/OhanaFS/ohana/controller/middleware"
 	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/service/pubsub"
 	"github.com/OhanaFS/ohana/util"
 	"github.com/OhanaFS/ohana/util/ctxutil"
 	"github.com/OhanaFS/stitch"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
 	"gorm.io/gorm"
 )
 
@@ -34,6 +40,21 @@ type BackendController struct {
 	Path       string
 	ServerName string
 	Inc        *inc.Inc
+	Events     pubsub.PubSub
+
+	// WebhookAllowedNetworks are the networks outside the public internet
+	// that webhooks may be delivered to
+	WebhookAllowedNetworks []*net.IPNet
+
+	uploads     uploadRegistry
+	s3Keys      s3KeyRegistry
+	webdav      *webdav.Handler
+	webdavOnce  sync.Once
+	thumbnailMu sync.Mutex
+	watchers    watcherRegistry
+
+	webhookClient *http.Client
+	webhookOnce   sync.Once
 }
 
 // NewBackend takes in config, dbfs, loggers, and middleware and registers the backend
@@ -55,8 +76,64 @@ func NewBackend(
 		Inc:        inc,
 	}
 
+	for _, cidr := range config.Webhooks.AllowedNetworks {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("invalid webhook allowed network %q: %w", cidr, err)
+		}
+		bc.WebhookAllowedNetworks = append(bc.WebhookAllowedNetworks, network)
+	}
+
+	if config.Redis.Address == "" {
+		logger.Warn("No redis address configured, live changes only reach the users of this server")
+		bc.Events = pubsub.NewMemoryPubSub()
+	} else {
+		bc.Events = pubsub.NewRedis(config)
+	}
+
 	bc.InitialiseShardsFolder()
 
+	// Copies that were running before a restart will never finish
+	if err := dbfs.FailInterruptedCopies(db, bc.ServerName); err != nil {
+		logger.Warn("failed to mark interrupted copies", zap.Error(err))
+	}
+
+	// Periodically clean up abandoned uploads
+	go func() {
+		ticker := time.NewTicker(time.Hour)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := bc.CleanupUploads(); err != nil {
+				logger.Warn("failed to clean up uploads", zap.Error(err))
+			}
+			if err := bc.CleanupS3Uploads(); err != nil {
+				logger.Warn("failed to clean up S3 multipart uploads", zap.Error(err))
+			}
+		}
+	}()
+
+	// Send the webhook deliveries that are due
+	go func() {
+		ticker := time.NewTicker(webhookInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := bc.DeliverWebhooks(context.Background()); err != nil {
+				logger.Warn("failed to deliver webhooks", zap.Error(err))
+			}
+		}
+	}()
+
+	// Publish the changes made to files to the users watching them
+	go func() {
+		ticker := time.NewTicker(fileEventInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			if err := bc.PublishFileEvents(context.Background()); err != nil {
+				logger.Warn("failed to publish file events", zap.Error(err))
+			}
+		}
+	}()
+
 	// Register routes
 	r := router.NewRoute().Subrouter()
 
@@ -71,6 +148,19 @@ func NewBackend(
 	r.HandleFunc("/api/v1/file/{fileID}/move", bc.MoveFile).Methods("POST")
 	r.HandleFunc("/api/v1/file/{fileID}/copy", bc.CopyFile).Methods("POST")
 	r.HandleFunc("/api/v1/file/{fileID}/path", bc.GetPath).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/thumbnail", bc.GetFileThumbnail).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/lock", bc.GetFileLock).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/lock", bc.LockFile).Methods("POST")
+	r.HandleFunc("/api/v1/file/{fileID}/lock", bc.RefreshFileLock).Methods("PUT")
+	r.HandleFunc("/api/v1/file/{fileID}/lock", bc.UnlockFile).Methods("DELETE")
+	r.HandleFunc("/api/v1/file/{fileID}/lock/break", bc.BreakFileLock).Methods("DELETE")
+	r.HandleFunc("/api/v1/file/{fileID}/tags", bc.GetFileTags).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/tags", bc.SetFileTags).Methods("PUT")
+	r.HandleFunc("/api/v1/file/{fileID}/tags/{key}", bc.SetFileTag).Methods("PUT")
+	r.HandleFunc("/api/v1/file/{fileID}/tags/{key}", bc.DeleteFileTag).Methods("DELETE")
+	r.HandleFunc("/api/v1/file/{fileID}/activity", bc.GetFileActivity).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/shortcut", bc.CreateShortcut).Methods("POST")
+	r.HandleFunc("/api/v1/file/{fileID}/target", bc.GetLinkTarget).Methods("GET")
 	r.HandleFunc("/api/v1/file/{fileID}", bc.DownloadFileVersion).Methods("GET")
 	r.HandleFunc("/api/v1/file/{fileID}", bc.DeleteFile).Methods("DELETE")
 	r.HandleFunc("/api/v1/file/{fileID}/permissions", bc.GetPermissionsFile).Methods("GET")
@@ -82,9 +172,12 @@ func NewBackend(
 	r.HandleFunc("/api/v1/file/{fileID}/share/{link}", bc.PatchFileSharedLink).Methods("PATCH")
 	r.HandleFunc("/api/v1/file/{fileID}/share/{link}", bc.DeleteFileSharedLink).Methods("DELETE")
 	r.HandleFunc("/api/v1/file/{fileID}/share/{link}", bc.CreateFileSharedLink).Methods("POST")
-	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionsID}/metadata", bc.GetFileVersionMetadata).Methods("GET")
-	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionsID}", bc.DownloadFileVersion).Methods("GET")
-	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionsID}", bc.DeleteFileVersion).Methods("DELETE")
+	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionID}/metadata", bc.GetFileVersionMetadata).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/versions/{fromVersionID}/diff/{toVersionID}", bc.GetFileVersionDiff).
+		Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionID}", bc.DownloadFileVersion).Methods("GET")
+	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionID}", bc.DeleteFileVersion).Methods("DELETE")
+	r.HandleFunc("/api/v1/file/{fileID}/versions/{versionID}/revert", bc.RevertFileVersion).Methods("POST")
 	r.HandleFunc("/api/v1/file/{fileID}/versions", bc.GetFileVersionHistory).Methods("GET")
 
 	// Folder
@@ -99,8 +192,68 @@ func NewBackend(
 	r.HandleFunc("/api/v1/folder/{folderID}/permissions/{permissionID}", bc.ModifyPermissionsFolder).Methods("PATCH")
 	r.HandleFunc("/api/v1/folder/{folderID}/permissions/{permissionID}", bc.DeletePermissionFolder).Methods("DELETE")
 	r.HandleFunc("/api/v1/folder/{folderID}/move", bc.MoveFolder).Methods("POST")
-	r.HandleFunc("/api/v1/file/{folderID}/copy", bc.CopyFile).Methods("POST")
+	r.HandleFunc("/api/v1/folder/{folderID}/copy", bc.CopyFolder).Methods("POST")
 	r.HandleFunc("/api/v1/folder/{folderID}/details", bc.GetMetadataFile).Methods("GET")
+	r.HandleFunc("/api/v1/folder/{folderID}/archive", bc.DownloadFolderArchive).Methods("GET")
+	r.HandleFunc("/api/v1/folder/{folderID}/import", bc.ImportFolderArchive).Methods("POST")
+
+	// Resumable Uploads
+	r.HandleFunc("/api/v1/upload", bc.StartUpload).Methods("POST")
+	r.HandleFunc("/api/v1/upload/{uploadID}", bc.GetUpload).Methods("GET")
+	r.HandleFunc("/api/v1/upload/{uploadID}", bc.AbortUpload).Methods("DELETE")
+	r.HandleFunc("/api/v1/upload/{uploadID}/finish", bc.FinishUpload).Methods("POST")
+	r.HandleFunc("/api/v1/upload/{uploadID}/{chunkNo:[0-9]+}", bc.UploadChunk).Methods("PUT")
+
+	// WebDAV
+	r.Path(WebDAVPrefix).HandlerFunc(bc.WebDAV)
+	r.PathPrefix(WebDAVPrefix + "/").HandlerFunc(bc.WebDAV)
+
+	// S3 Access Keys
+	r.HandleFunc("/api/v1/s3/keys", bc.GetS3AccessKeys).Methods("GET")
+	r.HandleFunc("/api/v1/s3/keys", bc.CreateS3AccessKey).Methods("POST")
+	r.HandleFunc("/api/v1/s3/keys/{accessKeyID}", bc.DeleteS3AccessKey).Methods("DELETE")
+
+	// Search
+	r.HandleFunc("/api/v1/search", bc.SearchFiles).Methods("GET")
+
+	// Batch
+	r.HandleFunc("/api/v1/batch", bc.Batch).Methods("POST")
+
+	// Background copies
+	r.HandleFunc("/api/v1/copy/{operationID}", bc.GetCopyOperation).Methods("GET")
+
+	// Webhooks
+	r.HandleFunc("/api/v1/webhooks", bc.GetWebhooks).Methods("GET")
+	r.HandleFunc("/api/v1/webhooks", bc.CreateWebhook).Methods("POST")
+	r.HandleFunc("/api/v1/webhooks/{webhookID}", bc.GetWebhook).Methods("GET")
+	r.HandleFunc("/api/v1/webhooks/{webhookID}", bc.UpdateWebhook).Methods("PATCH")
+	r.HandleFunc("/api/v1/webhooks/{webhookID}", bc.DeleteWebhook).Methods("DELETE")
+	r.HandleFunc("/api/v1/webhooks/{webhookID}/deliveries", bc.GetWebhookDeliveries).Methods("GET")
+
+	// Live changes
+	r.HandleFunc("/api/v1/events", bc.WatchFolders).Methods("GET")
+
+	// Trash
+	r.HandleFunc("/api/v1/trash", bc.GetTrash).Methods("GET")
+	r.HandleFunc("/api/v1/trash", bc.EmptyTrash).Methods("DELETE")
+	r.HandleFunc("/api/v1/trash/retention", bc.GetTrashRetention).Methods("GET")
+	r.HandleFunc("/api/v1/trash/retention", bc.SetTrashRetention).Methods("PUT")
+	r.HandleFunc("/api/v1/trash/{trashID}/restore", bc.RestoreTrashItem).Methods("POST")
+	r.HandleFunc("/api/v1/trash/{trashID}", bc.DeleteTrashItem).Methods("DELETE")
+
+	// Quotas
+	r.HandleFunc("/api/v1/quota", bc.GetOwnQuota).Methods("GET")
+	r.HandleFunc("/api/v1/quotas", bc.GetQuotas).Methods("GET")
+	r.HandleFunc("/api/v1/quotas/settings", bc.SetQuotaSettings).Methods("PUT")
+	r.HandleFunc("/api/v1/quotas/recalculate", bc.RecalculateQuotas).Methods("POST")
+	r.HandleFunc("/api/v1/quotas/users/{userID}", bc.GetUserQuota).Methods("GET")
+	r.HandleFunc("/api/v1/quotas/users/{userID}", bc.SetUserQuota).Methods("PUT", "DELETE")
+	r.HandleFunc("/api/v1/quotas/groups/{groupID}", bc.GetGroupQuota).Methods("GET")
+	r.HandleFunc("/api/v1/quotas/groups/{groupID}", bc.SetGroupQuota).Methods("PUT", "DELETE")
+
+	// Deduplication
+	r.HandleFunc("/api/v1/dedup", bc.GetDedupSettings).Methods("GET")
+	r.HandleFunc("/api/v1/dedup", bc.SetDedupSettings).Methods("PUT")
 
 	// Get Favorites, Get Shared
 	r.HandleFunc("/api/v1/favorites", bc.GetFavorites).Methods("GET")
@@ -113,8 +266,19 @@ func NewBackend(
 	// Use a fresh subrouter to skip auth
 	rPub := router.NewRoute().Subrouter()
 	rPub.HandleFunc("/api/v1/shared/{shortenedLink}/metadata", bc.GetMetadataSharedLink).Methods("GET")
+	rPub.HandleFunc("/api/v1/shared/{shortenedLink}/ls", bc.ListSharedLink).Methods("GET")
+	rPub.HandleFunc("/api/v1/shared/{shortenedLink}/archive", bc.DownloadSharedLinkArchive).Methods("GET")
 	rPub.HandleFunc("/api/v1/shared/{shortenedLink}", bc.DownloadSharedLink).Methods("GET")
 
+	// S3 Gateway
+	// Requests are signed with SigV4 instead of using the session cookie
+	rS3 := router.PathPrefix(S3Prefix).Subrouter()
+	rS3.HandleFunc("/", bc.S3ListBuckets).Methods("GET")
+	rS3.HandleFunc("/{bucket}", bc.S3Bucket)
+	rS3.HandleFunc("/{bucket}/", bc.S3Bucket)
+	rS3.HandleFunc("/{bucket}/{key:.+}", bc.S3Object)
+	rS3.Use(bc.S3Auth)
+
 	// Cluster Routes
 	r.HandleFunc("/api/v1/cluster/stats/num_of_files", bc.GetNumOfFiles).Methods("GET")
 	r.HandleFunc("/api/v1/cluster/stats/num_of_files_historical", bc.GetNumOfFilesHistorical).Methods("GET")
@@ -296,6 +460,16 @@ func (bc *BackendController) UploadFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Reject the upload early if the user has no space left
+	err = dbfs.CheckQuotaLeft(bc.Db, user.UserId)
+	if errors.Is(err, dbfs.ErrQuotaExceeded) {
+		util.HttpError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
 	// Get encoder params and create new encoder
 	stitchParams, err := dbfs.GetStitchParams(bc.Db, bc.Logger)
 	dataShards, parityShards, keyThreshold :=
@@ -416,7 +590,8 @@ func (bc *BackendController) UploadFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Encode the file
+	// Encode the file. Stitch compresses the data with seekable zstd before
+	// encrypting it, so downloads and range requests can still seek into it.
 	result, err := encoder.Encode(file, shardWriters, dataKeyBytes, dataIvBytes)
 	if err != nil {
 		util.HttpError(w, http.StatusInternalServerError,
@@ -476,9 +651,14 @@ func (bc *BackendController) UploadFile(w http.ResponseWriter, r *http.Request)
 		if err2 != nil {
 			errorText += " Error deleting file: " + err2.Error()
 		}
-		util.HttpError(w, http.StatusInternalServerError, errorText)
+		status := http.StatusInternalServerError
+		if errors.Is(err, dbfs.ErrQuotaExceeded) {
+			status = http.StatusInsufficientStorage
+		}
+		util.HttpError(w, status, errorText)
 		return
 	}
+	bc.queueThumbnails(user, &dbfsFile, "")
 
 	// success
 	util.HttpJson(w, http.StatusOK, dbfsFile)
@@ -514,6 +694,9 @@ func (bc *BackendController) UpdateFile(w http.ResponseWriter, r *http.Request)
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
+	if !checkPreconditions(w, r, dbfsFile) {
+		return
+	}
 
 	hasPermissions, err := user.HasPermission(bc.Db, dbfsFile, &dbfs.PermissionNeeded{Write: true})
 	if err != nil {
@@ -525,6 +708,18 @@ func (bc *BackendController) UpdateFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// Reject the update early if the owner of the file has no space left
+	if dbfsFile.OwnerUserId != nil {
+		err = dbfs.CheckQuotaLeft(bc.Db, *dbfsFile.OwnerUserId)
+		if errors.Is(err, dbfs.ErrQuotaExceeded) {
+			util.HttpError(w, http.StatusInsufficientStorage, err.Error())
+			return
+		} else if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
 	// Get encoder params and create new encoder
 	stitchParams, err := dbfs.GetStitchParams(bc.Db, bc.Logger)
 	dataShards, parityShards, keyThreshold := stitchParams.DataShards, stitchParams.ParityShards, stitchParams.KeyThreshold
@@ -552,12 +747,22 @@ func (bc *BackendController) UpdateFile(w http.ResponseWriter, r *http.Request)
 	defer file.Close()
 
 	// Use placeholder size values as it is not yet known at this point
-	err = dbfsFile.UpdateFile(bc.Db, 1024, 1024, "TODO:CHECKSUM", "", dataKey, dataIv, password, user, file.Filename)
+	err = bc.whileUnchanged(r, dbfsFile, func(tx *gorm.DB) error {
+		return dbfsFile.UpdateFile(tx, 1024, 1024, "TODO:CHECKSUM", "", dataKey, dataIv, password, user, file.Filename)
+	})
 	if err != nil {
+		if errors.Is(err, dbfs.ErrPreconditionFailed) {
+			util.HttpError(w, http.StatusPreconditionFailed, err.Error())
+			return
+		}
 		if errors.Is(err, dbfs.ErrIncorrectPassword) {
 			util.HttpError(w, http.StatusForbidden, err.Error())
 			return
 		}
+		if errors.Is(err, dbfs.ErrFileLocked) {
+			util.HttpError(w, http.StatusLocked, err.Error())
+			return
+		}
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -667,11 +872,18 @@ func (bc *BackendController) UpdateFile(w http.ResponseWriter, r *http.Request)
 		if err2 != nil {
 			errString += " " + err2.Error()
 		}
-		util.HttpError(w, http.StatusInternalServerError, errString)
+		status := http.StatusInternalServerError
+		if errors.Is(err, dbfs.ErrQuotaExceeded) {
+			status = http.StatusInsufficientStorage
+		}
+		util.HttpError(w, status, errString)
 		return
 	}
+	bc.queuePreviousAsPatch(user, dbfsFile, password)
+	bc.queueThumbnails(user, dbfsFile, password)
 
 	// success
+	w.Header().Set("ETag", dbfsFile.ETag())
 	util.HttpJson(w, http.StatusOK, dbfsFile)
 
 }
@@ -696,6 +908,7 @@ func (bc *BackendController) GetMetadataFile(w http.ResponseWriter, r *http.Requ
 	}
 
 	// json encode file
+	w.Header().Set("ETag", file.ETag())
 	util.HttpJson(w, http.StatusOK, file)
 }
 
@@ -730,17 +943,30 @@ func (bc *BackendController) UpdateMetadataFile(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !checkPreconditions(w, r, file) {
+		return
+	}
+
 	// Update file
-	err = file.UpdateMetaData(bc.Db, fmm, user)
-	if errors.Is(err, dbfs.ErrNoPermission) {
+	err = bc.whileUnchanged(r, file, func(tx *gorm.DB) error {
+		return file.UpdateMetaData(tx, fmm, user)
+	})
+	if errors.Is(err, dbfs.ErrPreconditionFailed) {
+		util.HttpError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrNoPermission) {
 		util.HttpError(w, http.StatusForbidden, err.Error())
 		return
+	} else if errors.Is(err, dbfs.ErrFileLocked) {
+		util.HttpError(w, http.StatusLocked, err.Error())
+		return
 	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// success
+	w.Header().Set("ETag", file.ETag())
 	util.HttpJson(w, http.StatusOK, file)
 
 }
@@ -788,17 +1014,30 @@ func (bc *BackendController) MoveFile(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !checkPreconditions(w, r, file) {
+		return
+	}
+
 	// Move file (Permission check will be done by dbfs)
-	err = file.Move(bc.Db, destFolder, user)
-	if errors.Is(err, dbfs.ErrNoPermission) {
+	err = bc.whileUnchanged(r, file, func(tx *gorm.DB) error {
+		return file.Move(tx, destFolder, user)
+	})
+	if errors.Is(err, dbfs.ErrPreconditionFailed) {
+		util.HttpError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrNoPermission) {
 		util.HttpError(w, http.StatusForbidden, err.Error())
 		return
+	} else if errors.Is(err, dbfs.ErrFileLocked) {
+		util.HttpError(w, http.StatusLocked, err.Error())
+		return
 	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	// success
+	w.Header().Set("ETag", file.ETag())
 	util.HttpJson(w, http.StatusOK, nil)
 
 }
@@ -859,6 +1098,9 @@ func (bc *BackendController) CopyFile(w http.ResponseWriter, r *http.Request) {
 	if errors.Is(err, dbfs.ErrNoPermission) {
 		util.HttpError(w, http.StatusForbidden, "No write permisison on destination folder")
 		return
+	} else if errors.Is(err, dbfs.ErrQuotaExceeded) {
+		util.HttpError(w, http.StatusInsufficientStorage, err.Error())
+		return
 	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -896,11 +1138,24 @@ func (bc *BackendController) DeleteFile(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	// Delete file
-	err = file.Delete(bc.Db, user, bc.ServerName)
-	if errors.Is(err, dbfs.ErrNoPermission) {
+	if !checkPreconditions(w, r, file) {
+		return
+	}
+
+	// Move file to the trash
+	err = bc.whileUnchanged(r, file, func(tx *gorm.DB) error {
+		_, err := file.Trash(tx, user)
+		return err
+	})
+	if errors.Is(err, dbfs.ErrPreconditionFailed) {
+		util.HttpError(w, http.StatusPreconditionFailed, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrNoPermission) {
 		util.HttpError(w, http.StatusForbidden, "No write permisison on destination folder")
 		return
+	} else if errors.Is(err, dbfs.ErrFileLocked) {
+		util.HttpError(w, http.StatusLocked, err.Error())
+		return
 	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -1283,8 +1538,12 @@ func (bc *BackendController) GetFileVersionMetadata(w http.ResponseWriter, r *ht
 	if errors.Is(err, dbfs.ErrVersionNotFound) {
 		util.HttpError(w, http.StatusNotFound, err.Error())
 		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
 	}
 
+	w.Header().Set("ETag", version.ETag())
 	util.HttpJson(w, http.StatusOK, version)
 
 }
@@ -1421,59 +1680,32 @@ func (bc *BackendController) DownloadFileVersion(w http.ResponseWriter, r *http.
 	if errors.Is(err, dbfs.ErrVersionNotFound) {
 		util.HttpError(w, http.StatusNotFound, err.Error())
 		return
-	}
-
-	// get file
-	shardsMeta, err := version.GetFragments(bc.Db, user)
-	if err != nil {
-		util.HttpError(w, http.StatusNotFound, err.Error())
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// Opening input files
-	var shards []io.ReadSeeker
-	for _, shardMeta := range shardsMeta {
-		shardReader, err := bc.Inc.NewShardReader(
-			r.Context(), shardMeta.ServerName, shardMeta.FileFragmentPath)
-		if err == nil {
-			shards = append(shards, shardReader)
-		}
+	// Decode file, rebuilding it first if it is stored as a patch
+	var reader io.ReadSeeker
+	if version.Patch {
+		reader, err = bc.openPatchedVersion(r.Context(), user, file, version, password)
+	} else {
+		reader, err = bc.openVersionData(r.Context(), user, version, password)
 	}
-
-	hexKey, hexIv, err := version.GetDecryptionKey(bc.Db, user, password)
 	if err != nil {
 		if errors.Is(err, dbfs.ErrIncorrectPassword) || errors.Is(err, dbfs.ErrPasswordRequired) {
 			w.Header().Add("WWW-Authenticate", `Basic realm="Encrypted file, password required"`)
 			util.HttpError(w, http.StatusUnauthorized, err.Error())
 			return
+		} else if errors.Is(err, dbfs.ErrFileNotFound) || errors.Is(err, dbfs.ErrNotFile) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+			return
 		}
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-
-	// Getting key and iv
-	key, err := hex.DecodeString(hexKey)
-	if err != nil {
-		util.HttpError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-	iv, err := hex.DecodeString(hexIv)
-	if err != nil {
-		util.HttpError(w, http.StatusInternalServerError, err.Error())
-		return
-	}
-
-	encoder := stitch.NewEncoder(&stitch.EncoderOptions{
-		DataShards:   uint8(version.DataShards),
-		ParityShards: uint8(version.ParityShards),
-		KeyThreshold: uint8(version.KeyThreshold)},
-	)
-
-	// Decode file
-	reader, err := encoder.NewReadSeeker(shards, key, iv)
-	if err != nil {
-		util.HttpError(w, http.StatusInternalServerError, err.Error())
-		return
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
 	}
 
 	w.Header().Set("Content-Type", file.MIMEType)
@@ -1483,6 +1715,14 @@ func (bc *BackendController) DownloadFileVersion(w http.ResponseWriter, r *http.
 		w.Header().Set("Content-Disposition", "inline; filename="+file.FileName)
 	}
 
+	// The current version is tagged like the file, older ones by themselves
+	if version.VersionNo == file.VersionNo {
+		w.Header().Set("ETag", file.ETag())
+	} else {
+		w.Header().Set("ETag", version.ETag())
+	}
+
+	bc.recordDownload(r, file, user, "version "+strconv.Itoa(version.VersionNo))
 	http.ServeContent(w, r, file.FileName, file.ModifiedTime, reader)
 }
 
@@ -1503,7 +1743,7 @@ func (bc *BackendController) DeleteFileVersion(w http.ResponseWriter, r *http.Re
 		util.HttpError(w, http.StatusBadRequest, "No fileID provided")
 		return
 	}
-	versionID := vars["versionsID"]
+	versionID := vars["versionID"]
 
 	// convert versionID into int
 	versionIDInt, err := strconv.Atoi(versionID)
@@ -1532,6 +1772,9 @@ func (bc *BackendController) DeleteFileVersion(w http.ResponseWriter, r *http.Re
 	if errors.Is(err, dbfs.ErrVersionNotFound) {
 		util.HttpError(w, http.StatusNotFound, err.Error())
 		return
+	} else if errors.Is(err, dbfs.ErrVersionIsPatchBase) {
+		util.HttpError(w, http.StatusConflict, err.Error())
+		return
 	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
@@ -1541,7 +1784,59 @@ func (bc *BackendController) DeleteFileVersion(w http.ResponseWriter, r *http.Re
 
 }
 
-// LsFolderID lists the contents of a folder based on the folderID
+// RevertFileVersion creates a new version of the file with the data and
+// metadata of the version given, and returns the file.
+func (bc *BackendController) RevertFileVersion(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	vars := mux.Vars(r)
+	versionNo, err := strconv.Atoi(vars["versionID"])
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	file, err := dbfs.GetFileById(bc.Db, vars["fileID"], user)
+	if errors.Is(err, dbfs.ErrFileNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file.EntryType != dbfs.IsFile {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFile.Error())
+		return
+	}
+
+	err = bc.revertFileToVersion(r.Context(), user, file, versionNo, r.Header.Get("password"))
+	if errors.Is(err, dbfs.ErrVersionNotFound) || errors.Is(err, gorm.ErrRecordNotFound) {
+		util.HttpError(w, http.StatusNotFound, dbfs.ErrVersionNotFound.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrNoPermission) {
+		util.HttpError(w, http.StatusForbidden, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrIncorrectPassword) || errors.Is(err, dbfs.ErrPasswordRequired) {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrFileLocked) {
+		util.HttpError(w, http.StatusLocked, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, file)
+}
+
+// LsFolderID lists the contents of a folder based on the folderID. The listing
+// can be sorted and paginated, with the cursor of the next page and the total
+// count returned in the X-Next-Cursor and X-Total-Count headers.
 func (bc *BackendController) LsFolderID(w http.ResponseWriter, r *http.Request) {
 	// somehow get user idk
 	user, err := ctxutil.GetUser(r.Context())
@@ -1573,15 +1868,50 @@ func (bc *BackendController) LsFolderID(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
+	// get listing options
+	queries := r.URL.Query()
+	opts := &dbfs.ListOptions{
+		SortBy:       queries.Get("sort"),
+		FoldersFirst: queries.Get("folders_first") == "true",
+		Cursor:       queries.Get("cursor"),
+		Count:        queries.Get("count") == "true",
+		Tags:         tagFiltersFromQuery(r),
+	}
+	switch queries.Get("order") {
+	case "", "asc":
+	case "desc":
+		opts.Descending = true
+	default:
+		util.HttpError(w, http.StatusBadRequest, "order must be asc or desc")
+		return
+	}
+	if limit := queries.Get("limit"); limit != "" {
+		opts.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
 	// get folder contents
-	files, err := folder.ListContents(bc.Db, user)
-	if err != nil {
+	page, err := folder.ListContentsPage(bc.Db, user, opts)
+	if errors.Is(err, dbfs.ErrInvalidListOptions) || errors.Is(err, dbfs.ErrInvalidCursor) ||
+		errors.Is(err, dbfs.ErrNotFolder) {
+		util.HttpError(w, http.StatusBadRequest, err.Error())
+		return
+	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
-	// return contents
-	util.HttpJson(w, http.StatusOK, files)
+	// return contents, with the pagination details in the headers
+	if page.NextCursor != "" {
+		w.Header().Set("X-Next-Cursor", page.NextCursor)
+	}
+	if page.Total != nil {
+		w.Header().Set("X-Total-Count", strconv.FormatInt(*page.Total, 10))
+	}
+	util.HttpJson(w, http.StatusOK, page.Files)
 }
 
 // UpdateFolderMetadata updates the filename or the versioningMode of a folder
@@ -1716,9 +2046,12 @@ func (bc *BackendController) DeleteFolder(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// attempt to delete folder
-	err = folder.Delete(bc.Db, user, bc.ServerName)
-	if err != nil {
+	// attempt to move folder to the trash
+	_, err = folder.Trash(bc.Db, user)
+	if errors.Is(err, dbfs.ErrNoPermission) {
+		util.HttpError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
@@ -2318,12 +2651,6 @@ func (bc *BackendController) GetFileSharedLinks(w http.ResponseWriter, r *http.R
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	// Check if file is actually a file
-	if file.EntryType != dbfs.IsFile {
-		util.HttpError(w, http.StatusBadRequest, "File is not a file")
-		return
-	}
-
 	// Get File Shared Links
 	sharedLinks, err := file.GetSharedLinks(bc.Db, user)
 	if err != nil {
@@ -2362,14 +2689,22 @@ func (bc *BackendController) CreateFileSharedLink(w http.ResponseWriter, r *http
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	// Check if file is actually a file
-	if file.EntryType != dbfs.IsFile {
-		util.HttpError(w, http.StatusBadRequest, "File is not a file")
+	options, hasOptions, err := sharedLinkOptionsFromHeaders(r)
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	// Create Shared Link
-	sharedLink, err := file.CreateSharedLink(bc.Db, user, link)
+	var sharedLink *dbfs.SharedLink
+	err = bc.Db.Transaction(func(tx *gorm.DB) error {
+		sharedLink, err = file.CreateSharedLink(tx, user, link)
+		if err != nil || !hasOptions {
+			return err
+		}
+		sharedLink, err = file.UpdateSharedLinkOptions(tx, user, sharedLink.ShortenedLink, options)
+		return err
+	})
 	if err != nil {
 		if errors.Is(err, dbfs.ErrLinkExists) {
 			util.HttpError(w, http.StatusConflict, err.Error())
@@ -2409,12 +2744,6 @@ func (bc *BackendController) DeleteFileSharedLink(w http.ResponseWriter, r *http
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	// Check if file is actually a file
-	if file.EntryType != dbfs.IsFile {
-		util.HttpError(w, http.StatusBadRequest, "File is not a file")
-		return
-	}
-
 	// Delete Shared Link
 	err = file.DeleteSharedLink(bc.Db, user, link)
 	if err != nil {
@@ -2437,13 +2766,18 @@ func (bc *BackendController) PatchFileSharedLink(w http.ResponseWriter, r *http.
 
 	// Get link from headers
 	newLink := r.Header.Get("new_link")
+	options, hasOptions, err := sharedLinkOptionsFromHeaders(r)
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
 	// fileID
 	vars := mux.Vars(r)
 	fileID := vars["fileID"]
 	link := vars["link"]
-	if fileID == "" || link == "" || newLink == "" {
-		util.HttpError(w, http.StatusBadRequest, "No fileID, link, new_link provided")
+	if fileID == "" || link == "" || (newLink == "" && !hasOptions) {
+		util.HttpError(w, http.StatusBadRequest, "No fileID, link, new_link or options provided")
 		return
 	}
 
@@ -2456,19 +2790,27 @@ func (bc *BackendController) PatchFileSharedLink(w http.ResponseWriter, r *http.
 		util.HttpError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
-	// Check if file is actually a file
-	if file.EntryType != dbfs.IsFile {
-		util.HttpError(w, http.StatusBadRequest, "File is not a file")
-		return
-	}
-
 	// Update Shared Link
-	err = file.UpdateSharedLink(bc.Db, user, link, newLink)
+	err = bc.Db.Transaction(func(tx *gorm.DB) error {
+		if hasOptions {
+			if _, err := file.UpdateSharedLinkOptions(tx, user, link, options); err != nil {
+				return err
+			}
+		}
+		if newLink != "" {
+			return file.UpdateSharedLink(tx, user, link, newLink)
+		}
+		return nil
+	})
 	if err != nil {
 		if errors.Is(err, dbfs.ErrLinkExists) {
 			util.HttpError(w, http.StatusConflict, err.Error())
 			return
 		}
+		if errors.Is(err, dbfs.ErrSharedLinkNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+			return
+		}
 		util.HttpError(w, http.StatusInternalServerError,
 			fmt.Sprintf("Error updating shared link: %s", err.Error()))
 		return
@@ -2478,7 +2820,8 @@ func (bc *BackendController) PatchFileSharedLink(w http.ResponseWriter, r *http.
 	util.HttpJson(w, http.StatusOK, true)
 }
 
-// GetMetadataSharedLink returns the metadata for the requested file based on ID
+// GetMetadataSharedLink returns the metadata of the file behind a shared link,
+// or of an entry inside a shared folder given its path
 func (bc *BackendController) GetMetadataSharedLink(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
@@ -2490,21 +2833,17 @@ func (bc *BackendController) GetMetadataSharedLink(w http.ResponseWriter, r *htt
 	}
 
 	// get file
-	file, err := dbfs.GetFileFromShortenedLink(bc.Db, shortenedLink)
-	if err != nil {
-		if errors.Is(err, dbfs.ErrSharedLinkNotFound) {
-			util.HttpError(w, http.StatusNotFound, err.Error())
-			return
-		} else {
-			util.HttpError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
+	_, file, ok := bc.openSharedLink(w, r, shortenedLink)
+	if !ok {
+		return
 	}
 	// json encode file
+	w.Header().Set("ETag", file.ETag())
 	util.HttpJson(w, http.StatusOK, file)
 }
 
-//DownloadSharedLink downloads a file version
+// DownloadSharedLink downloads the file behind a shared link, or a file inside
+// a shared folder given its path
 func (bc *BackendController) DownloadSharedLink(w http.ResponseWriter, r *http.Request) {
 
 	vars := mux.Vars(r)
@@ -2551,15 +2890,13 @@ func (bc *BackendController) DownloadSharedLink(w http.ResponseWriter, r *http.R
 	}
 
 	// get file
-	file, err := dbfs.GetFileFromShortenedLink(bc.Db, shortenedLink)
-	if err != nil {
-		if errors.Is(err, dbfs.ErrSharedLinkNotFound) {
-			util.HttpError(w, http.StatusNotFound, err.Error())
-			return
-		} else {
-			util.HttpError(w, http.StatusInternalServerError, err.Error())
-			return
-		}
+	sharedLink, file, ok := bc.openSharedLink(w, r, shortenedLink)
+	if !ok {
+		return
+	}
+	if file.EntryType == dbfs.IsFolder {
+		util.HttpError(w, http.StatusBadRequest, "Shared entry is a folder, list or archive it instead")
+		return
 	}
 
 	// get file
@@ -2615,6 +2952,11 @@ func (bc *BackendController) DownloadSharedLink(w http.ResponseWriter, r *http.R
 		return
 	}
 
+	if !bc.recordSharedLinkDownload(w, r, sharedLink, file) {
+		return
+	}
+
+	w.Header().Set("ETag", file.ETag())
 	w.Header().Set("Content-Type", file.MIMEType)
 	if isDownload {
 		w.Header().Set("Content-Disposition", "attachment; filename="+file.FileName)
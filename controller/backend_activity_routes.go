@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"go.uber.org/zap"
+)
+
+// isContinuedDownload returns whether the request only continues a download
+// that was already started, i.e. asks for a range that does not start at the
+// beginning of the file
+func isContinuedDownload(r *http.Request) bool {
+	rangeHeader := r.Header.Get("Range")
+	return rangeHeader != "" && !strings.HasPrefix(rangeHeader, "bytes=0-")
+}
+
+// recordDownload adds a download to the activity of a file. The user is nil
+// for anonymous downloads. Failing to record it does not stop the download.
+func (bc *BackendController) recordDownload(r *http.Request, file *dbfs.File, user *dbfs.User, details string) {
+	if isContinuedDownload(r) {
+		return
+	}
+
+	if err := dbfs.RecordActivity(bc.Db, file.FileId, user, dbfs.ActivityDownload, details); err != nil {
+		bc.Logger.Warn("failed to record download",
+			zap.String("fileId", file.FileId),
+			zap.Error(err))
+	}
+}
+
+// GetFileActivity returns the activity on a file or folder, newest first.
+// Requires the audit permission. Takes in the user, action and limit query
+// parameters to filter it.
+func (bc *BackendController) GetFileActivity(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	queries := r.URL.Query()
+	filter := &dbfs.ActivityFilter{
+		UserId: queries.Get("user"),
+		Action: queries.Get("action"),
+	}
+	if limit := queries.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	activity, err := file.GetActivity(bc.Db, user, filter)
+	if err != nil {
+		switch {
+		case errors.Is(err, dbfs.ErrFileNotFound):
+			util.HttpError(w, http.StatusNotFound, err.Error())
+		case errors.Is(err, dbfs.ErrNoPermission):
+			util.HttpError(w, http.StatusForbidden, err.Error())
+		case errors.Is(err, dbfs.ErrInvalidActivityFilter):
+			util.HttpError(w, http.StatusBadRequest, err.Error())
+		default:
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, activity)
+}
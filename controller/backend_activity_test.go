@@ -0,0 +1,85 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_FileActivity(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	reader, err := dbfs.CreateNewUser(db, "activityUser", "activityUser", dbfs.AccountTypeEndUser,
+		"activityUser", "activityUser", "activityUser", "activityUser", "localhost")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "activity", admin, "localhost")
+	Assert.NoError(err)
+	file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+		FileName:       "minutes",
+		ParentFolderId: folder.FileId,
+		Server:         "localhost",
+		FragmentPath:   t.TempDir(),
+		FileData:       "minutes data",
+		Size:           50,
+		ActualSize:     80,
+	})
+	Assert.NoError(err)
+
+	Assert.NoError(file.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, admin, *reader))
+	_, err = file.CreateSharedLink(db, admin, "")
+	Assert.NoError(err)
+
+	getActivity := func(as *dbfs.User, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/file/"+file.FileId+"/activity"+query, nil).
+			WithContext(ctxutil.WithUser(context.Background(), as))
+		w := httptest.NewRecorder()
+		bc.GetFileActivity(w, mux.SetURLVars(req, map[string]string{"fileID": file.FileId}))
+		return w
+	}
+
+	t.Run("Reading the activity", func(t *testing.T) {
+		var activity []dbfs.FileActivity
+		w := getActivity(admin, "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &activity))
+		Assert.Len(activity, 2)
+
+		w = getActivity(admin, "?action=share&user="+admin.UserId)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &activity))
+		Assert.Len(activity, 1)
+		Assert.Equal(dbfs.ActivityShare, activity[0].Action)
+
+		w = getActivity(admin, "?action=unknown")
+		Assert.Equal(http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Needs the audit permission", func(t *testing.T) {
+		w := getActivity(reader, "")
+		Assert.Equal(http.StatusForbidden, w.Code)
+	})
+}
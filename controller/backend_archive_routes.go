@@ -0,0 +1,317 @@
+package controller
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	ArchiveFormatZip = "zip"
+	ArchiveFormatTar = "tar"
+)
+
+// archiveWriter writes the entries of a folder into an archive
+type archiveWriter interface {
+	addFolder(name string, modified time.Time) error
+	addFile(name string, file *dbfs.File, data io.Reader) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) addFolder(name string, modified time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name + "/",
+		Modified: modified,
+	})
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(name string, file *dbfs.File, data io.Reader) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: file.ModifiedTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, data)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	tw *tar.Writer
+}
+
+func (a *tarArchiveWriter) addFolder(name string, modified time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeDir,
+		Name:     name + "/",
+		Mode:     0755,
+		ModTime:  modified,
+	})
+}
+
+func (a *tarArchiveWriter) addFile(name string, file *dbfs.File, data io.Reader) error {
+	err := a.tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     file.Size,
+		ModTime:  file.ModifiedTime,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.CopyN(a.tw, data, file.Size)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	return a.tw.Close()
+}
+
+// archiveRequest holds what is needed to write the contents of a folder into
+// an archive. If user is nil, the folder is read through a shared link.
+type archiveRequest struct {
+	bc             *BackendController
+	ctx            context.Context
+	user           *dbfs.User
+	password       string
+	filePasswords  map[string]string
+	archive        archiveWriter
+	writtenEntries int
+	skippedEntries int
+}
+
+// isSkippable returns true for errors caused by an entry that the requester
+// cannot read, which are left out of the archive.
+func isSkippable(err error) bool {
+	return errors.Is(err, dbfs.ErrFileNotFound) || errors.Is(err, dbfs.ErrNoPermission) ||
+		errors.Is(err, dbfs.ErrPasswordRequired) || errors.Is(err, dbfs.ErrIncorrectPassword)
+}
+
+// listFolder returns the contents of a folder that the requester can list
+func (a *archiveRequest) listFolder(folder *dbfs.File) ([]dbfs.File, error) {
+	if a.user == nil {
+		return folder.ListSharedContents(a.bc.Db)
+	}
+	return folder.ListContents(a.bc.Db, a.user)
+}
+
+// addContents recursively adds the contents of a folder to the archive
+func (a *archiveRequest) addContents(contents []dbfs.File, prefix string) error {
+	bc := a.bc
+
+	for i := range contents {
+		item := &contents[i]
+		name := prefix + item.FileName
+
+		switch item.EntryType {
+		case dbfs.IsFolder:
+			subContents, err := a.listFolder(item)
+			if err != nil {
+				if !isSkippable(err) {
+					return err
+				}
+				a.skippedEntries++
+				continue
+			}
+			if err := a.archive.addFolder(name, item.ModifiedTime); err != nil {
+				return err
+			}
+			if err := a.addContents(subContents, name+"/"); err != nil {
+				return err
+			}
+		case dbfs.IsFile:
+			if item.Status == dbfs.FileStatusWriting {
+				continue
+			}
+
+			password, ok := a.filePasswords[item.FileId]
+			if !ok {
+				password = a.password
+			}
+
+			reader, err := bc.openFileVersion(a.ctx, a.user, item, item.VersionNo, password)
+			if err != nil {
+				if !isSkippable(err) {
+					return err
+				}
+				bc.Logger.Debug("skipping file in archive",
+					zap.String("fileId", item.FileId), zap.Error(err))
+				a.skippedEntries++
+				continue
+			}
+
+			err = a.archive.addFile(name, item, reader)
+			if closer, ok := reader.(io.Closer); ok {
+				closer.Close()
+			}
+			if err != nil {
+				return err
+			}
+			a.writtenEntries++
+		}
+	}
+
+	return nil
+}
+
+// parseArchiveFormat returns the archive format requested, defaulting to zip
+func parseArchiveFormat(r *http.Request) (string, bool) {
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "":
+		return ArchiveFormatZip, true
+	case ArchiveFormatZip, ArchiveFormatTar:
+		return format, true
+	default:
+		return "", false
+	}
+}
+
+// parseArchivePasswords returns the passwords given for the files in the
+// archive. The "password" header applies to every file, while the
+// "passwords" header is a JSON object of file ids to passwords.
+func parseArchivePasswords(r *http.Request) (string, map[string]string, error) {
+	filePasswords := map[string]string{}
+	if header := r.Header.Get("passwords"); header != "" {
+		if err := json.Unmarshal([]byte(header), &filePasswords); err != nil {
+			return "", nil, err
+		}
+	}
+	return r.Header.Get("password"), filePasswords, nil
+}
+
+// streamArchive writes the contents of the folder given to the response as
+// an archive. Entries that cannot be read are skipped.
+func (bc *BackendController) streamArchive(w http.ResponseWriter, r *http.Request, user *dbfs.User,
+	folder *dbfs.File, format string) {
+
+	password, filePasswords, err := parseArchivePasswords(r)
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid passwords header")
+		return
+	}
+
+	request := &archiveRequest{
+		bc:            bc,
+		ctx:           r.Context(),
+		user:          user,
+		password:      password,
+		filePasswords: filePasswords,
+	}
+	contents, err := request.listFolder(folder)
+	if err != nil {
+		if isSkippable(err) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+		} else {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename="+folder.FileName+"."+format)
+	if format == ArchiveFormatTar {
+		w.Header().Set("Content-Type", "application/x-tar")
+		request.archive = &tarArchiveWriter{tw: tar.NewWriter(w)}
+	} else {
+		w.Header().Set("Content-Type", "application/zip")
+		request.archive = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	}
+
+	// The response has already started at this point, so errors can only be
+	// logged and the archive left incomplete.
+	if err := request.addContents(contents, ""); err != nil {
+		bc.Logger.Warn("failed to write archive",
+			zap.String("folderId", folder.FileId), zap.Error(err))
+		return
+	}
+	if err := request.archive.Close(); err != nil {
+		bc.Logger.Warn("failed to write archive",
+			zap.String("folderId", folder.FileId), zap.Error(err))
+		return
+	}
+
+	bc.Logger.Debug("archive written",
+		zap.String("folderId", folder.FileId),
+		zap.Int("written", request.writtenEntries),
+		zap.Int("skipped", request.skippedEntries))
+}
+
+// DownloadFolderArchive downloads the contents of a folder as a zip or tar
+// archive. Files the user cannot read are left out.
+func (bc *BackendController) DownloadFolderArchive(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	format, ok := parseArchiveFormat(r)
+	if !ok {
+		util.HttpError(w, http.StatusBadRequest, "Invalid format, expected zip or tar")
+		return
+	}
+
+	folder, err := dbfs.GetFileById(bc.Db, mux.Vars(r)["folderID"], user)
+	if err != nil {
+		if errors.Is(err, dbfs.ErrFileNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+		} else {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if folder.EntryType != dbfs.IsFolder {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFolder.Error())
+		return
+	}
+
+	bc.recordDownload(r, folder, user, "archive")
+	bc.streamArchive(w, r, user, folder, format)
+}
+
+// DownloadSharedLinkArchive downloads the contents of a shared folder, or of a
+// folder inside it given its path, as a zip or tar archive.
+func (bc *BackendController) DownloadSharedLinkArchive(w http.ResponseWriter, r *http.Request) {
+	format, ok := parseArchiveFormat(r)
+	if !ok {
+		util.HttpError(w, http.StatusBadRequest, "Invalid format, expected zip or tar")
+		return
+	}
+
+	sharedLink, folder, ok := bc.openSharedLink(w, r, mux.Vars(r)["shortenedLink"])
+	if !ok {
+		return
+	}
+	if folder.EntryType != dbfs.IsFolder {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFolder.Error())
+		return
+	}
+	if !bc.recordSharedLinkDownload(w, r, sharedLink, folder) {
+		return
+	}
+
+	bc.streamArchive(w, r, nil, folder, format)
+}
@@ -0,0 +1,198 @@
+package controller_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_FolderArchive(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5562",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	// Creating the folder tree through WebDAV
+	webdav := func(method, target, body string) {
+		req := httptest.NewRequest(method, controller.WebDAVPrefix+target, strings.NewReader(body)).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		w := httptest.NewRecorder()
+		bc.WebDAV(w, req)
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+	}
+	webdav("MKCOL", "/archive", "")
+	webdav("MKCOL", "/archive/sub", "")
+	webdav("PUT", "/archive/a.txt", "file a")
+	webdav("PUT", "/archive/sub/b.txt", "file b")
+
+	folder, err := dbfs.GetFileByPath(db, "/archive", user, true)
+	Assert.NoError(err)
+
+	// Password protecting a file leaves it out of the archive
+	webdav("PUT", "/archive/secret.txt", "secret")
+	secret, err := dbfs.GetFileByPath(db, "/archive/secret.txt", user, true)
+	Assert.NoError(err)
+	Assert.NoError(secret.PasswordProtect(db, "", "password", "hint", user))
+
+	expected := map[string]string{
+		"a.txt":     "file a",
+		"sub/":      "",
+		"sub/b.txt": "file b",
+	}
+
+	readZip := func(body []byte) map[string]string {
+		zr, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+		Assert.NoError(err)
+		entries := map[string]string{}
+		for _, f := range zr.File {
+			rc, err := f.Open()
+			Assert.NoError(err)
+			data, err := io.ReadAll(rc)
+			Assert.NoError(err)
+			rc.Close()
+			entries[f.Name] = string(data)
+		}
+		return entries
+	}
+
+	t.Run("Zip", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/folder/"+folder.FileId+"/archive?format=zip", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": folder.FileId})
+		w := httptest.NewRecorder()
+		bc.DownloadFolderArchive(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("application/zip", w.Header().Get("Content-Type"))
+		Assert.Equal(expected, readZip(w.Body.Bytes()))
+	})
+
+	t.Run("Tar with password", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/folder/"+folder.FileId+"/archive?format=tar", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": folder.FileId})
+		req.Header.Set("passwords", `{"`+secret.FileId+`": "password"}`)
+		w := httptest.NewRecorder()
+		bc.DownloadFolderArchive(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		tr := tar.NewReader(w.Body)
+		entries := map[string]string{}
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			Assert.NoError(err)
+			data, err := io.ReadAll(tr)
+			Assert.NoError(err)
+			entries[header.Name] = string(data)
+		}
+		Assert.Equal("secret", entries["secret.txt"])
+		Assert.Equal("file b", entries["sub/b.txt"])
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/folder/"+folder.FileId+"/archive?format=rar", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": folder.FileId})
+		w := httptest.NewRecorder()
+		bc.DownloadFolderArchive(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code, w.Body.String())
+
+		req = httptest.NewRequest("GET", "/api/v1/folder/"+secret.FileId+"/archive", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": secret.FileId})
+		w = httptest.NewRecorder()
+		bc.DownloadFolderArchive(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code, w.Body.String())
+
+		req = httptest.NewRequest("GET", "/api/v1/folder/nothere/archive", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": "nothere"})
+		w = httptest.NewRecorder()
+		bc.DownloadFolderArchive(w, req)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("Shared link", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/api/v1/shared/archivelink/archive", nil)
+		req = mux.SetURLVars(req, map[string]string{"shortenedLink": "archivelink"})
+		w := httptest.NewRecorder()
+		bc.DownloadSharedLinkArchive(w, req)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+
+		_, err := folder.CreateSharedLink(db, user, "archivelink")
+		Assert.NoError(err)
+
+		w = httptest.NewRecorder()
+		bc.DownloadSharedLinkArchive(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal(expected, readZip(w.Body.Bytes()))
+	})
+}
@@ -0,0 +1,254 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"gorm.io/gorm"
+)
+
+const (
+	BatchMove       = "move"
+	BatchCopy       = "copy"
+	BatchDelete     = "delete"
+	BatchPermission = "permission"
+	BatchFavorite   = "favorite"
+	BatchUnfavorite = "unfavorite"
+
+	MaxBatchOperations = 1000
+)
+
+var (
+	errBatchSkipped    = errors.New("not run, an earlier operation failed")
+	errBatchRolledBack = errors.New("rolled back, a later operation failed")
+	errBatchUnknownOp  = errors.New("unknown operation, expected move, copy, delete, permission, favorite or unfavorite")
+)
+
+// BatchOperation is a single operation of a batch request
+type BatchOperation struct {
+	Op       string `json:"op"`
+	FileId   string `json:"file_id"`
+	FolderId string `json:"folder_id"` // Destination of move and copy
+
+	// Permission to give to the users and groups for the permission operation
+	Users      []string `json:"users"`
+	Groups     []string `json:"groups"`
+	CanRead    bool     `json:"can_read"`
+	CanWrite   bool     `json:"can_write"`
+	CanExecute bool     `json:"can_execute"`
+	CanShare   bool     `json:"can_share"`
+	CanAudit   bool     `json:"can_audit"`
+}
+
+// BatchRequest is the body of a batch request. If Atomic is set, the
+// operations are run in a single transaction and nothing is changed unless
+// they all succeed.
+type BatchRequest struct {
+	Atomic     bool             `json:"atomic"`
+	Operations []BatchOperation `json:"operations"`
+}
+
+// BatchResult is the outcome of one operation of a batch request
+type BatchResult struct {
+	Op        string `json:"op"`
+	FileId    string `json:"file_id"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+	NewFileId string `json:"new_file_id,omitempty"` // The copy made by a copy operation
+}
+
+// BatchResponse holds the results of a batch request, in the order of the
+// operations. Committed is false if an atomic batch was rolled back.
+type BatchResponse struct {
+	Committed bool          `json:"committed"`
+	Results   []BatchResult `json:"results"`
+}
+
+// batchStatus returns the HTTP status matching an error returned by an
+// operation of a batch
+func batchStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrUserNotFound),
+		errors.Is(err, dbfs.ErrGroupNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrFileLocked):
+		return http.StatusLocked
+	case errors.Is(err, dbfs.ErrFileFolderExists):
+		return http.StatusConflict
+	case errors.Is(err, dbfs.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, dbfs.ErrNotFolder), errors.Is(err, dbfs.ErrCannotTrashRoot),
+		errors.Is(err, errBatchUnknownOp):
+		return http.StatusBadRequest
+	case errors.Is(err, errBatchSkipped), errors.Is(err, errBatchRolledBack):
+		return http.StatusFailedDependency
+	}
+	return http.StatusInternalServerError
+}
+
+// runBatchOperation runs a single operation of a batch in the transaction
+// given. It returns the ID of the new file for copies.
+func (bc *BackendController) runBatchOperation(tx *gorm.DB, user *dbfs.User, op *BatchOperation) (string, error) {
+	file, err := dbfs.GetFileById(tx, op.FileId, user)
+	if err != nil {
+		return "", err
+	}
+
+	switch op.Op {
+	case BatchMove, BatchCopy:
+		folder, err := dbfs.GetFileById(tx, op.FolderId, user)
+		if err != nil {
+			return "", err
+		}
+		if op.Op == BatchMove {
+			return "", file.Move(tx, folder, user)
+		}
+		newFile, err := file.CopyAs(tx, folder, file.FileName, user, bc.ServerName)
+		if err != nil {
+			return "", err
+		}
+		return newFile.FileId, nil
+
+	case BatchDelete:
+		_, err := file.Trash(tx, user)
+		return "", err
+
+	case BatchPermission:
+		users := make([]dbfs.User, len(op.Users))
+		for i, userId := range op.Users {
+			u, err := dbfs.GetUserById(tx, userId)
+			if err != nil {
+				return "", err
+			}
+			users[i] = *u
+		}
+		groups := make([]dbfs.Group, len(op.Groups))
+		for i, groupId := range op.Groups {
+			g, err := dbfs.GetGroupById(tx, groupId)
+			if err != nil {
+				return "", err
+			}
+			groups[i] = *g
+		}
+
+		permissionNeeded := dbfs.PermissionNeeded{
+			Read:    op.CanRead,
+			Write:   op.CanWrite,
+			Execute: op.CanExecute,
+			Share:   op.CanShare,
+			Audit:   op.CanAudit,
+		}
+		if len(users) > 0 {
+			if err := file.AddPermissionUsers(tx, &permissionNeeded, user, users...); err != nil {
+				return "", err
+			}
+		}
+		if len(groups) > 0 {
+			if err := file.AddPermissionGroups(tx, &permissionNeeded, user, groups...); err != nil {
+				return "", err
+			}
+		}
+		return "", nil
+
+	case BatchFavorite:
+		return "", file.AddToFavorites(tx, user)
+
+	case BatchUnfavorite:
+		return "", file.RemoveFromFavorites(tx, user)
+	}
+
+	return "", errBatchUnknownOp
+}
+
+// Batch runs a list of move, copy, delete, permission and favorite operations
+// in one request, and returns the result of each. Each operation runs in its
+// own transaction unless atomic is set, in which case they all run in one and
+// the batch stops at the first failure. An atomic batch that was rolled back
+// returns the status of the operation that failed.
+func (bc *BackendController) Batch(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var request BatchRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid batch request: "+err.Error())
+		return
+	}
+	if len(request.Operations) == 0 || len(request.Operations) > MaxBatchOperations {
+		util.HttpError(w, http.StatusBadRequest,
+			fmt.Sprintf("A batch needs between 1 and %d operations", MaxBatchOperations))
+		return
+	}
+
+	response := BatchResponse{
+		Committed: true,
+		Results:   make([]BatchResult, len(request.Operations)),
+	}
+	for i, op := range request.Operations {
+		response.Results[i] = BatchResult{Op: op.Op, FileId: op.FileId}
+	}
+	setResult := func(i int, newFileId string, err error) {
+		response.Results[i].Status = batchStatus(err)
+		response.Results[i].NewFileId = newFileId
+		if err != nil {
+			response.Results[i].Error = err.Error()
+		}
+	}
+
+	if !request.Atomic {
+		for i := range request.Operations {
+			var newFileId string
+			err := bc.Db.Transaction(func(tx *gorm.DB) error {
+				var err error
+				newFileId, err = bc.runBatchOperation(tx, user, &request.Operations[i])
+				return err
+			})
+			setResult(i, newFileId, err)
+		}
+		util.HttpJson(w, http.StatusOK, response)
+		return
+	}
+
+	failed := -1
+	err = bc.Db.Transaction(func(tx *gorm.DB) error {
+		for i := range request.Operations {
+			newFileId, err := bc.runBatchOperation(tx, user, &request.Operations[i])
+			setResult(i, newFileId, err)
+			if err != nil {
+				failed = i
+				return err
+			}
+		}
+		return nil
+	})
+	if err == nil {
+		util.HttpJson(w, http.StatusOK, response)
+		return
+	}
+
+	// Nothing was changed
+	response.Committed = false
+	if failed < 0 {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	for i := failed + 1; i < len(response.Results); i++ {
+		setResult(i, "", errBatchSkipped)
+	}
+	for i := 0; i < failed; i++ {
+		setResult(i, "", errBatchRolledBack)
+	}
+	util.HttpJson(w, response.Results[failed].Status, response)
+}
@@ -0,0 +1,143 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Batch(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	inbox, err := rootFolder.CreateSubFolder(db, "inbox", admin, "localhost")
+	Assert.NoError(err)
+	archive, err := rootFolder.CreateSubFolder(db, "archive", admin, "localhost")
+	Assert.NoError(err)
+
+	createFile := func(name string) *dbfs.File {
+		file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+			FileName:       name,
+			ParentFolderId: inbox.FileId,
+			Server:         "localhost",
+			FragmentPath:   t.TempDir(),
+			FileData:       name + " data",
+			Size:           50,
+			ActualSize:     80,
+		})
+		Assert.NoError(err)
+		return file
+	}
+	invoice := createFile("invoice")
+	receipt := createFile("receipt")
+	notes := createFile("notes")
+
+	runBatch := func(request controller.BatchRequest) (int, controller.BatchResponse) {
+		body, err := json.Marshal(request)
+		Assert.NoError(err)
+		req := httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(string(body))).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		w := httptest.NewRecorder()
+		bc.Batch(w, req)
+
+		var response controller.BatchResponse
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &response), w.Body.String())
+		return w.Code, response
+	}
+	parentOf := func(file *dbfs.File) string {
+		f, err := dbfs.GetFileById(db, file.FileId, admin)
+		Assert.NoError(err)
+		return *f.ParentFolderFileId
+	}
+
+	t.Run("Independent operations", func(t *testing.T) {
+		code, response := runBatch(controller.BatchRequest{
+			Operations: []controller.BatchOperation{
+				{Op: controller.BatchMove, FileId: invoice.FileId, FolderId: archive.FileId},
+				{Op: controller.BatchMove, FileId: "missing", FolderId: archive.FileId},
+				{Op: controller.BatchCopy, FileId: receipt.FileId, FolderId: archive.FileId},
+				{Op: "rename", FileId: receipt.FileId},
+				{Op: controller.BatchFavorite, FileId: receipt.FileId},
+			},
+		})
+		Assert.Equal(http.StatusOK, code)
+		Assert.True(response.Committed)
+		Assert.Len(response.Results, 5)
+		Assert.Equal(http.StatusOK, response.Results[0].Status)
+		Assert.Equal(http.StatusNotFound, response.Results[1].Status)
+		Assert.NotEmpty(response.Results[1].Error)
+		Assert.Equal(http.StatusOK, response.Results[2].Status)
+		Assert.NotEmpty(response.Results[2].NewFileId)
+		Assert.Equal(http.StatusBadRequest, response.Results[3].Status)
+		Assert.Equal(http.StatusOK, response.Results[4].Status)
+
+		Assert.Equal(archive.FileId, parentOf(invoice))
+	})
+
+	t.Run("Atomic batch rolled back", func(t *testing.T) {
+		code, response := runBatch(controller.BatchRequest{
+			Atomic: true,
+			Operations: []controller.BatchOperation{
+				{Op: controller.BatchMove, FileId: notes.FileId, FolderId: archive.FileId},
+				{Op: controller.BatchDelete, FileId: rootFolder.FileId},
+				{Op: controller.BatchDelete, FileId: receipt.FileId},
+			},
+		})
+		Assert.Equal(http.StatusBadRequest, code)
+		Assert.False(response.Committed)
+		Assert.Equal(http.StatusFailedDependency, response.Results[0].Status)
+		Assert.Equal(http.StatusBadRequest, response.Results[1].Status)
+		Assert.Equal(http.StatusFailedDependency, response.Results[2].Status)
+
+		// Nothing was changed
+		Assert.Equal(inbox.FileId, parentOf(notes))
+		Assert.Equal(inbox.FileId, parentOf(receipt))
+	})
+
+	t.Run("Atomic batch", func(t *testing.T) {
+		code, response := runBatch(controller.BatchRequest{
+			Atomic: true,
+			Operations: []controller.BatchOperation{
+				{Op: controller.BatchMove, FileId: notes.FileId, FolderId: archive.FileId},
+				{Op: controller.BatchDelete, FileId: receipt.FileId},
+			},
+		})
+		Assert.Equal(http.StatusOK, code)
+		Assert.True(response.Committed)
+		Assert.Equal(archive.FileId, parentOf(notes))
+
+		_, err := dbfs.GetFileById(db, receipt.FileId, admin)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/batch", strings.NewReader(`{"operations": []}`)).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		w := httptest.NewRecorder()
+		bc.Batch(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code)
+	})
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// copyStatus returns the HTTP status matching an error returned when copying
+func copyStatus(err error) int {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrCopyOperationNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrNotFolder), errors.Is(err, dbfs.ErrCopyIntoItself):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// CopyFolder copies a folder and everything in it the user can read into the
+// folder given in the folder_id header. The copy runs in the background, and
+// the operation returned can be polled with GetCopyOperation.
+func (bc *BackendController) CopyFolder(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	folderID := mux.Vars(r)["folderID"]
+	destID := r.Header.Get("folder_id")
+	if destID == "" {
+		util.HttpError(w, http.StatusBadRequest, "No folderID provided")
+		return
+	}
+
+	folder, err := dbfs.GetFileById(bc.Db, folderID, user)
+	if err != nil {
+		util.HttpError(w, copyStatus(err), err.Error())
+		return
+	}
+	dest, err := dbfs.GetFileById(bc.Db, destID, user)
+	if errors.Is(err, dbfs.ErrFileNotFound) {
+		util.HttpError(w, http.StatusNotFound, "Destination folder not found")
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	op, err := folder.StartCopy(bc.Db, dest, folder.FileName, user, bc.ServerName)
+	if err != nil {
+		util.HttpError(w, copyStatus(err), err.Error())
+		return
+	}
+
+	// The response is sent before the copy is done
+	o := *op
+	go func() {
+		if err := o.Run(bc.Db, user); err != nil {
+			bc.Logger.Warn("failed to copy folder",
+				zap.String("operation_id", o.OperationId), zap.Error(err))
+		}
+	}()
+
+	util.HttpJson(w, http.StatusAccepted, op)
+}
+
+// GetCopyOperation returns the progress of a folder copy
+func (bc *BackendController) GetCopyOperation(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	op, err := dbfs.GetCopyOperation(bc.Db, mux.Vars(r)["operationID"], user)
+	if err != nil {
+		util.HttpError(w, copyStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, op)
+}
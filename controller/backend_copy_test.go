@@ -0,0 +1,115 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_CopyFolder(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	// Each connection to an in-memory database is its own database, so the
+	// copy running in the background has to share the one connection
+	sqlDB, err := db.DB()
+	Assert.NoError(err)
+	sqlDB.SetMaxOpenConns(1)
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	project, err := rootFolder.CreateSubFolder(db, "project", admin, "localhost")
+	Assert.NoError(err)
+	assets, err := project.CreateSubFolder(db, "assets", admin, "localhost")
+	Assert.NoError(err)
+	backups, err := rootFolder.CreateSubFolder(db, "backups", admin, "localhost")
+	Assert.NoError(err)
+	_, err = dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+		FileName:       "logo",
+		ParentFolderId: assets.FileId,
+		Server:         "localhost",
+		FragmentPath:   t.TempDir(),
+		FileData:       "logo data",
+		Size:           50,
+		ActualSize:     80,
+	})
+	Assert.NoError(err)
+
+	newRequest := func(method, target string, vars, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, nil).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mux.SetURLVars(req, vars)
+	}
+
+	t.Run("Copying a folder", func(t *testing.T) {
+		var op dbfs.CopyOperation
+		w := httptest.NewRecorder()
+		bc.CopyFolder(w, newRequest("POST", "/api/v1/folder/"+project.FileId+"/copy",
+			map[string]string{"folderID": project.FileId},
+			map[string]string{"folder_id": backups.FileId}))
+		Assert.Equal(http.StatusAccepted, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &op))
+		Assert.NotEmpty(op.OperationId)
+
+		// Wait for it to finish
+		deadline := time.Now().Add(10 * time.Second)
+		for op.Status == dbfs.CopyStatusRunning && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+			w = httptest.NewRecorder()
+			bc.GetCopyOperation(w, newRequest("GET", "/api/v1/copy/"+op.OperationId,
+				map[string]string{"operationID": op.OperationId}, nil))
+			Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+			Assert.NoError(json.Unmarshal(w.Body.Bytes(), &op))
+		}
+		Assert.Equal(dbfs.CopyStatusDone, op.Status, op.Error)
+		Assert.Equal(int64(3), op.CopiedEntries)
+		Assert.Equal(op.TotalEntries, op.CopiedEntries)
+
+		var files []dbfs.File
+		w = httptest.NewRecorder()
+		bc.LsFolderID(w, newRequest("GET", "/api/v1/folder/"+backups.FileId,
+			map[string]string{"folderID": backups.FileId}, nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal(*op.NewFileId, files[0].FileId)
+	})
+
+	t.Run("Copying a folder into itself", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.CopyFolder(w, newRequest("POST", "/api/v1/folder/"+project.FileId+"/copy",
+			map[string]string{"folderID": project.FileId},
+			map[string]string{"folder_id": assets.FileId}))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		w = httptest.NewRecorder()
+		bc.GetCopyOperation(w, newRequest("GET", "/api/v1/copy/missing",
+			map[string]string{"operationID": "missing"}, nil))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
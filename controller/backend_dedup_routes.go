@@ -0,0 +1,55 @@
+package controller
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+)
+
+// GetDedupSettings returns whether newly written data is deduplicated
+func (bc *BackendController) GetDedupSettings(w http.ResponseWriter, r *http.Request) {
+	if _, err := ctxutil.GetUser(r.Context()); err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	enabled, err := dbfs.GetDedupEnabled(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, enabled)
+}
+
+// SetDedupSettings sets whether newly written data is deduplicated. Requires
+// the enabled header, and the user to be an admin.
+func (bc *BackendController) SetDedupSettings(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Check if user is admin
+	if user.AccountType != dbfs.AccountTypeAdmin {
+		util.HttpError(w, http.StatusForbidden, "You are not an admin")
+		return
+	}
+
+	enabled, err := strconv.ParseBool(r.Header.Get("enabled"))
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid enabled")
+		return
+	}
+
+	if err := dbfs.SetDedupEnabled(bc.Db, enabled); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, enabled)
+}
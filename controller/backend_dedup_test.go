@@ -0,0 +1,152 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_Dedup(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5566",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	upload := func(fileName string, data []byte) *dbfs.File {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", fileName)
+		Assert.NoError(err)
+		_, err = part.Write(data)
+		Assert.NoError(err)
+		Assert.NoError(writer.Close())
+
+		req := httptest.NewRequest("POST", "/api/v1/file", body).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("folder_id", "00000000-0000-0000-0000-000000000000")
+		w := httptest.NewRecorder()
+		bc.UploadFile(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var file dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &file))
+		return &file
+	}
+
+	download := func(fileId string) []byte {
+		req := httptest.NewRequest("GET", "/api/v1/file/"+fileId, nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": fileId})
+		w := httptest.NewRecorder()
+		bc.DownloadFileVersion(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		return w.Body.Bytes()
+	}
+
+	dataId := func(fileId string) string {
+		file, err := dbfs.GetFileById(db, fileId, user)
+		Assert.NoError(err)
+		return file.DataId
+	}
+
+	content := make([]byte, 200_000)
+	rand.New(rand.NewSource(2)).Read(content)
+
+	t.Run("Settings", func(t *testing.T) {
+		req := httptest.NewRequest("PUT", "/api/v1/dedup", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req.Header.Set("enabled", "maybe")
+		w := httptest.NewRecorder()
+		bc.SetDedupSettings(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		req.Header.Set("enabled", "true")
+		w = httptest.NewRecorder()
+		bc.SetDedupSettings(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetDedupSettings(w, httptest.NewRequest("GET", "/api/v1/dedup", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user)))
+		Assert.Equal(http.StatusOK, w.Code)
+		Assert.Equal("true\n", w.Body.String())
+	})
+
+	t.Run("Uploading the same data twice", func(t *testing.T) {
+		original := upload("original.bin", content)
+		duplicate := upload("duplicate.bin", content)
+		different := upload("different.bin", append([]byte("x"), content[1:]...))
+
+		Assert.Equal(dataId(original.FileId), dataId(duplicate.FileId))
+		Assert.NotEqual(dataId(original.FileId), dataId(different.FileId))
+
+		Assert.True(bytes.Equal(content, download(original.FileId)))
+		Assert.True(bytes.Equal(content, download(duplicate.FileId)))
+	})
+}
@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/delta"
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// maxPatchedVersionInMemory is the size up to which versions stored as patches
+// are rebuilt in memory
+const maxPatchedVersionInMemory = 16 * 1024 * 1024
+
+// queuePreviousAsPatch rewrites the data replaced by the update of a file
+// versioned with deltas as a patch against the new data in the background, if
+// it is not kept as a snapshot. Failing to do so only costs space, so errors
+// are logged and the old data is left whole.
+func (bc *BackendController) queuePreviousAsPatch(user *dbfs.User, file *dbfs.File, password string) {
+	f := *file
+	go func() {
+		if err := bc.storePatch(context.Background(), user, &f, password); err != nil {
+			bc.Logger.Warn("failed to store previous version as a patch",
+				zap.String("file_id", f.FileId), zap.Error(err))
+		}
+	}()
+}
+
+func (bc *BackendController) storePatch(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	password string) error {
+
+	version, err := file.GetPatchCandidate(bc.Db)
+	if err != nil || version == nil {
+		return err
+	}
+
+	base, err := bc.openFileVersion(ctx, user, file, file.VersionNo, password)
+	if err != nil {
+		return err
+	}
+	if closer, ok := base.(io.Closer); ok {
+		defer closer.Close()
+	}
+	target, err := bc.openFileVersion(ctx, user, file, version.VersionNo, password)
+	if err != nil {
+		return err
+	}
+	if closer, ok := target.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return err
+	}
+
+	// The patch is written with the same shard layout as the file
+	patch := &dbfs.File{
+		DataId:       uuid.New().String(),
+		TotalShards:  file.TotalShards,
+		DataShards:   file.DataShards,
+		ParityShards: file.ParityShards,
+		KeyThreshold: file.KeyThreshold,
+	}
+	p, err := bc.newShardPipeline(ctx, patch, dataKey, dataIv)
+	if err != nil {
+		return err
+	}
+	servers := make([]string, len(p.servers))
+	for i := range servers {
+		servers[i] = p.servers[i].Name
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(delta.Diff(base, file.Size, target, pw))
+	}()
+	_, err = p.encode(pr)
+	pr.Close()
+	if err != nil {
+		return bc.discardData(file, version, patch, servers, p.shardNames, err)
+	}
+
+	err = file.StorePatch(bc.Db, version, patch, dataKey, dataIv, password, servers, p.shardNames)
+	if err != nil {
+		return bc.discardData(file, version, patch, servers, p.shardNames, err)
+	}
+	return nil
+}
+
+// discardData queues the shards written for data that could not be stored
+// for deletion, and returns the error given (along with the error queueing
+// them if any).
+func (bc *BackendController) discardData(file *dbfs.File, version *dbfs.FileVersion, data *dbfs.File,
+	servers, shardNames []string, cause error) error {
+
+	if err := file.DiscardData(bc.Db, version, data, servers, shardNames); err != nil {
+		return fmt.Errorf("%w (failed to discard data: %s)", cause, err.Error())
+	}
+	return cause
+}
+
+// openPatchedVersion rebuilds a version stored as a patch by applying it to
+// its base version, which may itself be rebuilt the same way. Versions up to
+// maxPatchedVersionInMemory are rebuilt in memory, larger ones in an
+// encrypted spool file that is removed once closed.
+func (bc *BackendController) openPatchedVersion(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	version *dbfs.FileVersion, password string) (io.ReadSeeker, error) {
+
+	base, err := bc.openFileVersion(ctx, user, file, version.PatchBaseVersion, password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open base version %d: %w", version.PatchBaseVersion, err)
+	}
+	if closer, ok := base.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	patch, err := bc.openVersionData(ctx, user, version, password)
+	if err != nil {
+		return nil, err
+	}
+
+	if version.Size <= maxPatchedVersionInMemory {
+		out := bytes.NewBuffer(make([]byte, 0, version.Size))
+		if err := delta.Apply(base, patch, out); err != nil {
+			return nil, fmt.Errorf("failed to rebuild version %d: %w", version.VersionNo, err)
+		}
+		return bytes.NewReader(out.Bytes()), nil
+	}
+
+	key, err := newSpoolKey()
+	if err != nil {
+		return nil, err
+	}
+	out, err := createSpoolFile("", key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := delta.Apply(base, patch, out); err != nil {
+		out.Close()
+		return nil, fmt.Errorf("failed to rebuild version %d: %w", version.VersionNo, err)
+	}
+	if _, err := out.Seek(0, io.SeekStart); err != nil {
+		out.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+// revertFileToVersion reverts the file to the version given. A version stored
+// as a patch is rebuilt and stored whole first, as the data of the file is
+// always kept whole.
+func (bc *BackendController) revertFileToVersion(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	versionNo int, password string) error {
+
+	version, err := file.GetOldVersion(bc.Db, user, versionNo)
+	if err != nil {
+		return err
+	}
+	if version.Patch {
+		if err := bc.storeRebuiltVersion(ctx, user, file, version, password); err != nil {
+			return err
+		}
+	}
+
+	return file.RevertFileToVersion(bc.Db, versionNo, user)
+}
+
+func (bc *BackendController) storeRebuiltVersion(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	version *dbfs.FileVersion, password string) error {
+
+	data, err := bc.openPatchedVersion(ctx, user, file, version, password)
+	if err != nil {
+		return err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return err
+	}
+
+	// The data is written with the same shard layout as the patch
+	rebuilt := &dbfs.File{
+		DataId:       uuid.New().String(),
+		TotalShards:  version.TotalShards,
+		DataShards:   version.DataShards,
+		ParityShards: version.ParityShards,
+		KeyThreshold: version.KeyThreshold,
+	}
+	p, err := bc.newShardPipeline(ctx, rebuilt, dataKey, dataIv)
+	if err != nil {
+		return err
+	}
+	servers := make([]string, len(p.servers))
+	for i := range servers {
+		servers[i] = p.servers[i].Name
+	}
+
+	if _, err := p.encode(data); err != nil {
+		return bc.discardData(file, version, rebuilt, servers, p.shardNames, err)
+	}
+
+	err = file.StoreRebuiltVersion(bc.Db, version, rebuilt, dataKey, dataIv, password, servers, p.shardNames)
+	if err != nil {
+		return bc.discardData(file, version, rebuilt, servers, p.shardNames, err)
+	}
+	return nil
+}
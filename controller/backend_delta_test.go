@@ -0,0 +1,207 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"math/rand"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_DeltaVersions(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5565",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	upload := func(target string, data []byte, vars map[string]string,
+		handler http.HandlerFunc) *dbfs.File {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "data.bin")
+		Assert.NoError(err)
+		_, err = part.Write(data)
+		Assert.NoError(err)
+		Assert.NoError(writer.Close())
+
+		req := httptest.NewRequest("POST", target, body).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, vars)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("folder_id", "00000000-0000-0000-0000-000000000000")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var file dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &file))
+		return &file
+	}
+
+	download := func(fileId string, versionNo int) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/file/"+fileId+"/versions/"+strconv.Itoa(versionNo), nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": fileId, "versionID": strconv.Itoa(versionNo)})
+		w := httptest.NewRecorder()
+		bc.DownloadFileVersion(w, req)
+		return w
+	}
+
+	// Each version changes a bit of the previous one
+	contents := [][]byte{make([]byte, 300_000)}
+	rand.New(rand.NewSource(1)).Read(contents[0])
+	for i := 1; i < 4; i++ {
+		next := append([]byte{}, contents[i-1]...)
+		copy(next[i*50_000:], "version "+strconv.Itoa(i))
+		contents = append(contents, next)
+	}
+
+	var file *dbfs.File
+	var versionNos []int
+
+	t.Run("Storing versions as patches", func(t *testing.T) {
+		Assert.NoError(dbfs.SetDeltaSnapshotInterval(db, 10))
+
+		file = upload("/api/v1/file", contents[0], nil, bc.UploadFile)
+		dbFile, err := dbfs.GetFileById(db, file.FileId, user)
+		Assert.NoError(err)
+		Assert.NoError(dbFile.UpdateMetaData(db, dbfs.FileMetadataModification{
+			FileName: dbFile.FileName, MIMEType: dbFile.MIMEType, VersioningMode: dbfs.VersioningOnDeltas,
+		}, user))
+		versionNos = append(versionNos, dbFile.VersionNo)
+
+		for _, content := range contents[1:] {
+			file = upload("/api/v1/file/"+file.FileId+"/update", content,
+				map[string]string{"fileID": file.FileId}, bc.UpdateFile)
+			versionNos = append(versionNos, file.VersionNo)
+
+			// The previous version is stored as a patch in the background
+			Assert.Eventually(func() bool {
+				dbFile, err := dbfs.GetFileById(db, file.FileId, user)
+				Assert.NoError(err)
+				candidate, err := dbFile.GetPatchCandidate(db)
+				Assert.NoError(err)
+				return candidate == nil
+			}, 10*time.Second, 50*time.Millisecond)
+		}
+
+		// The first upload is a snapshot and the current data is whole
+		dbFile, err = dbfs.GetFileById(db, file.FileId, user)
+		Assert.NoError(err)
+		var patches []bool
+		for _, versionNo := range versionNos {
+			version, err := dbFile.GetOldVersion(db, user, versionNo)
+			Assert.NoError(err)
+			patches = append(patches, version.Patch)
+		}
+		Assert.Equal([]bool{false, true, true, false}, patches)
+	})
+
+	t.Run("Downloading old versions", func(t *testing.T) {
+		for i, versionNo := range versionNos {
+			w := download(file.FileId, versionNo)
+			Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+			Assert.True(bytes.Equal(contents[i], w.Body.Bytes()), "version %d", versionNo)
+		}
+	})
+
+	t.Run("Deleting a version others are patched against", func(t *testing.T) {
+		req := httptest.NewRequest("DELETE", "/api/v1/file/"+file.FileId+"/versions/"+
+			strconv.Itoa(versionNos[3]), nil).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": file.FileId, "versionID": strconv.Itoa(versionNos[3])})
+		w := httptest.NewRecorder()
+		bc.DeleteFileVersion(w, req)
+		Assert.Equal(http.StatusConflict, w.Code)
+	})
+
+	t.Run("Reverting to a patched version", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/file/"+file.FileId+"/versions/"+
+			strconv.Itoa(versionNos[1])+"/revert", nil).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": file.FileId, "versionID": strconv.Itoa(versionNos[1])})
+		w := httptest.NewRecorder()
+		bc.RevertFileVersion(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var reverted dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &reverted))
+		w = download(file.FileId, reverted.VersionNo)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.True(bytes.Equal(contents[1], w.Body.Bytes()))
+
+		// The version is now stored whole, and the others still rebuild
+		dbFile, err := dbfs.GetFileById(db, file.FileId, user)
+		Assert.NoError(err)
+		version, err := dbFile.GetOldVersion(db, user, versionNos[1])
+		Assert.NoError(err)
+		Assert.False(version.Patch)
+		for i, versionNo := range versionNos {
+			w := download(file.FileId, versionNo)
+			Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+			Assert.True(bytes.Equal(contents[i], w.Body.Bytes()), "version %d", versionNo)
+		}
+	})
+}
@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+const (
+	// MaxDiffSize is the size above which versions are only summarised
+	MaxDiffSize = 1024 * 1024
+
+	defaultDiffContext = 3
+
+	DiffSkippedBinary   = "binary"
+	DiffSkippedTooLarge = "too_large"
+)
+
+// textMIMETypes are the MIME types outside of text/* that are compared line
+// by line
+var textMIMETypes = map[string]bool{
+	"application/json":       true,
+	"application/xml":        true,
+	"application/javascript": true,
+	"application/x-sh":       true,
+	"application/x-yaml":     true,
+	"application/yaml":       true,
+	"application/toml":       true,
+	"application/sql":        true,
+}
+
+// VersionDiff compares two versions of a file. Diff is a unified diff from
+// one to the other, only set if both are text no larger than MaxDiffSize.
+// Otherwise Skipped says why it is missing.
+type VersionDiff struct {
+	FileId       string `json:"file_id"`
+	FromVersion  int    `json:"from_version"`
+	ToVersion    int    `json:"to_version"`
+	FromSize     int64  `json:"from_size"`
+	ToSize       int64  `json:"to_size"`
+	SizeChange   int64  `json:"size_change"`
+	FromChecksum string `json:"from_checksum"`
+	ToChecksum   string `json:"to_checksum"`
+	Changed      bool   `json:"changed"`
+	Diff         string `json:"diff,omitempty"`
+	Skipped      string `json:"skipped,omitempty"`
+}
+
+// isTextMIMEType checks if files of the MIME type can be compared as text
+func isTextMIMEType(mimeType string) bool {
+	mediaType, _, err := mime.ParseMediaType(mimeType)
+	if err != nil {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || textMIMETypes[mediaType] ||
+		strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// isText checks that the data really is text, whatever its MIME type says
+func isText(data []byte) bool {
+	return utf8.Valid(data) && bytes.IndexByte(data, 0) == -1
+}
+
+// splitDiffLines splits text into lines that keep their line endings. A last
+// line without one is marked like diff does.
+func splitDiffLines(data []byte) []string {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n\\ No newline at end of file\n"
+	return lines
+}
+
+// GetFileVersionDiff compares two versions of a file. Text files get a
+// unified diff, with the number of context lines set by the context query
+// parameter. Anything else is only compared by size and checksum.
+func (bc *BackendController) GetFileVersionDiff(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	vars := mux.Vars(r)
+	fromVersionNo, err := strconv.Atoi(vars["fromVersionID"])
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid version: "+err.Error())
+		return
+	}
+	toVersionNo, err := strconv.Atoi(vars["toVersionID"])
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid version: "+err.Error())
+		return
+	}
+
+	contextLines := defaultDiffContext
+	if c := r.URL.Query().Get("context"); c != "" {
+		contextLines, err = strconv.Atoi(c)
+		if err != nil || contextLines < 0 {
+			util.HttpError(w, http.StatusBadRequest, "Invalid context")
+			return
+		}
+	}
+
+	file, err := dbfs.GetFileById(bc.Db, vars["fileID"], user)
+	if errors.Is(err, dbfs.ErrFileNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if file.EntryType != dbfs.IsFile {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFile.Error())
+		return
+	}
+
+	var versions [2]*dbfs.FileVersion
+	for i, versionNo := range []int{fromVersionNo, toVersionNo} {
+		versions[i], err = file.GetOldVersion(bc.Db, user, versionNo)
+		if errors.Is(err, dbfs.ErrVersionNotFound) || errors.Is(err, dbfs.ErrFileNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+	from, to := versions[0], versions[1]
+
+	diff := VersionDiff{
+		FileId:       file.FileId,
+		FromVersion:  from.VersionNo,
+		ToVersion:    to.VersionNo,
+		FromSize:     from.Size,
+		ToSize:       to.Size,
+		SizeChange:   to.Size - from.Size,
+		FromChecksum: from.Checksum,
+		ToChecksum:   to.Checksum,
+		Changed:      from.Size != to.Size || from.Checksum != to.Checksum,
+	}
+
+	switch {
+	case !diff.Changed:
+	case !isTextMIMEType(from.MIMEType) || !isTextMIMEType(to.MIMEType):
+		diff.Skipped = DiffSkippedBinary
+	case from.Size > MaxDiffSize || to.Size > MaxDiffSize:
+		diff.Skipped = DiffSkippedTooLarge
+	default:
+		// Decode both versions, rebuilding them first if stored as patches
+		password := r.Header.Get("password")
+		var contents [2][]byte
+		for i, version := range versions {
+			contents[i], err = bc.readVersionForDiff(r, user, file, version.VersionNo, password)
+			if err != nil {
+				if errors.Is(err, dbfs.ErrIncorrectPassword) || errors.Is(err, dbfs.ErrPasswordRequired) {
+					util.HttpError(w, http.StatusUnauthorized, err.Error())
+					return
+				} else if errors.Is(err, dbfs.ErrFileNotFound) || errors.Is(err, dbfs.ErrNotFile) {
+					util.HttpError(w, http.StatusNotFound, err.Error())
+					return
+				}
+				util.HttpError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+		}
+
+		if contents[0] == nil || contents[1] == nil {
+			diff.Skipped = DiffSkippedTooLarge
+			break
+		}
+		if !isText(contents[0]) || !isText(contents[1]) {
+			diff.Skipped = DiffSkippedBinary
+			break
+		}
+
+		diff.Diff, err = difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+			A:        splitDiffLines(contents[0]),
+			B:        splitDiffLines(contents[1]),
+			FromFile: from.FileName,
+			FromDate: "version " + strconv.Itoa(from.VersionNo),
+			ToFile:   to.FileName,
+			ToDate:   "version " + strconv.Itoa(to.VersionNo),
+			Context:  contextLines,
+		})
+		if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+	}
+
+	util.HttpJson(w, http.StatusOK, diff)
+}
+
+// readVersionForDiff returns the contents of a version of the file, or nil if
+// it turns out to be larger than MaxDiffSize
+func (bc *BackendController) readVersionForDiff(r *http.Request, user *dbfs.User, file *dbfs.File,
+	versionNo int, password string) ([]byte, error) {
+
+	reader, err := bc.openFileVersion(r.Context(), user, file, versionNo, password)
+	if err != nil {
+		return nil, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	data, err := io.ReadAll(io.LimitReader(reader, MaxDiffSize+1))
+	if err != nil {
+		return nil, err
+	} else if len(data) > MaxDiffSize {
+		return nil, nil
+	}
+	return data, nil
+}
@@ -0,0 +1,176 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_GetFileVersionDiff(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5567",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	upload := func(target, fileName, contentType string, data []byte, vars map[string]string,
+		handler http.HandlerFunc) *dbfs.File {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		header := textproto.MIMEHeader{}
+		header.Set("Content-Disposition", `form-data; name="file"; filename="`+fileName+`"`)
+		header.Set("Content-Type", contentType)
+		part, err := writer.CreatePart(header)
+		Assert.NoError(err)
+		_, err = part.Write(data)
+		Assert.NoError(err)
+		Assert.NoError(writer.Close())
+
+		req := httptest.NewRequest("POST", target, body).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, vars)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("folder_id", "00000000-0000-0000-0000-000000000000")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var file dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &file))
+		return &file
+	}
+
+	diff := func(fileId string, from, to int, query string) (int, controller.VersionDiff) {
+		req := httptest.NewRequest("GET", "/api/v1/file/"+fileId+"/versions/"+strconv.Itoa(from)+
+			"/diff/"+strconv.Itoa(to)+query, nil).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{
+			"fileID":        fileId,
+			"fromVersionID": strconv.Itoa(from),
+			"toVersionID":   strconv.Itoa(to),
+		})
+		w := httptest.NewRecorder()
+		bc.GetFileVersionDiff(w, req)
+
+		var result controller.VersionDiff
+		if w.Code == http.StatusOK {
+			Assert.NoError(json.Unmarshal(w.Body.Bytes(), &result))
+		}
+		return w.Code, result
+	}
+
+	t.Run("Comparing text versions", func(t *testing.T) {
+		file := upload("/api/v1/file", "notes.txt", "text/plain; charset=utf-8",
+			[]byte("apples\nbananas\ncherries\ndates\n"), nil, bc.UploadFile)
+		first := file.VersionNo
+		file = upload("/api/v1/file/"+file.FileId+"/update", "notes.txt", "text/plain; charset=utf-8",
+			[]byte("apples\nblueberries\ncherries\ndates\nelderberries\n"),
+			map[string]string{"fileID": file.FileId}, bc.UpdateFile)
+
+		code, result := diff(file.FileId, first, file.VersionNo, "?context=1")
+		Assert.Equal(http.StatusOK, code)
+		Assert.True(result.Changed)
+		Assert.Empty(result.Skipped)
+		Assert.Equal(int64(len("blueberries\nelderberries\n")-len("bananas\n")), result.SizeChange)
+		Assert.Equal("--- notes.txt\tversion "+strconv.Itoa(first)+"\n"+
+			"+++ notes.txt\tversion "+strconv.Itoa(file.VersionNo)+"\n"+
+			"@@ -1,4 +1,5 @@\n"+
+			" apples\n"+
+			"-bananas\n"+
+			"+blueberries\n"+
+			" cherries\n"+
+			" dates\n"+
+			"+elderberries\n", result.Diff)
+
+		// A version compared to itself has not changed
+		code, result = diff(file.FileId, first, first, "")
+		Assert.Equal(http.StatusOK, code)
+		Assert.False(result.Changed)
+		Assert.Empty(result.Diff)
+
+		code, _ = diff(file.FileId, first, file.VersionNo+1, "")
+		Assert.Equal(http.StatusNotFound, code)
+		code, _ = diff(file.FileId, first, file.VersionNo, "?context=-1")
+		Assert.Equal(http.StatusBadRequest, code)
+	})
+
+	t.Run("Comparing binary versions", func(t *testing.T) {
+		file := upload("/api/v1/file", "data.bin", "application/octet-stream",
+			[]byte{0, 1, 2, 3}, nil, bc.UploadFile)
+		first := file.VersionNo
+		file = upload("/api/v1/file/"+file.FileId+"/update", "data.bin", "application/octet-stream",
+			[]byte{0, 1, 2, 3, 4, 5}, map[string]string{"fileID": file.FileId}, bc.UpdateFile)
+
+		code, result := diff(file.FileId, first, file.VersionNo, "")
+		Assert.Equal(http.StatusOK, code)
+		Assert.True(result.Changed)
+		Assert.Equal(controller.DiffSkippedBinary, result.Skipped)
+		Assert.Equal(int64(2), result.SizeChange)
+		Assert.NotEqual(result.FromChecksum, result.ToChecksum)
+		Assert.Empty(result.Diff)
+	})
+}
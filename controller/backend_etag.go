@@ -0,0 +1,78 @@
+package controller
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"gorm.io/gorm"
+)
+
+// etagMatches returns whether an If-Match header matches the entity tag.
+// Weak tags never match, as If-Match uses the strong comparison.
+func etagMatches(header, etag string) bool {
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPreconditions evaluates the If-Match and If-Unmodified-Since headers
+// of a request that changes a file. It writes 412 and returns false if the
+// file was changed since the client last saw it.
+func checkPreconditions(w http.ResponseWriter, r *http.Request, file *dbfs.File) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		// If-Unmodified-Since is ignored when If-Match is given
+		if !etagMatches(ifMatch, file.ETag()) {
+			util.HttpError(w, http.StatusPreconditionFailed, "File was changed (If-Match)")
+			return false
+		}
+		return true
+	}
+
+	if ifUnmodifiedSince := r.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" {
+		since, err := http.ParseTime(ifUnmodifiedSince)
+		if err != nil {
+			// Invalid dates are ignored
+			return true
+		}
+		if file.ModifiedTime.Truncate(time.Second).After(since) {
+			util.HttpError(w, http.StatusPreconditionFailed, "File was changed (If-Unmodified-Since)")
+			return false
+		}
+	}
+
+	return true
+}
+
+// hasPreconditions returns whether the request only applies to the state of
+// the file that the client last saw
+func hasPreconditions(r *http.Request) bool {
+	if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+		return strings.TrimSpace(ifMatch) != "*"
+	}
+	_, err := http.ParseTime(r.Header.Get("If-Unmodified-Since"))
+	return err == nil
+}
+
+// whileUnchanged runs fn, which changes the file. If the request has
+// preconditions, fn runs in a transaction that first checks that the file is
+// still the one that checkPreconditions passed, so that two clients cannot
+// both change it based on the same state. It fails with
+// dbfs.ErrPreconditionFailed if the file was changed in the meantime.
+func (bc *BackendController) whileUnchanged(r *http.Request, file *dbfs.File, fn func(tx *gorm.DB) error) error {
+	if !hasPreconditions(r) {
+		return fn(bc.Db)
+	}
+	return bc.Db.Transaction(func(tx *gorm.DB) error {
+		if err := file.CheckUnchanged(tx); err != nil {
+			return err
+		}
+		return fn(tx)
+	})
+}
@@ -0,0 +1,144 @@
+package controller_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_ETags(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	sqlDB, err := db.DB()
+	Assert.NoError(err)
+	sqlDB.SetMaxOpenConns(1)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "etags", admin, "localhost")
+	Assert.NoError(err)
+	file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+		FileName:       "budget",
+		ParentFolderId: folder.FileId,
+		Server:         "localhost",
+		FragmentPath:   t.TempDir(),
+		FileData:       "budget data",
+		Size:           50,
+		ActualSize:     80,
+	})
+	Assert.NoError(err)
+
+	vars := map[string]string{"fileID": file.FileId}
+	newRequest := func(method, target, body string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body)).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mux.SetURLVars(req, vars)
+	}
+	getETag := func() string {
+		w := httptest.NewRecorder()
+		bc.GetMetadataFile(w, newRequest("GET", "/api/v1/file/"+file.FileId+"/metadata", "", nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		return w.Header().Get("ETag")
+	}
+	rename := func(name string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		bc.UpdateMetadataFile(w, newRequest("PATCH", "/api/v1/file/"+file.FileId+"/metadata",
+			`{"file_name": "`+name+`"}`, headers))
+		return w
+	}
+
+	etag := getETag()
+	Assert.NotEmpty(etag)
+	Assert.True(strings.HasPrefix(etag, `"`))
+	Assert.Equal(etag, getETag())
+
+	t.Run("If-Match", func(t *testing.T) {
+		w := rename("budget 2", map[string]string{"If-Match": `"stale"`})
+		Assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+		w = rename("budget 2", map[string]string{"If-Match": `"other", ` + etag})
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		newETag := w.Header().Get("ETag")
+		Assert.NotEqual(etag, newETag)
+		Assert.Equal(newETag, getETag())
+
+		// The old tag no longer matches
+		w = rename("budget 3", map[string]string{"If-Match": etag})
+		Assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+		req := newRequest("POST", "/api/v1/file/"+file.FileId+"/move", "", map[string]string{
+			"folder_id": rootFolder.FileId,
+			"If-Match":  etag,
+		})
+		w = httptest.NewRecorder()
+		bc.MoveFile(w, req)
+		Assert.Equal(http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("If-Unmodified-Since", func(t *testing.T) {
+		past := time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)
+		w := rename("budget 4", map[string]string{"If-Unmodified-Since": past})
+		Assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+		req := newRequest("DELETE", "/api/v1/file/"+file.FileId, "",
+			map[string]string{"If-Unmodified-Since": past})
+		w = httptest.NewRecorder()
+		bc.DeleteFile(w, req)
+		Assert.Equal(http.StatusPreconditionFailed, w.Code)
+
+		future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+		w = rename("budget 4", map[string]string{"If-Unmodified-Since": future})
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	})
+	t.Run("Concurrent changes", func(t *testing.T) {
+		// Only one of the clients that saw the same state can change it
+		etag := getETag()
+		codes := make(chan int, 5)
+		var wg sync.WaitGroup
+		for i := 0; i < cap(codes); i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				codes <- rename("budget "+strconv.Itoa(i+5), map[string]string{"If-Match": etag}).Code
+			}(i)
+		}
+		wg.Wait()
+		close(codes)
+
+		counts := map[int]int{}
+		for code := range codes {
+			counts[code]++
+		}
+		Assert.Equal(map[int]int{
+			http.StatusOK:                 1,
+			http.StatusPreconditionFailed: 4,
+		}, counts)
+	})
+}
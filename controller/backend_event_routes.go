@@ -0,0 +1,216 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/service/pubsub"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"go.uber.org/zap"
+)
+
+const (
+	// fileEventsChannel is where the servers publish the file events they
+	// claimed, for every server to pass on to its watchers
+	fileEventsChannel = "ohana:file_events"
+
+	fileEventInterval  = time.Second
+	fileEventBatchSize = 100
+	watchKeepAlive     = 30 * time.Second
+	watchRetryDelay    = 5 * time.Second
+	watchBufferSize    = 32
+)
+
+// watcher is a user streaming the events of some folders
+type watcher struct {
+	user    *dbfs.User
+	folders []string
+	events  chan dbfs.FileEvent
+}
+
+func (wa *watcher) watches(event *dbfs.FileEvent) bool {
+	for _, folderId := range wa.folders {
+		if event.InFolder(folderId) {
+			return true
+		}
+	}
+	return false
+}
+
+type watcherRegistry struct {
+	mu       sync.Mutex
+	watchers map[*watcher]bool
+	once     sync.Once
+}
+
+func (wr *watcherRegistry) add(wa *watcher) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	if wr.watchers == nil {
+		wr.watchers = make(map[*watcher]bool)
+	}
+	wr.watchers[wa] = true
+}
+
+func (wr *watcherRegistry) remove(wa *watcher) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	delete(wr.watchers, wa)
+}
+
+// dispatch hands the event to the watchers of its folders. Watchers that are
+// too far behind miss it.
+func (wr *watcherRegistry) dispatch(event dbfs.FileEvent) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	for wa := range wr.watchers {
+		if !wa.watches(&event) {
+			continue
+		}
+		select {
+		case wa.events <- event:
+		default:
+		}
+	}
+}
+
+// startWatching subscribes to the file events published by every server, once
+func (bc *BackendController) startWatching() {
+	bc.watchers.once.Do(func() {
+		if bc.Events == nil {
+			bc.Events = pubsub.NewMemoryPubSub()
+		}
+
+		messages, err := bc.Events.Subscribe(context.Background(), fileEventsChannel)
+		go func() {
+			for {
+				if err != nil {
+					bc.Logger.Warn("failed to subscribe to file events", zap.Error(err))
+					time.Sleep(watchRetryDelay)
+				} else {
+					for message := range messages {
+						var event dbfs.FileEvent
+						if err := json.Unmarshal([]byte(message), &event); err != nil {
+							bc.Logger.Warn("invalid file event", zap.Error(err))
+							continue
+						}
+						bc.watchers.dispatch(event)
+					}
+				}
+				messages, err = bc.Events.Subscribe(context.Background(), fileEventsChannel)
+			}
+		}()
+	})
+}
+
+// PublishFileEvents claims the file events waiting in the database and
+// publishes them to every server
+func (bc *BackendController) PublishFileEvents(ctx context.Context) error {
+	bc.startWatching()
+
+	events, err := dbfs.ClaimFileEvents(bc.Db, fileEventBatchSize)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		message, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		if err := bc.Events.Publish(ctx, fileEventsChannel, string(message)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// WatchFolders streams the changes made in the folders given in the folder_id
+// query parameters as server-sent events, until the client disconnects. Each
+// event is named after what happened to the file and only sent if the user
+// can read it.
+func (bc *BackendController) WatchFolders(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	folderIds := r.URL.Query()["folder_id"]
+	if len(folderIds) == 0 {
+		util.HttpError(w, http.StatusBadRequest, "Expected at least one folder_id")
+		return
+	}
+	for _, folderId := range folderIds {
+		folder, err := dbfs.GetFileById(bc.Db, folderId, user)
+		if errors.Is(err, dbfs.ErrFileNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+			return
+		} else if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		if folder.EntryType != dbfs.IsFolder {
+			util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFolder.Error())
+			return
+		}
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		util.HttpError(w, http.StatusInternalServerError, "Streaming is not supported")
+		return
+	}
+
+	bc.startWatching()
+	wa := &watcher{
+		user:    user,
+		folders: folderIds,
+		events:  make(chan dbfs.FileEvent, watchBufferSize),
+	}
+	bc.watchers.add(wa)
+	defer bc.watchers.remove(wa)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintf(w, "retry: %d\n\n", watchRetryDelay.Milliseconds())
+	flusher.Flush()
+
+	keepAlive := time.NewTicker(watchKeepAlive)
+	defer keepAlive.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case event := <-wa.events:
+			visible, err := event.VisibleTo(bc.Db, user)
+			if err != nil {
+				bc.Logger.Warn("failed to check file event permissions", zap.Error(err))
+				continue
+			} else if !visible {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Event, data)
+		}
+		flusher.Flush()
+	}
+}
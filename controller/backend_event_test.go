@@ -0,0 +1,127 @@
+package controller_test
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/service/pubsub"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_WatchFolders(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+		Events:     pubsub.NewMemoryPubSub(),
+	}
+
+	// Each connection to an in-memory database is its own database, so the
+	// stream has to share the one connection
+	sqlDB, err := db.DB()
+	Assert.NoError(err)
+	sqlDB.SetMaxOpenConns(1)
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	outsider, err := dbfs.CreateNewUser(db, "watchOutsider", "watchOutsider", dbfs.AccountTypeEndUser,
+		"watchOutsider", "refreshToken", "accessToken", "idToken", "localhost")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	team, err := rootFolder.CreateSubFolder(db, "team", admin, "localhost")
+	Assert.NoError(err)
+	elsewhere, err := rootFolder.CreateSubFolder(db, "elsewhere", admin, "localhost")
+	Assert.NoError(err)
+	Assert.NoError(bc.PublishFileEvents(context.Background()))
+
+	// The user comes from the "user" query parameter
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := admin
+		if r.URL.Query().Get("user") == "outsider" {
+			user = outsider
+		}
+		bc.WatchFolders(w, r.WithContext(ctxutil.WithUser(r.Context(), user)))
+	}))
+	defer server.Close()
+
+	t.Run("Watching folders that cannot be seen", func(t *testing.T) {
+		resp, err := http.Get(server.URL + "/api/v1/events")
+		Assert.NoError(err)
+		resp.Body.Close()
+		Assert.Equal(http.StatusBadRequest, resp.StatusCode)
+
+		resp, err = http.Get(server.URL + "/api/v1/events?user=outsider&folder_id=" + team.FileId)
+		Assert.NoError(err)
+		resp.Body.Close()
+		Assert.Equal(http.StatusNotFound, resp.StatusCode)
+	})
+
+	t.Run("Receiving changes", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		req, err := http.NewRequestWithContext(ctx, "GET",
+			server.URL+"/api/v1/events?folder_id="+team.FileId, nil)
+		Assert.NoError(err)
+		resp, err := http.DefaultClient.Do(req)
+		Assert.NoError(err)
+		defer resp.Body.Close()
+		Assert.Equal(http.StatusOK, resp.StatusCode)
+		Assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+		stream := bufio.NewReader(resp.Body)
+		nextEvent := func() (string, dbfs.FileEvent) {
+			var name string
+			var event dbfs.FileEvent
+			for {
+				line, err := stream.ReadString('\n')
+				if !Assert.NoError(err) {
+					return "", event
+				}
+				line = strings.TrimSuffix(line, "\n")
+				switch {
+				case strings.HasPrefix(line, "event: "):
+					name = strings.TrimPrefix(line, "event: ")
+				case strings.HasPrefix(line, "data: "):
+					Assert.NoError(json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event))
+				case line == "" && name != "":
+					return name, event
+				}
+			}
+		}
+
+		// Changes in other folders are not sent
+		_, err = elsewhere.CreateSubFolder(db, "unrelated", admin, "localhost")
+		Assert.NoError(err)
+		folder, err := team.CreateSubFolder(db, "minutes", admin, "localhost")
+		Assert.NoError(err)
+		Assert.NoError(bc.PublishFileEvents(context.Background()))
+
+		name, event := nextEvent()
+		Assert.Equal(dbfs.WebhookEventCreated, name)
+		Assert.Equal(folder.FileId, event.FileId)
+		Assert.Equal("minutes", event.FileName)
+
+		Assert.NoError(folder.Move(db, elsewhere, admin))
+		Assert.NoError(bc.PublishFileEvents(context.Background()))
+
+		name, event = nextEvent()
+		Assert.Equal(dbfs.WebhookEventMoved, name)
+		Assert.Equal(folder.FileId, event.FileId)
+	})
+}
@@ -0,0 +1,375 @@
+package controller
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+)
+
+const (
+	ImportStatusCreated  = "created"
+	ImportStatusUpdated  = "updated"
+	ImportStatusExists   = "exists"
+	ImportStatusConflict = "conflict"
+	ImportStatusSkipped  = "skipped"
+	ImportStatusFailed   = "failed"
+
+	ImportConflictSkip      = "skip"
+	ImportConflictOverwrite = "overwrite"
+)
+
+// MaxImportZipSize is the largest zip archive that can be imported. Zip
+// archives are buffered before being read, unlike tar archives which are
+// read as they are received.
+var MaxImportZipSize int64 = 4 * 1024 * 1024 * 1024
+
+// ArchiveImportResult is the outcome of importing one entry of an archive
+type ArchiveImportResult struct {
+	Path   string `json:"path"`
+	Status string `json:"status"`
+	FileId string `json:"file_id,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// importRequest recreates the entries of an archive under a folder
+type importRequest struct {
+	bc        *BackendController
+	ctx       context.Context
+	user      *dbfs.User
+	overwrite bool
+
+	// folders caches the folders created or found so far by their path in
+	// the archive, with "" being the target folder.
+	folders     map[string]*dbfs.File
+	folderTimes map[string]time.Time
+	results     []ArchiveImportResult
+}
+
+// cleanImportPath returns the path of an archive entry relative to the
+// target folder, or false if the path would escape it.
+func cleanImportPath(name string) (string, bool) {
+	name = strings.ReplaceAll(name, "\\", "/")
+	if strings.HasPrefix(name, "/") {
+		return "", false
+	}
+	cleaned := path.Clean(name)
+	if cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", false
+	}
+	return cleaned, true
+}
+
+// findChild returns the entry with the name given in a folder, or nil
+func (i *importRequest) findChild(folder *dbfs.File, name string) (*dbfs.File, error) {
+	contents, err := folder.ListContents(i.bc.Db, i.user)
+	if err != nil {
+		return nil, err
+	}
+	for j := range contents {
+		if contents[j].FileName == name {
+			return &contents[j], nil
+		}
+	}
+	return nil, nil
+}
+
+// ensureFolder returns the folder at the path given, creating it and any
+// folders above it. created is true if the folder itself was created.
+func (i *importRequest) ensureFolder(folderPath string) (folder *dbfs.File, created bool, err error) {
+	if folder, ok := i.folders[folderPath]; ok {
+		return folder, false, nil
+	}
+
+	parentPath, name := path.Split(folderPath)
+	parent, _, err := i.ensureFolder(strings.TrimSuffix(parentPath, "/"))
+	if err != nil {
+		return nil, false, err
+	}
+
+	folder, err = i.findChild(parent, name)
+	if err != nil {
+		return nil, false, err
+	}
+	if folder == nil {
+		folder, err = dbfs.CreateFolderByParentId(i.bc.Db, parent.FileId, name, i.user, i.bc.ServerName)
+		if err != nil {
+			return nil, false, err
+		}
+		created = true
+	} else if folder.EntryType != dbfs.IsFolder {
+		return nil, false, fmt.Errorf("%q: %w", folderPath, dbfs.ErrFileFolderExists)
+	}
+
+	i.folders[folderPath] = folder
+	return folder, created, nil
+}
+
+func (i *importRequest) addResult(entryPath, status string, file *dbfs.File, err error) {
+	result := ArchiveImportResult{Path: entryPath, Status: status}
+	if file != nil {
+		result.FileId = file.FileId
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+	i.results = append(i.results, result)
+}
+
+// importFolder handles a folder entry of the archive
+func (i *importRequest) importFolder(entryPath string, modified time.Time) {
+	folder, created, err := i.ensureFolder(entryPath)
+	switch {
+	case errors.Is(err, dbfs.ErrFileFolderExists):
+		i.addResult(entryPath, ImportStatusConflict, nil, err)
+	case err != nil:
+		i.addResult(entryPath, ImportStatusFailed, nil, err)
+	case created:
+		i.folderTimes[entryPath] = modified
+		i.addResult(entryPath, ImportStatusCreated, folder, nil)
+	default:
+		i.addResult(entryPath, ImportStatusExists, folder, nil)
+	}
+}
+
+// importFile handles a file entry of the archive
+func (i *importRequest) importFile(entryPath string, modified time.Time, data io.Reader) {
+	folderPath, fileName := path.Split(entryPath)
+	folder, _, err := i.ensureFolder(strings.TrimSuffix(folderPath, "/"))
+	if errors.Is(err, dbfs.ErrFileFolderExists) {
+		i.addResult(entryPath, ImportStatusConflict, nil, err)
+		return
+	} else if err != nil {
+		i.addResult(entryPath, ImportStatusFailed, nil, err)
+		return
+	}
+
+	existing, err := i.findChild(folder, fileName)
+	if err != nil {
+		i.addResult(entryPath, ImportStatusFailed, nil, err)
+		return
+	}
+
+	var file *dbfs.File
+	status := ImportStatusCreated
+	switch {
+	case existing == nil:
+		file, err = i.bc.writeNewFile(i.ctx, i.user, folder.FileId, fileName,
+			mime.TypeByExtension(path.Ext(fileName)), data)
+	case existing.EntryType != dbfs.IsFile || !i.overwrite:
+		i.addResult(entryPath, ImportStatusConflict, existing, dbfs.ErrFileFolderExists)
+		return
+	default:
+		file, status = existing, ImportStatusUpdated
+		err = i.bc.updateFileData(i.ctx, i.user, existing, "", data)
+	}
+	if err != nil {
+		i.addResult(entryPath, ImportStatusFailed, nil, err)
+		return
+	}
+
+	if !modified.IsZero() {
+		if err := file.SetModifiedTime(i.bc.Db, modified, i.user); err != nil {
+			i.addResult(entryPath, ImportStatusFailed, file, err)
+			return
+		}
+	}
+	i.addResult(entryPath, status, file, nil)
+}
+
+// importTar imports the entries of a tar archive as they are read
+func (i *importRequest) importTar(r io.Reader) error {
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		entryPath, ok := cleanImportPath(header.Name)
+		if !ok {
+			i.addResult(header.Name, ImportStatusSkipped, nil, errors.New("invalid path"))
+			continue
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			i.importFolder(entryPath, header.ModTime)
+		case tar.TypeReg:
+			i.importFile(entryPath, header.ModTime, tr)
+		default:
+			i.addResult(entryPath, ImportStatusSkipped, nil, errors.New("unsupported entry type"))
+		}
+	}
+}
+
+// importZip imports the entries of a zip archive
+func (i *importRequest) importZip(zr *zip.Reader) error {
+	for _, f := range zr.File {
+		entryPath, ok := cleanImportPath(f.Name)
+		if !ok {
+			i.addResult(f.Name, ImportStatusSkipped, nil, errors.New("invalid path"))
+			continue
+		}
+
+		mode := f.Mode()
+		switch {
+		case mode.IsDir():
+			i.importFolder(entryPath, f.Modified)
+		case mode.IsRegular():
+			rc, err := f.Open()
+			if err != nil {
+				i.addResult(entryPath, ImportStatusFailed, nil, err)
+				continue
+			}
+			i.importFile(entryPath, f.Modified, rc)
+			rc.Close()
+		default:
+			i.addResult(entryPath, ImportStatusSkipped, nil, errors.New("unsupported entry type"))
+		}
+	}
+	return nil
+}
+
+// finish sets the modified times of the folders created, as adding their
+// contents would otherwise leave them with the time of the import.
+func (i *importRequest) finish() {
+	for folderPath, modified := range i.folderTimes {
+		if modified.IsZero() {
+			continue
+		}
+		if err := i.folders[folderPath].SetModifiedTime(i.bc.Db, modified, i.user); err != nil {
+			i.addResult(folderPath, ImportStatusFailed, i.folders[folderPath], err)
+		}
+	}
+}
+
+// ImportFolderArchive unpacks a zip or tar archive sent as the request body
+// into a folder. Entries that conflict with existing ones are skipped unless
+// conflict=overwrite is given, in which case existing files get a new version.
+func (bc *BackendController) ImportFolderArchive(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	query := r.URL.Query()
+	format := query.Get("format")
+	if format == "" {
+		switch r.Header.Get("Content-Type") {
+		case "application/zip", "application/x-zip-compressed":
+			format = ArchiveFormatZip
+		case "application/x-tar":
+			format = ArchiveFormatTar
+		}
+	}
+	if format != ArchiveFormatZip && format != ArchiveFormatTar {
+		util.HttpError(w, http.StatusBadRequest, "Invalid format, expected zip or tar")
+		return
+	}
+
+	conflict := query.Get("conflict")
+	if conflict == "" {
+		conflict = ImportConflictSkip
+	}
+	if conflict != ImportConflictSkip && conflict != ImportConflictOverwrite {
+		util.HttpError(w, http.StatusBadRequest, "Invalid conflict, expected skip or overwrite")
+		return
+	}
+
+	folder, err := dbfs.GetFileById(bc.Db, mux.Vars(r)["folderID"], user)
+	if err != nil {
+		if errors.Is(err, dbfs.ErrFileNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+		} else {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+	if folder.EntryType != dbfs.IsFolder {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFolder.Error())
+		return
+	}
+
+	// Check for write permission before reading the archive
+	hasPermission, err := user.HasPermission(bc.Db, folder, &dbfs.PermissionNeeded{Write: true})
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	} else if !hasPermission {
+		util.HttpError(w, http.StatusForbidden, dbfs.ErrNoPermission.Error())
+		return
+	}
+
+	request := &importRequest{
+		bc:          bc,
+		ctx:         r.Context(),
+		user:        user,
+		overwrite:   conflict == ImportConflictOverwrite,
+		folders:     map[string]*dbfs.File{"": folder},
+		folderTimes: map[string]time.Time{},
+	}
+
+	var importErr error
+	if format == ArchiveFormatTar {
+		importErr = request.importTar(r.Body)
+	} else {
+		// Zip archives have their index at the end, so they need to be
+		// buffered before they can be read.
+		key, err := newSpoolKey()
+		if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		spool, err := createSpoolFile("", key)
+		if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		defer spool.Close()
+
+		size, err := io.Copy(spool, io.LimitReader(r.Body, MaxImportZipSize+1))
+		if err != nil {
+			util.HttpError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if size > MaxImportZipSize {
+			util.HttpError(w, http.StatusRequestEntityTooLarge,
+				fmt.Sprintf("Zip archive is larger than %d bytes", MaxImportZipSize))
+			return
+		}
+		zr, err := zip.NewReader(spool, size)
+		if err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid zip archive: "+err.Error())
+			return
+		}
+		importErr = request.importZip(zr)
+	}
+	request.finish()
+
+	// Entries before a corrupted part of the archive are still imported
+	if importErr != nil {
+		if len(request.results) == 0 {
+			util.HttpError(w, http.StatusBadRequest, "Invalid archive: "+importErr.Error())
+			return
+		}
+		request.addResult("", ImportStatusFailed, nil, fmt.Errorf("invalid archive: %w", importErr))
+	}
+
+	util.HttpJson(w, http.StatusOK, request.results)
+}
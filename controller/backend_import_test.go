@@ -0,0 +1,262 @@
+package controller_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_ImportArchive(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5563",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	target, err := rootFolder.CreateSubFolder(db, "import", user, "localhost")
+	Assert.NoError(err)
+
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	doImport := func(query string, body []byte) []controller.ArchiveImportResult {
+		req := httptest.NewRequest("POST", "/api/v1/folder/"+target.FileId+"/import?"+query,
+			bytes.NewReader(body)).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": target.FileId})
+		w := httptest.NewRecorder()
+		bc.ImportFolderArchive(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var results []controller.ArchiveImportResult
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &results))
+		return results
+	}
+
+	statuses := func(results []controller.ArchiveImportResult) map[string]string {
+		m := map[string]string{}
+		for _, result := range results {
+			m[result.Path] = result.Status
+		}
+		return m
+	}
+
+	readFile := func(filePath string) string {
+		file, err := dbfs.GetFileByPath(db, "/import/"+filePath, user, true)
+		Assert.NoError(err)
+		req := httptest.NewRequest("GET", "/api/v1/file/"+file.FileId, nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": file.FileId})
+		w := httptest.NewRecorder()
+		bc.DownloadFileVersion(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		return w.Body.String()
+	}
+
+	t.Run("Tar", func(t *testing.T) {
+		var buf bytes.Buffer
+		tw := tar.NewWriter(&buf)
+		Assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: "docs/", Mode: 0755,
+			ModTime: mtime}))
+		for name, data := range map[string]string{"docs/a.txt": "file a", "docs/deep/b.txt": "file b"} {
+			Assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644,
+				Size: int64(len(data)), ModTime: mtime}))
+			_, err := tw.Write([]byte(data))
+			Assert.NoError(err)
+		}
+		Assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: "../escape.txt",
+			Mode: 0644}))
+		Assert.NoError(tw.Close())
+
+		results := statuses(doImport("format=tar", buf.Bytes()))
+		Assert.Equal(map[string]string{
+			"docs":            controller.ImportStatusCreated,
+			"docs/a.txt":      controller.ImportStatusCreated,
+			"docs/deep/b.txt": controller.ImportStatusCreated,
+			"../escape.txt":   controller.ImportStatusSkipped,
+		}, results)
+
+		Assert.Equal("file a", readFile("docs/a.txt"))
+		Assert.Equal("file b", readFile("docs/deep/b.txt"))
+
+		// Times are kept
+		file, err := dbfs.GetFileByPath(db, "/import/docs/a.txt", user, true)
+		Assert.NoError(err)
+		Assert.True(mtime.Equal(file.ModifiedTime), file.ModifiedTime)
+		folder, err := dbfs.GetFileByPath(db, "/import/docs", user, true)
+		Assert.NoError(err)
+		Assert.True(mtime.Equal(folder.ModifiedTime), folder.ModifiedTime)
+	})
+
+	zipArchive := func(files map[string]string) []byte {
+		var buf bytes.Buffer
+		zw := zip.NewWriter(&buf)
+		for name, data := range files {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: mtime})
+			Assert.NoError(err)
+			_, err = io.WriteString(w, data)
+			Assert.NoError(err)
+		}
+		Assert.NoError(zw.Close())
+		return buf.Bytes()
+	}
+
+	t.Run("Zip with conflicts", func(t *testing.T) {
+		archive := zipArchive(map[string]string{
+			"docs/a.txt":    "new file a",
+			"docs/c.txt":    "file c",
+			"docs/a.txt/x":  "file under a file",
+			"docs/deep/b.t": "file b2",
+		})
+
+		results := statuses(doImport("format=zip", archive))
+		Assert.Equal(controller.ImportStatusConflict, results["docs/a.txt"])
+		Assert.Equal(controller.ImportStatusCreated, results["docs/c.txt"])
+		Assert.Equal(controller.ImportStatusConflict, results["docs/a.txt/x"])
+		Assert.Equal(controller.ImportStatusCreated, results["docs/deep/b.t"])
+		Assert.Equal("file a", readFile("docs/a.txt"))
+		Assert.Equal("file c", readFile("docs/c.txt"))
+
+		// Overwriting creates a new version instead
+		results = statuses(doImport("format=zip&conflict=overwrite",
+			zipArchive(map[string]string{"docs/a.txt": "new file a"})))
+		Assert.Equal(controller.ImportStatusUpdated, results["docs/a.txt"])
+		Assert.Equal("new file a", readFile("docs/a.txt"))
+	})
+
+	t.Run("Tar with a truncated entry", func(t *testing.T) {
+		truncated := func(name string) []byte {
+			var buf bytes.Buffer
+			tw := tar.NewWriter(&buf)
+			Assert.NoError(tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Mode: 0644,
+				Size: 100, ModTime: mtime}))
+			_, err := tw.Write([]byte("only part"))
+			Assert.NoError(err)
+			return buf.Bytes()
+		}
+
+		results := statuses(doImport("format=tar", truncated("docs/cut.txt")))
+		Assert.Equal(controller.ImportStatusFailed, results["docs/cut.txt"])
+		_, err := dbfs.GetFileByPath(db, "/import/docs/cut.txt", user, true)
+		Assert.Error(err)
+
+		// An existing file is left as it was
+		before, err := dbfs.GetFileByPath(db, "/import/docs/a.txt", user, true)
+		Assert.NoError(err)
+		results = statuses(doImport("format=tar&conflict=overwrite", truncated("docs/a.txt")))
+		Assert.Equal(controller.ImportStatusFailed, results["docs/a.txt"])
+		Assert.Equal("new file a", readFile("docs/a.txt"))
+		after, err := dbfs.GetFileByPath(db, "/import/docs/a.txt", user, true)
+		Assert.NoError(err)
+		Assert.Equal(before.DataId, after.DataId)
+		versions, err := after.GetAllVersions(db, user)
+		Assert.NoError(err)
+		for _, version := range versions {
+			Assert.Equal(dbfs.FileStatusGood, version.Status, "version %d", version.VersionNo)
+		}
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		req := httptest.NewRequest("POST", "/api/v1/folder/"+target.FileId+"/import?format=zip",
+			bytes.NewReader([]byte("not a zip"))).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": target.FileId})
+		w := httptest.NewRecorder()
+		bc.ImportFolderArchive(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code, w.Body.String())
+
+		req = httptest.NewRequest("POST", "/api/v1/folder/"+target.FileId+"/import", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": target.FileId})
+		w = httptest.NewRecorder()
+		bc.ImportFolderArchive(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code, w.Body.String())
+
+		// Zip archives over the limit are refused before being read
+		defer func(size int64) { controller.MaxImportZipSize = size }(controller.MaxImportZipSize)
+		archive := zipArchive(map[string]string{"docs/big.txt": "too big"})
+		controller.MaxImportZipSize = int64(len(archive)) - 1
+		req = httptest.NewRequest("POST", "/api/v1/folder/"+target.FileId+"/import?format=zip",
+			bytes.NewReader(archive)).WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"folderID": target.FileId})
+		w = httptest.NewRecorder()
+		bc.ImportFolderArchive(w, req)
+		Assert.Equal(http.StatusRequestEntityTooLarge, w.Code, w.Body.String())
+		_, err := dbfs.GetFileByPath(db, "/import/docs/big.txt", user, true)
+		Assert.Error(err)
+
+		noPermUser, err := dbfs.CreateNewUser(db, "importUser", "importUser", dbfs.AccountTypeEndUser,
+			"importUser", "importUser", "importUser", "importUser", "localhost")
+		Assert.NoError(err)
+		req = httptest.NewRequest("POST", "/api/v1/folder/"+target.FileId+"/import?format=tar", nil).
+			WithContext(ctxutil.WithUser(context.Background(), noPermUser))
+		req = mux.SetURLVars(req, map[string]string{"folderID": target.FileId})
+		w = httptest.NewRecorder()
+		bc.ImportFolderArchive(w, req)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,75 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+)
+
+// linkStatus returns the HTTP status matching an error returned when creating
+// or following a link
+func linkStatus(err error) int {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrFileFolderExists):
+		return http.StatusConflict
+	case errors.Is(err, dbfs.ErrNotFolder), errors.Is(err, dbfs.ErrNotLink),
+		errors.Is(err, dbfs.ErrInvalidLinkTarget):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// CreateShortcut creates a link to the file or folder in another folder,
+// without copying it. Takes in the folder_id header, and the optional
+// link_name header, which defaults to the name of the file.
+func (bc *BackendController) CreateShortcut(w http.ResponseWriter, r *http.Request) {
+	user, target, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	folderID := r.Header.Get("folder_id")
+	if folderID == "" {
+		util.HttpError(w, http.StatusBadRequest, "No folderID provided")
+		return
+	}
+	folder, err := dbfs.GetFileById(bc.Db, folderID, user)
+	if err != nil {
+		util.HttpError(w, linkStatus(err), err.Error())
+		return
+	}
+
+	link, err := folder.CreateLink(bc.Db, user, r.Header.Get("link_name"), target, bc.ServerName)
+	if err != nil {
+		util.HttpError(w, linkStatus(err), err.Error())
+		return
+	}
+	link.LinkTarget = target
+
+	util.HttpJson(w, http.StatusOK, link)
+}
+
+// GetLinkTarget follows a link and returns the metadata of the file or folder
+// it points to. Returns 404 if the target was deleted or cannot be read by
+// the user.
+func (bc *BackendController) GetLinkTarget(w http.ResponseWriter, r *http.Request) {
+	user, link, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	target, err := link.ResolveLink(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, linkStatus(err), err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", target.ETag())
+	util.HttpJson(w, http.StatusOK, target)
+}
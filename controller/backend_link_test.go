@@ -0,0 +1,119 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Shortcuts(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	project, err := rootFolder.CreateSubFolder(db, "project", admin, "localhost")
+	Assert.NoError(err)
+	shared, err := rootFolder.CreateSubFolder(db, "shared", admin, "localhost")
+	Assert.NoError(err)
+	file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+		FileName:       "guidelines",
+		ParentFolderId: shared.FileId,
+		Server:         "localhost",
+		FragmentPath:   t.TempDir(),
+		FileData:       "guidelines data",
+		Size:           50,
+		ActualSize:     80,
+	})
+	Assert.NoError(err)
+
+	newRequest := func(method, target string, vars, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, nil).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mux.SetURLVars(req, vars)
+	}
+
+	var link dbfs.File
+
+	t.Run("Creating a shortcut", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.CreateShortcut(w, newRequest("POST", "/api/v1/file/"+file.FileId+"/shortcut",
+			map[string]string{"fileID": file.FileId},
+			map[string]string{"folder_id": project.FileId, "link_name": "Team guidelines"}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &link))
+		Assert.Equal(dbfs.IsLink, link.EntryType)
+		Assert.Equal("Team guidelines", link.FileName)
+
+		// Links cannot be placed in files
+		w = httptest.NewRecorder()
+		bc.CreateShortcut(w, newRequest("POST", "/api/v1/file/"+file.FileId+"/shortcut",
+			map[string]string{"fileID": project.FileId},
+			map[string]string{"folder_id": file.FileId}))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Listing and following it", func(t *testing.T) {
+		var files []dbfs.File
+		w := httptest.NewRecorder()
+		bc.LsFolderID(w, newRequest("GET", "/api/v1/folder/"+project.FileId,
+			map[string]string{"folderID": project.FileId}, nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.NotNil(files[0].LinkTarget)
+		Assert.Equal("guidelines", files[0].LinkTarget.FileName)
+
+		var target dbfs.File
+		w = httptest.NewRecorder()
+		bc.GetLinkTarget(w, newRequest("GET", "/api/v1/file/"+link.FileId+"/target",
+			map[string]string{"fileID": link.FileId}, nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &target))
+		Assert.Equal(file.FileId, target.FileId)
+
+		w = httptest.NewRecorder()
+		bc.GetLinkTarget(w, newRequest("GET", "/api/v1/file/"+file.FileId+"/target",
+			map[string]string{"fileID": file.FileId}, nil))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("Dangling shortcut", func(t *testing.T) {
+		_, err := file.Trash(db, admin)
+		Assert.NoError(err)
+
+		w := httptest.NewRecorder()
+		bc.GetLinkTarget(w, newRequest("GET", "/api/v1/file/"+link.FileId+"/target",
+			map[string]string{"fileID": link.FileId}, nil))
+		Assert.Equal(http.StatusNotFound, w.Code)
+
+		w = httptest.NewRecorder()
+		bc.LsFolderID(w, newRequest("GET", "/api/v1/folder/"+project.FileId,
+			map[string]string{"folderID": project.FileId}, nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+	})
+}
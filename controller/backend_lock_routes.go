@@ -0,0 +1,180 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+)
+
+// lockStatus returns the HTTP status matching an error returned when locking
+// or unlocking a file
+func lockStatus(err error) int {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrLockNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrFileLocked):
+		return http.StatusLocked
+	case errors.Is(err, dbfs.ErrInvalidLockToken):
+		return http.StatusConflict
+	case errors.Is(err, dbfs.ErrInvalidLock), errors.Is(err, dbfs.ErrNotFile):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// parseLockDuration reads the duration header, in seconds. It returns 0 if
+// the header is not set, for the default duration.
+func parseLockDuration(r *http.Request) (time.Duration, error) {
+	durationString := r.Header.Get("duration")
+	if durationString == "" {
+		return 0, nil
+	}
+	seconds, err := strconv.Atoi(durationString)
+	if err != nil || seconds <= 0 {
+		return 0, dbfs.ErrInvalidLock
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// getRequestFile returns the user and the file given by the fileID of a
+// request, writing the error and returning false if either cannot be found
+func (bc *BackendController) getRequestFile(w http.ResponseWriter, r *http.Request) (*dbfs.User, *dbfs.File, bool) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return nil, nil, false
+	}
+
+	fileID := mux.Vars(r)["fileID"]
+	if fileID == "" {
+		util.HttpError(w, http.StatusBadRequest, "No fileID provided")
+		return nil, nil, false
+	}
+
+	file, err := dbfs.GetFileById(bc.Db, fileID, user)
+	if err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return nil, nil, false
+	}
+
+	return user, file, true
+}
+
+// GetFileLock returns the lock on a file. The lock token is only shown to the
+// owner of the lock.
+func (bc *BackendController) GetFileLock(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	lock, err := file.GetLock(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, lock)
+}
+
+// LockFile locks a file. Takes in the lock_type header ("advisory" or
+// "exclusive", defaults to exclusive) and the duration header in seconds.
+func (bc *BackendController) LockFile(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	var lockType int8
+	switch r.Header.Get("lock_type") {
+	case "", "exclusive":
+		lockType = dbfs.LockExclusive
+	case "advisory":
+		lockType = dbfs.LockAdvisory
+	default:
+		util.HttpError(w, http.StatusBadRequest, "Invalid lock_type, expected advisory or exclusive")
+		return
+	}
+
+	duration, err := parseLockDuration(r)
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid duration")
+		return
+	}
+
+	lock, err := file.Lock(bc.Db, user, lockType, duration)
+	if err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, lock)
+}
+
+// RefreshFileLock extends a lock held by the user. Takes in the lock_token
+// header and the duration header in seconds.
+func (bc *BackendController) RefreshFileLock(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	duration, err := parseLockDuration(r)
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid duration")
+		return
+	}
+
+	lock, err := file.RefreshLock(bc.Db, user, r.Header.Get("lock_token"), duration)
+	if err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, lock)
+}
+
+// UnlockFile releases a lock held by the user. Takes in the lock_token header.
+func (bc *BackendController) UnlockFile(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	if err := file.Unlock(bc.Db, user, r.Header.Get("lock_token")); err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
+
+// BreakFileLock removes the lock on a file, whoever holds it. Requires the
+// user to be an admin.
+func (bc *BackendController) BreakFileLock(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	// Check if user is admin
+	if user.AccountType != dbfs.AccountTypeAdmin {
+		util.HttpError(w, http.StatusForbidden, "You are not an admin")
+		return
+	}
+
+	if err := file.BreakLock(bc.Db); err != nil {
+		util.HttpError(w, lockStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
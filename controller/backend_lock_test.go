@@ -0,0 +1,145 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_FileLocks(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	editor, err := dbfs.CreateNewUser(db, "lockUser", "lockUser", dbfs.AccountTypeEndUser,
+		"lockUser", "lockUser", "lockUser", "lockUser", "localhost")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "locks", admin, "localhost")
+	Assert.NoError(err)
+	Assert.NoError(folder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true}, admin, *editor))
+	file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+		FileName:       "sheet",
+		ParentFolderId: folder.FileId,
+		Server:         "localhost",
+		FragmentPath:   t.TempDir(),
+		FileData:       "sheet data",
+		Size:           50,
+		ActualSize:     80,
+	})
+	Assert.NoError(err)
+
+	newRequest := func(as *dbfs.User, method string, headers map[string]string) *http.Request {
+		req := httptest.NewRequest(method, "/api/v1/file/"+file.FileId+"/lock", nil).
+			WithContext(ctxutil.WithUser(context.Background(), as))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		return mux.SetURLVars(req, map[string]string{"fileID": file.FileId})
+	}
+
+	var lock dbfs.FileLock
+
+	t.Run("Locking a file", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.LockFile(w, newRequest(editor, "POST", map[string]string{"lock_type": "shared"}))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		w = httptest.NewRecorder()
+		bc.LockFile(w, newRequest(editor, "POST", map[string]string{"duration": "600"}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &lock))
+		Assert.Equal(dbfs.LockExclusive, lock.LockType)
+		Assert.NotEmpty(lock.LockToken)
+
+		w = httptest.NewRecorder()
+		bc.LockFile(w, newRequest(admin, "POST", nil))
+		Assert.Equal(http.StatusLocked, w.Code)
+
+		var otherLock dbfs.FileLock
+		w = httptest.NewRecorder()
+		bc.GetFileLock(w, newRequest(admin, "GET", nil))
+		Assert.Equal(http.StatusOK, w.Code)
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &otherLock))
+		Assert.Equal(editor.UserId, otherLock.OwnerUserId)
+		Assert.Empty(otherLock.LockToken)
+	})
+
+	t.Run("Respecting the lock", func(t *testing.T) {
+		vars := map[string]string{"fileID": file.FileId}
+
+		req := httptest.NewRequest("POST", "/api/v1/file/"+file.FileId+"/move", nil).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		req.Header.Set("folder_id", rootFolder.FileId)
+		w := httptest.NewRecorder()
+		bc.MoveFile(w, mux.SetURLVars(req, vars))
+		Assert.Equal(http.StatusLocked, w.Code, w.Body.String())
+
+		req = httptest.NewRequest("DELETE", "/api/v1/file/"+file.FileId, nil).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		w = httptest.NewRecorder()
+		bc.DeleteFile(w, mux.SetURLVars(req, vars))
+		Assert.Equal(http.StatusLocked, w.Code, w.Body.String())
+
+		_, err := dbfs.GetFileById(db, file.FileId, admin)
+		Assert.NoError(err)
+	})
+
+	t.Run("Refreshing and unlocking", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.RefreshFileLock(w, newRequest(editor, "PUT", map[string]string{"lock_token": "wrong"}))
+		Assert.Equal(http.StatusConflict, w.Code)
+
+		w = httptest.NewRecorder()
+		bc.RefreshFileLock(w, newRequest(editor, "PUT", map[string]string{
+			"lock_token": lock.LockToken, "duration": "3600"}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.UnlockFile(w, newRequest(editor, "DELETE", map[string]string{"lock_token": lock.LockToken}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetFileLock(w, newRequest(editor, "GET", nil))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Breaking a lock", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.LockFile(w, newRequest(editor, "POST", map[string]string{"lock_type": "advisory"}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.BreakFileLock(w, newRequest(editor, "DELETE", nil))
+		Assert.Equal(http.StatusForbidden, w.Code)
+
+		w = httptest.NewRecorder()
+		bc.BreakFileLock(w, newRequest(admin, "DELETE", nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.BreakFileLock(w, newRequest(admin, "DELETE", nil))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
@@ -0,0 +1,251 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+)
+
+// QuotasResponse is the usage of every user and group against their quotas
+type QuotasResponse struct {
+	CountReplicas bool              `json:"count_replicas"`
+	Users         []dbfs.QuotaUsage `json:"users"`
+	Groups        []dbfs.QuotaUsage `json:"groups"`
+}
+
+// getAdmin returns the user of the request if they are an admin. Otherwise it
+// writes the error response and returns nil.
+func getAdmin(w http.ResponseWriter, r *http.Request) *dbfs.User {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return nil
+	}
+
+	// Check if user is admin
+	if user.AccountType != dbfs.AccountTypeAdmin {
+		util.HttpError(w, http.StatusForbidden, "You are not an admin")
+		return nil
+	}
+
+	return user
+}
+
+// parseQuota reads the quota header, in bytes. An empty header is no quota.
+func parseQuota(r *http.Request) (*int64, error) {
+	quotaString := r.Header.Get("quota")
+	if quotaString == "" {
+		return nil, nil
+	}
+	quota, err := strconv.ParseInt(quotaString, 10, 64)
+	if err != nil || quota < 0 {
+		return nil, dbfs.ErrInvalidQuota
+	}
+	return &quota, nil
+}
+
+// GetOwnQuota returns the usage of the user against their quota
+func (bc *BackendController) GetOwnQuota(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	usage, err := user.GetQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, usage)
+}
+
+// GetQuotas returns the usage of every user and group against their quotas.
+// Requires the user to be an admin.
+func (bc *BackendController) GetQuotas(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	countReplicas, err := dbfs.GetQuotaCountReplicas(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	users, err := dbfs.GetUsersQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	groups, err := dbfs.GetGroupsQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, QuotasResponse{
+		CountReplicas: countReplicas,
+		Users:         users,
+		Groups:        groups,
+	})
+}
+
+// GetUserQuota returns the usage of a user against their quota.
+// Requires the user to be an admin.
+func (bc *BackendController) GetUserQuota(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	target, err := dbfs.GetUserById(bc.Db, mux.Vars(r)["userID"])
+	if errors.Is(err, dbfs.ErrUserNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	usage, err := target.GetQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, usage)
+}
+
+// SetUserQuota sets the quota of a user in bytes, from the quota header.
+// Without the header (or with DELETE) the quota is removed.
+// Requires the user to be an admin.
+func (bc *BackendController) SetUserQuota(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	var quota *int64
+	if r.Method != http.MethodDelete {
+		var err error
+		if quota, err = parseQuota(r); err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid quota")
+			return
+		}
+	}
+
+	target, err := dbfs.GetUserById(bc.Db, mux.Vars(r)["userID"])
+	if errors.Is(err, dbfs.ErrUserNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err := target.SetQuota(bc.Db, quota); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	usage, err := target.GetQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, usage)
+}
+
+// GetGroupQuota returns the usage of a group against its quota.
+// Requires the user to be an admin.
+func (bc *BackendController) GetGroupQuota(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	group, err := dbfs.GetGroupById(bc.Db, mux.Vars(r)["groupID"])
+	if errors.Is(err, dbfs.ErrGroupNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	usage, err := group.GetQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, usage)
+}
+
+// SetGroupQuota sets the quota of a group in bytes, from the quota header.
+// Without the header (or with DELETE) the quota is removed.
+// Requires the user to be an admin.
+func (bc *BackendController) SetGroupQuota(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	var quota *int64
+	if r.Method != http.MethodDelete {
+		var err error
+		if quota, err = parseQuota(r); err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid quota")
+			return
+		}
+	}
+
+	group, err := dbfs.GetGroupById(bc.Db, mux.Vars(r)["groupID"])
+	if errors.Is(err, dbfs.ErrGroupNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	if err := group.SetQuota(bc.Db, quota); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	usage, err := group.GetQuotaUsage(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, usage)
+}
+
+// SetQuotaSettings sets whether parity shards count towards the quotas, from
+// the count_replicas header. Requires the user to be an admin.
+func (bc *BackendController) SetQuotaSettings(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	countReplicas, err := strconv.ParseBool(r.Header.Get("count_replicas"))
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid count_replicas")
+		return
+	}
+
+	if err := dbfs.SetQuotaCountReplicas(bc.Db, countReplicas); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, countReplicas)
+}
+
+// RecalculateQuotas recalculates the usage of every user from the files that
+// they own. Requires the user to be an admin.
+func (bc *BackendController) RecalculateQuotas(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(w, r) == nil {
+		return
+	}
+
+	if err := dbfs.RecalculateQuotaUsage(bc.Db); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
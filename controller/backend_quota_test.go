@@ -0,0 +1,107 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Quotas(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	user, err := dbfs.CreateNewUser(db, "quotaUser", "quotaUser", dbfs.AccountTypeEndUser,
+		"quotaUser", "quotaUser", "quotaUser", "quotaUser", "localhost")
+	Assert.NoError(err)
+
+	newRequest := func(as *dbfs.User, method, target string, vars map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, nil).
+			WithContext(ctxutil.WithUser(context.Background(), as))
+		return mux.SetURLVars(req, vars)
+	}
+	userVars := map[string]string{"userID": user.UserId}
+
+	t.Run("Setting a quota", func(t *testing.T) {
+		req := newRequest(user, "PUT", "/api/v1/quotas/users/"+user.UserId, userVars)
+		req.Header.Set("quota", "1000")
+		w := httptest.NewRecorder()
+		bc.SetUserQuota(w, req)
+		Assert.Equal(http.StatusForbidden, w.Code)
+
+		req = newRequest(admin, "PUT", "/api/v1/quotas/users/"+user.UserId, userVars)
+		req.Header.Set("quota", "-5")
+		w = httptest.NewRecorder()
+		bc.SetUserQuota(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		req = newRequest(admin, "PUT", "/api/v1/quotas/users/"+user.UserId, userVars)
+		req.Header.Set("quota", "1000")
+		w = httptest.NewRecorder()
+		bc.SetUserQuota(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var usage dbfs.QuotaUsage
+		w = httptest.NewRecorder()
+		bc.GetOwnQuota(w, newRequest(user, "GET", "/api/v1/quota", nil))
+		Assert.Equal(http.StatusOK, w.Code)
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &usage))
+		Assert.Equal(int64(1000), *usage.Quota)
+		Assert.Equal(int64(0), usage.Used)
+	})
+
+	t.Run("Listing usage", func(t *testing.T) {
+		req := newRequest(admin, "PUT", "/api/v1/quotas/settings", nil)
+		req.Header.Set("count_replicas", "true")
+		w := httptest.NewRecorder()
+		bc.SetQuotaSettings(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var quotas controller.QuotasResponse
+		w = httptest.NewRecorder()
+		bc.GetQuotas(w, newRequest(admin, "GET", "/api/v1/quotas", nil))
+		Assert.Equal(http.StatusOK, w.Code)
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &quotas))
+		Assert.True(quotas.CountReplicas)
+		Assert.Len(quotas.Users, 2)
+
+		w = httptest.NewRecorder()
+		bc.GetQuotas(w, newRequest(user, "GET", "/api/v1/quotas", nil))
+		Assert.Equal(http.StatusForbidden, w.Code)
+	})
+
+	t.Run("Removing a quota", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.SetUserQuota(w, newRequest(admin, "DELETE", "/api/v1/quotas/users/"+user.UserId, userVars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var usage dbfs.QuotaUsage
+		w = httptest.NewRecorder()
+		bc.GetUserQuota(w, newRequest(admin, "GET", "/api/v1/quotas/users/"+user.UserId, userVars))
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &usage))
+		Assert.Nil(usage.Quota)
+
+		w = httptest.NewRecorder()
+		bc.GetGroupQuota(w, newRequest(admin, "GET", "/api/v1/quotas/groups/nope",
+			map[string]string{"groupID": "nope"}))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
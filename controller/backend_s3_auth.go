@@ -0,0 +1,253 @@
+package controller
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+)
+
+const (
+	s3SigV4Algorithm      = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload     = "UNSIGNED-PAYLOAD"
+	s3StreamingPayload    = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	s3MaxRequestClockSkew = 15 * time.Minute
+	s3AmzDateFormat       = "20060102T150405Z"
+)
+
+var errS3PayloadHashMismatch = errors.New("payload does not match x-amz-content-sha256")
+
+// s3Credential is the parsed Authorization header of a SigV4 request
+type s3Credential struct {
+	accessKeyId   string
+	date          string
+	region        string
+	service       string
+	signedHeaders []string
+	signature     string
+}
+
+// parseS3Authorization parses a SigV4 Authorization header, e.g.
+// AWS4-HMAC-SHA256 Credential=AKID/20220101/us-east-1/s3/aws4_request,
+// SignedHeaders=host;x-amz-date, Signature=abcdef
+func parseS3Authorization(header string) (*s3Credential, error) {
+	if !strings.HasPrefix(header, s3SigV4Algorithm+" ") {
+		return nil, errors.New("unsupported authorization type")
+	}
+
+	cred := &s3Credential{}
+	for _, field := range strings.Split(strings.TrimPrefix(header, s3SigV4Algorithm+" "), ",") {
+		k, v, found := strings.Cut(strings.TrimSpace(field), "=")
+		if !found {
+			return nil, errors.New("malformed authorization header")
+		}
+		switch k {
+		case "Credential":
+			parts := strings.Split(v, "/")
+			if len(parts) != 5 || parts[4] != "aws4_request" {
+				return nil, errors.New("malformed credential")
+			}
+			cred.accessKeyId, cred.date, cred.region, cred.service =
+				parts[0], parts[1], parts[2], parts[3]
+		case "SignedHeaders":
+			cred.signedHeaders = strings.Split(v, ";")
+		case "Signature":
+			cred.signature = v
+		}
+	}
+
+	if cred.accessKeyId == "" || cred.signature == "" || len(cred.signedHeaders) == 0 {
+		return nil, errors.New("malformed authorization header")
+	}
+	if cred.service != "s3" {
+		return nil, errors.New("credential is not scoped to s3")
+	}
+
+	return cred, nil
+}
+
+// s3URIEncode encodes a string the way SigV4 expects, leaving only the
+// unreserved characters as is.
+func s3URIEncode(s string, encodeSlash bool) string {
+	var buf strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && !encodeSlash) {
+			buf.WriteByte(c)
+		} else {
+			buf.WriteString("%" + strings.ToUpper(hex.EncodeToString([]byte{c})))
+		}
+	}
+	return buf.String()
+}
+
+// s3CanonicalRequest builds the canonical request of a SigV4 signature
+func s3CanonicalRequest(r *http.Request, signedHeaders []string, payloadHash string) string {
+
+	// Query string, sorted by key and then value
+	query := r.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		values := query[k]
+		sort.Strings(values)
+		for _, v := range values {
+			params = append(params, s3URIEncode(k, true)+"="+s3URIEncode(v, true))
+		}
+	}
+
+	// Headers
+	var headers strings.Builder
+	for _, h := range signedHeaders {
+		var value string
+		if h == "host" {
+			value = r.Host
+		} else {
+			value = strings.Join(r.Header.Values(h), ",")
+		}
+		headers.WriteString(h + ":" + strings.Join(strings.Fields(value), " ") + "\n")
+	}
+
+	return strings.Join([]string{
+		r.Method,
+		s3URIEncode(r.URL.Path, false),
+		strings.Join(params, "&"),
+		headers.String(),
+		strings.Join(signedHeaders, ";"),
+		payloadHash,
+	}, "\n")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Signature computes the SigV4 signature of a request
+func s3Signature(secret string, cred *s3Credential, amzDate, canonicalRequest string) string {
+	scope := strings.Join([]string{cred.date, cred.region, cred.service, "aws4_request"}, "/")
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		s3SigV4Algorithm,
+		amzDate,
+		scope,
+		hex.EncodeToString(hashedRequest[:]),
+	}, "\n")
+
+	key := hmacSHA256([]byte("AWS4"+secret), cred.date)
+	key = hmacSHA256(key, cred.region)
+	key = hmacSHA256(key, cred.service)
+	key = hmacSHA256(key, "aws4_request")
+
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+// s3VerifiedBody wraps a request body and fails the read that reaches the end
+// of the body if it does not match the hash that was signed.
+type s3VerifiedBody struct {
+	body     io.ReadCloser
+	hash     hash.Hash
+	expected []byte
+}
+
+func (b *s3VerifiedBody) Read(p []byte) (int, error) {
+	n, err := b.body.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !bytes.Equal(b.hash.Sum(nil), b.expected) {
+		return n, errS3PayloadHashMismatch
+	}
+	return n, err
+}
+
+func (b *s3VerifiedBody) Close() error {
+	return b.body.Close()
+}
+
+// S3Auth is a middleware that authenticates S3 requests signed with SigV4
+// using the access keys created through CreateS3AccessKey, and sets the
+// owner of the key as the user in the request context.
+func (bc *BackendController) S3Auth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, err := parseS3Authorization(r.Header.Get("Authorization"))
+		if err != nil {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+			return
+		}
+
+		// Check the request date
+		amzDate := r.Header.Get("X-Amz-Date")
+		requestTime, err := time.Parse(s3AmzDateFormat, amzDate)
+		if err != nil {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied", "Missing or invalid X-Amz-Date")
+			return
+		}
+		if skew := time.Since(requestTime); skew > s3MaxRequestClockSkew || skew < -s3MaxRequestClockSkew {
+			s3Error(w, r, http.StatusForbidden, "RequestTimeTooSkewed",
+				"The difference between the request time and the server's time is too large")
+			return
+		}
+		if !strings.HasPrefix(amzDate, cred.date) {
+			s3Error(w, r, http.StatusForbidden, "AccessDenied", "Credential date does not match X-Amz-Date")
+			return
+		}
+
+		payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+		if payloadHash == s3StreamingPayload {
+			s3Error(w, r, http.StatusNotImplemented, "NotImplemented",
+				"Chunked payload signing is not supported, please use UNSIGNED-PAYLOAD")
+			return
+		}
+		if payloadHash == "" {
+			s3Error(w, r, http.StatusBadRequest, "InvalidRequest", "Missing x-amz-content-sha256")
+			return
+		}
+
+		key, err := dbfs.GetS3AccessKey(bc.Db, cred.accessKeyId)
+		if errors.Is(err, dbfs.ErrS3AccessKeyNotFound) {
+			s3Error(w, r, http.StatusForbidden, "InvalidAccessKeyId", err.Error())
+			return
+		} else if err != nil {
+			s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+
+		signature := s3Signature(key.SecretAccessKey, cred, amzDate,
+			s3CanonicalRequest(r, cred.signedHeaders, payloadHash))
+		if !hmac.Equal([]byte(signature), []byte(cred.signature)) {
+			s3Error(w, r, http.StatusForbidden, "SignatureDoesNotMatch",
+				"The request signature we calculated does not match the signature you provided")
+			return
+		}
+
+		// Verify the payload as it is read
+		if payloadHash != s3UnsignedPayload {
+			expected, err := hex.DecodeString(payloadHash)
+			if err != nil {
+				s3Error(w, r, http.StatusBadRequest, "InvalidRequest", "Invalid x-amz-content-sha256")
+				return
+			}
+			r.Body = &s3VerifiedBody{body: r.Body, hash: sha256.New(), expected: expected}
+		}
+
+		key.MarkUsed(bc.Db)
+
+		r = r.WithContext(ctxutil.WithUser(r.Context(), key.User))
+		next.ServeHTTP(w, r)
+	})
+}
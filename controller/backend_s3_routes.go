@@ -0,0 +1,941 @@
+package controller
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	S3Prefix = "/s3"
+
+	s3XMLNamespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3DefaultMaxKeys   = 1000
+	s3MaxPartNumber    = 10000
+	s3MaxPartSize      = 5 * 1024 * 1024 * 1024
+	s3MultipartDirName = "ohana-s3-multipart"
+)
+
+type s3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string   `xml:"Code"`
+	Message  string   `xml:"Message"`
+	Resource string   `xml:"Resource"`
+}
+
+type s3Owner struct {
+	ID          string `xml:"ID"`
+	DisplayName string `xml:"DisplayName"`
+}
+
+type s3Bucket struct {
+	Name         string `xml:"Name"`
+	CreationDate string `xml:"CreationDate"`
+}
+
+type s3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Owner   s3Owner    `xml:"Owner"`
+	Buckets []s3Bucket `xml:"Buckets>Bucket"`
+}
+
+type s3Object struct {
+	Key          string `xml:"Key"`
+	LastModified string `xml:"LastModified"`
+	ETag         string `xml:"ETag"`
+	Size         int64  `xml:"Size"`
+	StorageClass string `xml:"StorageClass"`
+}
+
+type s3CommonPrefix struct {
+	Prefix string `xml:"Prefix"`
+}
+
+type s3ListBucketResult struct {
+	XMLName               xml.Name         `xml:"ListBucketResult"`
+	Xmlns                 string           `xml:"xmlns,attr"`
+	Name                  string           `xml:"Name"`
+	Prefix                string           `xml:"Prefix"`
+	Delimiter             string           `xml:"Delimiter,omitempty"`
+	MaxKeys               int              `xml:"MaxKeys"`
+	KeyCount              int              `xml:"KeyCount"`
+	IsTruncated           bool             `xml:"IsTruncated"`
+	ContinuationToken     string           `xml:"ContinuationToken,omitempty"`
+	NextContinuationToken string           `xml:"NextContinuationToken,omitempty"`
+	StartAfter            string           `xml:"StartAfter,omitempty"`
+	Contents              []s3Object       `xml:"Contents"`
+	CommonPrefixes        []s3CommonPrefix `xml:"CommonPrefixes"`
+}
+
+type s3LocationConstraint struct {
+	XMLName xml.Name `xml:"LocationConstraint"`
+	Xmlns   string   `xml:"xmlns,attr"`
+}
+
+type s3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string   `xml:"Bucket"`
+	Key      string   `xml:"Key"`
+	UploadId string   `xml:"UploadId"`
+}
+
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	} `xml:"Part"`
+}
+
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Bucket  string   `xml:"Bucket"`
+	Key     string   `xml:"Key"`
+	ETag    string   `xml:"ETag"`
+}
+
+// s3Error writes an S3 error response
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(s3ErrorResponse{
+		Code:     code,
+		Message:  message,
+		Resource: r.URL.Path,
+	})
+}
+
+// s3DbfsError writes the S3 error matching a dbfs error
+func s3DbfsError(w http.ResponseWriter, r *http.Request, err error, notFoundCode string) {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound):
+		s3Error(w, r, http.StatusNotFound, notFoundCode, err.Error())
+	case errors.Is(err, dbfs.ErrNoPermission), errors.Is(err, dbfs.ErrPasswordRequired),
+		errors.Is(err, dbfs.ErrIncorrectPassword):
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+	case errors.Is(err, dbfs.ErrQuotaExceeded):
+		s3Error(w, r, http.StatusInsufficientStorage, "QuotaExceeded", err.Error())
+	default:
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+	}
+}
+
+// s3XML writes an S3 XML response
+func s3XML(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	io.WriteString(w, xml.Header)
+	xml.NewEncoder(w).Encode(data)
+}
+
+// s3ETag returns the ETag of a file
+func s3ETag(file *dbfs.File) string {
+	return `"` + file.Checksum + `"`
+}
+
+// s3Time formats a time the way S3 does in XML responses
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+// s3KeySegments splits an object key into its path segments. Keys that do not
+// map onto a dbfs path (e.g. with empty segments or "..") are rejected.
+func s3KeySegments(key string) ([]string, error) {
+	segments := strings.Split(strings.TrimSuffix(key, "/"), "/")
+	for _, segment := range segments {
+		if segment == "" || segment == "." || segment == ".." {
+			return nil, fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return segments, nil
+}
+
+// s3GetBucket returns the folder in the user's home folder that backs a bucket
+func (bc *BackendController) s3GetBucket(user *dbfs.User, bucket string) (*dbfs.File, error) {
+	if bucket == "" || strings.Contains(bucket, "/") {
+		return nil, dbfs.ErrFileNotFound
+	}
+	folder, err := dbfs.GetFileByPath(bc.Db, "/"+bucket, user, true)
+	if err != nil {
+		return nil, err
+	}
+	if folder.EntryType != dbfs.IsFolder {
+		return nil, dbfs.ErrFileNotFound
+	}
+	return folder, nil
+}
+
+// s3GetObject returns the file backing an object
+func (bc *BackendController) s3GetObject(user *dbfs.User, bucket, key string) (*dbfs.File, error) {
+	segments, err := s3KeySegments(key)
+	if err != nil {
+		return nil, dbfs.ErrFileNotFound
+	}
+	file, err := dbfs.GetFileByPath(bc.Db, "/"+bucket+"/"+strings.Join(segments, "/"), user, true)
+	if err != nil {
+		return nil, err
+	}
+	if file.EntryType != dbfs.IsFile || file.Status == dbfs.FileStatusWriting {
+		return nil, dbfs.ErrFileNotFound
+	}
+	return file, nil
+}
+
+// s3EnsureFolders returns the folder at the path given inside the bucket,
+// creating any folders that do not exist yet.
+func (bc *BackendController) s3EnsureFolders(user *dbfs.User, folder *dbfs.File, segments []string,
+) (*dbfs.File, error) {
+	for _, segment := range segments {
+		contents, err := folder.ListContents(bc.Db, user)
+		if err != nil {
+			return nil, err
+		}
+
+		var next *dbfs.File
+		for i := range contents {
+			if contents[i].FileName == segment {
+				next = &contents[i]
+				break
+			}
+		}
+		if next == nil {
+			next, err = folder.CreateSubFolder(bc.Db, segment, user, bc.ServerName)
+			if err != nil {
+				return nil, err
+			}
+		} else if next.EntryType != dbfs.IsFolder {
+			return nil, dbfs.ErrNotFolder
+		}
+		folder = next
+	}
+	return folder, nil
+}
+
+// s3PutData stores the data given under the key given, replacing the existing
+// object if there is one.
+func (bc *BackendController) s3PutData(r *http.Request, user *dbfs.User, bucket *dbfs.File,
+	key, contentType string, data io.Reader) (*dbfs.File, error) {
+
+	segments, err := s3KeySegments(key)
+	if err != nil {
+		return nil, err
+	}
+
+	folder, err := bc.s3EnsureFolders(user, bucket, segments[:len(segments)-1])
+	if err != nil {
+		return nil, err
+	}
+	fileName := segments[len(segments)-1]
+
+	// Keys ending with a slash are folders
+	if strings.HasSuffix(key, "/") {
+		return bc.s3EnsureFolders(user, folder, []string{fileName})
+	}
+
+	if contentType == "" || contentType == "binary/octet-stream" {
+		contentType = mime.TypeByExtension(path.Ext(fileName))
+	}
+
+	contents, err := folder.ListContents(bc.Db, user)
+	if err != nil {
+		return nil, err
+	}
+	for i := range contents {
+		if contents[i].FileName != fileName {
+			continue
+		}
+		existing := &contents[i]
+		if existing.EntryType != dbfs.IsFile {
+			return nil, dbfs.ErrFileFolderExists
+		}
+		if err := bc.updateFileData(r.Context(), user, existing, "", data); err != nil {
+			return nil, err
+		}
+		return existing, nil
+	}
+
+	return bc.writeNewFile(r.Context(), user, folder.FileId, fileName, contentType, data)
+}
+
+// S3ListBuckets lists the folders in the user's home folder as buckets
+func (bc *BackendController) S3ListBuckets(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	contents, err := dbfs.LsHomeFolder(bc.Db, user)
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	result := s3ListAllMyBucketsResult{
+		Xmlns:   s3XMLNamespace,
+		Owner:   s3Owner{ID: user.UserId, DisplayName: user.Name},
+		Buckets: []s3Bucket{},
+	}
+	for _, folder := range contents {
+		if folder.EntryType != dbfs.IsFolder {
+			continue
+		}
+		result.Buckets = append(result.Buckets, s3Bucket{
+			Name:         folder.FileName,
+			CreationDate: s3Time(folder.CreatedTime),
+		})
+	}
+
+	s3XML(w, http.StatusOK, result)
+}
+
+// S3Bucket handles requests made on a bucket
+func (bc *BackendController) S3Bucket(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	bucketName := mux.Vars(r)["bucket"]
+
+	// Creating a bucket
+	if r.Method == http.MethodPut {
+		home, err := dbfs.GetHomeFolder(bc.Db, user)
+		if err != nil {
+			s3DbfsError(w, r, err, "NoSuchBucket")
+			return
+		}
+		_, err = home.CreateSubFolder(bc.Db, bucketName, user, bc.ServerName)
+		if errors.Is(err, dbfs.ErrFileFolderExists) {
+			s3Error(w, r, http.StatusConflict, "BucketAlreadyOwnedByYou", err.Error())
+			return
+		} else if err != nil {
+			s3DbfsError(w, r, err, "NoSuchBucket")
+			return
+		}
+		w.Header().Set("Location", "/"+bucketName)
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	bucket, err := bc.s3GetBucket(user, bucketName)
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK)
+	case http.MethodDelete:
+		isEmpty, err := bucket.IsFileOrEmptyFolder(bc.Db, user)
+		if err != nil {
+			s3DbfsError(w, r, err, "NoSuchBucket")
+			return
+		}
+		if !isEmpty {
+			s3Error(w, r, http.StatusConflict, "BucketNotEmpty", "The bucket you tried to delete is not empty")
+			return
+		}
+		if _, err := bucket.Trash(bc.Db, user); err != nil {
+			s3DbfsError(w, r, err, "NoSuchBucket")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodGet:
+		if _, ok := r.URL.Query()["location"]; ok {
+			s3XML(w, http.StatusOK, s3LocationConstraint{Xmlns: s3XMLNamespace})
+			return
+		}
+		bc.s3ListObjects(w, r, user, bucket)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", "Operation not supported")
+	}
+}
+
+// s3ListObjects implements ListObjectsV2
+func (bc *BackendController) s3ListObjects(w http.ResponseWriter, r *http.Request, user *dbfs.User,
+	bucket *dbfs.File) {
+
+	query := r.URL.Query()
+	prefix := query.Get("prefix")
+	delimiter := query.Get("delimiter")
+	startAfter := query.Get("start-after")
+	continuationToken := query.Get("continuation-token")
+
+	maxKeys := s3DefaultMaxKeys
+	if query.Get("max-keys") != "" {
+		n, err := strconv.Atoi(query.Get("max-keys"))
+		if err != nil || n < 0 {
+			s3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid max-keys")
+			return
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+
+	after := startAfter
+	if continuationToken != "" {
+		token, err := base64.URLEncoding.DecodeString(continuationToken)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid continuation-token")
+			return
+		}
+		after = string(token)
+	}
+
+	// Collect all the objects under the prefix
+	var objects []s3Object
+	var walk func(folder *dbfs.File, folderKey string) error
+	walk = func(folder *dbfs.File, folderKey string) error {
+		contents, err := folder.ListContents(bc.Db, user)
+		if err != nil {
+			return err
+		}
+		for i := range contents {
+			item := &contents[i]
+			key := folderKey + item.FileName
+			if item.EntryType == dbfs.IsFolder {
+				key += "/"
+				// Only descend into folders that can contain matching keys
+				if strings.HasPrefix(key, prefix) || strings.HasPrefix(prefix, key) {
+					if err := walk(item, key); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+			if item.EntryType != dbfs.IsFile || item.Status == dbfs.FileStatusWriting ||
+				!strings.HasPrefix(key, prefix) {
+				continue
+			}
+			objects = append(objects, s3Object{
+				Key:          key,
+				LastModified: s3Time(item.ModifiedTime),
+				ETag:         s3ETag(item),
+				Size:         item.Size,
+				StorageClass: "STANDARD",
+			})
+		}
+		return nil
+	}
+	if err := walk(bucket, ""); err != nil {
+		s3DbfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	// Group the keys by delimiter
+	type entry struct {
+		key    string
+		object *s3Object
+	}
+	var entries []entry
+	seenPrefixes := map[string]bool{}
+	for i := range objects {
+		rest := strings.TrimPrefix(objects[i].Key, prefix)
+		if delimiter != "" {
+			if idx := strings.Index(rest, delimiter); idx >= 0 {
+				commonPrefix := prefix + rest[:idx+len(delimiter)]
+				if !seenPrefixes[commonPrefix] {
+					seenPrefixes[commonPrefix] = true
+					entries = append(entries, entry{key: commonPrefix})
+				}
+				continue
+			}
+		}
+		entries = append(entries, entry{key: objects[i].Key, object: &objects[i]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+
+	result := s3ListBucketResult{
+		Xmlns:             s3XMLNamespace,
+		Name:              bucket.FileName,
+		Prefix:            prefix,
+		Delimiter:         delimiter,
+		MaxKeys:           maxKeys,
+		ContinuationToken: continuationToken,
+		StartAfter:        startAfter,
+	}
+	for _, e := range entries {
+		if e.key <= after {
+			continue
+		}
+		if result.KeyCount >= maxKeys {
+			result.IsTruncated = true
+			break
+		}
+		if e.object != nil {
+			result.Contents = append(result.Contents, *e.object)
+		} else {
+			result.CommonPrefixes = append(result.CommonPrefixes, s3CommonPrefix{Prefix: e.key})
+		}
+		result.KeyCount++
+		after = e.key
+	}
+	if result.IsTruncated {
+		result.NextContinuationToken = base64.URLEncoding.EncodeToString([]byte(after))
+	}
+
+	s3XML(w, http.StatusOK, result)
+}
+
+// S3Object handles requests made on an object
+func (bc *BackendController) S3Object(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		s3Error(w, r, http.StatusForbidden, "AccessDenied", err.Error())
+		return
+	}
+
+	vars := mux.Vars(r)
+	bucketName, key := vars["bucket"], vars["key"]
+	query := r.URL.Query()
+
+	bucket, err := bc.s3GetBucket(user, bucketName)
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchBucket")
+		return
+	}
+
+	_, isUploads := query["uploads"]
+	uploadId := query.Get("uploadId")
+
+	switch {
+	case r.Method == http.MethodPost && isUploads:
+		bc.s3CreateMultipartUpload(w, r, user, bucketName, key)
+	case r.Method == http.MethodPut && uploadId != "":
+		bc.s3UploadPart(w, r, user, uploadId)
+	case r.Method == http.MethodPost && uploadId != "":
+		bc.s3CompleteMultipartUpload(w, r, user, bucket, uploadId)
+	case r.Method == http.MethodDelete && uploadId != "":
+		bc.s3AbortMultipartUpload(w, r, user, uploadId)
+	case r.Method == http.MethodPut:
+		bc.s3PutObject(w, r, user, bucket, key)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		bc.s3GetObjectData(w, r, user, bucketName, key)
+	case r.Method == http.MethodDelete:
+		file, err := bc.s3GetObject(user, bucketName, key)
+		if err == nil {
+			_, err = file.Trash(bc.Db, user)
+		}
+		if err != nil && !errors.Is(err, dbfs.ErrFileNotFound) {
+			s3DbfsError(w, r, err, "NoSuchKey")
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", "Operation not supported")
+	}
+}
+
+// s3PutObject implements PutObject
+func (bc *BackendController) s3PutObject(w http.ResponseWriter, r *http.Request, user *dbfs.User,
+	bucket *dbfs.File, key string) {
+
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		s3Error(w, r, http.StatusNotImplemented, "NotImplemented", "CopyObject is not supported")
+		return
+	}
+
+	file, err := bc.s3PutData(r, user, bucket, key, r.Header.Get("Content-Type"), r.Body)
+	if errors.Is(err, errS3PayloadHashMismatch) {
+		s3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+		return
+	} else if err != nil {
+		s3DbfsError(w, r, err, "NoSuchKey")
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(file))
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3GetObjectData implements GetObject and HeadObject
+func (bc *BackendController) s3GetObjectData(w http.ResponseWriter, r *http.Request, user *dbfs.User,
+	bucketName, key string) {
+
+	file, err := bc.s3GetObject(user, bucketName, key)
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchKey")
+		return
+	}
+
+	w.Header().Set("ETag", s3ETag(file))
+	w.Header().Set("Last-Modified", file.ModifiedTime.UTC().Format(http.TimeFormat))
+	contentType := file.MIMEType
+	if contentType == "" {
+		contentType = "binary/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	if r.Method == http.MethodHead {
+		w.Header().Set("Content-Length", strconv.FormatInt(file.Size, 10))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	reader, err := bc.openFileVersion(r.Context(), user, file, file.VersionNo, "")
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchKey")
+		return
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	bc.recordDownload(r, file, user, "s3")
+
+	http.ServeContent(w, r, file.FileName, file.ModifiedTime, reader)
+}
+
+// s3KeyRegistry keeps the keys that the parts of the multipart uploads
+// handled by this server are encrypted with. They are only kept in memory, so
+// uploads cannot be completed after a restart.
+type s3KeyRegistry struct {
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+func (kr *s3KeyRegistry) get(uploadId string) []byte {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	return kr.keys[uploadId]
+}
+
+func (kr *s3KeyRegistry) add(uploadId string, key []byte) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	if kr.keys == nil {
+		kr.keys = make(map[string][]byte)
+	}
+	kr.keys[uploadId] = key
+}
+
+func (kr *s3KeyRegistry) remove(uploadId string) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	delete(kr.keys, uploadId)
+}
+
+// s3MultipartDir returns the directory that the parts of an upload are kept in
+func s3MultipartDir(uploadId string) string {
+	return filepath.Join(os.TempDir(), s3MultipartDirName, uploadId)
+}
+
+// s3PartPath returns the path of a part of an upload
+func s3PartPath(uploadId string, partNumber int) string {
+	return filepath.Join(s3MultipartDir(uploadId), fmt.Sprintf("part-%05d", partNumber))
+}
+
+// s3CreateMultipartUpload implements CreateMultipartUpload
+func (bc *BackendController) s3CreateMultipartUpload(w http.ResponseWriter, r *http.Request,
+	user *dbfs.User, bucketName, key string) {
+
+	if _, err := s3KeySegments(key); err != nil {
+		s3Error(w, r, http.StatusBadRequest, "InvalidArgument", err.Error())
+		return
+	}
+
+	upload, err := dbfs.CreateS3MultipartUpload(bc.Db, user, bucketName, key,
+		r.Header.Get("Content-Type"), bc.ServerName)
+	if err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	partsKey, err := newSpoolKey()
+	if err != nil {
+		upload.Delete(bc.Db)
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	if err := os.MkdirAll(s3MultipartDir(upload.UploadId), 0700); err != nil {
+		upload.Delete(bc.Db)
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	bc.s3Keys.add(upload.UploadId, partsKey)
+
+	s3XML(w, http.StatusOK, s3InitiateMultipartUploadResult{
+		Xmlns:    s3XMLNamespace,
+		Bucket:   bucketName,
+		Key:      key,
+		UploadId: upload.UploadId,
+	})
+}
+
+// s3GetMultipartUpload returns an upload handled by this server, and the key
+// that its parts are encrypted with
+func (bc *BackendController) s3GetMultipartUpload(w http.ResponseWriter, r *http.Request,
+	user *dbfs.User, uploadId string) (*dbfs.S3MultipartUpload, []byte) {
+
+	upload, err := dbfs.GetS3MultipartUpload(bc.Db, user, uploadId)
+	if errors.Is(err, dbfs.ErrS3UploadNotFound) {
+		s3Error(w, r, http.StatusNotFound, "NoSuchUpload", err.Error())
+		return nil, nil
+	} else if err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return nil, nil
+	}
+	if upload.HandledServer != bc.ServerName {
+		s3Error(w, r, http.StatusServiceUnavailable, "SlowDown",
+			"The upload is handled by another server")
+		return nil, nil
+	}
+
+	// The key is lost if the server restarted, and the parts with it
+	partsKey := bc.s3Keys.get(upload.UploadId)
+	if partsKey == nil {
+		if err := bc.s3DeleteMultipartUpload(upload); err != nil {
+			bc.Logger.Warn("failed to clean up multipart upload",
+				zap.String("uploadId", upload.UploadId), zap.Error(err))
+		}
+		s3Error(w, r, http.StatusNotFound, "NoSuchUpload", dbfs.ErrS3UploadNotFound.Error())
+		return nil, nil
+	}
+	return upload, partsKey
+}
+
+// s3UploadPart implements UploadPart
+func (bc *BackendController) s3UploadPart(w http.ResponseWriter, r *http.Request, user *dbfs.User,
+	uploadId string) {
+
+	partNumber, err := strconv.Atoi(r.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		s3Error(w, r, http.StatusBadRequest, "InvalidArgument", "Invalid partNumber")
+		return
+	}
+
+	upload, partsKey := bc.s3GetMultipartUpload(w, r, user, uploadId)
+	if upload == nil {
+		return
+	}
+
+	partFile, err := createSpoolFile(s3PartPath(upload.UploadId, partNumber), partsKey)
+	if err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	defer partFile.Close()
+
+	hash := md5.New()
+	size, err := io.Copy(io.MultiWriter(partFile, hash), io.LimitReader(r.Body, s3MaxPartSize+1))
+	if errors.Is(err, errS3PayloadHashMismatch) {
+		s3Error(w, r, http.StatusBadRequest, "XAmzContentSHA256Mismatch", err.Error())
+		return
+	} else if err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	if size > s3MaxPartSize {
+		s3Error(w, r, http.StatusBadRequest, "EntityTooLarge", "Part is too large")
+		return
+	}
+
+	etag := `"` + hex.EncodeToString(hash.Sum(nil)) + `"`
+	if err := upload.PutPart(bc.Db, partNumber, etag, size); err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	w.Header().Set("ETag", etag)
+	w.WriteHeader(http.StatusOK)
+}
+
+// s3CompleteMultipartUpload implements CompleteMultipartUpload. The parts
+// listed are streamed into the encoder in order.
+func (bc *BackendController) s3CompleteMultipartUpload(w http.ResponseWriter, r *http.Request,
+	user *dbfs.User, bucket *dbfs.File, uploadId string) {
+
+	upload, partsKey := bc.s3GetMultipartUpload(w, r, user, uploadId)
+	if upload == nil {
+		return
+	}
+
+	var request s3CompleteMultipartUpload
+	if err := xml.NewDecoder(r.Body).Decode(&request); err != nil || len(request.Parts) == 0 {
+		s3Error(w, r, http.StatusBadRequest, "MalformedXML", "Invalid CompleteMultipartUpload body")
+		return
+	}
+
+	parts, err := upload.GetParts(bc.Db)
+	if err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+	partsByNumber := make(map[int]dbfs.S3MultipartPart, len(parts))
+	for _, part := range parts {
+		partsByNumber[part.PartNumber] = part
+	}
+
+	// Open the parts in the order requested
+	var readers []io.Reader
+	lastPartNumber := 0
+	for _, requested := range request.Parts {
+		part, ok := partsByNumber[requested.PartNumber]
+		if !ok || part.ETag != `"`+strings.Trim(requested.ETag, `"`)+`"` {
+			s3Error(w, r, http.StatusBadRequest, "InvalidPart",
+				fmt.Sprintf("Part %d could not be found", requested.PartNumber))
+			return
+		}
+		if requested.PartNumber <= lastPartNumber {
+			s3Error(w, r, http.StatusBadRequest, "InvalidPartOrder", "Parts must be in ascending order")
+			return
+		}
+		lastPartNumber = requested.PartNumber
+
+		partFile, err := openSpoolFile(s3PartPath(upload.UploadId, part.PartNumber), partsKey)
+		if err != nil {
+			s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+			return
+		}
+		defer partFile.Close()
+		readers = append(readers, partFile)
+	}
+
+	file, err := bc.s3PutData(r, user, bucket, upload.Key, upload.ContentType, io.MultiReader(readers...))
+	if err != nil {
+		s3DbfsError(w, r, err, "NoSuchKey")
+		return
+	}
+
+	if err := bc.s3DeleteMultipartUpload(upload); err != nil {
+		bc.Logger.Warn("failed to clean up multipart upload",
+			zap.String("uploadId", upload.UploadId), zap.Error(err))
+	}
+
+	s3XML(w, http.StatusOK, s3CompleteMultipartUploadResult{
+		Xmlns:  s3XMLNamespace,
+		Bucket: bucket.FileName,
+		Key:    upload.Key,
+		ETag:   s3ETag(file),
+	})
+}
+
+// s3AbortMultipartUpload implements AbortMultipartUpload
+func (bc *BackendController) s3AbortMultipartUpload(w http.ResponseWriter, r *http.Request,
+	user *dbfs.User, uploadId string) {
+
+	upload, _ := bc.s3GetMultipartUpload(w, r, user, uploadId)
+	if upload == nil {
+		return
+	}
+
+	if err := bc.s3DeleteMultipartUpload(upload); err != nil {
+		s3Error(w, r, http.StatusInternalServerError, "InternalError", err.Error())
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// s3DeleteMultipartUpload removes the parts of an upload
+func (bc *BackendController) s3DeleteMultipartUpload(upload *dbfs.S3MultipartUpload) error {
+	bc.s3Keys.remove(upload.UploadId)
+	if err := os.RemoveAll(s3MultipartDir(upload.UploadId)); err != nil {
+		return err
+	}
+	return upload.Delete(bc.Db)
+}
+
+// CleanupS3Uploads removes the multipart uploads handled by this server that
+// were started more than dbfs.UploadSessionTimeout ago.
+func (bc *BackendController) CleanupS3Uploads() error {
+	uploads, err := dbfs.GetStaleS3MultipartUploads(bc.Db, bc.ServerName,
+		time.Now().Add(-dbfs.UploadSessionTimeout))
+	if err != nil {
+		return err
+	}
+
+	for i := range uploads {
+		if err := bc.s3DeleteMultipartUpload(&uploads[i]); err != nil {
+			bc.Logger.Warn("failed to clean up multipart upload",
+				zap.String("uploadId", uploads[i].UploadId), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// GetS3AccessKeys lists the S3 access keys of the user
+func (bc *BackendController) GetS3AccessKeys(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	keys, err := dbfs.GetS3AccessKeys(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, keys)
+}
+
+// CreateS3AccessKey creates a new S3 access key for the user. The secret is
+// only returned in this response.
+func (bc *BackendController) CreateS3AccessKey(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	key, err := dbfs.CreateS3AccessKey(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, key)
+}
+
+// DeleteS3AccessKey deletes one of the user's S3 access keys
+func (bc *BackendController) DeleteS3AccessKey(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	err = dbfs.DeleteS3AccessKey(bc.Db, user, mux.Vars(r)["accessKeyID"])
+	if errors.Is(err, dbfs.ErrS3AccessKeyNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
@@ -0,0 +1,394 @@
+package controller_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// signS3Request signs a request with SigV4 the way S3 clients do
+func signS3Request(req *http.Request, accessKeyId, secret string, body []byte) {
+	now := time.Now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	payloadHash := sha256.Sum256(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	// Query
+	query := req.URL.Query()
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var params []string
+	for _, k := range keys {
+		for _, v := range query[k] {
+			params = append(params, k+"="+strings.ReplaceAll(url.QueryEscape(v), "+", "%20"))
+		}
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.Host + "\n" +
+		"x-amz-content-sha256:" + req.Header.Get("X-Amz-Content-Sha256") + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	canonicalRequest := strings.Join([]string{
+		req.Method, req.URL.EscapedPath(), strings.Join(params, "&"),
+		canonicalHeaders, signedHeaders, hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+
+	scope := date + "/us-east-1/s3/aws4_request"
+	hashedRequest := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" +
+		hex.EncodeToString(hashedRequest[:])
+
+	sign := func(key []byte, data string) []byte {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(data))
+		return mac.Sum(nil)
+	}
+	key := sign([]byte("AWS4"+secret), date)
+	key = sign(key, "us-east-1")
+	key = sign(key, "s3")
+	key = sign(key, "aws4_request")
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKeyId+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(sign(key, stringToSign)))
+}
+
+func TestBackendController_S3(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5560",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Setting up the S3 routes
+	router := mux.NewRouter()
+	rS3 := router.PathPrefix(controller.S3Prefix).Subrouter()
+	rS3.HandleFunc("/", bc.S3ListBuckets).Methods("GET")
+	rS3.HandleFunc("/{bucket}", bc.S3Bucket)
+	rS3.HandleFunc("/{bucket}/", bc.S3Bucket)
+	rS3.HandleFunc("/{bucket}/{key:.+}", bc.S3Object)
+	rS3.Use(bc.S3Auth)
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	accessKey, err := dbfs.CreateS3AccessKey(db, user)
+	Assert.NoError(err)
+
+	doRequest := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, controller.S3Prefix+target, strings.NewReader(body))
+		signS3Request(req, accessKey.AccessKeyId, accessKey.SecretAccessKey, []byte(body))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("Authentication", func(t *testing.T) {
+		req := httptest.NewRequest("GET", controller.S3Prefix+"/", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		Assert.Equal(http.StatusForbidden, w.Code, w.Body.String())
+
+		req = httptest.NewRequest("GET", controller.S3Prefix+"/", nil)
+		signS3Request(req, accessKey.AccessKeyId, "wrongsecret", nil)
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		Assert.Equal(http.StatusForbidden, w.Code, w.Body.String())
+		Assert.Contains(w.Body.String(), "SignatureDoesNotMatch")
+
+		// Body that doesn't match the signed hash
+		req = httptest.NewRequest("PUT", controller.S3Prefix+"/nobucket/tampered.txt",
+			strings.NewReader("tampered"))
+		signS3Request(req, accessKey.AccessKeyId, accessKey.SecretAccessKey, []byte("original"))
+		w = httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		Assert.NotEqual(http.StatusOK, w.Code, w.Body.String())
+	})
+
+	t.Run("Buckets", func(t *testing.T) {
+		w := doRequest("PUT", "/bucket", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = doRequest("PUT", "/bucket", "")
+		Assert.Equal(http.StatusConflict, w.Code, w.Body.String())
+
+		w = doRequest("HEAD", "/bucket", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = doRequest("HEAD", "/nobucket", "")
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Contains(w.Body.String(), "<Name>bucket</Name>")
+	})
+
+	t.Run("PutObject and GetObject", func(t *testing.T) {
+		w := doRequest("PUT", "/bucket/dir/hello.txt", "hello world")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NotEmpty(w.Header().Get("ETag"))
+
+		w = doRequest("GET", "/bucket/dir/hello.txt", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("hello world", w.Body.String())
+
+		// Overwriting
+		w = doRequest("PUT", "/bucket/dir/hello.txt", "goodbye world")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = doRequest("HEAD", "/bucket/dir/hello.txt", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("13", w.Header().Get("Content-Length"))
+
+		w = doRequest("GET", "/bucket/dir/hello.txt", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+
+		// Both GETs are downloads, the HEAD is not
+		file, err := dbfs.GetFileByPath(db, "/bucket/dir/hello.txt", user, true)
+		Assert.NoError(err)
+		activity, err := file.GetActivity(db, user, &dbfs.ActivityFilter{Action: dbfs.ActivityDownload})
+		Assert.NoError(err)
+		Assert.Len(activity, 2)
+		for _, entry := range activity {
+			Assert.Equal("s3", entry.Details)
+		}
+
+		w = doRequest("GET", "/bucket/dir/nothere.txt", "")
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+		Assert.Contains(w.Body.String(), "NoSuchKey")
+	})
+
+	t.Run("PutObject with a cut short body", func(t *testing.T) {
+		// The client drops after sending part of the object
+		cutShort := func(target string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("PUT", controller.S3Prefix+target,
+				io.MultiReader(strings.NewReader("cut"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+			signS3Request(req, accessKey.AccessKeyId, accessKey.SecretAccessKey, []byte("cut short"))
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			return w
+		}
+
+		before, err := dbfs.GetFileByPath(db, "/bucket/dir/hello.txt", user, true)
+		Assert.NoError(err)
+		w := cutShort("/bucket/dir/hello.txt")
+		Assert.NotEqual(http.StatusOK, w.Code, w.Body.String())
+
+		// The data is the same, and the cut off version is gone
+		after, err := dbfs.GetFileByPath(db, "/bucket/dir/hello.txt", user, true)
+		Assert.NoError(err)
+		Assert.Equal(before.DataId, after.DataId)
+		versions, err := after.GetAllVersions(db, user)
+		Assert.NoError(err)
+		for _, version := range versions {
+			Assert.Equal(dbfs.FileStatusGood, version.Status, "version %d", version.VersionNo)
+		}
+		w = doRequest("GET", "/bucket/dir/hello.txt", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+
+		w = cutShort("/bucket/dir/cut.txt")
+		Assert.NotEqual(http.StatusOK, w.Code, w.Body.String())
+		_, err = dbfs.GetFileByPath(db, "/bucket/dir/cut.txt", user, true)
+		Assert.Error(err)
+	})
+
+	t.Run("ListObjectsV2", func(t *testing.T) {
+		w := doRequest("PUT", "/bucket/top.txt", "top")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		type listResult struct {
+			Contents []struct {
+				Key string `xml:"Key"`
+			} `xml:"Contents"`
+			CommonPrefixes []struct {
+				Prefix string `xml:"Prefix"`
+			} `xml:"CommonPrefixes"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		list := func(query string) listResult {
+			w := doRequest("GET", "/bucket?list-type=2"+query, "")
+			Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+			var result listResult
+			Assert.NoError(xml.Unmarshal(w.Body.Bytes(), &result))
+			return result
+		}
+
+		result := list("")
+		Assert.Len(result.Contents, 2)
+		Assert.Equal("dir/hello.txt", result.Contents[0].Key)
+		Assert.Equal("top.txt", result.Contents[1].Key)
+
+		result = list("&delimiter=/")
+		Assert.Len(result.Contents, 1)
+		Assert.Len(result.CommonPrefixes, 1)
+		Assert.Equal("dir/", result.CommonPrefixes[0].Prefix)
+
+		result = list("&prefix=dir/")
+		Assert.Len(result.Contents, 1)
+
+		result = list("&max-keys=1")
+		Assert.Len(result.Contents, 1)
+		Assert.True(result.IsTruncated)
+		result = list("&max-keys=1&continuation-token=" + result.NextContinuationToken)
+		Assert.Len(result.Contents, 1)
+		Assert.Equal("top.txt", result.Contents[0].Key)
+		Assert.False(result.IsTruncated)
+	})
+
+	t.Run("Multipart upload", func(t *testing.T) {
+		w := doRequest("POST", "/bucket/multi.txt?uploads", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		var initResult struct {
+			UploadId string `xml:"UploadId"`
+		}
+		Assert.NoError(xml.Unmarshal(w.Body.Bytes(), &initResult))
+		Assert.NotEmpty(initResult.UploadId)
+
+		w = doRequest("PUT", "/bucket/multi.txt?partNumber=1&uploadId="+initResult.UploadId, "hello ")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		etag1 := w.Header().Get("ETag")
+		w = doRequest("PUT", "/bucket/multi.txt?partNumber=2&uploadId="+initResult.UploadId, "multipart")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		etag2 := w.Header().Get("ETag")
+
+		// The parts are not kept as plaintext
+		partPaths, err := filepath.Glob(filepath.Join(os.TempDir(), "ohana-s3-multipart",
+			initResult.UploadId, "*"))
+		Assert.NoError(err)
+		Assert.Len(partPaths, 2)
+		for _, partPath := range partPaths {
+			data, err := os.ReadFile(partPath)
+			Assert.NoError(err)
+			Assert.NotContains(string(data), "hello")
+			Assert.NotContains(string(data), "multipart")
+		}
+
+		// Wrong ETag
+		w = doRequest("POST", "/bucket/multi.txt?uploadId="+initResult.UploadId,
+			"<CompleteMultipartUpload><Part><PartNumber>1</PartNumber><ETag>nope</ETag></Part>"+
+				"</CompleteMultipartUpload>")
+		Assert.Equal(http.StatusBadRequest, w.Code, w.Body.String())
+
+		w = doRequest("POST", "/bucket/multi.txt?uploadId="+initResult.UploadId,
+			"<CompleteMultipartUpload>"+
+				"<Part><PartNumber>1</PartNumber><ETag>"+etag1+"</ETag></Part>"+
+				"<Part><PartNumber>2</PartNumber><ETag>"+etag2+"</ETag></Part>"+
+				"</CompleteMultipartUpload>")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/bucket/multi.txt", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("hello multipart", w.Body.String())
+
+		// The upload is gone
+		w = doRequest("DELETE", "/bucket/multi.txt?uploadId="+initResult.UploadId, "")
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+
+		// Aborting
+		w = doRequest("POST", "/bucket/aborted.txt?uploads", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(xml.Unmarshal(w.Body.Bytes(), &initResult))
+		w = doRequest("DELETE", "/bucket/aborted.txt?uploadId="+initResult.UploadId, "")
+		Assert.Equal(http.StatusNoContent, w.Code, w.Body.String())
+	})
+
+	t.Run("DeleteObject and DeleteBucket", func(t *testing.T) {
+		w := doRequest("DELETE", "/bucket", "")
+		Assert.Equal(http.StatusConflict, w.Code, w.Body.String())
+
+		for _, key := range []string{"/bucket/dir/hello.txt", "/bucket/top.txt", "/bucket/multi.txt",
+			"/bucket/dir/"} {
+			w = doRequest("DELETE", key, "")
+			Assert.Equal(http.StatusNoContent, w.Code, w.Body.String())
+		}
+
+		w = doRequest("GET", "/bucket/top.txt", "")
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+
+		// The folder created for the key prefix is still there
+		folder, err := dbfs.GetFileByPath(db, "/bucket/dir", user, true)
+		Assert.NoError(err)
+		Assert.NoError(folder.Delete(db, user, bc.ServerName))
+
+		w = doRequest("DELETE", "/bucket", "")
+		Assert.Equal(http.StatusNoContent, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/", "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		body, _ := io.ReadAll(w.Body)
+		Assert.NotContains(string(body), "<Name>bucket</Name>")
+	})
+}
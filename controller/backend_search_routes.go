@@ -0,0 +1,108 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+)
+
+// parseSearchQuery parses the query parameters of a search request
+func parseSearchQuery(values url.Values) (*dbfs.SearchQuery, error) {
+	query := &dbfs.SearchQuery{
+		Name:           values.Get("name"),
+		Glob:           values.Get("glob"),
+		MIMEType:       values.Get("mime_type"),
+		ModifiedUserId: values.Get("modified_by"),
+		RootFolderId:   values.Get("folder_id"),
+	}
+
+	switch values.Get("type") {
+	case "":
+	case "file":
+		query.EntryType = dbfs.IsFile
+	case "folder":
+		query.EntryType = dbfs.IsFolder
+	default:
+		return nil, errors.New("type must be file or folder")
+	}
+
+	for param, dest := range map[string]**int64{
+		"min_size": &query.MinSize,
+		"max_size": &query.MaxSize,
+	} {
+		if v := values.Get(param); v != "" {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", param)
+			}
+			*dest = &n
+		}
+	}
+
+	for param, dest := range map[string]**time.Time{
+		"modified_after":  &query.ModifiedAfter,
+		"modified_before": &query.ModifiedBefore,
+		"created_after":   &query.CreatedAfter,
+		"created_before":  &query.CreatedBefore,
+	} {
+		if v := values.Get(param); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s, expected RFC 3339", param)
+			}
+			*dest = &t
+		}
+	}
+
+	for param, dest := range map[string]*int{
+		"limit":  &query.Limit,
+		"offset": &query.Offset,
+	} {
+		if v := values.Get(param); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid %s", param)
+			}
+			*dest = n
+		}
+	}
+
+	return query, nil
+}
+
+// SearchFiles searches the metadata of the files and folders that the user
+// can read.
+func (bc *BackendController) SearchFiles(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	query, err := parseSearchQuery(r.URL.Query())
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	files, err := dbfs.SearchFiles(bc.Db, user, query)
+	if err != nil {
+		if errors.Is(err, dbfs.ErrInvalidSearch) || errors.Is(err, dbfs.ErrNotFolder) {
+			util.HttpError(w, http.StatusBadRequest, err.Error())
+		} else if errors.Is(err, dbfs.ErrFileNotFound) {
+			util.HttpError(w, http.StatusNotFound, err.Error())
+		} else {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, files)
+}
@@ -0,0 +1,73 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Search(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "searchable", user, "localhost")
+	Assert.NoError(err)
+	_, err = folder.CreateSubFolder(db, "nested", user, "localhost")
+	Assert.NoError(err)
+
+	doSearch := func(query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/search?"+query, nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		w := httptest.NewRecorder()
+		bc.SearchFiles(w, req)
+		return w
+	}
+
+	t.Run("Searching", func(t *testing.T) {
+		w := doSearch("name=NEST&type=folder&folder_id=" + folder.FileId)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var files []dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal("nested", files[0].FileName)
+
+		w = doSearch("glob=search*&modified_after=2000-01-01T00:00:00Z&limit=10")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal(folder.FileId, files[0].FileId)
+	})
+
+	t.Run("Invalid queries", func(t *testing.T) {
+		for _, query := range []string{"type=link", "min_size=abc", "modified_after=yesterday",
+			"limit=100000"} {
+			w := doSearch(query)
+			Assert.Equal(http.StatusBadRequest, w.Code, query)
+		}
+
+		w := doSearch("folder_id=nothere")
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+)
+
+// sharedLinkOptionsFromHeaders reads the restrictions of a shared link from
+// the headers of the request:
+//   - expiry_time: RFC 3339 time after which the link stops working, or
+//     "never" to remove it
+//   - max_downloads: number of downloads allowed, 0 for no limit
+//   - link_password: password needed to use the link, empty to remove it
+//   - disabled: true or false
+//
+// It returns false if none of them were given.
+func sharedLinkOptionsFromHeaders(r *http.Request) (*dbfs.SharedLinkOptions, bool, error) {
+	options := &dbfs.SharedLinkOptions{}
+	given := false
+
+	if expiryTime := r.Header.Get("expiry_time"); expiryTime != "" {
+		given = true
+		if expiryTime == "never" {
+			options.ExpiryTime = &time.Time{}
+		} else {
+			t, err := time.Parse(time.RFC3339, expiryTime)
+			if err != nil {
+				return nil, false, errors.New("Invalid expiry_time")
+			}
+			options.ExpiryTime = &t
+		}
+	}
+
+	if maxDownloads := r.Header.Get("max_downloads"); maxDownloads != "" {
+		given = true
+		n, err := strconv.Atoi(maxDownloads)
+		if err != nil || n < 0 {
+			return nil, false, errors.New("Invalid max_downloads")
+		}
+		options.MaxDownloads = &n
+	}
+
+	// An empty password removes it, so the header only has to be present
+	if values, ok := r.Header[textproto.CanonicalMIMEHeaderKey("link_password")]; ok {
+		given = true
+		password := ""
+		if len(values) > 0 {
+			password = values[0]
+		}
+		options.Password = &password
+	}
+
+	if disabled := r.Header.Get("disabled"); disabled != "" {
+		given = true
+		b, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return nil, false, errors.New("Invalid disabled")
+		}
+		options.Disabled = &b
+	}
+
+	return options, given, nil
+}
+
+// openSharedLink returns the shared link requested and the file behind it,
+// checking the restrictions of the link. The password of the link is taken
+// from the link_password header. For links to folders, the path query
+// parameter selects an entry inside the folder. It writes the error and
+// returns false if the link cannot be used.
+func (bc *BackendController) openSharedLink(w http.ResponseWriter, r *http.Request,
+	shortenedLink string) (*dbfs.SharedLink, *dbfs.File, bool) {
+
+	sharedLink, file, err := dbfs.OpenSharedLink(bc.Db, shortenedLink, r.Header.Get("link_password"))
+	if err == nil {
+		if path := r.URL.Query().Get("path"); path != "" {
+			file, err = file.GetSharedDescendant(bc.Db, path)
+		}
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, dbfs.ErrSharedLinkNotFound), errors.Is(err, dbfs.ErrSharedLinkDisabled):
+			util.HttpError(w, http.StatusNotFound, dbfs.ErrSharedLinkNotFound.Error())
+		case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrNotFolder):
+			util.HttpError(w, http.StatusNotFound, dbfs.ErrFileNotFound.Error())
+		case errors.Is(err, dbfs.ErrSharedLinkExpired), errors.Is(err, dbfs.ErrSharedLinkLimitReached):
+			util.HttpError(w, http.StatusGone, err.Error())
+		case errors.Is(err, dbfs.ErrLinkPasswordRequired), errors.Is(err, dbfs.ErrIncorrectLinkPassword):
+			util.HttpError(w, http.StatusUnauthorized, err.Error())
+		default:
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return nil, nil, false
+	}
+
+	return sharedLink, file, true
+}
+
+// recordSharedLinkDownload counts a download of the shared link and adds it
+// to the activity of the file. Every request counts, ranges included, as the
+// server cannot tell which ones continue a download that was already counted.
+// It writes the error and returns false if the link ran out of downloads.
+func (bc *BackendController) recordSharedLinkDownload(w http.ResponseWriter, r *http.Request,
+	sharedLink *dbfs.SharedLink, file *dbfs.File) bool {
+
+	if err := sharedLink.RecordDownload(bc.Db); err != nil {
+		if errors.Is(err, dbfs.ErrSharedLinkLimitReached) {
+			util.HttpError(w, http.StatusGone, err.Error())
+		} else {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+		}
+		return false
+	}
+
+	bc.recordDownload(r, file, nil, "shared link "+sharedLink.ShortenedLink)
+	return true
+}
@@ -0,0 +1,36 @@
+package controller
+
+import (
+	"net/http"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/gorilla/mux"
+)
+
+// ListSharedLink lists the contents of a shared folder, or of a folder inside
+// it given its path
+func (bc *BackendController) ListSharedLink(w http.ResponseWriter, r *http.Request) {
+	shortenedLink := mux.Vars(r)["shortenedLink"]
+	if shortenedLink == "" {
+		util.HttpError(w, http.StatusBadRequest, "No shortenedLink provided")
+		return
+	}
+
+	_, folder, ok := bc.openSharedLink(w, r, shortenedLink)
+	if !ok {
+		return
+	}
+	if folder.EntryType != dbfs.IsFolder {
+		util.HttpError(w, http.StatusBadRequest, dbfs.ErrNotFolder.Error())
+		return
+	}
+
+	files, err := folder.ListSharedContents(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, files)
+}
@@ -311,6 +311,179 @@ func TestBackendController_SharedLinks(t *testing.T) {
 
 	})
 
+	t.Run("Restricted shared links", func(t *testing.T) {
+
+		Assert := assert.New(t)
+
+		openLink := func(handler http.HandlerFunc, linkPassword string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/api/v1/shared/{shortenedLink}", nil)
+			req = mux.SetURLVars(req, map[string]string{"shortenedLink": "limited123"})
+			if linkPassword != "" {
+				req.Header.Add("link_password", linkPassword)
+			}
+			w := httptest.NewRecorder()
+			handler(w, req)
+			return w
+		}
+
+		patchLink := func(header, value string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("PATCH", "/api/v1/file/{fileID}/share", nil).
+				WithContext(ctxutil.WithUser(context.Background(), user))
+			req = mux.SetURLVars(req, map[string]string{
+				"fileID": file.FileId,
+				"link":   "limited123"})
+			req.Header.Add(header, value)
+			w := httptest.NewRecorder()
+			bc.PatchFileSharedLink(w, req)
+			return w
+		}
+
+		// Creating a link with a password and a download limit
+		req := httptest.NewRequest("POST", "/api/v1/file/{fileID}/share", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{
+			"fileID": file.FileId,
+			"link":   "limited123"})
+		req.Header.Add("link_password", "secret")
+		req.Header.Add("max_downloads", "1")
+		w := httptest.NewRecorder()
+		bc.CreateFileSharedLink(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var sharedLink dbfs.SharedLink
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &sharedLink))
+		Assert.True(sharedLink.PasswordActive)
+		Assert.NotNil(sharedLink.MaxDownloads)
+		Assert.NotContains(w.Body.String(), "secret")
+
+		// Invalid options are refused
+		w = patchLink("max_downloads", "lots")
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		// The link password is needed
+		Assert.Equal(http.StatusUnauthorized, openLink(bc.GetMetadataSharedLink, "").Code)
+		Assert.Equal(http.StatusUnauthorized, openLink(bc.DownloadSharedLink, "wrong").Code)
+		Assert.Equal(http.StatusOK, openLink(bc.GetMetadataSharedLink, "secret").Code)
+
+		// Only one download is allowed, metadata does not count
+		w = openLink(bc.DownloadSharedLink, "secret")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal(http.StatusGone, openLink(bc.DownloadSharedLink, "secret").Code)
+		Assert.Equal(http.StatusGone, openLink(bc.GetMetadataSharedLink, "secret").Code)
+
+		updated, err := dbfs.GetSharedLink(db, "limited123")
+		Assert.NoError(err)
+		Assert.Equal(1, updated.DownloadCount)
+
+		// Ranged requests count too, wherever they start
+		Assert.Equal(http.StatusOK, patchLink("max_downloads", "2").Code)
+		openRange := func() *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/api/v1/shared/{shortenedLink}", nil)
+			req = mux.SetURLVars(req, map[string]string{"shortenedLink": "limited123"})
+			req.Header.Add("link_password", "secret")
+			req.Header.Add("Range", "bytes=1-")
+			w := httptest.NewRecorder()
+			bc.DownloadSharedLink(w, req)
+			return w
+		}
+		w = openRange()
+		Assert.Equal(http.StatusPartialContent, w.Code, w.Body.String())
+		Assert.Equal(http.StatusGone, openRange().Code)
+
+		updated, err = dbfs.GetSharedLink(db, "limited123")
+		Assert.NoError(err)
+		Assert.Equal(2, updated.DownloadCount)
+
+		// Lifting the limit, then disabling the link
+		Assert.Equal(http.StatusOK, patchLink("max_downloads", "0").Code)
+		Assert.Equal(http.StatusOK, openLink(bc.DownloadSharedLink, "secret").Code)
+
+		Assert.Equal(http.StatusOK, patchLink("disabled", "true").Code)
+		Assert.Equal(http.StatusNotFound, openLink(bc.DownloadSharedLink, "secret").Code)
+		Assert.Equal(http.StatusOK, patchLink("disabled", "false").Code)
+
+		// Expiring the link
+		w = patchLink("expiry_time", time.Now().Add(-time.Minute).Format(time.RFC3339))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal(http.StatusGone, openLink(bc.GetMetadataSharedLink, "secret").Code)
+
+		Assert.Equal(http.StatusOK, patchLink("expiry_time", "never").Code)
+		Assert.Equal(http.StatusOK, openLink(bc.GetMetadataSharedLink, "secret").Code)
+	})
+
+	t.Run("Shared folders", func(t *testing.T) {
+
+		Assert := assert.New(t)
+
+		folder, err := rootFolder.CreateSubFolder(db, "sharedFolder", user, "localhost")
+		Assert.NoError(err)
+		subFolder, err := folder.CreateSubFolder(db, "subFolder", user, "localhost")
+		Assert.NoError(err)
+		innerFile, err := dbfstestutils.EXAMPLECreateFile(db, user, dbfstestutils.ExampleFile{
+			FileName:       "inner",
+			ParentFolderId: subFolder.FileId,
+			Server:         "localhost",
+			FragmentPath:   bc.Inc.ShardsLocation,
+			FileData:       "inner data",
+			Size:           50,
+			ActualSize:     80,
+		})
+		Assert.NoError(err)
+
+		// Folders can be shared too
+		req := httptest.NewRequest("POST", "/api/v1/file/{fileID}/share", nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{
+			"fileID": folder.FileId,
+			"link":   "folder123"})
+		w := httptest.NewRecorder()
+		bc.CreateFileSharedLink(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		openPath := func(handler http.HandlerFunc, path string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", "/api/v1/shared/folder123?path="+path, nil)
+			req = mux.SetURLVars(req, map[string]string{"shortenedLink": "folder123"})
+			w := httptest.NewRecorder()
+			handler(w, req)
+			return w
+		}
+
+		// Listing the folder and the folders inside it
+		w = openPath(bc.ListSharedLink, "")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		var files []dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal(subFolder.FileId, files[0].FileId)
+
+		w = openPath(bc.ListSharedLink, "subFolder")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal(innerFile.FileId, files[0].FileId)
+
+		Assert.Equal(http.StatusBadRequest, openPath(bc.ListSharedLink, "subFolder/inner").Code)
+
+		// Reading a file inside it
+		w = openPath(bc.GetMetadataSharedLink, "subFolder/inner")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		var metadata dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &metadata))
+		Assert.Equal(innerFile.FileId, metadata.FileId)
+
+		w = openPath(bc.DownloadSharedLink, "subFolder/inner")
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("inner data", w.Body.String())
+
+		// The folder itself cannot be downloaded as a file
+		Assert.Equal(http.StatusBadRequest, openPath(bc.DownloadSharedLink, "").Code)
+
+		// Nothing outside the folder can be reached
+		Assert.Equal(http.StatusNotFound, openPath(bc.GetMetadataSharedLink, "../blah").Code)
+		Assert.Equal(http.StatusNotFound, openPath(bc.DownloadSharedLink, "subFolder/../../blah").Code)
+		Assert.Equal(http.StatusNotFound, openPath(bc.ListSharedLink, "..").Code)
+	})
+
 	t.Run("Favorites test", func(t *testing.T) {
 
 		// Trying to get favorites (should be 0)
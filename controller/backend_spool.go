@@ -0,0 +1,156 @@
+package controller
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+const (
+	spoolKeySize   = 32
+	spoolNonceSize = 8
+)
+
+// spoolFile is a file that data is buffered in on the way to or from the
+// shards. It is encrypted with AES-CTR under a key that is only kept in
+// memory, so decrypted data never reaches the disk. The nonce is written at
+// the start of the file, and it can be read from any offset.
+type spoolFile struct {
+	file   *os.File
+	block  cipher.Block
+	nonce  []byte
+	offset int64
+}
+
+// newSpoolKey generates a key for spool files
+func newSpoolKey() ([]byte, error) {
+	key := make([]byte, spoolKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// createSpoolFile creates the spool file at the path given, replacing any
+// file already there. An empty path creates an unlinked temporary file,
+// which is removed once closed.
+func createSpoolFile(path string, key []byte) (*spoolFile, error) {
+	var file *os.File
+	var err error
+	if path == "" {
+		file, err = os.CreateTemp("", "ohana-spool-")
+		if err == nil {
+			if err = os.Remove(file.Name()); err != nil {
+				file.Close()
+			}
+		}
+	} else {
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, spoolNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Write(nonce); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return newSpoolFile(file, key, nonce)
+}
+
+// openSpoolFile opens the spool file at the path given for reading
+func openSpoolFile(path string, key []byte) (*spoolFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, spoolNonceSize)
+	if _, err := io.ReadFull(file, nonce); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	return newSpoolFile(file, key, nonce)
+}
+
+func newSpoolFile(file *os.File, key, nonce []byte) (*spoolFile, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &spoolFile{file: file, block: block, nonce: nonce}, nil
+}
+
+// xor encrypts or decrypts data found at the offset given
+func (s *spoolFile) xor(p []byte, offset int64) {
+	iv := make([]byte, aes.BlockSize)
+	copy(iv, s.nonce)
+	binary.BigEndian.PutUint64(iv[spoolNonceSize:], uint64(offset/aes.BlockSize))
+	stream := cipher.NewCTR(s.block, iv)
+	if skip := offset % aes.BlockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+	stream.XORKeyStream(p, p)
+}
+
+func (s *spoolFile) Write(p []byte) (int, error) {
+	encrypted := make([]byte, len(p))
+	copy(encrypted, p)
+	s.xor(encrypted, s.offset)
+
+	n, err := s.file.WriteAt(encrypted, spoolNonceSize+s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+func (s *spoolFile) Read(p []byte) (int, error) {
+	n, err := s.ReadAt(p, s.offset)
+	s.offset += int64(n)
+	return n, err
+}
+
+// ReadAt implements io.ReaderAt, leaving the offset used by Read and Write
+// as it is
+func (s *spoolFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.file.ReadAt(p, spoolNonceSize+off)
+	s.xor(p[:n], off)
+	return n, err
+}
+
+func (s *spoolFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.offset
+	case io.SeekEnd:
+		info, err := s.file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		offset += info.Size() - spoolNonceSize
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	s.offset = offset
+	return offset, nil
+}
+
+func (s *spoolFile) Close() error {
+	return s.file.Close()
+}
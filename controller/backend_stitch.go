@@ -0,0 +1,439 @@
+package controller
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/stitch"
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// fullReader wraps a reader so that every Read fills the buffer given unless
+// the underlying reader runs out of data. The stitch encoder stops reading as
+// soon as it gets a short read, so readers that return partial reads (such as
+// pipes or network streams) need to be wrapped before being encoded. Only
+// io.EOF ends the data, any other error (io.ErrUnexpectedEOF from a body cut
+// short included) is passed on so that the data is not taken as complete.
+type fullReader struct {
+	r io.Reader
+}
+
+// Read implements io.Reader
+func (fr *fullReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m, err := fr.r.Read(p[n:])
+		n += m
+		if err == io.EOF {
+			if n > 0 {
+				return n, nil
+			}
+			return 0, io.EOF
+		} else if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// shardPipeline holds the state needed to encode the data of a new file into
+// its shards.
+type shardPipeline struct {
+	file         *dbfs.File
+	dataKey      []byte
+	dataIv       []byte
+	encoder      *stitch.Encoder
+	servers      []dbfs.Server
+	shardNames   []string
+	shardWriters []io.Writer
+}
+
+// newFileMetadata creates the dbfs entries for a new file in the folder
+// given, and returns the file along with the hex encoded key and iv that its
+// data should be encrypted with.
+func (bc *BackendController) newFileMetadata(user *dbfs.User, folderId, fileName, mimeType string,
+) (*dbfs.File, string, string, error) {
+
+	// Reject the file early if the user has no space left
+	if err := dbfs.CheckQuotaLeft(bc.Db, user.UserId); err != nil {
+		return nil, "", "", err
+	}
+
+	// Get encoder params
+	stitchParams, err := dbfs.GetStitchParams(bc.Db, bc.Logger)
+	if err != nil {
+		return nil, "", "", err
+	}
+	dataShards, parityShards, keyThreshold :=
+		stitchParams.DataShards, stitchParams.ParityShards, stitchParams.KeyThreshold
+
+	// This is the fileKey and fileIV for the passwordProtect
+	fileKey, fileIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	// This is the key and IV for the pipeline
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	dbfsFile := dbfs.File{
+		FileId:             uuid.New().String(),
+		FileName:           fileName,
+		MIMEType:           mimeType,
+		ParentFolderFileId: &folderId,
+		Size:               512, // placeholder size
+		VersioningMode:     dbfs.VersioningOff,
+		TotalShards:        dataShards + parityShards,
+		DataShards:         dataShards,
+		ParityShards:       parityShards,
+		KeyThreshold:       keyThreshold,
+		PasswordProtected:  false,
+		HandledServer:      bc.ServerName,
+	}
+
+	passwordProtect := dbfs.PasswordProtect{
+		FileId:         dbfsFile.FileId,
+		FileKey:        fileKey,
+		FileIv:         fileIv,
+		PasswordActive: false,
+	}
+
+	err = bc.Db.Transaction(func(tx *gorm.DB) error {
+		if err := dbfs.CreateInitialFile(tx, &dbfsFile,
+			fileKey, fileIv, dataKey, dataIv, user); err != nil {
+			return fmt.Errorf("failed to create initial file: %w", err)
+		}
+
+		if err := tx.Create(&passwordProtect).Error; err != nil {
+			return fmt.Errorf("failed to create PasswordProtect row: %w", err)
+		}
+
+		if err := dbfs.CreatePermissions(tx, &dbfsFile); err != nil {
+			return fmt.Errorf("failed to create permissions: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	return &dbfsFile, dataKey, dataIv, nil
+}
+
+// newShardPipeline assigns servers to the shards of the file given and opens
+// a writer to each of them.
+func (bc *BackendController) newShardPipeline(ctx context.Context, file *dbfs.File,
+	dataKey, dataIv string) (*shardPipeline, error) {
+
+	// Decode the data key and iv
+	dataKeyBytes, err := hex.DecodeString(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data key: %w", err)
+	}
+	dataIvBytes, err := hex.DecodeString(dataIv)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode data iv: %w", err)
+	}
+
+	// Fetch a list of servers
+	servers, err := bc.Inc.AssignShardServer(ctx, file.TotalShards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to assign servers: %w", err)
+	}
+
+	p := &shardPipeline{
+		file:    file,
+		dataKey: dataKeyBytes,
+		dataIv:  dataIvBytes,
+		encoder: stitch.NewEncoder(&stitch.EncoderOptions{
+			DataShards:   uint8(file.DataShards),
+			ParityShards: uint8(file.ParityShards),
+			KeyThreshold: uint8(file.KeyThreshold),
+		}),
+		servers:      servers,
+		shardNames:   make([]string, file.TotalShards),
+		shardWriters: make([]io.Writer, 0, file.TotalShards),
+	}
+
+	// Generate names for the shards
+	for i := 0; i < file.TotalShards; i++ {
+		p.shardNames[i] = file.DataId + ".shard" + strconv.Itoa(i)
+	}
+
+	// Open the output writers
+	for i := 0; i < file.TotalShards; i++ {
+		shardWriter, err := bc.Inc.NewShardWriter(ctx, servers[i].Name, p.shardNames[i])
+		if err != nil {
+			p.close()
+			return nil, fmt.Errorf("failed to initialize shard writer: %w", err)
+		}
+		p.shardWriters = append(p.shardWriters, shardWriter)
+	}
+
+	return p, nil
+}
+
+// encode encodes the data given into the shards, and closes the writers once
+// done.
+func (p *shardPipeline) encode(data io.Reader) (*stitch.EncodingResult, error) {
+	result, err := p.encoder.Encode(&fullReader{data}, p.shardWriters, p.dataKey, p.dataIv)
+	if err != nil {
+		p.close()
+		return nil, fmt.Errorf("failed to encode file: %w", err)
+	}
+
+	if err := p.close(); err != nil {
+		return nil, fmt.Errorf("failed to close shard writer: %w", err)
+	}
+
+	return result, nil
+}
+
+// close closes all the shard writers that are still open.
+func (p *shardPipeline) close() error {
+	var firstErr error
+	for _, writer := range p.shardWriters {
+		if err := writer.(io.WriteCloser).Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.shardWriters = nil
+	return firstErr
+}
+
+// finishShardPipeline records the fragments written by the pipeline and marks
+// the file as finished. The file is deleted if anything goes wrong.
+func (bc *BackendController) finishShardPipeline(p *shardPipeline, user *dbfs.User,
+	result *stitch.EncodingResult) error {
+
+	file := p.file
+
+	// get the file size
+	fileSizeActual, err := bc.Inc.GetActualFileSize(p.shardNames, p.servers)
+	if err != nil {
+		return bc.abortNewFile(file, user, fmt.Errorf("failed to get file size: %w", err))
+	}
+
+	// Insert fragments into the database
+	err = bc.Db.Transaction(func(tx *gorm.DB) error {
+		for i := 1; i <= file.TotalShards; i++ {
+			if err := dbfs.CreateFragment(tx,
+				file.FileId, file.DataId, file.VersionNo,
+				i, p.servers[i-1].Name, p.shardNames[i-1]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return bc.abortNewFile(file, user, fmt.Errorf("failed to create fragments: %w", err))
+	}
+
+	// checksum
+	checksum := hex.EncodeToString(result.FileHash)
+
+	file.Size = int64(result.FileSize)
+	file.ActualSize = fileSizeActual
+	err = dbfs.FinishFile(bc.Db, file, user, int64(result.FileSize), fileSizeActual, checksum)
+	if err != nil {
+		return bc.abortNewFile(file, user, fmt.Errorf("error finishing file: %w", err))
+	}
+	bc.queueThumbnails(user, file, "")
+
+	return nil
+}
+
+// abortNewFile deletes a file that failed to be written, and returns the
+// error given (along with the deletion error if any).
+func (bc *BackendController) abortNewFile(file *dbfs.File, user *dbfs.User, cause error) error {
+	if err := file.Delete(bc.Db, user, bc.ServerName); err != nil {
+		return fmt.Errorf("%w (failed to delete file: %s)", cause, err.Error())
+	}
+	return cause
+}
+
+// writeNewFile creates a new file in the folder given with the data from the
+// reader given.
+func (bc *BackendController) writeNewFile(ctx context.Context, user *dbfs.User,
+	folderId, fileName, mimeType string, data io.Reader) (*dbfs.File, error) {
+
+	file, dataKey, dataIv, err := bc.newFileMetadata(user, folderId, fileName, mimeType)
+	if err != nil {
+		return nil, err
+	}
+
+	p, err := bc.newShardPipeline(ctx, file, dataKey, dataIv)
+	if err != nil {
+		return nil, bc.abortNewFile(file, user, err)
+	}
+
+	result, err := p.encode(data)
+	if err != nil {
+		return nil, bc.abortNewFile(file, user, err)
+	}
+
+	if err := bc.finishShardPipeline(p, user, result); err != nil {
+		return nil, err
+	}
+
+	return file, nil
+}
+
+// updateFileData replaces the contents of an existing file with the data from
+// the reader given, creating a new version of the file. The file is reverted
+// to its previous version if anything goes wrong, and the failed version is
+// deleted.
+func (bc *BackendController) updateFileData(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	password string, data io.Reader) error {
+
+	// Reject the update early if the owner of the file has no space left
+	if file.OwnerUserId != nil {
+		if err := dbfs.CheckQuotaLeft(bc.Db, *file.OwnerUserId); err != nil {
+			return err
+		}
+	}
+
+	// This is the key and IV for the pipeline
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return err
+	}
+
+	// Use placeholder size values as it is not yet known at this point
+	err = file.UpdateFile(bc.Db, 1024, 1024, "", bc.ServerName, dataKey, dataIv, password, user, "")
+	if err != nil {
+		return err
+	}
+
+	// The version being written is dropped along with whatever made it there
+	failedVersionNo := file.VersionNo
+	revert := func(cause error) error {
+		if err := file.RevertFileToVersion(bc.Db, failedVersionNo-1, user); err != nil {
+			return fmt.Errorf("%w (failed to revert file: %s)", cause, err.Error())
+		}
+		if err := file.DeleteFileVersion(bc.Db, user, failedVersionNo); err != nil {
+			return fmt.Errorf("%w (failed to delete failed version: %s)", cause, err.Error())
+		}
+		return cause
+	}
+
+	p, err := bc.newShardPipeline(ctx, file, dataKey, dataIv)
+	if err != nil {
+		return revert(err)
+	}
+
+	result, err := p.encode(data)
+	if err != nil {
+		return revert(err)
+	}
+
+	// Insert fragments into the database
+	for i := 1; i <= file.TotalShards; i++ {
+		err = file.UpdateFragment(bc.Db, i, p.shardNames[i-1], "", p.servers[i-1].Name)
+		if err != nil {
+			return revert(err)
+		}
+	}
+
+	// Get new Actual File Size
+	fileSizeActual, err := bc.Inc.GetActualFileSize(p.shardNames, p.servers)
+	if err != nil {
+		return revert(fmt.Errorf("failed to get file size: %w", err))
+	}
+
+	file.Size = int64(result.FileSize)
+	file.ActualSize = fileSizeActual
+	if err := file.FinishUpdateFile(bc.Db, hex.EncodeToString(result.FileHash)); err != nil {
+		return revert(err)
+	}
+	bc.queuePreviousAsPatch(user, file, password)
+	bc.queueThumbnails(user, file, password)
+
+	return nil
+}
+
+// openFileVersion returns a reader over the decrypted contents of the version
+// of the file given. user can be nil for files accessed through a shared link.
+// Versions stored as patches are rebuilt first.
+func (bc *BackendController) openFileVersion(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	versionNo int, password string) (io.ReadSeeker, error) {
+
+	if user == nil {
+		shardsMeta, err := file.GetFileFragments(bc.Db, nil)
+		if err != nil {
+			return nil, err
+		}
+		hexKey, hexIv, err := file.GetDecryptionKey(bc.Db, nil, password)
+		if err != nil {
+			return nil, err
+		}
+		return bc.openShards(ctx, shardsMeta, hexKey, hexIv, &stitch.EncoderOptions{
+			DataShards:   uint8(file.DataShards),
+			ParityShards: uint8(file.ParityShards),
+			KeyThreshold: uint8(file.KeyThreshold),
+		})
+	}
+
+	version, err := file.GetOldVersion(bc.Db, user, versionNo)
+	if err != nil {
+		return nil, err
+	}
+	if version.Patch {
+		return bc.openPatchedVersion(ctx, user, file, version, password)
+	}
+	return bc.openVersionData(ctx, user, version, password)
+}
+
+// openVersionData returns a reader over the decrypted data stored for the
+// version, which is a patch for versions stored as one.
+func (bc *BackendController) openVersionData(ctx context.Context, user *dbfs.User, version *dbfs.FileVersion,
+	password string) (io.ReadSeeker, error) {
+
+	shardsMeta, err := version.GetFragments(bc.Db, user)
+	if err != nil {
+		return nil, err
+	}
+	hexKey, hexIv, err := version.GetDecryptionKey(bc.Db, user, password)
+	if err != nil {
+		return nil, err
+	}
+	return bc.openShards(ctx, shardsMeta, hexKey, hexIv, &stitch.EncoderOptions{
+		DataShards:   uint8(version.DataShards),
+		ParityShards: uint8(version.ParityShards),
+		KeyThreshold: uint8(version.KeyThreshold),
+	})
+}
+
+// openShards returns a reader over the data encoded in the shards given
+func (bc *BackendController) openShards(ctx context.Context, shardsMeta []dbfs.Fragment,
+	hexKey, hexIv string, encoderOpts *stitch.EncoderOptions) (io.ReadSeeker, error) {
+
+	// Opening input files
+	var shards []io.ReadSeeker
+	for _, shardMeta := range shardsMeta {
+		shardReader, err := bc.Inc.NewShardReader(ctx, shardMeta.ServerName, shardMeta.FileFragmentPath)
+		if err == nil {
+			shards = append(shards, shardReader)
+		}
+	}
+
+	// Getting key and iv
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(hexIv)
+	if err != nil {
+		return nil, err
+	}
+
+	return stitch.NewEncoder(encoderOpts).NewReadSeeker(shards, key, iv)
+}
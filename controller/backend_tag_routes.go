@@ -0,0 +1,113 @@
+package controller
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/gorilla/mux"
+)
+
+// tagStatus returns the HTTP status matching an error returned when changing
+// the tags of a file
+func tagStatus(err error) int {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrTagNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrFileLocked):
+		return http.StatusLocked
+	case errors.Is(err, dbfs.ErrInvalidTag):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// tagFiltersFromQuery reads the tag filters of a listing. Each tag query
+// parameter is either a key, matching any value, or key=value.
+func tagFiltersFromQuery(r *http.Request) []dbfs.TagFilter {
+	var filters []dbfs.TagFilter
+	for _, tag := range r.URL.Query()["tag"] {
+		key, value, hasValue := strings.Cut(tag, "=")
+		filter := dbfs.TagFilter{Key: key}
+		if hasValue {
+			filter.Value = &value
+		}
+		filters = append(filters, filter)
+	}
+	return filters
+}
+
+// GetFileTags returns the tags of a file or folder as an object of key to value
+func (bc *BackendController) GetFileTags(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	tags, err := file.GetTags(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, tagStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, tags)
+}
+
+// SetFileTags replaces all the tags of a file or folder with the object of
+// key to value in the body
+func (bc *BackendController) SetFileTags(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	var tags map[string]string
+	if err := json.NewDecoder(r.Body).Decode(&tags); err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid tags")
+		return
+	}
+
+	if err := file.SetTags(bc.Db, user, tags); err != nil {
+		util.HttpError(w, tagStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, tags)
+}
+
+// SetFileTag adds or changes a single tag of a file or folder. Takes in the
+// value header, which can be left out for a plain tag.
+func (bc *BackendController) SetFileTag(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	key := mux.Vars(r)["key"]
+	if err := file.SetTag(bc.Db, user, key, r.Header.Get("value")); err != nil {
+		util.HttpError(w, tagStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
+
+// DeleteFileTag removes a tag from a file or folder
+func (bc *BackendController) DeleteFileTag(w http.ResponseWriter, r *http.Request) {
+	user, file, ok := bc.getRequestFile(w, r)
+	if !ok {
+		return
+	}
+
+	if err := file.DeleteTag(bc.Db, user, mux.Vars(r)["key"]); err != nil {
+		util.HttpError(w, tagStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
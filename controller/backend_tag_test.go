@@ -0,0 +1,120 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	dbfstestutils "github.com/OhanaFS/ohana/dbfs/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_FileTags(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	reader, err := dbfs.CreateNewUser(db, "tagUser", "tagUser", dbfs.AccountTypeEndUser,
+		"tagUser", "tagUser", "tagUser", "tagUser", "localhost")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "tags", admin, "localhost")
+	Assert.NoError(err)
+	Assert.NoError(folder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, admin, *reader))
+
+	createFile := func(name string) *dbfs.File {
+		file, err := dbfstestutils.EXAMPLECreateFile(db, admin, dbfstestutils.ExampleFile{
+			FileName:       name,
+			ParentFolderId: folder.FileId,
+			Server:         "localhost",
+			FragmentPath:   t.TempDir(),
+			FileData:       name + " data",
+			Size:           50,
+			ActualSize:     80,
+		})
+		Assert.NoError(err)
+		return file
+	}
+	contract := createFile("contract")
+	createFile("notes")
+
+	newRequest := func(as *dbfs.User, method, target string, body string, vars map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body)).
+			WithContext(ctxutil.WithUser(context.Background(), as))
+		return mux.SetURLVars(req, vars)
+	}
+	tagsPath := "/api/v1/file/" + contract.FileId + "/tags"
+	fileVars := map[string]string{"fileID": contract.FileId}
+
+	t.Run("Setting tags", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.SetFileTags(w, newRequest(admin, "PUT", tagsPath, `{"contract": "", "project": "ABC"}`, fileVars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.SetFileTags(w, newRequest(admin, "PUT", tagsPath, `["contract"]`, fileVars))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		req := newRequest(admin, "PUT", tagsPath+"/status", "",
+			map[string]string{"fileID": contract.FileId, "key": "status"})
+		req.Header.Set("value", "reviewed")
+		w = httptest.NewRecorder()
+		bc.SetFileTag(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		// Needs write permission
+		w = httptest.NewRecorder()
+		bc.SetFileTag(w, newRequest(reader, "PUT", tagsPath+"/mine", "",
+			map[string]string{"fileID": contract.FileId, "key": "mine"}))
+		Assert.Equal(http.StatusForbidden, w.Code)
+
+		var tags map[string]string
+		w = httptest.NewRecorder()
+		bc.GetFileTags(w, newRequest(reader, "GET", tagsPath, "", fileVars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &tags))
+		Assert.Equal(map[string]string{"contract": "", "project": "ABC", "status": "reviewed"}, tags)
+	})
+
+	t.Run("Filtering a listing", func(t *testing.T) {
+		var files []dbfs.File
+		w := httptest.NewRecorder()
+		bc.LsFolderID(w, newRequest(reader, "GET", "/api/v1/folder/"+folder.FileId+"?tag=project=ABC&tag=contract",
+			"", map[string]string{"folderID": folder.FileId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &files))
+		Assert.Len(files, 1)
+		Assert.Equal(contract.FileId, files[0].FileId)
+	})
+
+	t.Run("Deleting tags", func(t *testing.T) {
+		vars := map[string]string{"fileID": contract.FileId, "key": "status"}
+
+		w := httptest.NewRecorder()
+		bc.DeleteFileTag(w, newRequest(admin, "DELETE", tagsPath+"/status", "", vars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.DeleteFileTag(w, newRequest(admin, "DELETE", tagsPath+"/status", "", vars))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
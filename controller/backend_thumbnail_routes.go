@@ -0,0 +1,261 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/thumbnail"
+	"github.com/OhanaFS/stitch"
+	"github.com/google/uuid"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// GetFileThumbnail returns a thumbnail of an image file, in the size given by
+// the size query parameter (defaults to the smallest size). Thumbnails that
+// have not been generated yet are generated on the spot.
+func (bc *BackendController) GetFileThumbnail(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	fileID := mux.Vars(r)["fileID"]
+	password := r.Header.Get("password")
+
+	size := dbfs.ThumbnailSizes[0]
+	if sizeString := r.URL.Query().Get("size"); sizeString != "" {
+		size, err = strconv.Atoi(sizeString)
+		if err != nil || !dbfs.IsValidThumbnailSize(size) {
+			util.HttpError(w, http.StatusBadRequest,
+				fmt.Sprintf("Invalid size, must be one of %v", dbfs.ThumbnailSizes))
+			return
+		}
+	}
+
+	file, err := dbfs.GetFileById(bc.Db, fileID, user)
+	if errors.Is(err, dbfs.ErrFileNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if !file.CanHaveThumbnails() {
+		util.HttpError(w, http.StatusUnsupportedMediaType, dbfs.ErrNotThumbnailable.Error())
+		return
+	}
+
+	t, err := file.GetThumbnail(bc.Db, size)
+	if errors.Is(err, dbfs.ErrThumbnailNotFound) {
+		err = bc.generateThumbnails(r.Context(), user, file, password)
+		if err == nil {
+			t, err = file.GetThumbnail(bc.Db, size)
+		}
+	}
+	if err != nil {
+		thumbnailError(w, err)
+		return
+	}
+
+	reader, err := bc.openThumbnail(r.Context(), user, file, t, password)
+	if err != nil {
+		thumbnailError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", t.MIMEType)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", t.CreatedTime, reader)
+}
+
+// thumbnailError writes the response for an error from getting a thumbnail
+func thumbnailError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound):
+		util.HttpError(w, http.StatusNotFound, err.Error())
+	case errors.Is(err, dbfs.ErrPasswordRequired), errors.Is(err, dbfs.ErrIncorrectPassword):
+		util.HttpError(w, http.StatusForbidden, err.Error())
+	case errors.Is(err, dbfs.ErrNotThumbnailable):
+		util.HttpError(w, http.StatusUnsupportedMediaType, err.Error())
+	default:
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+	}
+}
+
+// queueThumbnails generates the thumbnails of a file that was just written in
+// the background, if it is an image.
+func (bc *BackendController) queueThumbnails(user *dbfs.User, file *dbfs.File, password string) {
+	if !file.CanHaveThumbnails() {
+		return
+	}
+
+	f := *file
+	go func() {
+		if err := bc.generateThumbnails(context.Background(), user, &f, password); err != nil {
+			bc.Logger.Warn("failed to generate thumbnails",
+				zap.String("file_id", f.FileId), zap.Error(err))
+		}
+	}()
+}
+
+// generateThumbnails generates the thumbnails of the current data of the file
+// that are missing. Only one file is processed at a time, as the whole image
+// is held in memory.
+func (bc *BackendController) generateThumbnails(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	password string) error {
+
+	if !file.CanHaveThumbnails() {
+		return dbfs.ErrNotThumbnailable
+	}
+
+	bc.thumbnailMu.Lock()
+	defer bc.thumbnailMu.Unlock()
+
+	// They might have been generated while waiting for the lock
+	done, err := file.HasAllThumbnails(bc.Db)
+	if err != nil || done {
+		return err
+	}
+
+	sourceKey, sourceIv, err := file.GetDecryptionKey(bc.Db, user, password)
+	if err != nil {
+		return err
+	}
+
+	data, err := bc.openFileVersion(ctx, user, file, file.VersionNo, password)
+	if err != nil {
+		return err
+	}
+	if closer, ok := data.(io.Closer); ok {
+		defer closer.Close()
+	}
+	img, err := thumbnail.Decode(data)
+	if err != nil {
+		return fmt.Errorf("%w: %s", dbfs.ErrNotThumbnailable, err.Error())
+	}
+
+	stitchParams, err := dbfs.GetStitchParams(bc.Db, bc.Logger)
+	if err != nil {
+		return err
+	}
+
+	for _, size := range dbfs.ThumbnailSizes {
+		_, err := file.GetThumbnail(bc.Db, size)
+		if err == nil {
+			continue
+		} else if !errors.Is(err, dbfs.ErrThumbnailNotFound) {
+			return err
+		}
+
+		resized := thumbnail.Resize(img, size)
+		encoded, err := thumbnail.Encode(resized)
+		if err != nil {
+			return err
+		}
+
+		t := &dbfs.Thumbnail{
+			DataId:          file.DataId,
+			Size:            size,
+			ThumbnailDataId: uuid.New().String(),
+			FileId:          file.FileId,
+			VersionNo:       file.VersionNo,
+			MIMEType:        thumbnail.MIMEType,
+			Width:           resized.Bounds().Dx(),
+			Height:          resized.Bounds().Dy(),
+			Length:          int64(len(encoded)),
+			TotalShards:     stitchParams.DataShards + stitchParams.ParityShards,
+			DataShards:      stitchParams.DataShards,
+			ParityShards:    stitchParams.ParityShards,
+			KeyThreshold:    stitchParams.KeyThreshold,
+		}
+		if err := bc.storeThumbnail(ctx, t, encoded, sourceKey, sourceIv); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// storeThumbnail encrypts the thumbnail given into its shards and records it
+func (bc *BackendController) storeThumbnail(ctx context.Context, t *dbfs.Thumbnail, encoded []byte,
+	sourceKey, sourceIv string) error {
+
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	if err != nil {
+		return err
+	}
+
+	// The pipeline only needs the data id and shard layout of what it writes
+	p, err := bc.newShardPipeline(ctx, &dbfs.File{
+		DataId:       t.ThumbnailDataId,
+		TotalShards:  t.TotalShards,
+		DataShards:   t.DataShards,
+		ParityShards: t.ParityShards,
+		KeyThreshold: t.KeyThreshold,
+	}, dataKey, dataIv)
+	if err != nil {
+		return err
+	}
+	if _, err := p.encode(bytes.NewReader(encoded)); err != nil {
+		return err
+	}
+
+	servers := make([]string, len(p.servers))
+	for i := range servers {
+		servers[i] = p.servers[i].Name
+	}
+
+	return dbfs.CreateThumbnail(bc.Db, t, dataKey, dataIv, sourceKey, sourceIv, servers, p.shardNames)
+}
+
+// openThumbnail returns a reader over the decrypted contents of the thumbnail
+func (bc *BackendController) openThumbnail(ctx context.Context, user *dbfs.User, file *dbfs.File,
+	t *dbfs.Thumbnail, password string) (io.ReadSeeker, error) {
+
+	sourceKey, sourceIv, err := file.GetDecryptionKey(bc.Db, user, password)
+	if err != nil {
+		return nil, err
+	}
+	hexKey, hexIv, err := t.GetDecryptionKey(sourceKey, sourceIv)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(hexKey)
+	if err != nil {
+		return nil, err
+	}
+	iv, err := hex.DecodeString(hexIv)
+	if err != nil {
+		return nil, err
+	}
+
+	fragments, err := t.GetFragments(bc.Db)
+	if err != nil {
+		return nil, err
+	}
+	var shards []io.ReadSeeker
+	for _, fragment := range fragments {
+		shardReader, err := bc.Inc.NewShardReader(ctx, fragment.ServerName, fragment.FileFragmentPath)
+		if err == nil {
+			shards = append(shards, shardReader)
+		}
+	}
+
+	return stitch.NewEncoder(&stitch.EncoderOptions{
+		DataShards:   uint8(t.DataShards),
+		ParityShards: uint8(t.ParityShards),
+		KeyThreshold: uint8(t.KeyThreshold),
+	}).NewReadSeeker(shards, key, iv)
+}
@@ -0,0 +1,169 @@
+package controller_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_Thumbnails(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5564",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	// pngImage returns a png of the size given
+	pngImage := func(width, height int) []byte {
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		for y := 0; y < height; y++ {
+			for x := 0; x < width; x++ {
+				img.Set(x, y, color.RGBA{R: uint8(x), G: uint8(y), B: 100, A: 255})
+			}
+		}
+		var buf bytes.Buffer
+		Assert.NoError(png.Encode(&buf, img))
+		return buf.Bytes()
+	}
+
+	upload := func(target, fileName string, data []byte, vars map[string]string,
+		handler http.HandlerFunc) *dbfs.File {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", fileName)
+		Assert.NoError(err)
+		_, err = part.Write(data)
+		Assert.NoError(err)
+		Assert.NoError(writer.Close())
+
+		req := httptest.NewRequest("POST", target, body).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, vars)
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		req.Header.Set("folder_id", "00000000-0000-0000-0000-000000000000")
+		w := httptest.NewRecorder()
+		handler(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		var file dbfs.File
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &file))
+		return &file
+	}
+
+	getThumbnail := func(fileId, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/v1/file/"+fileId+"/thumbnail"+query, nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		req = mux.SetURLVars(req, map[string]string{"fileID": fileId})
+		w := httptest.NewRecorder()
+		bc.GetFileThumbnail(w, req)
+		return w
+	}
+
+	thumbnailBounds := func(w *httptest.ResponseRecorder) image.Rectangle {
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("image/jpeg", w.Header().Get("Content-Type"))
+		img, err := jpeg.Decode(w.Body)
+		Assert.NoError(err)
+		if err != nil {
+			return image.Rectangle{}
+		}
+		return img.Bounds()
+	}
+
+	var photo *dbfs.File
+
+	t.Run("Getting thumbnails", func(t *testing.T) {
+		photo = upload("/api/v1/file", "photo.png", pngImage(256, 128), nil, bc.UploadFile)
+
+		Assert.Equal(image.Rect(0, 0, 128, 64), thumbnailBounds(getThumbnail(photo.FileId, "")))
+		Assert.Equal(image.Rect(0, 0, 128, 64), thumbnailBounds(getThumbnail(photo.FileId, "?size=128")))
+
+		// Never scaled up
+		Assert.Equal(image.Rect(0, 0, 256, 128), thumbnailBounds(getThumbnail(photo.FileId, "?size=512")))
+
+		Assert.Equal(http.StatusBadRequest, getThumbnail(photo.FileId, "?size=300").Code)
+		Assert.Equal(http.StatusNotFound, getThumbnail("nope", "").Code)
+
+		text := upload("/api/v1/file", "notes.txt", []byte("not an image"), nil, bc.UploadFile)
+		Assert.Equal(http.StatusUnsupportedMediaType, getThumbnail(text.FileId, "").Code)
+	})
+
+	t.Run("Regenerating for new versions", func(t *testing.T) {
+		upload("/api/v1/file/"+photo.FileId+"/update", "photo.png", pngImage(100, 200),
+			map[string]string{"fileID": photo.FileId}, bc.UpdateFile)
+
+		Assert.Equal(image.Rect(0, 0, 64, 128), thumbnailBounds(getThumbnail(photo.FileId, "")))
+
+		// The thumbnails of the old data are kept with it
+		var count int64
+		Assert.NoError(db.Model(&dbfs.Thumbnail{}).Where("file_id = ?", photo.FileId).Count(&count).Error)
+		Assert.Equal(int64(2*len(dbfs.ThumbnailSizes)), count)
+	})
+}
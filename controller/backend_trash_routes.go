@@ -0,0 +1,152 @@
+package controller
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+)
+
+// GetTrash lists the items that the user has moved to the trash
+func (bc *BackendController) GetTrash(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	items, err := dbfs.GetTrashItems(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, items)
+}
+
+// EmptyTrash permanently deletes every item in the user's trash
+func (bc *BackendController) EmptyTrash(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	if _, err := dbfs.EmptyTrash(bc.Db, user, bc.ServerName); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
+
+// RestoreTrashItem moves an item out of the trash, back to where it was deleted
+// from, and returns the restored file or folder
+func (bc *BackendController) RestoreTrashItem(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	item, err := dbfs.GetTrashItem(bc.Db, user, mux.Vars(r)["trashID"])
+	if errors.Is(err, dbfs.ErrTrashItemNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	file, err := item.Restore(bc.Db, user)
+	if errors.Is(err, dbfs.ErrFileFolderExists) || errors.Is(err, dbfs.ErrRestoreFolderGone) {
+		util.HttpError(w, http.StatusConflict, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrNoPermission) {
+		util.HttpError(w, http.StatusForbidden, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, file)
+}
+
+// DeleteTrashItem permanently deletes an item in the trash
+func (bc *BackendController) DeleteTrashItem(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	item, err := dbfs.GetTrashItem(bc.Db, user, mux.Vars(r)["trashID"])
+	if errors.Is(err, dbfs.ErrTrashItemNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if err := item.Purge(bc.Db, bc.ServerName); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
+
+// GetTrashRetention returns the number of days items are kept in the trash
+func (bc *BackendController) GetTrashRetention(w http.ResponseWriter, r *http.Request) {
+	if _, err := ctxutil.GetUser(r.Context()); err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	days, err := dbfs.GetTrashRetentionDays(bc.Db)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, days)
+}
+
+// SetTrashRetention sets the number of days items are kept in the trash.
+// Requires the days header, and the user to be an admin.
+func (bc *BackendController) SetTrashRetention(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Check if user is admin
+	if user.AccountType != dbfs.AccountTypeAdmin {
+		util.HttpError(w, http.StatusForbidden, "You are not an admin")
+		return
+	}
+
+	days, err := strconv.Atoi(r.Header.Get("days"))
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid days")
+		return
+	}
+
+	err = dbfs.SetTrashRetentionDays(bc.Db, days)
+	if errors.Is(err, dbfs.ErrInvalidCronJobProperty) {
+		util.HttpError(w, http.StatusBadRequest, "days must be at least 1")
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, days)
+}
@@ -0,0 +1,111 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Trash(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     config.NewLogger(&config.Config{}),
+		ServerName: "localhost",
+	}
+
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	folder, err := rootFolder.CreateSubFolder(db, "binned", user, "localhost")
+	Assert.NoError(err)
+
+	newRequest := func(method, target string, vars map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, nil).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		return mux.SetURLVars(req, vars)
+	}
+
+	var items []dbfs.TrashItem
+
+	t.Run("Deleting and restoring", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.DeleteFolder(w, newRequest("DELETE", "/api/v1/folder/"+folder.FileId,
+			map[string]string{"folderID": folder.FileId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetTrash(w, newRequest("GET", "/api/v1/trash", nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &items))
+		Assert.Len(items, 1)
+		Assert.Equal("/binned", items[0].OriginalPath)
+
+		w = httptest.NewRecorder()
+		bc.RestoreTrashItem(w, newRequest("POST", "/api/v1/trash/"+items[0].TrashId+"/restore",
+			map[string]string{"trashID": items[0].TrashId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		_, err := dbfs.GetFileByPath(db, "/binned", user, false)
+		Assert.NoError(err)
+
+		w = httptest.NewRecorder()
+		bc.RestoreTrashItem(w, newRequest("POST", "/api/v1/trash/"+items[0].TrashId+"/restore",
+			map[string]string{"trashID": items[0].TrashId}))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+
+	t.Run("Deleting permanently", func(t *testing.T) {
+		_, err := folder.Trash(db, user)
+		Assert.NoError(err)
+
+		w := httptest.NewRecorder()
+		bc.GetTrash(w, newRequest("GET", "/api/v1/trash", nil))
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &items))
+		Assert.Len(items, 1)
+
+		w = httptest.NewRecorder()
+		bc.DeleteTrashItem(w, newRequest("DELETE", "/api/v1/trash/"+items[0].TrashId,
+			map[string]string{"trashID": items[0].TrashId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetTrash(w, newRequest("GET", "/api/v1/trash", nil))
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &items))
+		Assert.Empty(items)
+	})
+
+	t.Run("Retention", func(t *testing.T) {
+		req := newRequest("PUT", "/api/v1/trash/retention", nil)
+		req.Header.Set("days", "14")
+		w := httptest.NewRecorder()
+		bc.SetTrashRetention(w, req)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetTrashRetention(w, newRequest("GET", "/api/v1/trash/retention", nil))
+		Assert.Equal(http.StatusOK, w.Code)
+		Assert.JSONEq("14", w.Body.String())
+
+		req = newRequest("PUT", "/api/v1/trash/retention", nil)
+		req.Header.Set("days", "0")
+		w = httptest.NewRecorder()
+		bc.SetTrashRetention(w, req)
+		Assert.Equal(http.StatusBadRequest, w.Code)
+	})
+}
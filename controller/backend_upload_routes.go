@@ -0,0 +1,490 @@
+package controller
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/stitch"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+// uploadStream is the in-memory half of a resumable upload. Chunks are written
+// into the pipe, and a goroutine feeds the other end of the pipe into the
+// encoder.
+type uploadStream struct {
+	mu       sync.Mutex
+	pipe     *io.PipeWriter
+	pipeline *shardPipeline
+	cancel   context.CancelFunc
+	done     chan struct{}
+	result   *stitch.EncodingResult
+	err      error
+}
+
+// uploadRegistry keeps track of the upload streams handled by this server.
+type uploadRegistry struct {
+	mu      sync.Mutex
+	streams map[string]*uploadStream
+}
+
+func (ur *uploadRegistry) get(uploadId string) *uploadStream {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	return ur.streams[uploadId]
+}
+
+func (ur *uploadRegistry) add(uploadId string, stream *uploadStream) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	if ur.streams == nil {
+		ur.streams = make(map[string]*uploadStream)
+	}
+	ur.streams[uploadId] = stream
+}
+
+func (ur *uploadRegistry) remove(uploadId string) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	delete(ur.streams, uploadId)
+}
+
+// abort stops the encoder and closes the shard writers of the stream.
+func (us *uploadStream) abort() {
+	us.pipe.CloseWithError(dbfs.ErrUploadSessionClosed)
+	<-us.done
+	us.cancel()
+}
+
+// StartUpload creates a new file and an upload session that the file contents
+// can be sent to chunk by chunk.
+// Expects folder_id, file_name and total_size in the header. content_type is
+// optional.
+func (bc *BackendController) StartUpload(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	// Get parameters
+	folderId := r.Header.Get("folder_id")
+	fileName := r.Header.Get("file_name")
+	mimeType := r.Header.Get("content_type")
+	totalSizeString := r.Header.Get("total_size")
+
+	if folderId == "" {
+		util.HttpError(w, http.StatusBadRequest, "folder_id is required")
+		return
+	}
+	if fileName == "" {
+		util.HttpError(w, http.StatusBadRequest, "file_name is required")
+		return
+	}
+	totalSize, err := strconv.ParseInt(totalSizeString, 10, 64)
+	if err != nil || totalSize < 0 {
+		util.HttpError(w, http.StatusBadRequest, "total_size is invalid")
+		return
+	}
+
+	// Check if the user has the permission to write to the folder
+	folder, err := dbfs.GetFileById(bc.Db, folderId, user)
+	if errors.Is(err, dbfs.ErrFileNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	hasPermissions, err := user.HasPermission(bc.Db, folder, &dbfs.PermissionNeeded{Write: true})
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if !hasPermissions {
+		util.HttpError(w, http.StatusForbidden, "You do not have permission to write to this folder")
+		return
+	}
+
+	// The total size is known up front, so the quota can be checked now
+	err = dbfs.CheckQuota(bc.Db, user.UserId, totalSize, totalSize)
+	if errors.Is(err, dbfs.ErrQuotaExceeded) {
+		util.HttpError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	file, dataKey, dataIv, err := bc.newFileMetadata(user, folderId, fileName, mimeType)
+	if errors.Is(err, dbfs.ErrQuotaExceeded) {
+		util.HttpError(w, http.StatusInsufficientStorage, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError,
+			fmt.Sprintf("failed to create file metadata: %s", err.Error()))
+		return
+	}
+
+	// The shard writers outlive this request, so they get their own context.
+	ctx, cancel := context.WithCancel(context.Background())
+	pipeline, err := bc.newShardPipeline(ctx, file, dataKey, dataIv)
+	if err != nil {
+		cancel()
+		util.HttpError(w, http.StatusInternalServerError,
+			bc.abortNewFile(file, user, err).Error())
+		return
+	}
+
+	session, err := dbfs.CreateUploadSession(bc.Db, file, user, totalSize, bc.ServerName)
+	if err != nil {
+		pipeline.close()
+		cancel()
+		util.HttpError(w, http.StatusInternalServerError,
+			bc.abortNewFile(file, user, err).Error())
+		return
+	}
+
+	// Start feeding the encoder
+	pr, pw := io.Pipe()
+	stream := &uploadStream{
+		pipe:     pw,
+		pipeline: pipeline,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go func() {
+		defer close(stream.done)
+		stream.result, stream.err = pipeline.encode(pr)
+		pr.CloseWithError(stream.err)
+	}()
+	bc.uploads.add(session.UploadId, stream)
+
+	util.HttpJson(w, http.StatusOK, session)
+}
+
+// GetUpload returns the state of an upload session so that a client can
+// figure out which chunk to resume from.
+func (bc *BackendController) GetUpload(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	uploadId := mux.Vars(r)["uploadID"]
+
+	session, err := dbfs.GetUploadSession(bc.Db, uploadId, user)
+	if errors.Is(err, dbfs.ErrUploadSessionNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, session)
+}
+
+// UploadChunk appends a chunk to an upload session. Chunks are numbered from 0
+// and must be sent in order. Re-sending a chunk that has already been received
+// is a no-op, so clients can safely retry after a dropped connection.
+// chunk_checksum (hex sha256 of the chunk) can be sent in the header for the
+// chunk to be verified before it is accepted.
+func (bc *BackendController) UploadChunk(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	vars := mux.Vars(r)
+	uploadId := vars["uploadID"]
+	chunkNo, err := strconv.Atoi(vars["chunkNo"])
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid chunk number")
+		return
+	}
+
+	session, err := dbfs.GetUploadSession(bc.Db, uploadId, user)
+	if errors.Is(err, dbfs.ErrUploadSessionNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session.HandledServer != bc.ServerName {
+		util.HttpError(w, http.StatusConflict, dbfs.ErrUploadWrongServer.Error())
+		return
+	}
+
+	stream := bc.uploads.get(uploadId)
+	if stream == nil {
+		util.HttpError(w, http.StatusGone, dbfs.ErrUploadSessionClosed.Error())
+		return
+	}
+
+	// Read the chunk fully before touching the encoder, so that a dropped
+	// connection never leaves half a chunk in the stream.
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, session.MaxChunkSize+1))
+	if err != nil {
+		util.HttpError(w, http.StatusBadRequest, "failed to read chunk: "+err.Error())
+		return
+	}
+	if int64(len(chunk)) > session.MaxChunkSize {
+		util.HttpError(w, http.StatusRequestEntityTooLarge, "chunk is too large")
+		return
+	}
+	if checksum := r.Header.Get("chunk_checksum"); checksum != "" {
+		sum := sha256.Sum256(chunk)
+		if hex.EncodeToString(sum[:]) != checksum {
+			util.HttpError(w, http.StatusBadRequest, "chunk checksum does not match")
+			return
+		}
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	// Reload the session now that we hold the lock, in case another request
+	// for the same chunk got in first.
+	session, err = dbfs.GetUploadSession(bc.Db, uploadId, user)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	received, err := session.CheckChunk(chunkNo)
+	if errors.Is(err, dbfs.ErrUploadSessionClosed) {
+		util.HttpError(w, http.StatusGone, err.Error())
+		return
+	} else if errors.Is(err, dbfs.ErrUploadChunkOutOfOrder) {
+		util.HttpError(w, http.StatusConflict, err.Error())
+		return
+	}
+	if received {
+		util.HttpJson(w, http.StatusOK, session)
+		return
+	}
+	if session.TotalSize > 0 && session.BytesReceived+int64(len(chunk)) > session.TotalSize {
+		util.HttpError(w, http.StatusBadRequest, "chunk exceeds total_size of the upload")
+		return
+	}
+
+	if _, err := stream.pipe.Write(chunk); err != nil {
+		bc.failUpload(session, stream, user)
+		util.HttpError(w, http.StatusInternalServerError, "failed to encode chunk: "+err.Error())
+		return
+	}
+
+	// The chunk is already in the encoder, so a retry of it would encode the
+	// same bytes twice
+	if err := session.RecordChunk(bc.Db, int64(len(chunk))); err != nil {
+		bc.failUpload(session, stream, user)
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, session)
+}
+
+// FinishUpload completes an upload session, and returns the file created.
+func (bc *BackendController) FinishUpload(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	uploadId := mux.Vars(r)["uploadID"]
+
+	session, err := dbfs.GetUploadSession(bc.Db, uploadId, user)
+	if errors.Is(err, dbfs.ErrUploadSessionNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session.HandledServer != bc.ServerName {
+		util.HttpError(w, http.StatusConflict, dbfs.ErrUploadWrongServer.Error())
+		return
+	}
+	if session.Status != dbfs.UploadSessionActive {
+		util.HttpError(w, http.StatusGone, dbfs.ErrUploadSessionClosed.Error())
+		return
+	}
+
+	stream := bc.uploads.get(uploadId)
+	if stream == nil {
+		util.HttpError(w, http.StatusGone, dbfs.ErrUploadSessionClosed.Error())
+		return
+	}
+
+	stream.mu.Lock()
+	defer stream.mu.Unlock()
+
+	if session.TotalSize > 0 && session.BytesReceived != session.TotalSize {
+		util.HttpError(w, http.StatusBadRequest,
+			fmt.Sprintf("upload incomplete: received %d of %d bytes",
+				session.BytesReceived, session.TotalSize))
+		return
+	}
+
+	// Close the pipe and wait for the encoder to flush
+	stream.pipe.Close()
+	<-stream.done
+	bc.uploads.remove(uploadId)
+	defer stream.cancel()
+
+	file, err := dbfs.GetFileById(bc.Db, session.FileId, user)
+	if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	if stream.err != nil {
+		bc.failUpload(session, stream, user)
+		util.HttpError(w, http.StatusInternalServerError, stream.err.Error())
+		return
+	}
+
+	stream.pipeline.file = file
+	if err := bc.finishShardPipeline(stream.pipeline, user, stream.result); err != nil {
+		session.Fail(bc.Db)
+		status := http.StatusInternalServerError
+		if errors.Is(err, dbfs.ErrQuotaExceeded) {
+			status = http.StatusInsufficientStorage
+		}
+		util.HttpError(w, status, err.Error())
+		return
+	}
+
+	if err := session.Finish(bc.Db); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, file)
+}
+
+// AbortUpload cancels an upload session and deletes the partially written file.
+func (bc *BackendController) AbortUpload(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	uploadId := mux.Vars(r)["uploadID"]
+
+	session, err := dbfs.GetUploadSession(bc.Db, uploadId, user)
+	if errors.Is(err, dbfs.ErrUploadSessionNotFound) {
+		util.HttpError(w, http.StatusNotFound, err.Error())
+		return
+	} else if err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	if session.Status != dbfs.UploadSessionActive {
+		util.HttpError(w, http.StatusGone, dbfs.ErrUploadSessionClosed.Error())
+		return
+	}
+	if session.HandledServer != bc.ServerName {
+		util.HttpError(w, http.StatusConflict, dbfs.ErrUploadWrongServer.Error())
+		return
+	}
+
+	if err := bc.abortUpload(session, user); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, true)
+}
+
+// failUpload stops the stream of an upload that could not be completed, marks
+// the session as failed and deletes the file. Expects stream.mu to be held.
+func (bc *BackendController) failUpload(session *dbfs.UploadSession, stream *uploadStream,
+	user *dbfs.User) {
+
+	stream.abort()
+	bc.uploads.remove(session.UploadId)
+
+	if file, err := dbfs.GetFileById(bc.Db, session.FileId, user); err == nil {
+		if err := file.Delete(bc.Db, user, bc.ServerName); err != nil {
+			bc.Logger.Warn("failed to delete file of failed upload",
+				zap.String("uploadId", session.UploadId), zap.Error(err))
+		}
+	}
+	if err := session.Fail(bc.Db); err != nil {
+		bc.Logger.Warn("failed to mark upload as failed",
+			zap.String("uploadId", session.UploadId), zap.Error(err))
+	}
+}
+
+// abortUpload stops the stream of an upload if it is still open, deletes the
+// file and marks the session as aborted.
+func (bc *BackendController) abortUpload(session *dbfs.UploadSession, user *dbfs.User) error {
+	if stream := bc.uploads.get(session.UploadId); stream != nil {
+		stream.mu.Lock()
+		stream.abort()
+		stream.mu.Unlock()
+		bc.uploads.remove(session.UploadId)
+	}
+
+	file, err := dbfs.GetFileById(bc.Db, session.FileId, user)
+	if err == nil {
+		if err := file.Delete(bc.Db, user, bc.ServerName); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, dbfs.ErrFileNotFound) {
+		return err
+	}
+
+	return session.Abort(bc.Db)
+}
+
+// CleanupUploads aborts the upload sessions handled by this server that have
+// been idle for longer than dbfs.UploadSessionTimeout, or that have lost their
+// stream (e.g. because the server was restarted).
+func (bc *BackendController) CleanupUploads() error {
+	sessions, err := dbfs.GetActiveUploadSessions(bc.Db, bc.ServerName)
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-dbfs.UploadSessionTimeout)
+	for i := range sessions {
+		session := &sessions[i]
+		if bc.uploads.get(session.UploadId) != nil && session.LastActivity.After(cutoff) {
+			continue
+		}
+
+		user, err := dbfs.GetUserById(bc.Db, session.UserId)
+		if err != nil {
+			bc.Logger.Warn("failed to get owner of stale upload",
+				zap.String("uploadId", session.UploadId), zap.Error(err))
+			continue
+		}
+		if err := bc.abortUpload(session, user); err != nil {
+			bc.Logger.Warn("failed to abort stale upload",
+				zap.String("uploadId", session.UploadId), zap.Error(err))
+		}
+	}
+
+	return nil
+}
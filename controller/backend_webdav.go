@@ -0,0 +1,567 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"go.uber.org/zap"
+	"golang.org/x/net/webdav"
+)
+
+const WebDAVPrefix = "/api/v1/webdav"
+
+var errIncompleteBody = errors.New("request body ended before all of it was received")
+
+// webdavHandler returns the WebDAV handler that serves the home folder of the
+// logged-in user. Users are authenticated by the UserAuth middleware, so the
+// WebDAV client needs to send the session cookie along.
+func (bc *BackendController) webdavHandler() *webdav.Handler {
+	bc.webdavOnce.Do(func() {
+		bc.webdav = &webdav.Handler{
+			Prefix:     WebDAVPrefix,
+			FileSystem: &webdavFS{bc: bc},
+			LockSystem: webdav.NewMemLS(),
+			Logger: func(r *http.Request, err error) {
+				if err != nil {
+					bc.Logger.Debug("webdav request failed",
+						zap.String("method", r.Method), zap.String("path", r.URL.Path), zap.Error(err))
+				}
+			},
+		}
+	})
+	return bc.webdav
+}
+
+// WebDAV serves the WebDAV endpoint. COPY requests are handled separately so
+// that copies are made with File.CopyAs instead of re-encoding the data.
+func (bc *BackendController) WebDAV(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "COPY" {
+		bc.webdavCopy(w, r)
+		return
+	}
+	if r.Method == http.MethodPut {
+		body := &webdavBody{ReadCloser: r.Body, expected: r.ContentLength}
+		r.Body = body
+		r = r.WithContext(context.WithValue(r.Context(), webdavBodyKey{}, body))
+	}
+	if r.Method == http.MethodGet {
+		r = r.WithContext(context.WithValue(r.Context(), webdavDownloadKey{}, r))
+	}
+	bc.webdavHandler().ServeHTTP(w, r)
+}
+
+type webdavBodyKey struct{}
+
+// webdavDownloadKey holds the GET request that files are opened for, so that
+// reading them counts as a download
+type webdavDownloadKey struct{}
+
+// webdavBody remembers why reading the body of a PUT request stopped. The
+// WebDAV handler closes the file it writes to even when copying the body
+// failed, so the file needs to know whether it got everything.
+type webdavBody struct {
+	io.ReadCloser
+	expected int64
+	read     int64
+	err      error
+}
+
+func (b *webdavBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.read += int64(n)
+	if err != nil && err != io.EOF {
+		b.err = err
+	}
+	return n, err
+}
+
+// incomplete returns why the body was not read fully, if it was not
+func (b *webdavBody) incomplete() error {
+	if b.err != nil {
+		return fmt.Errorf("%w: %s", errIncompleteBody, b.err.Error())
+	}
+	if b.expected >= 0 && b.read != b.expected {
+		return errIncompleteBody
+	}
+	return nil
+}
+
+// webdavCopy handles WebDAV COPY requests.
+func (bc *BackendController) webdavCopy(w http.ResponseWriter, r *http.Request) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	srcPath := strings.TrimPrefix(r.URL.Path, WebDAVPrefix)
+
+	dest, err := url.Parse(r.Header.Get("Destination"))
+	if err != nil || (dest.Host != "" && dest.Host != r.Host) ||
+		!strings.HasPrefix(dest.Path, WebDAVPrefix) {
+		http.Error(w, "Invalid destination", http.StatusBadGateway)
+		return
+	}
+	destPath := strings.TrimPrefix(dest.Path, WebDAVPrefix)
+
+	fsys := &webdavFS{bc: bc}
+	src, err := fsys.resolve(user, srcPath)
+	if err != nil {
+		http.Error(w, err.Error(), webdavStatus(err))
+		return
+	}
+	if path.Clean("/"+srcPath) == path.Clean("/"+destPath) {
+		http.Error(w, "Source and destination are the same", http.StatusForbidden)
+		return
+	}
+	destParent, err := fsys.resolve(user, path.Dir(path.Clean("/"+destPath)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	// Replace the destination if it already exists and overwriting is allowed
+	status := http.StatusCreated
+	if existing, err := fsys.resolve(user, destPath); err == nil {
+		if r.Header.Get("Overwrite") == "F" {
+			http.Error(w, "Destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		if _, err := existing.Trash(bc.Db, user); err != nil {
+			http.Error(w, err.Error(), webdavStatus(mapWebDAVError("copy", destPath, err)))
+			return
+		}
+		status = http.StatusNoContent
+	}
+
+	newName := path.Base(path.Clean("/" + destPath))
+	if src.EntryType == dbfs.IsFolder && r.Header.Get("Depth") == "0" {
+		_, err = destParent.CreateSubFolder(bc.Db, newName, user, bc.ServerName)
+	} else {
+		_, err = src.CopyAs(bc.Db, destParent, newName, user, bc.ServerName)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), webdavStatus(mapWebDAVError("copy", destPath, err)))
+		return
+	}
+
+	w.WriteHeader(status)
+}
+
+// webdavStatus returns the HTTP status matching an error returned by webdavFS
+func webdavStatus(err error) int {
+	switch {
+	case os.IsNotExist(err):
+		return http.StatusNotFound
+	case os.IsPermission(err):
+		return http.StatusForbidden
+	case os.IsExist(err):
+		return http.StatusPreconditionFailed
+	case errors.Is(err, dbfs.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, dbfs.ErrFileLocked):
+		return http.StatusLocked
+	}
+	return http.StatusInternalServerError
+}
+
+// mapWebDAVError converts dbfs errors into the os errors expected by the
+// webdav package.
+func mapWebDAVError(op, name string, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, dbfs.ErrFileNotFound):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+	case errors.Is(err, dbfs.ErrNoPermission), errors.Is(err, dbfs.ErrPasswordRequired),
+		errors.Is(err, dbfs.ErrIncorrectPassword):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrPermission}
+	case errors.Is(err, dbfs.ErrFileFolderExists):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrExist}
+	case errors.Is(err, dbfs.ErrNotFolder):
+		return &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	return err
+}
+
+// webdavFS implements webdav.FileSystem on top of dbfs. Paths are relative to
+// the home folder of the user in the request context.
+type webdavFS struct {
+	bc *BackendController
+}
+
+var _ webdav.FileSystem = &webdavFS{}
+
+// resolve returns the file at the path given
+func (wfs *webdavFS) resolve(user *dbfs.User, name string) (*dbfs.File, error) {
+	name = path.Clean("/" + name)
+
+	var file *dbfs.File
+	var err error
+	if name == "/" {
+		file, err = dbfs.GetHomeFolder(wfs.bc.Db, user)
+		if err == nil {
+			var hasPermissions bool
+			hasPermissions, err = user.HasPermission(wfs.bc.Db, file, &dbfs.PermissionNeeded{Read: true})
+			if err == nil && !hasPermissions {
+				err = dbfs.ErrFileNotFound
+			}
+		}
+	} else {
+		file, err = dbfs.GetFileByPath(wfs.bc.Db, name, user, true)
+	}
+	if err != nil {
+		return nil, mapWebDAVError("stat", name, err)
+	}
+
+	return file, nil
+}
+
+// resolveParent returns the folder that the path given is in, after checking
+// that the user can write to it.
+func (wfs *webdavFS) resolveParent(user *dbfs.User, name string) (*dbfs.File, error) {
+	parent, err := wfs.resolve(user, path.Dir(path.Clean("/"+name)))
+	if err != nil {
+		return nil, err
+	}
+	if parent.EntryType != dbfs.IsFolder {
+		return nil, mapWebDAVError("open", name, dbfs.ErrNotFolder)
+	}
+
+	hasPermissions, err := user.HasPermission(wfs.bc.Db, parent, &dbfs.PermissionNeeded{Write: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, mapWebDAVError("open", name, dbfs.ErrNoPermission)
+	}
+
+	return parent, nil
+}
+
+// Mkdir implements webdav.FileSystem
+func (wfs *webdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	user, err := ctxutil.GetUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	parent, err := wfs.resolveParent(user, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = dbfs.CreateFolderByParentId(wfs.bc.Db, parent.FileId, path.Base(name), user,
+		wfs.bc.ServerName)
+	return mapWebDAVError("mkdir", name, err)
+}
+
+// OpenFile implements webdav.FileSystem
+func (wfs *webdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode,
+) (webdav.File, error) {
+	user, err := ctxutil.GetUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := wfs.resolve(user, name)
+	if err != nil && !(os.IsNotExist(err) && flag&os.O_CREATE != 0) {
+		return nil, err
+	}
+
+	// Read only
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) == 0 {
+		return &webdavFile{ctx: ctx, bc: wfs.bc, user: user, file: file}, nil
+	}
+
+	// Writing
+	if file != nil {
+		if flag&os.O_EXCL != 0 {
+			return nil, mapWebDAVError("open", name, dbfs.ErrFileFolderExists)
+		}
+		if file.EntryType != dbfs.IsFile {
+			return nil, mapWebDAVError("open", name, dbfs.ErrNotFile)
+		}
+		hasPermissions, err := user.HasPermission(wfs.bc.Db, file, &dbfs.PermissionNeeded{Write: true})
+		if err != nil {
+			return nil, err
+		} else if !hasPermissions {
+			return nil, mapWebDAVError("open", name, dbfs.ErrNoPermission)
+		}
+	}
+
+	parent, err := wfs.resolveParent(user, name)
+	if err != nil {
+		return nil, err
+	}
+
+	fileName := path.Base(path.Clean("/" + name))
+	pr, pw := io.Pipe()
+	wf := &webdavWriteFile{
+		name: fileName,
+		pipe: pw,
+		done: make(chan struct{}),
+	}
+	wf.body, _ = ctx.Value(webdavBodyKey{}).(*webdavBody)
+
+	go func() {
+		defer close(wf.done)
+		if file != nil {
+			wf.err = wfs.bc.updateFileData(ctx, user, file, "", pr)
+		} else {
+			_, wf.err = wfs.bc.writeNewFile(ctx, user, parent.FileId, fileName,
+				mime.TypeByExtension(path.Ext(fileName)), pr)
+		}
+		pr.CloseWithError(wf.err)
+	}()
+
+	return wf, nil
+}
+
+// RemoveAll implements webdav.FileSystem
+func (wfs *webdavFS) RemoveAll(ctx context.Context, name string) error {
+	user, err := ctxutil.GetUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if path.Clean("/"+name) == "/" {
+		return mapWebDAVError("remove", name, dbfs.ErrNoPermission)
+	}
+
+	file, err := wfs.resolve(user, name)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Trash(wfs.bc.Db, user)
+	return mapWebDAVError("remove", name, err)
+}
+
+// Rename implements webdav.FileSystem
+func (wfs *webdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	user, err := ctxutil.GetUser(ctx)
+	if err != nil {
+		return err
+	}
+
+	if path.Clean("/"+oldName) == "/" {
+		return mapWebDAVError("rename", oldName, dbfs.ErrNoPermission)
+	}
+
+	file, err := wfs.resolve(user, oldName)
+	if err != nil {
+		return err
+	}
+	newParent, err := wfs.resolveParent(user, newName)
+	if err != nil {
+		return err
+	}
+
+	if file.ParentFolderFileId == nil || *file.ParentFolderFileId != newParent.FileId {
+		if err := file.Move(wfs.bc.Db, newParent, user); err != nil {
+			return mapWebDAVError("rename", oldName, err)
+		}
+	}
+
+	base := path.Base(path.Clean("/" + newName))
+	if base != file.FileName {
+		err = file.UpdateMetaData(wfs.bc.Db, dbfs.FileMetadataModification{FileName: base}, user)
+		if err != nil {
+			return mapWebDAVError("rename", oldName, err)
+		}
+	}
+
+	return nil
+}
+
+// Stat implements webdav.FileSystem
+func (wfs *webdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	user, err := ctxutil.GetUser(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := wfs.resolve(user, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return &webdavFileInfo{file: file}, nil
+}
+
+// webdavFileInfo implements os.FileInfo for a dbfs file
+type webdavFileInfo struct {
+	file *dbfs.File
+}
+
+var _ webdav.ContentTyper = &webdavFileInfo{}
+
+func (fi *webdavFileInfo) Name() string       { return fi.file.FileName }
+func (fi *webdavFileInfo) Size() int64        { return fi.file.Size }
+func (fi *webdavFileInfo) ModTime() time.Time { return fi.file.ModifiedTime }
+func (fi *webdavFileInfo) IsDir() bool        { return fi.file.EntryType == dbfs.IsFolder }
+func (fi *webdavFileInfo) Sys() interface{}   { return nil }
+
+func (fi *webdavFileInfo) Mode() os.FileMode {
+	if fi.IsDir() {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ContentType implements webdav.ContentTyper, so that the file does not need
+// to be decoded to sniff its type.
+func (fi *webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	if fi.file.MIMEType == "" {
+		return "application/octet-stream", nil
+	}
+	return fi.file.MIMEType, nil
+}
+
+// webdavFile is a dbfs file or folder opened for reading. The file contents
+// are only decoded when the file is first read, which counts as a download
+// when it is read for a GET request.
+type webdavFile struct {
+	ctx    context.Context
+	bc     *BackendController
+	user   *dbfs.User
+	file   *dbfs.File
+	reader io.ReadSeeker
+}
+
+func (f *webdavFile) open() error {
+	if f.reader != nil {
+		return nil
+	}
+	if f.file.EntryType != dbfs.IsFile {
+		return mapWebDAVError("read", f.file.FileName, dbfs.ErrNotFile)
+	}
+
+	reader, err := f.bc.openFileVersion(f.ctx, f.user, f.file, f.file.VersionNo, "")
+	if err != nil {
+		return mapWebDAVError("read", f.file.FileName, err)
+	}
+	f.reader = reader
+
+	if r, ok := f.ctx.Value(webdavDownloadKey{}).(*http.Request); ok {
+		f.bc.recordDownload(r, f.file, f.user, "webdav")
+	}
+	return nil
+}
+
+func (f *webdavFile) Read(p []byte) (int, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.reader.Read(p)
+}
+
+func (f *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.open(); err != nil {
+		return 0, err
+	}
+	return f.reader.Seek(offset, whence)
+}
+
+func (f *webdavFile) Readdir(count int) ([]fs.FileInfo, error) {
+	files, err := f.file.ListContents(f.bc.Db, f.user)
+	if err != nil {
+		return nil, mapWebDAVError("readdir", f.file.FileName, err)
+	}
+
+	infos := make([]fs.FileInfo, 0, len(files))
+	for i := range files {
+		if files[i].Status == dbfs.FileStatusWriting {
+			continue
+		}
+		infos = append(infos, &webdavFileInfo{file: &files[i]})
+	}
+	if count > 0 && len(infos) > count {
+		infos = infos[:count]
+	}
+
+	return infos, nil
+}
+
+func (f *webdavFile) Stat() (fs.FileInfo, error) {
+	return &webdavFileInfo{file: f.file}, nil
+}
+
+func (f *webdavFile) Write(p []byte) (int, error) {
+	return 0, mapWebDAVError("write", f.file.FileName, dbfs.ErrNoPermission)
+}
+
+func (f *webdavFile) Close() error {
+	if closer, ok := f.reader.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// webdavWriteFile is a file opened for writing. Data written to it is encoded
+// in the background, and Close waits for the encoding to finish. If the body
+// of the request was cut short, the encoding is failed so that nothing is
+// committed.
+type webdavWriteFile struct {
+	name    string
+	written int64
+	pipe    *io.PipeWriter
+	body    *webdavBody
+	done    chan struct{}
+	err     error
+}
+
+func (f *webdavWriteFile) Write(p []byte) (int, error) {
+	n, err := f.pipe.Write(p)
+	f.written += int64(n)
+	return n, err
+}
+
+func (f *webdavWriteFile) Close() error {
+	if f.body != nil {
+		if err := f.body.incomplete(); err != nil {
+			f.pipe.CloseWithError(err)
+			<-f.done
+			if f.err == nil {
+				f.err = err
+			}
+			return f.err
+		}
+	}
+	f.pipe.Close()
+	<-f.done
+	return f.err
+}
+
+func (f *webdavWriteFile) Read(p []byte) (int, error) {
+	return 0, mapWebDAVError("read", f.name, dbfs.ErrNoPermission)
+}
+
+func (f *webdavWriteFile) Seek(offset int64, whence int) (int64, error) {
+	return 0, mapWebDAVError("seek", f.name, dbfs.ErrInvalidAction)
+}
+
+func (f *webdavWriteFile) Readdir(count int) ([]fs.FileInfo, error) {
+	return nil, mapWebDAVError("readdir", f.name, dbfs.ErrNotFolder)
+}
+
+func (f *webdavWriteFile) Stat() (fs.FileInfo, error) {
+	return &webdavFileInfo{file: &dbfs.File{
+		FileName:     f.name,
+		Size:         f.written,
+		EntryType:    dbfs.IsFile,
+		ModifiedTime: time.Now(),
+	}}, nil
+}
@@ -0,0 +1,224 @@
+package controller_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/controller/inc"
+	"github.com/OhanaFS/ohana/dbfs"
+	selfsigntestutils "github.com/OhanaFS/ohana/selfsign/test_utils"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func TestBackendController_WebDAV(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// Generate dummy certificates for Inc
+	tmpDir, err := os.MkdirTemp("", "ohana-test-")
+	Assert.NoError(err)
+	defer os.RemoveAll(tmpDir)
+	certs, err := selfsigntestutils.GenCertsTest(tmpDir)
+	Assert.NoError(err)
+	shardsLocation := path.Join(tmpDir, "shards")
+	Assert.NoError(os.MkdirAll(shardsLocation, 0755))
+
+	//Set up mock Db
+	configFile := &config.Config{
+		Stitch: config.StitchConfig{
+			ShardsLocation: shardsLocation,
+		},
+		Inc: config.IncConfig{
+			CaCert:     certs.CaCertPath,
+			PublicCert: certs.PublicCertPath,
+			PrivateKey: certs.PrivateKeyPath,
+			ServerName: "localhost",
+			HostName:   "localhost",
+			Port:       "5561",
+		},
+	}
+	logger := config.NewLogger(configFile)
+	db := testutil.NewMockDB(t)
+
+	// set up mock zapper
+	zapper, _ := zap.NewDevelopment()
+
+	// Setting up controller
+	bc := &controller.BackendController{
+		Db:         db,
+		Logger:     logger,
+		Path:       configFile.Stitch.ShardsLocation,
+		ServerName: "localhost",
+		Inc:        inc.NewInc(configFile, db, zapper),
+	}
+
+	// Register inc services
+	inc.RegisterIncServices(bc.Inc)
+	time.Sleep(time.Second * 3)
+
+	bc.InitialiseShardsFolder()
+
+	// Getting Superuser to use with testing
+	user, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	doRequest := func(method, target, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, controller.WebDAVPrefix+target, strings.NewReader(body)).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		w := httptest.NewRecorder()
+		bc.WebDAV(w, req)
+		return w
+	}
+
+	t.Run("MKCOL", func(t *testing.T) {
+		w := doRequest("MKCOL", "/webdav", "", nil)
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		// Folder already exists
+		w = doRequest("MKCOL", "/webdav", "", nil)
+		Assert.Equal(http.StatusMethodNotAllowed, w.Code, w.Body.String())
+
+		// Parent does not exist
+		w = doRequest("MKCOL", "/nothere/webdav", "", nil)
+		Assert.Equal(http.StatusConflict, w.Code, w.Body.String())
+	})
+
+	t.Run("PUT and GET", func(t *testing.T) {
+		w := doRequest("PUT", "/webdav/hello.txt", "hello world", nil)
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/webdav/hello.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("hello world", w.Body.String())
+
+		// Overwriting the file creates a new version
+		w = doRequest("PUT", "/webdav/hello.txt", "goodbye world", nil)
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/webdav/hello.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+
+		file, err := dbfs.GetFileByPath(db, "/webdav/hello.txt", user, true)
+		Assert.NoError(err)
+		Assert.Equal(int64(len("goodbye world")), file.Size)
+
+		// Both GETs are downloads, a HEAD is not
+		w = doRequest("HEAD", "/webdav/hello.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		activity, err := file.GetActivity(db, user, &dbfs.ActivityFilter{Action: dbfs.ActivityDownload})
+		Assert.NoError(err)
+		Assert.Len(activity, 2)
+		for _, entry := range activity {
+			Assert.Equal("webdav", entry.Details)
+		}
+	})
+
+	t.Run("PUT with a short body", func(t *testing.T) {
+		// The client drops before sending all it announced
+		req := httptest.NewRequest("PUT", controller.WebDAVPrefix+"/webdav/hello.txt",
+			strings.NewReader("good")).WithContext(ctxutil.WithUser(context.Background(), user))
+		req.ContentLength = int64(len("goodbye world, again"))
+		w := httptest.NewRecorder()
+		bc.WebDAV(w, req)
+		Assert.NotEqual(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/webdav/hello.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+
+		// The connection breaks while a new file is sent
+		req = httptest.NewRequest("PUT", controller.WebDAVPrefix+"/webdav/partial.txt",
+			io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(errors.New("connection reset")))).
+			WithContext(ctxutil.WithUser(context.Background(), user))
+		w = httptest.NewRecorder()
+		bc.WebDAV(w, req)
+		Assert.NotEqual(http.StatusCreated, w.Code, w.Body.String())
+
+		_, err := dbfs.GetFileByPath(db, "/webdav/partial.txt", user, true)
+		Assert.Error(err)
+	})
+
+	t.Run("PROPFIND", func(t *testing.T) {
+		w := doRequest("PROPFIND", "/webdav", "", map[string]string{"Depth": "1"})
+		Assert.Equal(http.StatusMultiStatus, w.Code, w.Body.String())
+		Assert.Contains(w.Body.String(), "hello.txt")
+
+		w = doRequest("PROPFIND", "/nothere", "", map[string]string{"Depth": "0"})
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("COPY", func(t *testing.T) {
+		w := doRequest("COPY", "/webdav/hello.txt", "", map[string]string{
+			"Destination": controller.WebDAVPrefix + "/webdav/copy.txt",
+		})
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/webdav/copy.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+
+		// Overwrite disallowed
+		w = doRequest("COPY", "/webdav/hello.txt", "", map[string]string{
+			"Destination": controller.WebDAVPrefix + "/webdav/copy.txt",
+			"Overwrite":   "F",
+		})
+		Assert.Equal(http.StatusPreconditionFailed, w.Code, w.Body.String())
+	})
+
+	t.Run("MOVE", func(t *testing.T) {
+		w := doRequest("MKCOL", "/moved", "", nil)
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("MOVE", "/webdav/copy.txt", "", map[string]string{
+			"Destination": controller.WebDAVPrefix + "/moved/renamed.txt",
+		})
+		Assert.Equal(http.StatusCreated, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/webdav/copy.txt", "", nil)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/moved/renamed.txt", "", nil)
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.Equal("goodbye world", w.Body.String())
+	})
+
+	t.Run("DELETE", func(t *testing.T) {
+		w := doRequest("DELETE", "/moved", "", nil)
+		Assert.Equal(http.StatusNoContent, w.Code, w.Body.String())
+
+		w = doRequest("GET", "/moved/renamed.txt", "", nil)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+
+	t.Run("No permission", func(t *testing.T) {
+		noPermUser, err := dbfs.CreateNewUser(db, "webdavUser", "webdavUser", dbfs.AccountTypeEndUser,
+			"webdavUser", "webdavUser", "webdavUser", "webdavUser", "localhost")
+		Assert.NoError(err)
+
+		// The user's home folder is not the root folder, so the folder created
+		// earlier isn't visible.
+		req := httptest.NewRequest("GET", controller.WebDAVPrefix+"/webdav/hello.txt", nil).
+			WithContext(ctxutil.WithUser(context.Background(), noPermUser))
+		w := httptest.NewRecorder()
+		bc.WebDAV(w, req)
+		Assert.Equal(http.StatusNotFound, w.Code, w.Body.String())
+	})
+}
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/gorilla/mux"
+	"go.uber.org/zap"
+)
+
+const (
+	// WebhookSignatureHeader holds the HMAC-SHA256 of the body, keyed with the
+	// secret of the webhook, as "sha256=<hex>"
+	WebhookSignatureHeader = "X-Ohana-Signature"
+	WebhookEventHeader     = "X-Ohana-Event"
+	WebhookDeliveryHeader  = "X-Ohana-Delivery"
+
+	webhookInterval  = 10 * time.Second
+	webhookTimeout   = 10 * time.Second
+	webhookBatchSize = 50
+)
+
+var errWebhookAddressNotAllowed = errors.New("webhook address is not allowed")
+
+// blockedWebhookNetworks are the networks that webhooks may not be delivered
+// to on top of the loopback, private, link-local and multicast ones
+var blockedWebhookNetworks = []*net.IPNet{
+	mustParseCIDR("0.0.0.0/8"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+// webhookRequest is the body of CreateWebhook
+type webhookRequest struct {
+	FolderId string   `json:"folder_id"`
+	Url      string   `json:"url"`
+	Events   []string `json:"events"`
+}
+
+// webhookStatus returns the HTTP status matching an error returned by the
+// webhook functions of dbfs
+func webhookStatus(err error) int {
+	switch {
+	case errors.Is(err, dbfs.ErrFileNotFound), errors.Is(err, dbfs.ErrWebhookNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, dbfs.ErrNoPermission):
+		return http.StatusForbidden
+	case errors.Is(err, dbfs.ErrNotFolder), errors.Is(err, dbfs.ErrInvalidWebhook),
+		errors.Is(err, dbfs.ErrInvalidListOptions):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// SignWebhookPayload returns the signature of a webhook body, as sent in the
+// WebhookSignatureHeader
+func SignWebhookPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// CreateWebhook subscribes a URL to the events of a folder. The secret used to
+// sign the deliveries is only returned here.
+func (bc *BackendController) CreateWebhook(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	var request webhookRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		util.HttpError(w, http.StatusBadRequest, "Invalid webhook: "+err.Error())
+		return
+	}
+
+	folder, err := dbfs.GetFileById(bc.Db, request.FolderId, user)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return
+	}
+
+	webhook, err := folder.CreateWebhook(bc.Db, user, request.Url, request.Events)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, webhook)
+}
+
+// GetWebhooks returns the webhooks of the folder in the folder_id query
+// parameter, or the ones created by the user if there is none
+func (bc *BackendController) GetWebhooks(w http.ResponseWriter, r *http.Request) {
+
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+
+	folderId := r.URL.Query().Get("folder_id")
+	if folderId == "" {
+		webhooks, err := dbfs.GetUserWebhooks(bc.Db, user)
+		if err != nil {
+			util.HttpError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		util.HttpJson(w, http.StatusOK, webhooks)
+		return
+	}
+
+	folder, err := dbfs.GetFileById(bc.Db, folderId, user)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return
+	}
+	webhooks, err := folder.GetWebhooks(bc.Db, user)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, webhooks)
+}
+
+// getRequestWebhook returns the user and the webhook in the request path,
+// writing the error response if they cannot be found
+func (bc *BackendController) getRequestWebhook(w http.ResponseWriter, r *http.Request) (*dbfs.User, *dbfs.Webhook, bool) {
+	user, err := ctxutil.GetUser(r.Context())
+	if err != nil {
+		util.HttpError(w, http.StatusUnauthorized, err.Error())
+		return nil, nil, false
+	}
+
+	webhook, err := dbfs.GetWebhookById(bc.Db, mux.Vars(r)["webhookID"], user)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return nil, nil, false
+	}
+
+	return user, webhook, true
+}
+
+// GetWebhook returns a webhook
+func (bc *BackendController) GetWebhook(w http.ResponseWriter, r *http.Request) {
+	_, webhook, ok := bc.getRequestWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, webhook)
+}
+
+// UpdateWebhook pauses or resumes a webhook, from the active field of the
+// JSON body
+func (bc *BackendController) UpdateWebhook(w http.ResponseWriter, r *http.Request) {
+	_, webhook, ok := bc.getRequestWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	var request struct {
+		Active *bool `json:"active"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Active == nil {
+		util.HttpError(w, http.StatusBadRequest, "Expected a body with the active field")
+		return
+	}
+
+	if err := webhook.SetActive(bc.Db, *request.Active); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, webhook)
+}
+
+// DeleteWebhook removes a webhook and its delivery log
+func (bc *BackendController) DeleteWebhook(w http.ResponseWriter, r *http.Request) {
+	_, webhook, ok := bc.getRequestWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	if err := webhook.Delete(bc.Db); err != nil {
+		util.HttpError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, nil)
+}
+
+// GetWebhookDeliveries returns the delivery log of a webhook, newest first.
+// The number of deliveries can be limited with the limit query parameter.
+func (bc *BackendController) GetWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	_, webhook, ok := bc.getRequestWebhook(w, r)
+	if !ok {
+		return
+	}
+
+	limit := 0
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			util.HttpError(w, http.StatusBadRequest, "Invalid limit")
+			return
+		}
+	}
+
+	deliveries, err := webhook.GetDeliveries(bc.Db, limit)
+	if err != nil {
+		util.HttpError(w, webhookStatus(err), err.Error())
+		return
+	}
+
+	util.HttpJson(w, http.StatusOK, deliveries)
+}
+
+// DeliverWebhooks sends the webhook deliveries that are due, and records the
+// outcome of each attempt
+func (bc *BackendController) DeliverWebhooks(ctx context.Context) error {
+	deliveries, err := dbfs.ClaimWebhookDeliveries(bc.Db, webhookBatchSize, 2*webhookTimeout)
+	if err != nil {
+		return err
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+		statusCode, sendErr := bc.sendWebhook(ctx, delivery)
+		if err := delivery.RecordAttempt(bc.Db, statusCode, sendErr); err != nil {
+			bc.Logger.Warn("failed to record webhook delivery",
+				zap.String("delivery_id", delivery.DeliveryId), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// webhookAddressAllowed checks if webhooks may be delivered to the IP address.
+// Only public addresses are, unless WebhookAllowedNetworks says otherwise.
+func (bc *BackendController) webhookAddressAllowed(ip net.IP) bool {
+	for _, network := range bc.WebhookAllowedNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() || ip.IsMulticast() {
+		return false
+	}
+	for _, network := range blockedWebhookNetworks {
+		if network.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// getWebhookClient returns the client that webhooks are delivered with. The
+// address is checked when connecting, once it has been resolved, so that
+// neither redirects nor DNS changes can point a webhook at the internal network.
+func (bc *BackendController) getWebhookClient() *http.Client {
+	bc.webhookOnce.Do(func() {
+		dialer := &net.Dialer{
+			Timeout: webhookTimeout,
+			Control: func(network, address string, _ syscall.RawConn) error {
+				host, _, err := net.SplitHostPort(address)
+				if err != nil {
+					return err
+				}
+				if ip := net.ParseIP(host); ip == nil || !bc.webhookAddressAllowed(ip) {
+					return fmt.Errorf("%w: %s", errWebhookAddressNotAllowed, host)
+				}
+				return nil
+			},
+		}
+		bc.webhookClient = &http.Client{
+			Timeout: webhookTimeout,
+			Transport: &http.Transport{
+				DialContext:         dialer.DialContext,
+				TLSHandshakeTimeout: webhookTimeout,
+				MaxIdleConns:        10,
+				IdleConnTimeout:     90 * time.Second,
+			},
+		}
+	})
+	return bc.webhookClient
+}
+
+// sendWebhook POSTs a delivery to its webhook, and returns the status code of
+// the response
+func (bc *BackendController) sendWebhook(ctx context.Context, delivery *dbfs.WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, delivery.Webhook.Url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookEventHeader, delivery.Event)
+	req.Header.Set(WebhookDeliveryHeader, delivery.DeliveryId)
+	req.Header.Set(WebhookSignatureHeader, SignWebhookPayload(delivery.Webhook.Secret, body))
+
+	resp, err := bc.getWebhookClient().Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,181 @@
+package controller_test
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/OhanaFS/ohana/controller"
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/ctxutil"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendController_Webhooks(t *testing.T) {
+
+	Assert := assert.New(t)
+
+	// The receiver runs on the loopback address, which has to be allowed
+	_, loopback, err := net.ParseCIDR("127.0.0.0/8")
+	Assert.NoError(err)
+
+	db := testutil.NewMockDB(t)
+	bc := &controller.BackendController{
+		Db:                     db,
+		Logger:                 config.NewLogger(&config.Config{}),
+		ServerName:             "localhost",
+		WebhookAllowedNetworks: []*net.IPNet{loopback},
+	}
+
+	admin, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	incoming, err := rootFolder.CreateSubFolder(db, "incoming", admin, "localhost")
+	Assert.NoError(err)
+
+	// The receiving end checks the signature of everything it gets
+	type received struct {
+		event     string
+		signature string
+		body      []byte
+	}
+	var deliveries []received
+	failing := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		deliveries = append(deliveries, received{
+			event:     r.Header.Get(controller.WebhookEventHeader),
+			signature: r.Header.Get(controller.WebhookSignatureHeader),
+			body:      body,
+		})
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	newRequest := func(method, target, body string, vars map[string]string) *http.Request {
+		req := httptest.NewRequest(method, target, strings.NewReader(body)).
+			WithContext(ctxutil.WithUser(context.Background(), admin))
+		return mux.SetURLVars(req, vars)
+	}
+
+	var webhook dbfs.Webhook
+
+	t.Run("Creating a webhook", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		bc.CreateWebhook(w, newRequest("POST", "/api/v1/webhooks",
+			`{"folder_id": "`+incoming.FileId+`", "url": "`+receiver.URL+`", "events": ["created"]}`, nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &webhook))
+		Assert.NotEmpty(webhook.Secret)
+
+		w = httptest.NewRecorder()
+		bc.CreateWebhook(w, newRequest("POST", "/api/v1/webhooks",
+			`{"folder_id": "`+incoming.FileId+`", "url": "`+receiver.URL+`", "events": ["opened"]}`, nil))
+		Assert.Equal(http.StatusBadRequest, w.Code)
+
+		var webhooks []dbfs.Webhook
+		w = httptest.NewRecorder()
+		bc.GetWebhooks(w, newRequest("GET", "/api/v1/webhooks?folder_id="+incoming.FileId, "", nil))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &webhooks))
+		Assert.Len(webhooks, 1)
+		Assert.Empty(webhooks[0].Secret)
+	})
+
+	t.Run("Delivering signed events", func(t *testing.T) {
+		folder, err := incoming.CreateSubFolder(db, "batch-42", admin, "localhost")
+		Assert.NoError(err)
+
+		Assert.NoError(bc.DeliverWebhooks(context.Background()))
+		Assert.Len(deliveries, 1)
+		Assert.Equal(dbfs.WebhookEventCreated, deliveries[0].event)
+		Assert.Equal(controller.SignWebhookPayload(webhook.Secret, deliveries[0].body), deliveries[0].signature)
+
+		var payload dbfs.WebhookPayload
+		Assert.NoError(json.Unmarshal(deliveries[0].body, &payload))
+		Assert.Equal(folder.FileId, payload.FileId)
+
+		// Nothing is sent twice
+		Assert.NoError(bc.DeliverWebhooks(context.Background()))
+		Assert.Len(deliveries, 1)
+	})
+
+	t.Run("Failed deliveries are retried later", func(t *testing.T) {
+		failing = true
+		_, err := incoming.CreateSubFolder(db, "batch-43", admin, "localhost")
+		Assert.NoError(err)
+
+		Assert.NoError(bc.DeliverWebhooks(context.Background()))
+		Assert.Len(deliveries, 2)
+
+		var log []dbfs.WebhookDelivery
+		w := httptest.NewRecorder()
+		bc.GetWebhookDeliveries(w, newRequest("GET", "/api/v1/webhooks/"+webhook.WebhookId+"/deliveries", "",
+			map[string]string{"webhookID": webhook.WebhookId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &log))
+		Assert.Len(log, 2)
+		Assert.Equal(dbfs.DeliveryStatusPending, log[0].Status)
+		Assert.Equal(http.StatusServiceUnavailable, log[0].LastStatusCode)
+		Assert.Equal(1, log[0].Attempts)
+		Assert.Equal(dbfs.DeliveryStatusDelivered, log[1].Status)
+
+		// The retry is not due yet
+		Assert.NoError(bc.DeliverWebhooks(context.Background()))
+		Assert.Len(deliveries, 2)
+	})
+
+	t.Run("Private addresses are refused", func(t *testing.T) {
+		strict := &controller.BackendController{
+			Db:         db,
+			Logger:     bc.Logger,
+			ServerName: "localhost",
+		}
+
+		_, err := incoming.CreateSubFolder(db, "batch-44", admin, "localhost")
+		Assert.NoError(err)
+
+		Assert.NoError(strict.DeliverWebhooks(context.Background()))
+		Assert.Len(deliveries, 2)
+
+		var log []dbfs.WebhookDelivery
+		w := httptest.NewRecorder()
+		bc.GetWebhookDeliveries(w, newRequest("GET", "/api/v1/webhooks/"+webhook.WebhookId+"/deliveries", "",
+			map[string]string{"webhookID": webhook.WebhookId}))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+		Assert.NoError(json.Unmarshal(w.Body.Bytes(), &log))
+		Assert.Len(log, 3)
+		Assert.Equal(dbfs.DeliveryStatusPending, log[0].Status)
+		Assert.Equal(1, log[0].Attempts)
+		Assert.Contains(log[0].LastError, "not allowed")
+	})
+
+	t.Run("Pausing and deleting", func(t *testing.T) {
+		vars := map[string]string{"webhookID": webhook.WebhookId}
+
+		w := httptest.NewRecorder()
+		bc.UpdateWebhook(w, newRequest("PATCH", "/api/v1/webhooks/"+webhook.WebhookId,
+			`{"active": false}`, vars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.DeleteWebhook(w, newRequest("DELETE", "/api/v1/webhooks/"+webhook.WebhookId, "", vars))
+		Assert.Equal(http.StatusOK, w.Code, w.Body.String())
+
+		w = httptest.NewRecorder()
+		bc.GetWebhook(w, newRequest("GET", "/api/v1/webhooks/"+webhook.WebhookId, "", vars))
+		Assert.Equal(http.StatusNotFound, w.Code)
+	})
+}
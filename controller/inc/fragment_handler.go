@@ -110,6 +110,11 @@ func (i Inc) CronJobDeleteShards(manualRun bool) (string, error) {
 	}
 
 	// Start the job
+	_, err = dbfs.PurgeExpiredTrash(i.Db, i.ServerName)
+	if err != nil {
+		return "", err
+	}
+
 	_, err = dbfs.MarkOldFileVersions(i.Db)
 	if err != nil {
 		return "", err
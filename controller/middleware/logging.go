@@ -35,6 +35,14 @@ func (rw *responseWriter) WriteHeader(code int) {
 	return
 }
 
+// Flush sends what has been written so far, so that streamed responses are
+// not held back by the wrapper.
+func (rw *responseWriter) Flush() {
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
 // NewLoggingMW creates a middleware that logs the incoming request and
 // its duration.
 func NewLoggingMW(logger *zap.Logger) middleware {
@@ -16,12 +16,38 @@ func InitDB(db *gorm.DB) error {
 		&ResultsCFSHC{}, &JobProgressCFSHC{}, &ResultsAFSHC{}, &JobProgressAFSHC{},
 		&ResultsMissingShard{}, &JobProgressMissingShard{}, &ResultsOrphanedShard{}, &JobProgressOrphanedShard{},
 		&JobProgressPermissionCheck{}, &JobProgressDeleteFragments{}, &JobProgressOrphanedFile{}, &ResultsOrphanedFile{},
-		&HistoricalStats{}, &Job{})
+		&HistoricalStats{}, &Job{}, &UploadSession{},
+		&S3AccessKey{}, &S3MultipartUpload{}, &S3MultipartPart{}, &TrashItem{}, &Thumbnail{}, &SupersededData{},
+		&FileLock{},
+		&FileTag{},
+		&FileVersionTag{},
+		&FileActivity{},
+		&CopyOperation{},
+		&Webhook{},
+		&WebhookDelivery{},
+		&FileEvent{})
 
 	if err != nil {
 		return err
 	}
 
+	// Links are left dangling when their target is deleted, so databases
+	// created with a foreign key on the target need it dropped
+	if db.Migrator().HasConstraint(&File{}, "fk_files_link_file") {
+		if err := db.Migrator().DropConstraint(&File{}, "fk_files_link_file"); err != nil {
+			return err
+		}
+	}
+	if db.Migrator().HasConstraint(&FileVersion{}, "fk_file_versions_link_file") {
+		if err := db.Migrator().DropConstraint(&FileVersion{}, "fk_file_versions_link_file"); err != nil {
+			return err
+		}
+	}
+
+	if err := createSearchIndexes(db); err != nil {
+		return err
+	}
+
 	// Checking if the DB is empty
 
 	return db.Transaction(func(db *gorm.DB) error {
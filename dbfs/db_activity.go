@@ -0,0 +1,139 @@
+package dbfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	ActivityDownload   = "download"
+	ActivityUpdate     = "update"
+	ActivityRename     = "rename"
+	ActivityMetadata   = "metadata"
+	ActivityMove       = "move"
+	ActivityCopy       = "copy"
+	ActivityTrash      = "trash"
+	ActivityDelete     = "delete"
+	ActivityShare      = "share"
+	ActivityPermission = "permission"
+)
+
+var (
+	ErrInvalidActivityFilter = errors.New("invalid activity filter")
+)
+
+// activityActions are the actions that can be recorded and filtered on
+var activityActions = map[string]bool{
+	ActivityDownload:   true,
+	ActivityUpdate:     true,
+	ActivityRename:     true,
+	ActivityMetadata:   true,
+	ActivityMove:       true,
+	ActivityCopy:       true,
+	ActivityTrash:      true,
+	ActivityDelete:     true,
+	ActivityShare:      true,
+	ActivityPermission: true,
+}
+
+// FileActivity is an entry in the audit trail of a file or folder. Entries
+// are kept after the file is deleted. UserId is nil for anonymous access,
+// such as downloads through a shared link.
+type FileActivity struct {
+	ActivityId  int       `gorm:"primaryKey; autoIncrement" json:"activity_id"`
+	FileId      string    `gorm:"not null; index" json:"file_id"`
+	UserId      *string   `gorm:"index" json:"user_id"`
+	Action      string    `gorm:"not null; index" json:"action"`
+	Details     string    `json:"details"`
+	CreatedTime time.Time `gorm:"not null; index" json:"created_time"`
+}
+
+// ActivityFilter narrows down the activity returned by GetActivity
+type ActivityFilter struct {
+	UserId string // Only the activity of this user
+	Action string // Only this action, one of the Activity consts
+	Limit  int    // 0 returns every entry
+}
+
+// RecordActivity adds an entry to the audit trail of a file. The user can be
+// nil if the action was done anonymously.
+func RecordActivity(tx *gorm.DB, fileId string, user *User, action, details string) error {
+	activity := FileActivity{
+		FileId:      fileId,
+		Action:      action,
+		Details:     details,
+		CreatedTime: time.Now(),
+	}
+	if user != nil {
+		activity.UserId = &user.UserId
+	}
+	return tx.Create(&activity).Error
+}
+
+// permissionDetails describes the permissions given for the audit trail
+func permissionDetails(permission *PermissionNeeded) string {
+	var given []string
+	if permission.Read {
+		given = append(given, "read")
+	}
+	if permission.Write {
+		given = append(given, "write")
+	}
+	if permission.Execute {
+		given = append(given, "execute")
+	}
+	if permission.Share {
+		given = append(given, "share")
+	}
+	if permission.Audit {
+		given = append(given, "audit")
+	}
+	return strings.Join(given, ",")
+}
+
+// GetActivity returns the audit trail of the file, newest first. Requires the
+// audit permission on the file.
+func (f *File) GetActivity(tx *gorm.DB, user *User, filter *ActivityFilter) ([]FileActivity, error) {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	// Check if user has audit permission (if not 403)
+	hasPermissions, err = user.HasPermission(tx, f, &PermissionNeeded{Audit: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrNoPermission
+	}
+
+	if filter.Limit < 0 || filter.Limit > MaxListLimit ||
+		(filter.Action != "" && !activityActions[filter.Action]) {
+		return nil, ErrInvalidActivityFilter
+	}
+
+	q := tx.Where("file_id = ?", f.FileId)
+	if filter.UserId != "" {
+		q = q.Where("user_id = ?", filter.UserId)
+	}
+	if filter.Action != "" {
+		q = q.Where("action = ?", filter.Action)
+	}
+	if filter.Limit > 0 {
+		q = q.Limit(filter.Limit)
+	}
+
+	activity := []FileActivity{}
+	err = q.Order("created_time DESC").Order("activity_id DESC").Find(&activity).Error
+	if err != nil {
+		return nil, err
+	}
+	return activity, nil
+}
@@ -0,0 +1,100 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileActivity(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	editor, err := dbfs.CreateNewUser(db, "activityEditor", "activityEditor", dbfs.AccountTypeEndUser,
+		"activityEditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	auditor, err := dbfs.CreateNewUser(db, "activityAuditor", "activityAuditor", dbfs.AccountTypeEndUser,
+		"activityAuditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+
+	workFolder, err := rootFolder.CreateSubFolder(db, "activityFolder", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, workFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true},
+		&superUser, *editor))
+	otherFolder, err := rootFolder.CreateSubFolder(db, "activityOther", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	file, err := EXAMPLECreateFile(db, &superUser, "report.docx", workFolder.FileId)
+	assert.NoError(t, err)
+
+	t.Run("Recording activity", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(file.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Audit: true},
+			&superUser, *auditor))
+		Assert.NoError(EXAMPLEUpdateFile(db, file, "", editor))
+		_, err := file.CreateSharedLink(db, &superUser, "")
+		Assert.NoError(err)
+		Assert.NoError(file.Copy(db, otherFolder, &superUser, "ThisServer"))
+		Assert.NoError(file.Move(db, otherFolder, &superUser))
+		Assert.NoError(dbfs.RecordActivity(db, file.FileId, nil, dbfs.ActivityDownload, "shared link"))
+
+		activity, err := file.GetActivity(db, auditor, &dbfs.ActivityFilter{})
+		Assert.NoError(err)
+		var actions []string
+		for _, entry := range activity {
+			actions = append(actions, entry.Action)
+		}
+		Assert.Equal([]string{dbfs.ActivityDownload, dbfs.ActivityMove, dbfs.ActivityCopy,
+			dbfs.ActivityShare, dbfs.ActivityUpdate, dbfs.ActivityPermission}, actions)
+		Assert.Nil(activity[0].UserId)
+	})
+
+	t.Run("Filtering activity", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		activity, err := file.GetActivity(db, auditor, &dbfs.ActivityFilter{UserId: editor.UserId})
+		Assert.NoError(err)
+		Assert.Len(activity, 1)
+		Assert.Equal(dbfs.ActivityUpdate, activity[0].Action)
+
+		activity, err = file.GetActivity(db, auditor, &dbfs.ActivityFilter{Action: dbfs.ActivityPermission})
+		Assert.NoError(err)
+		Assert.Len(activity, 1)
+		Assert.Equal("user "+auditor.UserId+": read,share,audit", activity[0].Details)
+
+		activity, err = file.GetActivity(db, auditor, &dbfs.ActivityFilter{Limit: 2})
+		Assert.NoError(err)
+		Assert.Len(activity, 2)
+
+		_, err = file.GetActivity(db, auditor, &dbfs.ActivityFilter{Action: "read"})
+		Assert.ErrorIs(err, dbfs.ErrInvalidActivityFilter)
+	})
+
+	t.Run("Needs the audit permission", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := file.GetActivity(db, editor, &dbfs.ActivityFilter{})
+		Assert.ErrorIs(err, dbfs.ErrNoPermission)
+	})
+
+	t.Run("Keeping activity after deletion", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(file.Delete(db, &superUser, "ThisServer"))
+
+		var count int64
+		Assert.NoError(db.Model(&dbfs.FileActivity{}).
+			Where("file_id = ? AND action = ?", file.FileId, dbfs.ActivityDelete).Count(&count).Error)
+		Assert.Equal(int64(1), count)
+	})
+}
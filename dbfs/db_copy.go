@@ -0,0 +1,304 @@
+package dbfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	CopyStatusRunning = int8(1)
+	CopyStatusDone    = int8(2)
+	CopyStatusFailed  = int8(3)
+
+	// copyProgressInterval is the number of entries copied between updates
+	// of the progress of a copy operation
+	copyProgressInterval = 100
+)
+
+var (
+	ErrCopyIntoItself        = errors.New("cannot copy a folder into itself")
+	ErrCopyOperationNotFound = errors.New("copy operation not found")
+)
+
+// CopyOperation tracks a folder copy running in the background. The copy is
+// made entry by entry, so a failed operation leaves behind what was copied
+// before the error.
+type CopyOperation struct {
+	OperationId   string     `gorm:"primaryKey" json:"operation_id"`
+	UserId        string     `gorm:"not null; index" json:"user_id"`
+	SourceFileId  string     `gorm:"not null" json:"source_file_id"`
+	DestFolderId  string     `gorm:"not null" json:"dest_folder_id"`
+	FileName      string     `json:"file_name"`
+	NewFileId     *string    `json:"new_file_id"`
+	Status        int8       `gorm:"not null; index" json:"status"`
+	TotalEntries  int64      `json:"total_entries"`
+	CopiedEntries int64      `json:"copied_entries"`
+	Error         string     `json:"error,omitempty"`
+	HandledServer string     `json:"handled_server"`
+	StartTime     time.Time  `gorm:"not null" json:"start_time"`
+	EndTime       *time.Time `json:"end_time"`
+}
+
+// checkCopy checks that the user can copy the file into the new parent
+func (f *File) checkCopy(tx *gorm.DB, newParent *File, user *User) error {
+
+	// Checking that the user has read permissions on the file and the new parent folder
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrFileNotFound
+	}
+
+	hasPermissions, err = user.HasPermission(tx, newParent, &PermissionNeeded{Read: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrFileNotFound
+	}
+
+	if newParent.EntryType != IsFolder {
+		return ErrNotFolder
+	}
+
+	// Check that the user has write permissions on the new parent folder
+	hasPermissions, err = user.HasPermission(tx, newParent, &PermissionNeeded{Write: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrNoPermission
+	}
+
+	// A folder copied into its own tree would never stop growing
+	if f.EntryType == IsFolder {
+		inside, err := isInside(tx, newParent, f.FileId)
+		if err != nil {
+			return err
+		} else if inside {
+			return ErrCopyIntoItself
+		}
+	}
+
+	return nil
+}
+
+// isInside returns whether the file is the folder with the ID given, or is
+// somewhere inside it
+func isInside(tx *gorm.DB, file *File, folderId string) (bool, error) {
+	current := file
+	for current.FileId != folderId {
+		if current.ParentFolderFileId == nil {
+			return false, nil
+		}
+
+		var parent File
+		err := tx.Where("file_id = ?", *current.ParentFolderFileId).First(&parent).Error
+		if err != nil {
+			return false, err
+		}
+		current = &parent
+	}
+	return true, nil
+}
+
+// copyContents copies the contents of the folder src that the user can read
+// into dst, recursively. copied is called after each entry is copied, if it
+// is set.
+func copyContents(tx *gorm.DB, src, dst *File, user *User, server string, copied func() error) error {
+
+	var children []File
+	err := tx.Where("parent_folder_file_id = ? AND trash_id IS NULL", src.FileId).Find(&children).Error
+	if err != nil {
+		return err
+	}
+
+	for i := range children {
+		child := &children[i]
+		hasPermissions, err := user.HasPermission(tx, child, &PermissionNeeded{Read: true})
+		if err != nil {
+			return err
+		} else if !hasPermissions {
+			continue
+		}
+
+		newChild, err := child.copyEntry(tx, dst, child.FileName, user, server)
+		if err != nil {
+			return err
+		}
+		if copied != nil {
+			if err := copied(); err != nil {
+				return err
+			}
+		}
+
+		if child.EntryType == IsFolder {
+			if err := copyContents(tx, child, newChild, user, server, copied); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// countContents returns the number of entries in the folder that the user can
+// read, recursively
+func countContents(tx *gorm.DB, folder *File, user *User) (int64, error) {
+
+	var children []File
+	err := tx.Where("parent_folder_file_id = ? AND trash_id IS NULL", folder.FileId).Find(&children).Error
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	for i := range children {
+		hasPermissions, err := user.HasPermission(tx, &children[i], &PermissionNeeded{Read: true})
+		if err != nil {
+			return 0, err
+		} else if !hasPermissions {
+			continue
+		}
+
+		count++
+		if children[i].EntryType == IsFolder {
+			n, err := countContents(tx, &children[i], user)
+			if err != nil {
+				return 0, err
+			}
+			count += n
+		}
+	}
+
+	return count, nil
+}
+
+// StartCopy checks that the user can copy the file into the new parent, and
+// records a copy operation for it. The copy itself is made by Run.
+func (f *File) StartCopy(tx *gorm.DB, newParent *File, newName string, user *User, server string) (*CopyOperation, error) {
+
+	if err := f.checkCopy(tx, newParent, user); err != nil {
+		return nil, err
+	}
+
+	op := &CopyOperation{
+		OperationId:   uuid.New().String(),
+		UserId:        user.UserId,
+		SourceFileId:  f.FileId,
+		DestFolderId:  newParent.FileId,
+		FileName:      newName,
+		Status:        CopyStatusRunning,
+		HandledServer: server,
+		StartTime:     time.Now(),
+	}
+	if err := tx.Create(op).Error; err != nil {
+		return nil, err
+	}
+
+	return op, nil
+}
+
+// Run makes the copy of a copy operation started by StartCopy, updating its
+// progress as it goes. Each entry is copied in its own transaction, so that
+// large trees can be copied. The error that stopped the copy, if any, is
+// recorded in the operation as well as returned.
+func (op *CopyOperation) Run(tx *gorm.DB, user *User) error {
+
+	copyErr := op.run(tx, user)
+
+	now := time.Now()
+	op.EndTime = &now
+	op.Status = CopyStatusDone
+	if copyErr != nil {
+		op.Status = CopyStatusFailed
+		op.Error = copyErr.Error()
+	}
+
+	if err := tx.Save(op).Error; err != nil {
+		return err
+	}
+	return copyErr
+}
+
+func (op *CopyOperation) run(tx *gorm.DB, user *User) error {
+
+	source, err := GetFileById(tx, op.SourceFileId, user)
+	if err != nil {
+		return err
+	}
+	dest, err := GetFileById(tx, op.DestFolderId, user)
+	if err != nil {
+		return err
+	}
+
+	// Things might have changed since the copy was started
+	if err := source.checkCopy(tx, dest, user); err != nil {
+		return err
+	}
+
+	op.TotalEntries = 1
+	if source.EntryType == IsFolder {
+		n, err := countContents(tx, source, user)
+		if err != nil {
+			return err
+		}
+		op.TotalEntries += n
+	}
+	if err := tx.Save(op).Error; err != nil {
+		return err
+	}
+
+	newFile, err := source.copyEntry(tx, dest, op.FileName, user, op.HandledServer)
+	if err != nil {
+		return err
+	}
+	op.NewFileId = &newFile.FileId
+	op.CopiedEntries = 1
+	if err := tx.Save(op).Error; err != nil {
+		return err
+	}
+
+	if source.EntryType != IsFolder {
+		return nil
+	}
+	return copyContents(tx, source, newFile, user, op.HandledServer, func() error {
+		op.CopiedEntries++
+		if op.CopiedEntries%copyProgressInterval != 0 {
+			return nil
+		}
+		return tx.Model(op).Update("copied_entries", op.CopiedEntries).Error
+	})
+}
+
+// GetCopyOperation returns the copy operation with the ID given. Users can
+// only see their own operations, unless they are an admin.
+func GetCopyOperation(tx *gorm.DB, operationId string, user *User) (*CopyOperation, error) {
+	var op CopyOperation
+	err := tx.Where("operation_id = ?", operationId).First(&op).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrCopyOperationNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	if op.UserId != user.UserId && user.AccountType != AccountTypeAdmin {
+		return nil, ErrCopyOperationNotFound
+	}
+	return &op, nil
+}
+
+// FailInterruptedCopies marks the copy operations that were running on the
+// server as failed. It is meant to be called when the server starts, as
+// nothing is running them anymore.
+func FailInterruptedCopies(tx *gorm.DB, server string) error {
+	return tx.Model(&CopyOperation{}).
+		Where("handled_server = ? AND status = ?", server, CopyStatusRunning).
+		Updates(map[string]interface{}{
+			"status":   CopyStatusFailed,
+			"error":    "interrupted by a server restart",
+			"end_time": time.Now(),
+		}).Error
+}
@@ -0,0 +1,123 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFolderCopy(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	reviewer, err := dbfs.CreateNewUser(db, "copyReviewer", "copyReviewer", dbfs.AccountTypeEndUser,
+		"copyReviewer", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	auditor, err := dbfs.CreateNewUser(db, "copyAuditor", "copyAuditor", dbfs.AccountTypeEndUser,
+		"copyAuditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+
+	// project
+	// ├── plan.txt
+	// └── drafts
+	//     ├── draft.txt
+	//     └── old
+	project, err := rootFolder.CreateSubFolder(db, "copyProject", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, project.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, &superUser, *reviewer))
+	drafts, err := project.CreateSubFolder(db, "drafts", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	old, err := drafts.CreateSubFolder(db, "old", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	plan, err := EXAMPLECreateFile(db, &superUser, "plan.txt", project.FileId)
+	assert.NoError(t, err)
+	_, err = EXAMPLECreateFile(db, &superUser, "draft.txt", drafts.FileId)
+	assert.NoError(t, err)
+
+	// The copies go into a folder shared with someone else
+	backups, err := rootFolder.CreateSubFolder(db, "copyBackups", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, backups.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, &superUser, *auditor))
+
+	t.Run("Copying a folder into itself", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := project.CopyAs(db, project, "loop", &superUser, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrCopyIntoItself)
+		_, err = project.StartCopy(db, old, "loop", &superUser, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrCopyIntoItself)
+		_, err = project.StartCopy(db, plan, "loop", &superUser, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrNotFolder)
+		_, err = project.StartCopy(db, backups, "loop", reviewer, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+	})
+
+	t.Run("Copying in the background", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		op, err := project.StartCopy(db, backups, "project copy", &superUser, "ThisServer")
+		Assert.NoError(err)
+		Assert.Equal(dbfs.CopyStatusRunning, op.Status)
+		Assert.NoError(op.Run(db, &superUser))
+
+		op, err = dbfs.GetCopyOperation(db, op.OperationId, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(dbfs.CopyStatusDone, op.Status)
+		Assert.Equal(int64(5), op.TotalEntries)
+		Assert.Equal(int64(5), op.CopiedEntries)
+		Assert.NotNil(op.EndTime)
+		Assert.NotNil(op.NewFileId)
+
+		// Only the user who started it can see it
+		_, err = dbfs.GetCopyOperation(db, op.OperationId, reviewer)
+		Assert.ErrorIs(err, dbfs.ErrCopyOperationNotFound)
+
+		copied, err := dbfs.GetFileById(db, *op.NewFileId, &superUser)
+		Assert.NoError(err)
+		Assert.Equal("project copy", copied.FileName)
+		files, err := copied.ListContents(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(files, 2)
+
+		for _, file := range files {
+			if file.FileName == "plan.txt" {
+				// The data is shared with the original
+				Assert.Equal(plan.DataId, file.DataId)
+			} else {
+				Assert.Equal("drafts", file.FileName)
+				inner, err := file.ListContents(db, &superUser)
+				Assert.NoError(err)
+				Assert.Len(inner, 2)
+			}
+		}
+
+		// The copy has the permissions of where it was copied to
+		_, err = dbfs.GetFileById(db, copied.FileId, auditor)
+		Assert.NoError(err)
+		_, err = dbfs.GetFileById(db, copied.FileId, reviewer)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+	})
+
+	t.Run("Interrupted copies", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		op, err := drafts.StartCopy(db, backups, "drafts copy", &superUser, "ThisServer")
+		Assert.NoError(err)
+		Assert.NoError(dbfs.FailInterruptedCopies(db, "ThisServer"))
+
+		op, err = dbfs.GetCopyOperation(db, op.OperationId, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(dbfs.CopyStatusFailed, op.Status)
+		Assert.NotEmpty(op.Error)
+	})
+}
@@ -50,10 +50,6 @@ func GetToBeDeletedFragments(tx *gorm.DB) ([]Fragment, error) {
 		return nil, err
 	}
 
-	if len(fileVersions) == 0 {
-		return fragments, nil
-	}
-
 	// Get Fragments that are marked as to be deleted
 
 	dataIdSeen := util.NewSet[string]()
@@ -106,9 +102,23 @@ func GetToBeDeletedFragments(tx *gorm.DB) ([]Fragment, error) {
 
 		fragments = append(fragments, tempFragments...)
 
+		// The thumbnails of the data go along with it
+		thumbnailFragments, err3 := getThumbnailFragments(tx, fileVersion.DataId)
+		if err3 != nil {
+			return nil, err3
+		}
+		fragments = append(fragments, thumbnailFragments...)
+
 		dataIdSeen.Add(fileVersion.DataId)
 	}
 
+	// Data that was replaced by a patch
+	supersededFragments, err := getSupersededFragments(tx)
+	if err != nil {
+		return nil, err
+	}
+	fragments = append(fragments, supersededFragments...)
+
 	return fragments, err
 }
 
@@ -120,6 +130,18 @@ func FinishDeleteDataId(tx *gorm.DB, dataId string) error {
 		return err
 	}
 
+	// The dataId might be the one of a thumbnail
+	err = tx.Where("thumbnail_data_id = ?", dataId).Delete(&Thumbnail{}).Error
+	if err != nil {
+		return err
+	}
+
+	// or data that was replaced by a patch
+	err = tx.Where("data_id = ?", dataId).Delete(&SupersededData{}).Error
+	if err != nil {
+		return err
+	}
+
 	// In that case, deleting a folder should just go ahead and delete everything else as well.
 	return tx.Model(&FileVersion{}).Where("data_id = ?", dataId).Update("status", FileStatusDeleted).Error
 }
@@ -163,8 +185,15 @@ func MarkOldFileVersions(tx *gorm.DB) (int64, error) {
 }
 
 func ClearFileStatusDeletedEntries(tx *gorm.DB) error {
-	return tx.Model(&FileVersion{}).Where("status = ? AND modified_time < ?", FileStatusDeleted,
+	err := tx.Model(&FileVersion{}).Where("status = ? AND modified_time < ?", FileStatusDeleted,
 		time.Now()).Delete(&FileVersion{}).Error
+	if err != nil {
+		return err
+	}
+
+	// Tags kept for the versions that were just removed
+	return tx.Where("NOT EXISTS (SELECT 1 FROM file_versions WHERE file_versions.file_id = file_version_tags.file_id " +
+		"AND file_versions.version_no = file_version_tags.version_no)").Delete(&FileVersionTag{}).Error
 }
 
 // createCronJobKeyValues creates the parameters for the cron
@@ -175,6 +204,7 @@ func createCronJobKeyValues(tx *gorm.DB) error {
 		CronJobDeleteFragmentsLastStart,
 		CronJobDeleteFragmentsLastEnd,
 		CronJobDeleteKeepVersionsFor,
+		CronJobTrashRetentionDays,
 	}
 
 	return tx.Transaction(func(tx *gorm.DB) error {
@@ -0,0 +1,164 @@
+package dbfs
+
+import (
+	"errors"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Key: DedupEnabled
+// Value (int): 1 if newly written data is deduplicated against the data that
+// is already stored in the cluster.
+const DedupEnabled = "DedupEnabled"
+
+// maxDedupCandidates is how many files with the same checksum are tried as
+// the source of the data.
+const maxDedupCandidates = 10
+
+// Deduplication works on the plaintext checksum of whole files. Once a file
+// has been written, if another file already holds identical data, the file is
+// pointed at that data instead and its own copy is dropped by the fragment
+// deletion job, like data superseded by a patch.
+//
+// Each file still has its own key: the key of the shared data is recovered
+// through the file that holds it, and wrapped again with the key of the new
+// file. This only works for files without a password on either side, as the
+// key of a password protected file cannot be recovered (or should not be
+// shared). Such files are never deduplicated.
+//
+// Shared data is recorded in DataCopies, so that it is only deleted once no
+// version of any file uses it anymore.
+
+// GetDedupEnabled returns whether newly written data is deduplicated
+func GetDedupEnabled(tx *gorm.DB) (bool, error) {
+	var pair KeyValueDBPair
+	err := tx.First(&pair, "key = ?", DedupEnabled).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return pair.ValueInt == 1, nil
+}
+
+// SetDedupEnabled sets whether newly written data is deduplicated
+func SetDedupEnabled(tx *gorm.DB, enabled bool) error {
+	pair := KeyValueDBPair{Key: DedupEnabled}
+	if enabled {
+		pair.ValueInt = 1
+	}
+	return tx.Save(&pair).Error
+}
+
+// deduplicate points the file that was just written, and its current version,
+// at identical data that is already stored, if deduplication is enabled and
+// there is any.
+func deduplicate(tx *gorm.DB, f *File) error {
+	if f.EntryType != IsFile || f.Checksum == "" || f.Size == 0 {
+		return nil
+	}
+
+	enabled, err := GetDedupEnabled(tx)
+	if err != nil || !enabled {
+		return err
+	}
+
+	var passwordProtect PasswordProtect
+	err = tx.Where("file_id = ?", f.FileId).First(&passwordProtect).Error
+	if err != nil {
+		return err
+	}
+	if passwordProtect.PasswordActive {
+		return nil
+	}
+
+	source, dataKey, dataIv, err := findDedupSource(tx, f)
+	if err != nil || source == nil {
+		return err
+	}
+
+	// Wrapping the key of the data with the key of the file
+	encryptionKey, err := EncryptWithKeyIV(dataKey, passwordProtect.FileKey, passwordProtect.FileIv)
+	if err != nil {
+		return err
+	}
+	encryptionIv, err := EncryptWithKeyIV(dataIv, passwordProtect.FileKey, passwordProtect.FileIv)
+	if err != nil {
+		return err
+	}
+
+	// The data written for the file is dropped
+	if err := supersedeData(tx, f.DataId, f.FileId); err != nil {
+		return err
+	}
+
+	f.DataId = source.DataId
+	f.EncryptionKey = encryptionKey
+	f.EncryptionIv = encryptionIv
+	f.TotalShards = source.TotalShards
+	f.DataShards = source.DataShards
+	f.ParityShards = source.ParityShards
+	f.KeyThreshold = source.KeyThreshold
+	if err := tx.Save(f).Error; err != nil {
+		return err
+	}
+
+	err = tx.Model(&FileVersion{}).Where("file_id = ? AND version_no = ?", f.FileId, f.VersionNo).
+		Updates(map[string]interface{}{
+			"data_id":        f.DataId,
+			"encryption_key": f.EncryptionKey,
+			"encryption_iv":  f.EncryptionIv,
+			"total_shards":   f.TotalShards,
+			"data_shards":    f.DataShards,
+			"parity_shards":  f.ParityShards,
+			"key_threshold":  f.KeyThreshold,
+		}).Error
+	if err != nil {
+		return err
+	}
+
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Save(&DataCopies{DataId: f.DataId}).Error
+}
+
+// findDedupSource returns a file holding the same data as the file given,
+// along with the plain key and iv of its data. It returns nil if there is
+// none whose key can be recovered.
+func findDedupSource(tx *gorm.DB, f *File) (*File, string, string, error) {
+	var candidates []File
+	err := tx.Where("checksum = ? AND size = ? AND entry_type = ? AND status = ? AND data_id <> ? "+
+		"AND data_id NOT IN (?)",
+		f.Checksum, f.Size, IsFile, FileStatusGood, f.DataId,
+		tx.Model(&SupersededData{}).Select("data_id")).
+		Order("created_time").Limit(maxDedupCandidates).Find(&candidates).Error
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	for i := range candidates {
+		candidate := &candidates[i]
+
+		var passwordProtect PasswordProtect
+		err := tx.Where("file_id = ?", candidate.FileId).First(&passwordProtect).Error
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return nil, "", "", err
+		}
+		if passwordProtect.PasswordActive {
+			continue
+		}
+
+		dataKey, err := DecryptWithKeyIV(candidate.EncryptionKey, passwordProtect.FileKey, passwordProtect.FileIv)
+		if err != nil {
+			continue
+		}
+		dataIv, err := DecryptWithKeyIV(candidate.EncryptionIv, passwordProtect.FileKey, passwordProtect.FileIv)
+		if err != nil {
+			continue
+		}
+		return candidate, dataKey, dataIv, nil
+	}
+
+	return nil, "", "", nil
+}
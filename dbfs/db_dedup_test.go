@@ -0,0 +1,167 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedup(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// The example files all have the same checksum and size
+	original, err := EXAMPLECreateFile(db, &superUser, "original.iso", rootFolder.FileId)
+	assert.NoError(t, err)
+
+	var duplicate *dbfs.File
+
+	t.Run("Disabled by default", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		enabled, err := dbfs.GetDedupEnabled(db)
+		Assert.NoError(err)
+		Assert.False(enabled)
+
+		other, err := EXAMPLECreateFile(db, &superUser, "other.iso", rootFolder.FileId)
+		Assert.NoError(err)
+		Assert.NotEqual(original.DataId, other.DataId)
+	})
+
+	t.Run("Sharing identical data", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(dbfs.SetDedupEnabled(db, true))
+
+		duplicate, err = EXAMPLECreateFile(db, &superUser, "duplicate.iso", rootFolder.FileId)
+		Assert.NoError(err)
+		Assert.Equal(original.DataId, duplicate.DataId)
+
+		// The file can still decrypt the data with its own key
+		originalKey, originalIv, err := original.GetDecryptionKey(db, &superUser, "")
+		Assert.NoError(err)
+		key, iv, err := duplicate.GetDecryptionKey(db, &superUser, "")
+		Assert.NoError(err)
+		Assert.Equal(originalKey, key)
+		Assert.Equal(originalIv, iv)
+		Assert.NotEqual(original.EncryptionKey, duplicate.EncryptionKey)
+
+		version, err := duplicate.GetOldVersion(db, &superUser, duplicate.VersionNo)
+		Assert.NoError(err)
+		Assert.Equal(original.DataId, version.DataId)
+		Assert.Equal("checksum", version.Checksum)
+
+		var copies int64
+		Assert.NoError(db.Model(&dbfs.DataCopies{}).Where("data_id = ?", original.DataId).Count(&copies).Error)
+		Assert.Equal(int64(1), copies)
+	})
+
+	t.Run("Dropping the duplicate shards", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		var superseded dbfs.SupersededData
+		Assert.NoError(db.First(&superseded, "file_id = ?", duplicate.FileId).Error)
+
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+		for _, fragment := range fragments {
+			Assert.Equal(superseded.DataId, fragment.FileVersionDataId)
+		}
+		Assert.NoError(dbfs.FinishDeleteDataId(db, superseded.DataId))
+	})
+
+	t.Run("Keeping shared data", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		// Still used by the duplicate
+		Assert.NoError(original.Delete(db, &superUser, "ThisServer"))
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Empty(fragments)
+
+		Assert.NoError(duplicate.Delete(db, &superUser, "ThisServer"))
+		fragments, err = dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+		for _, fragment := range fragments {
+			Assert.Equal(duplicate.DataId, fragment.FileVersionDataId)
+		}
+	})
+}
+
+func TestDedupPatches(t *testing.T) {
+	Assert := assert.New(t)
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+	Assert.NoError(db.Where("email = ?", "superuser").First(&superUser).Error)
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+
+	Assert.NoError(dbfs.SetDedupEnabled(db, true))
+	original, err := EXAMPLECreateFile(db, &superUser, "original.iso", rootFolder.FileId)
+	Assert.NoError(err)
+	duplicate, err := EXAMPLECreateFile(db, &superUser, "duplicate.iso", rootFolder.FileId)
+	Assert.NoError(err)
+	Assert.Equal(original.DataId, duplicate.DataId)
+	shared := original.DataId
+
+	// The data written for the duplicate is already dropped
+	var dropped dbfs.SupersededData
+	Assert.NoError(db.First(&dropped, "file_id = ?", duplicate.FileId).Error)
+	Assert.NoError(dbfs.FinishDeleteDataId(db, dropped.DataId))
+
+	// Both files replace the shared data with a patch of their own
+	Assert.NoError(dbfs.SetDedupEnabled(db, false))
+	for i, file := range []*dbfs.File{original, duplicate} {
+		Assert.NoError(file.UpdateMetaData(db, dbfs.FileMetadataModification{
+			FileName: file.FileName, MIMEType: file.MIMEType, VersioningMode: dbfs.VersioningOnDeltas,
+		}, &superUser))
+		version, err := file.GetOldVersion(db, &superUser, file.VersionNo)
+		Assert.NoError(err)
+		Assert.NoError(EXAMPLEUpdateFile(db, file, "", &superUser))
+
+		dataKey, dataIv, err := dbfs.GenerateKeyIV()
+		Assert.NoError(err)
+		patch := &dbfs.File{
+			DataId:       "dedup-patch" + string(rune('0'+i)),
+			TotalShards:  ExampleTotalShards,
+			DataShards:   file.DataShards,
+			ParityShards: file.ParityShards,
+			KeyThreshold: file.KeyThreshold,
+		}
+		servers := make([]string, ExampleTotalShards)
+		paths := make([]string, ExampleTotalShards)
+		for j := range servers {
+			servers[j] = "ThisServer"
+			paths[j] = patch.DataId + ".shard" + string(rune('0'+j))
+		}
+		Assert.NoError(file.StorePatch(db, version, patch, dataKey, dataIv, "", servers, paths))
+	}
+
+	var count int64
+	Assert.NoError(db.Model(&dbfs.SupersededData{}).Where("data_id = ?", shared).Count(&count).Error)
+	Assert.Equal(int64(2), count)
+
+	// The shared data is deleted once
+	fragments, err := dbfs.GetToBeDeletedFragments(db)
+	Assert.NoError(err)
+	Assert.Len(fragments, ExampleTotalShards)
+	for _, fragment := range fragments {
+		Assert.Equal(shared, fragment.FileVersionDataId)
+	}
+	Assert.NoError(dbfs.FinishDeleteDataId(db, shared))
+	Assert.NoError(db.Model(&dbfs.SupersededData{}).Count(&count).Error)
+	Assert.Zero(count)
+}
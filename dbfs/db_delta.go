@@ -0,0 +1,328 @@
+package dbfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/OhanaFS/ohana/util"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Key: DeltaSnapshotInterval
+// Value (int): Every how many data versions of a file with VersioningOnDeltas
+// are kept whole instead of being stored as a patch. Defaults to
+// DefaultDeltaSnapshotInterval if not set.
+const (
+	DeltaSnapshotInterval        = "DeltaSnapshotInterval"
+	DefaultDeltaSnapshotInterval = 10
+)
+
+var (
+	ErrVersionIsPatch     = errors.New("version is stored as a patch and has to be rebuilt")
+	ErrVersionIsPatchBase = errors.New("other versions of the file are stored as patches against this version")
+	ErrPatchBaseChanged   = errors.New("file was updated again while the patch was being written")
+	ErrInvalidInterval    = errors.New("snapshot interval must be at least 1")
+)
+
+// Versions of files with VersioningOnDeltas are stored as reverse deltas: the
+// current data of the file is always kept whole, and once it is replaced, the
+// data of the previous versions is rewritten as a patch that rebuilds it from
+// the new data (its PatchBaseVersion). Reading an old version walks the chain
+// of patches up to the first version that is stored whole.
+//
+// Every DeltaSnapshotInterval data versions, the old data is kept whole, so
+// that the chains stay short.
+
+// SupersededData is data that was replaced by a patch (or by identical data
+// that was already stored), and is deleted along with the other fragments to
+// be deleted once no version uses it anymore. Deduplicated data is shared by
+// several files, so it can be superseded once for each of them.
+type SupersededData struct {
+	DataId         string    `gorm:"primaryKey"`
+	FileId         string    `gorm:"primaryKey"`
+	SupersededTime time.Time `gorm:"not null"`
+}
+
+// supersedeData records that the file no longer uses the data given
+func supersedeData(tx *gorm.DB, dataId, fileId string) error {
+	return tx.Clauses(clause.OnConflict{DoNothing: true}).Create(&SupersededData{
+		DataId:         dataId,
+		FileId:         fileId,
+		SupersededTime: time.Now(),
+	}).Error
+}
+
+// GetDeltaSnapshotInterval returns every how many data versions one is kept
+// whole.
+func GetDeltaSnapshotInterval(tx *gorm.DB) (int, error) {
+	var interval KeyValueDBPair
+	err := tx.First(&interval, "key = ?", DeltaSnapshotInterval).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	if interval.ValueInt <= 0 {
+		return DefaultDeltaSnapshotInterval, nil
+	}
+	return interval.ValueInt, nil
+}
+
+// SetDeltaSnapshotInterval sets every how many data versions one is kept whole
+func SetDeltaSnapshotInterval(tx *gorm.DB, interval int) error {
+	if interval < 1 {
+		return ErrInvalidInterval
+	}
+	return tx.Save(&KeyValueDBPair{Key: DeltaSnapshotInterval, ValueInt: interval}).Error
+}
+
+// GetPatchCandidate returns the version holding the data that the current data
+// of the file replaced, if it should now be stored as a patch against the
+// current version. It returns nil if there is nothing to convert: the file is
+// not versioned with deltas, the data was not replaced, or it is a snapshot.
+func (f *File) GetPatchCandidate(tx *gorm.DB) (*FileVersion, error) {
+	if f.VersioningMode != VersioningOnDeltas || f.EntryType != IsFile || f.Status != FileStatusGood {
+		return nil, nil
+	}
+
+	var previous FileVersion
+	err := tx.Where("file_id = ? AND version_no < ? AND data_id <> ? AND status = ?",
+		f.FileId, f.VersionNo, f.DataId, FileStatusGood).
+		Order("version_no DESC").First(&previous).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if previous.Patch {
+		return nil, nil
+	}
+
+	interval, err := GetDeltaSnapshotInterval(tx)
+	if err != nil {
+		return nil, err
+	}
+	if previous.DataIdVersion%interval == 0 {
+		return nil, nil
+	}
+
+	return &previous, nil
+}
+
+// StorePatch replaces the data of the version given (and of every other
+// version of the file sharing it) with a patch that rebuilds it from the
+// current version of the file.
+// dataKey and dataIv are the plain key and iv that the patch was encrypted
+// with, patch holds its data id and shard layout, and servers and shardPaths
+// hold the location of each of its shards.
+func (f *File) StorePatch(tx *gorm.DB, version *FileVersion, patch *File,
+	dataKey, dataIv, password string, servers, shardPaths []string) error {
+
+	fileKey, fileIv, err := f.getFileKey(tx, password)
+	if err != nil {
+		return err
+	}
+	dataKey, err = EncryptWithKeyIV(dataKey, fileKey, fileIv)
+	if err != nil {
+		return err
+	}
+	dataIv, err = EncryptWithKeyIV(dataIv, fileKey, fileIv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		// The current data must still be the one that the patch is against
+		var current File
+		if err := tx.Select("version_no", "data_id").First(&current, "file_id = ?", f.FileId).Error; err != nil {
+			return err
+		}
+		if current.DataId != f.DataId {
+			return ErrPatchBaseChanged
+		}
+
+		if err := createDataFragments(tx, f.FileId, version.VersionNo, patch, servers, shardPaths); err != nil {
+			return err
+		}
+
+		err := tx.Model(&FileVersion{}).
+			Where("file_id = ? AND data_id = ? AND status = ?", f.FileId, version.DataId, FileStatusGood).
+			Updates(map[string]interface{}{
+				"data_id":            patch.DataId,
+				"patch":              true,
+				"patch_base_version": f.VersionNo,
+				"encryption_key":     dataKey,
+				"encryption_iv":      dataIv,
+				"total_shards":       patch.TotalShards,
+				"data_shards":        patch.DataShards,
+				"parity_shards":      patch.ParityShards,
+				"key_threshold":      patch.KeyThreshold,
+			}).Error
+		if err != nil {
+			return err
+		}
+
+		return supersedeData(tx, version.DataId, f.FileId)
+	})
+}
+
+// StoreRebuiltVersion replaces the patch of the version given (and of every
+// other version of the file sharing it) with the data it rebuilds to, so that
+// it can be used without its base version, such as when reverting to it.
+// The arguments are the same as for StorePatch, with rebuilt holding the data
+// id and shard layout of the rebuilt data.
+func (f *File) StoreRebuiltVersion(tx *gorm.DB, version *FileVersion, rebuilt *File,
+	dataKey, dataIv, password string, servers, shardPaths []string) error {
+
+	fileKey, fileIv, err := f.getFileKey(tx, password)
+	if err != nil {
+		return err
+	}
+	dataKey, err = EncryptWithKeyIV(dataKey, fileKey, fileIv)
+	if err != nil {
+		return err
+	}
+	dataIv, err = EncryptWithKeyIV(dataIv, fileKey, fileIv)
+	if err != nil {
+		return err
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := createDataFragments(tx, f.FileId, version.VersionNo, rebuilt, servers, shardPaths); err != nil {
+			return err
+		}
+
+		result := tx.Model(&FileVersion{}).
+			Where("file_id = ? AND data_id = ? AND patch = ? AND status = ?",
+				f.FileId, version.DataId, true, FileStatusGood).
+			Updates(map[string]interface{}{
+				"data_id":            rebuilt.DataId,
+				"patch":              false,
+				"patch_base_version": 0,
+				"encryption_key":     dataKey,
+				"encryption_iv":      dataIv,
+				"total_shards":       rebuilt.TotalShards,
+				"data_shards":        rebuilt.DataShards,
+				"parity_shards":      rebuilt.ParityShards,
+				"key_threshold":      rebuilt.KeyThreshold,
+			})
+		if result.Error != nil {
+			return result.Error
+		} else if result.RowsAffected == 0 {
+			// The version was deleted or rebuilt in the meantime
+			return ErrVersionNotFound
+		}
+
+		return supersedeData(tx, version.DataId, f.FileId)
+	})
+}
+
+// DiscardData records the shards written for data that could not be stored,
+// such as a patch for data that has changed since, so that they are deleted
+// along with the other superseded data. The arguments are the same as for
+// StorePatch.
+func (f *File) DiscardData(tx *gorm.DB, version *FileVersion, data *File, servers, shardPaths []string) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := createDataFragments(tx, f.FileId, version.VersionNo, data, servers, shardPaths); err != nil {
+			return err
+		}
+		return supersedeData(tx, data.DataId, f.FileId)
+	})
+}
+
+// createDataFragments records the shards of the data given as the fragments
+// of a version of the file.
+func createDataFragments(tx *gorm.DB, fileId string, versionNo int, data *File,
+	servers, shardPaths []string) error {
+
+	for i := range shardPaths {
+		fragment := Fragment{
+			FileVersionFileId:    fileId,
+			FileVersionDataId:    data.DataId,
+			FileVersionVersionNo: versionNo,
+			FragId:               i + 1,
+			ServerName:           servers[i],
+			FileFragmentPath:     shardPaths[i],
+			LastChecked:          time.Now(),
+			TotalShards:          data.TotalShards,
+			Status:               FragmentStatusGood,
+		}
+		if err := tx.Create(&fragment).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// getFileKey returns the key and iv that the data keys of the file are
+// encrypted with.
+func (f *File) getFileKey(tx *gorm.DB, password string) (string, string, error) {
+	var passwordProtect PasswordProtect
+	err := tx.Model(&PasswordProtect{}).Where("file_id = ?", f.FileId).First(&passwordProtect).Error
+	if err != nil {
+		return "", "", err
+	}
+
+	if !passwordProtect.PasswordActive {
+		return passwordProtect.FileKey, passwordProtect.FileIv, nil
+	} else if password == "" {
+		return "", "", ErrPasswordRequired
+	}
+	return passwordProtect.DecryptWithPassword(password)
+}
+
+// isPatchBase returns whether other versions of the file are stored as
+// patches against the data of the version given.
+func (f *File) isPatchBase(tx *gorm.DB, version *FileVersion) (bool, error) {
+	var count int64
+	err := tx.Model(&FileVersion{}).
+		Where("file_id = ? AND patch = ? AND status = ? AND patch_base_version IN (?)",
+			f.FileId, true, FileStatusGood,
+			tx.Model(&FileVersion{}).Select("version_no").
+				Where("file_id = ? AND data_id = ?", f.FileId, version.DataId)).
+		Count(&count).Error
+	return count > 0, err
+}
+
+// getSupersededFragments returns the fragments of the data replaced by patches
+// that is not used by any version anymore, along with their thumbnails.
+// Superseded data without fragments left is forgotten.
+func getSupersededFragments(tx *gorm.DB) ([]Fragment, error) {
+	var superseded []SupersededData
+	err := tx.Where("data_id NOT IN (?) AND data_id NOT IN (?)",
+		tx.Model(&FileVersion{}).Select("data_id").
+			Where("status NOT IN ?", []int8{FileStatusToBeDeleted, FileStatusDeleted}),
+		tx.Model(&File{}).Select("data_id").Where("entry_type = ?", IsFile)).
+		Find(&superseded).Error
+	if err != nil {
+		return nil, err
+	}
+
+	var fragments []Fragment
+	dataIdSeen := util.NewSet[string]()
+	for _, data := range superseded {
+		if dataIdSeen.Has(data.DataId) {
+			continue
+		}
+		dataIdSeen.Add(data.DataId)
+
+		var dataFragments []Fragment
+		err := tx.Where("file_version_data_id = ?", data.DataId).Find(&dataFragments).Error
+		if err != nil {
+			return nil, err
+		}
+		if len(dataFragments) == 0 {
+			if err := tx.Where("data_id = ?", data.DataId).Delete(&SupersededData{}).Error; err != nil {
+				return nil, err
+			}
+			continue
+		}
+		fragments = append(fragments, dataFragments...)
+
+		thumbnailFragments, err := getThumbnailFragments(tx, data.DataId)
+		if err != nil {
+			return nil, err
+		}
+		fragments = append(fragments, thumbnailFragments...)
+	}
+	return fragments, nil
+}
@@ -0,0 +1,227 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaVersions(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	file, err := EXAMPLECreateFile(db, &superUser, "delta.txt", rootFolder.FileId)
+	assert.NoError(t, err)
+	assert.NoError(t, file.UpdateMetaData(db, dbfs.FileMetadataModification{
+		FileName: file.FileName, MIMEType: file.MIMEType, VersioningMode: dbfs.VersioningOnDeltas,
+	}, &superUser))
+	assert.NoError(t, dbfs.SetDeltaSnapshotInterval(db, 3))
+
+	var patched *dbfs.FileVersion
+
+	t.Run("Picking the versions to patch", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		interval, err := dbfs.GetDeltaSnapshotInterval(db)
+		Assert.NoError(err)
+		Assert.Equal(3, interval)
+		Assert.ErrorIs(dbfs.SetDeltaSnapshotInterval(db, 0), dbfs.ErrInvalidInterval)
+
+		// Nothing was replaced yet
+		candidate, err := file.GetPatchCandidate(db)
+		Assert.NoError(err)
+		Assert.Nil(candidate)
+
+		// The data first uploaded is a snapshot
+		Assert.NoError(EXAMPLEUpdateFile(db, file, "", &superUser))
+		candidate, err = file.GetPatchCandidate(db)
+		Assert.NoError(err)
+		Assert.Nil(candidate)
+
+		replacedDataId := file.DataId
+		Assert.NoError(EXAMPLEUpdateFile(db, file, "", &superUser))
+		candidate, err = file.GetPatchCandidate(db)
+		Assert.NoError(err)
+		Assert.NotNil(candidate)
+		if candidate != nil {
+			Assert.Equal(replacedDataId, candidate.DataId)
+			Assert.False(candidate.Patch)
+		}
+		patched = candidate
+	})
+
+	t.Run("Storing a patch", func(t *testing.T) {
+		Assert := assert.New(t)
+		if patched == nil {
+			t.Skip("no version to patch")
+		}
+
+		dataKey, dataIv, err := dbfs.GenerateKeyIV()
+		Assert.NoError(err)
+		patch := &dbfs.File{
+			DataId:       "delta-patch",
+			TotalShards:  ExampleTotalShards,
+			DataShards:   file.DataShards,
+			ParityShards: file.ParityShards,
+			KeyThreshold: file.KeyThreshold,
+		}
+		servers := make([]string, ExampleTotalShards)
+		paths := make([]string, ExampleTotalShards)
+		for i := range servers {
+			servers[i] = "ThisServer"
+			paths[i] = "delta-patch.shard" + string(rune('0'+i))
+		}
+
+		// Not against data that is no longer current
+		stale := *file
+		stale.DataId = patched.DataId
+		Assert.ErrorIs(stale.StorePatch(db, patched, patch, dataKey, dataIv, "", servers, paths),
+			dbfs.ErrPatchBaseChanged)
+
+		Assert.NoError(file.StorePatch(db, patched, patch, dataKey, dataIv, "", servers, paths))
+
+		version, err := file.GetOldVersion(db, &superUser, patched.VersionNo)
+		Assert.NoError(err)
+		Assert.True(version.Patch)
+		Assert.Equal(file.VersionNo, version.PatchBaseVersion)
+		Assert.Equal(patch.DataId, version.DataId)
+
+		// The key of the patch can be read back
+		key, iv, err := version.GetDecryptionKey(db, &superUser, "")
+		Assert.NoError(err)
+		Assert.Equal(dataKey, key)
+		Assert.Equal(dataIv, iv)
+
+		fragments, err := version.GetFragments(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+
+		// It is only converted once
+		candidate, err := file.GetPatchCandidate(db)
+		Assert.NoError(err)
+		Assert.Nil(candidate)
+	})
+
+	t.Run("Protecting the patch chain", func(t *testing.T) {
+		Assert := assert.New(t)
+		if patched == nil {
+			t.Skip("no version to patch")
+		}
+
+		Assert.ErrorIs(file.DeleteFileVersion(db, &superUser, file.VersionNo), dbfs.ErrVersionIsPatchBase)
+		Assert.ErrorIs(file.RevertFileToVersion(db, patched.VersionNo, &superUser), dbfs.ErrVersionIsPatch)
+	})
+
+	t.Run("Deleting the replaced data", func(t *testing.T) {
+		Assert := assert.New(t)
+		if patched == nil {
+			t.Skip("no version to patch")
+		}
+
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+		for _, fragment := range fragments {
+			Assert.Equal(patched.DataId, fragment.FileVersionDataId)
+		}
+
+		Assert.NoError(dbfs.FinishDeleteDataId(db, patched.DataId))
+
+		fragments, err = dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Empty(fragments)
+
+		var count int64
+		Assert.NoError(db.Model(&dbfs.SupersededData{}).Count(&count).Error)
+		Assert.Zero(count)
+
+		// The patch itself is still there
+		version, err := file.GetOldVersion(db, &superUser, patched.VersionNo)
+		Assert.NoError(err)
+		Assert.Equal(dbfs.FileStatusGood, version.Status)
+	})
+
+	t.Run("Reverting to a rebuilt version", func(t *testing.T) {
+		Assert := assert.New(t)
+		if patched == nil {
+			t.Skip("no version to patch")
+		}
+
+		version, err := file.GetOldVersion(db, &superUser, patched.VersionNo)
+		Assert.NoError(err)
+		dataKey, dataIv, err := dbfs.GenerateKeyIV()
+		Assert.NoError(err)
+		rebuilt := &dbfs.File{
+			DataId:       "delta-rebuilt",
+			TotalShards:  ExampleTotalShards,
+			DataShards:   file.DataShards,
+			ParityShards: file.ParityShards,
+			KeyThreshold: file.KeyThreshold,
+		}
+		servers := make([]string, ExampleTotalShards)
+		paths := make([]string, ExampleTotalShards)
+		for i := range servers {
+			servers[i] = "ThisServer"
+			paths[i] = "delta-rebuilt.shard" + string(rune('0'+i))
+		}
+		Assert.NoError(file.StoreRebuiltVersion(db, version, rebuilt, dataKey, dataIv, "", servers, paths))
+
+		// Only once
+		Assert.ErrorIs(file.StoreRebuiltVersion(db, version, rebuilt, dataKey, dataIv, "", servers, paths),
+			dbfs.ErrVersionNotFound)
+
+		version, err = file.GetOldVersion(db, &superUser, patched.VersionNo)
+		Assert.NoError(err)
+		Assert.False(version.Patch)
+		Assert.Equal(rebuilt.DataId, version.DataId)
+		key, iv, err := version.GetDecryptionKey(db, &superUser, "")
+		Assert.NoError(err)
+		Assert.Equal(dataKey, key)
+		Assert.Equal(dataIv, iv)
+
+		Assert.NoError(file.RevertFileToVersion(db, patched.VersionNo, &superUser))
+		Assert.Equal(rebuilt.DataId, file.DataId)
+
+		// The patch is deleted along with the other replaced data
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+		for _, fragment := range fragments {
+			Assert.Equal("delta-patch", fragment.FileVersionDataId)
+		}
+	})
+
+	t.Run("Discarding data that could not be stored", func(t *testing.T) {
+		Assert := assert.New(t)
+		if patched == nil {
+			t.Skip("no version to patch")
+		}
+		Assert.NoError(dbfs.FinishDeleteDataId(db, "delta-patch"))
+
+		discarded := &dbfs.File{DataId: "delta-discarded", TotalShards: ExampleTotalShards}
+		servers := make([]string, ExampleTotalShards)
+		paths := make([]string, ExampleTotalShards)
+		for i := range servers {
+			servers[i] = "ThisServer"
+			paths[i] = "delta-discarded.shard" + string(rune('0'+i))
+		}
+		Assert.NoError(file.DiscardData(db, patched, discarded, servers, paths))
+
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Len(fragments, ExampleTotalShards)
+		for _, fragment := range fragments {
+			Assert.Equal(discarded.DataId, fragment.FileVersionDataId)
+		}
+	})
+}
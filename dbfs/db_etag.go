@@ -0,0 +1,52 @@
+package dbfs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+var (
+	ErrPreconditionFailed = errors.New("file was changed")
+)
+
+// etag returns a strong entity tag for the state of a file. The modified time
+// is kept to milliseconds, as databases store it with different precisions.
+func etag(fileId string, versionNo, dataIdVersion int, modifiedTime time.Time) string {
+	hash := sha256.Sum256([]byte(fileId + ":" + strconv.Itoa(versionNo) + ":" +
+		strconv.Itoa(dataIdVersion) + ":" + strconv.FormatInt(modifiedTime.UnixMilli(), 10)))
+	return `"` + hex.EncodeToString(hash[:16]) + `"`
+}
+
+// ETag returns a strong entity tag that changes whenever the file or its
+// metadata is changed
+func (f *File) ETag() string {
+	return etag(f.FileId, f.VersionNo, f.DataIdVersion, f.ModifiedTime)
+}
+
+// ETag returns a strong entity tag for this version of the file
+func (fv *FileVersion) ETag() string {
+	return etag(fv.FileId, fv.VersionNo, fv.DataIdVersion, fv.ModifiedTime)
+}
+
+// CheckUnchanged checks that the file is still in the state it was read in,
+// as tagged by ETag, and holds its row for the rest of the transaction so that
+// nobody else can change it in the meantime. It fails with
+// ErrPreconditionFailed if the file was changed since.
+func (f *File) CheckUnchanged(tx *gorm.DB) error {
+	result := tx.Model(&File{}).
+		Where("file_id = ? AND version_no = ? AND data_id_version = ? AND modified_time = ?",
+			f.FileId, f.VersionNo, f.DataIdVersion, f.ModifiedTime).
+		UpdateColumn("version_no", gorm.Expr("version_no"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
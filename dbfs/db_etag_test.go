@@ -0,0 +1,51 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestFileCheckUnchanged(t *testing.T) {
+	Assert := assert.New(t)
+	db := testutil.NewMockDB(t)
+
+	superUser, err := dbfs.GetUser(db, "superuser")
+	Assert.NoError(err)
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+	file, err := EXAMPLECreateFile(db, superUser, "unchanged.txt", rootFolder.FileId)
+	Assert.NoError(err)
+
+	first, err := dbfs.GetFileById(db, file.FileId, superUser)
+	Assert.NoError(err)
+	second, err := dbfs.GetFileById(db, file.FileId, superUser)
+	Assert.NoError(err)
+	Assert.Equal(first.ETag(), second.ETag())
+	Assert.NoError(first.CheckUnchanged(db))
+
+	// Both copies were read in the same state, only the first change passes
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := first.CheckUnchanged(tx); err != nil {
+			return err
+		}
+		return first.UpdateMetaData(tx, dbfs.FileMetadataModification{FileName: "first.txt"}, superUser)
+	})
+	Assert.NoError(err)
+
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if err := second.CheckUnchanged(tx); err != nil {
+			return err
+		}
+		return second.UpdateMetaData(tx, dbfs.FileMetadataModification{FileName: "second.txt"}, superUser)
+	})
+	Assert.ErrorIs(err, dbfs.ErrPreconditionFailed)
+
+	current, err := dbfs.GetFileById(db, file.FileId, superUser)
+	Assert.NoError(err)
+	Assert.Equal("first.txt", current.FileName)
+	Assert.NoError(current.CheckUnchanged(db))
+}
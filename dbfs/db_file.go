@@ -11,6 +11,7 @@ import (
 	"mime"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -60,24 +61,27 @@ var (
 	ErrLinkConstraint     = errors.New("link must be alphanumerical and between 1-40 characters")
 )
 
+// File is a file, folder or link. Size is the size of the data as uploaded,
+// and ActualSize what is stored across all the shards once stitch has
+// compressed it with seekable zstd, encrypted it and added parity.
 type File struct {
 	FileId             string    `gorm:"primaryKey" json:"file_id"`
-	FileName           string    `json:"file_name"`
-	MIMEType           string    `json:"mime_type"`
+	FileName           string    `gorm:"index" json:"file_name"`
+	MIMEType           string    `gorm:"index" json:"mime_type"`
 	EntryType          int8      `gorm:"not null" json:"entry_type"`
 	ParentFolder       *File     `gorm:"foreignKey:ParentFolderFileId" json:"-"`
-	ParentFolderFileId *string   `json:"parent_folder_id"`
+	ParentFolderFileId *string   `gorm:"index" json:"parent_folder_id"`
 	VersionNo          int       `gorm:"not null" json:"version_no"`
 	DataId             string    `json:"-"` //TODO: Convert this to a pointer to a string and make it unique or nullable
 	DataIdVersion      int       `json:"data_version_no"`
-	Size               int64     `gorm:"not null" json:"size"`
+	Size               int64     `gorm:"not null; index" json:"size"`
 	ActualSize         int64     `gorm:"not null" json:"actual_size"`
-	CreatedTime        time.Time `gorm:"not null"  json:"created_time"`
+	CreatedTime        time.Time `gorm:"not null; index" json:"created_time"`
 	ModifiedUser       *User     `gorm:"foreignKey:ModifiedUserUserId" json:"-"`
-	ModifiedUserUserId *string   `json:"modified_user_user_id"`
-	ModifiedTime       time.Time `gorm:"not null; autoUpdateTime" json:"modified_time"`
+	ModifiedUserUserId *string   `gorm:"index" json:"modified_user_user_id"`
+	ModifiedTime       time.Time `gorm:"not null; autoUpdateTime; index" json:"modified_time"`
 	VersioningMode     int8      `gorm:"not null" json:"versioning_mode"`
-	Checksum           string    `json:"checksum"`
+	Checksum           string    `gorm:"index" json:"checksum"`
 	TotalShards        int       `json:"total_shards"`
 	DataShards         int       `json:"data_shards"`
 	ParityShards       int       `json:"parity_shards"`
@@ -85,11 +89,14 @@ type File struct {
 	EncryptionKey      string    `json:"-"`
 	EncryptionIv       string    `json:"-"`
 	PasswordProtected  bool      `json:"password_protected"`
-	LinkFile           *File     `gorm:"foreignKey:LinkFileFileId" json:"-"`
+	LinkFile           *File     `gorm:"foreignKey:LinkFileFileId;constraint:-" json:"-"`
 	LinkFileFileId     *string   `json:"link_file_id"`
 	LastChecked        time.Time `json:"last_checked"`
 	Status             int8      `gorm:"not null" json:"status"`
 	HandledServer      string    `gorm:"not null" json:"-"`
+	TrashId            *string   `gorm:"index" json:"-"`
+	OwnerUserId        *string   `gorm:"index" json:"owner_user_id"`
+	LinkTarget         *File     `gorm:"-" json:"link_target,omitempty"`
 }
 
 type FileMetadataModification struct {
@@ -115,10 +122,13 @@ type FileInterface interface {
 
 	// Update Functions (Local)
 	UpdateMetaData(tx *gorm.DB, modificationsRequested FileMetadataModification, user *User) error
+	SetModifiedTime(tx *gorm.DB, modifiedTime time.Time, user *User) error
 	rename(tx *gorm.DB, newName string) error
 	PasswordProtect(tx *gorm.DB, oldPassword string, newPassword string, hint string, user *User) error
 	PasswordUnprotect(tx *gorm.DB, password string, user *User) error
 	Move(tx *gorm.DB, newParent *File, user *User) error
+	Copy(tx *gorm.DB, newParent *File, user *User, server string) error
+	CopyAs(tx *gorm.DB, newParent *File, newName string, user *User, server string) (*File, error)
 	Delete(tx *gorm.DB, user *User, server string) error
 	AddPermissionUsers(tx *gorm.DB, permission *PermissionNeeded, requestUser *User, users ...User) error
 	AddPermissionGroups(tx *gorm.DB, permission *PermissionNeeded, requestUser *User, groups ...Group) error
@@ -130,6 +140,7 @@ type FileInterface interface {
 	GetSharedLinks(tx *gorm.DB, user *User) ([]SharedLink, error)
 	DeleteSharedLink(tx *gorm.DB, user *User, link string) error
 	UpdateSharedLink(tx *gorm.DB, user *User, link string, newLink string) error
+	UpdateSharedLinkOptions(tx *gorm.DB, user *User, link string, options *SharedLinkOptions) (*SharedLink, error)
 	AddToFavorites(tx *gorm.DB, user *User) error
 	RemoveFromFavorites(tx *gorm.DB, user *User) error
 }
@@ -202,7 +213,7 @@ func GetFileById(tx *gorm.DB, id string, user *User) (*File, error) {
 
 	err := tx.First(file).Error
 
-	if err != nil {
+	if err != nil || file.TrashId != nil {
 		return nil, ErrFileNotFound
 	}
 
@@ -250,7 +261,7 @@ func ListFilesByFolderId(tx *gorm.DB, id string, user *User) ([]File, error) {
 
 	var files []File
 
-	err = tx.Where("parent_folder_file_id = ?", id).Find(&files).Error
+	err = tx.Where("parent_folder_file_id = ? AND trash_id IS NULL", id).Find(&files).Error
 
 	if err != nil {
 		return nil, err
@@ -488,20 +499,42 @@ func FinishFile(tx *gorm.DB, file *File, user *User, size, actualSize int64, che
 		return ErrInvalidAction
 	}
 
-	// Update the file to be finished
-	file.Status = FileStatusGood
-	file.Checksum = checksum
-	file.Size = size
-	file.ActualSize = actualSize
-	file.ModifiedUserUserId = &user.UserId
-	file.ModifiedTime = time.Now()
-	err := tx.Save(file).Error
-	if err != nil {
-		return err
-	}
+	return tx.Transaction(func(tx *gorm.DB) error {
+
+		// The user that uploaded the file is charged for it
+		if err := CheckQuota(tx, user.UserId, size, actualSize); err != nil {
+			return err
+		}
+		if err := chargeQuota(tx, user.UserId, size, actualSize); err != nil {
+			return err
+		}
+
+		// Update the file to be finished
+		file.Status = FileStatusGood
+		file.Checksum = checksum
+		file.Size = size
+		file.ActualSize = actualSize
+		file.ModifiedUserUserId = &user.UserId
+		file.ModifiedTime = time.Now()
+		file.OwnerUserId = &user.UserId
+		err := tx.Save(file).Error
+		if err != nil {
+			return err
+		}
+
+		// Updating the FileVersion
+		err = finaliseFileVersionFromFile(tx, file, size, actualSize)
+		if err != nil {
+			return err
+		}
+
+		err = deduplicate(tx, file)
+		if err != nil {
+			return err
+		}
 
-	// Updating the FileVersion
-	return finaliseFileVersionFromFile(tx, file, size, actualSize)
+		return queueFileEvent(tx, file, user, WebhookEventCreated, "")
+	})
 
 }
 
@@ -533,7 +566,7 @@ func DeleteFileById(tx *gorm.DB, id string, user *User, server string) error {
 
 }
 
-// DeleteFolderById deletes a folder based on the FileId given.
+// DeleteFolderById moves a folder based on the FileId given to the trash.
 // Will not delete if there is contents in the folder
 func DeleteFolderById(tx *gorm.DB, id string, user *User) error {
 
@@ -564,20 +597,21 @@ func DeleteFolderById(tx *gorm.DB, id string, user *User) error {
 		return ErrFolderNotEmpty
 	}
 
-	return tx.Delete(folder).Error
+	_, err = folder.Trash(tx, user)
+	return err
 
 }
 
-// DeleteFolderByIdCascade deletes a folder based on the FileId given.
-// Will delete all inner contents.
+// DeleteFolderByIdCascade moves a folder based on the FileId given to the trash.
+// If the folder has contents, its contents are moved to the trash instead.
 func DeleteFolderByIdCascade(tx *gorm.DB, id string, user *User, server string) error {
 
 	// Checking if the user has permissions
 
 	err := DeleteFolderById(tx, id, user)
 
-	if errors.Is(ErrFolderNotEmpty, err) {
-		// Cascading down the folders
+	if errors.Is(err, ErrFolderNotEmpty) {
+		// Moving the contents to the trash
 
 		var files []File
 		files, err = ListFilesByFolderId(tx, id, user)
@@ -586,21 +620,15 @@ func DeleteFolderByIdCascade(tx *gorm.DB, id string, user *User, server string)
 			return err
 		}
 
-		err = tx.Transaction(func(tx *gorm.DB) error {
-
-			for _, file := range files {
-				err := tx.Transaction(func(tx2 *gorm.DB) error {
-					return deleteSubFoldersCascade(tx, &file, user, server)
-				})
-				if err != nil {
+		return tx.Transaction(func(tx *gorm.DB) error {
+			for i := range files {
+				if _, err := files[i].Trash(tx, user); err != nil {
 					return err
 				}
 			}
 			return nil
 		})
 
-	} else {
-		return err
 	}
 
 	return err
@@ -670,9 +698,10 @@ func (f File) GetFileFragments(tx *gorm.DB, user *User) ([]Fragment, error) {
 		}
 	} else {
 		// Check if the file is public
-		var count int64
-		tx.Model(&SharedLink{}).Where("file_id = ?", f.FileId).Count(&count)
-		if count == 0 {
+		isShared, err := f.IsShared(tx)
+		if err != nil {
+			return nil, err
+		} else if !isShared {
 			return nil, ErrFileNotFound
 		}
 	}
@@ -717,6 +746,11 @@ func (f *File) GetOldVersion(tx *gorm.DB, user *User, versionNo int) (*FileVersi
 		return nil, err
 	}
 
+	err = fileVersion.loadTags(tx)
+	if err != nil {
+		return nil, err
+	}
+
 	return fileVersion, nil
 
 }
@@ -743,7 +777,7 @@ func (f *File) CreateSubFolder(tx *gorm.DB, folderName string, user *User, serve
 
 	var rows int64
 
-	err = tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ?",
+	err = tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ? AND trash_id IS NULL",
 		folderName, f.FileId).Count(&rows).Error
 
 	if err != nil {
@@ -788,7 +822,12 @@ func (f *File) CreateSubFolder(tx *gorm.DB, folderName string, user *User, serve
 			return err
 		}
 
-		return CreateFileVersionFromFile(tx, newFolder, user)
+		err = CreateFileVersionFromFile(tx, newFolder, user)
+		if err != nil {
+			return err
+		}
+
+		return queueFileEvent(tx, newFolder, user, WebhookEventCreated, "")
 
 	})
 
@@ -798,6 +837,45 @@ func (f *File) CreateSubFolder(tx *gorm.DB, folderName string, user *User, serve
 	return newFolder, nil
 }
 
+// SetModifiedTime overrides the modified time of a file or folder and its
+// current version, e.g. to keep the times of files imported from an archive.
+func (f *File) SetModifiedTime(tx *gorm.DB, modifiedTime time.Time, user *User) error {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrFileNotFound
+	}
+
+	// Check if user has write permission (if not 403)
+	hasPermissions, err = user.HasPermission(tx, f, &PermissionNeeded{Write: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrNoPermission
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		// UpdateColumn skips autoUpdateTime, which would overwrite the time given
+		err := tx.Model(&File{}).Where("file_id = ?", f.FileId).
+			UpdateColumn("modified_time", modifiedTime).Error
+		if err != nil {
+			return err
+		}
+
+		err = tx.Model(&FileVersion{}).Where("file_id = ? AND version_no = ?", f.FileId, f.VersionNo).
+			UpdateColumn("modified_time", modifiedTime).Error
+		if err != nil {
+			return err
+		}
+
+		f.ModifiedTime = modifiedTime
+		return nil
+	})
+}
+
 // UpdateMetaData used to update file's metadata (name, mime type, etc)
 func (f *File) UpdateMetaData(tx *gorm.DB, modificationsRequested FileMetadataModification, user *User) error {
 
@@ -817,7 +895,13 @@ func (f *File) UpdateMetaData(tx *gorm.DB, modificationsRequested FileMetadataMo
 		return ErrNoPermission
 	}
 
+	// Check that no one else holds a lock on the file
+	if err := f.checkLock(tx, user); err != nil {
+		return err
+	}
+
 	changesMade := false
+	action, details := ActivityMetadata, ""
 
 	if modificationsRequested.PasswordModification {
 
@@ -843,6 +927,7 @@ func (f *File) UpdateMetaData(tx *gorm.DB, modificationsRequested FileMetadataMo
 	} else {
 		if modificationsRequested.FileName != "" {
 			if f.FileName != modificationsRequested.FileName {
+				action, details = ActivityRename, f.FileName+" -> "+modificationsRequested.FileName
 				err := f.rename(tx, modificationsRequested.FileName)
 				if err != nil {
 					return err
@@ -880,7 +965,15 @@ func (f *File) UpdateMetaData(tx *gorm.DB, modificationsRequested FileMetadataMo
 			return err
 		}
 
-		return tx.Save(f).Error
+		err = tx.Save(f).Error
+		if err != nil {
+			return err
+		}
+
+		if err := RecordActivity(tx, f.FileId, user, action, details); err != nil {
+			return err
+		}
+		return queueFileEvent(tx, f, user, WebhookEventUpdated, details)
 	})
 	return err
 }
@@ -892,7 +985,7 @@ func (f *File) rename(tx *gorm.DB, newName string) error {
 
 	var rows int64
 
-	err := tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ?",
+	err := tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ? AND trash_id IS NULL",
 		newName, f.ParentFolderFileId).Count(&rows).Error
 
 	if err != nil {
@@ -1029,7 +1122,16 @@ func (f *File) Move(tx *gorm.DB, newParent *File, user *User) error {
 		return ErrNoPermission
 	}
 
+	// Check that no one else holds a lock on the file or its contents
+	if err := f.checkSubtreeLock(tx, user); err != nil {
+		return err
+	}
+
 	// Update the parent folder of the file
+	oldParentId := ""
+	if f.ParentFolderFileId != nil {
+		oldParentId = *f.ParentFolderFileId
+	}
 	f.ParentFolderFileId = &newParent.FileId
 	f.VersionNo = f.VersionNo + 1
 
@@ -1045,8 +1147,15 @@ func (f *File) Move(tx *gorm.DB, newParent *File, user *User) error {
 		}
 
 		err2 = CreateFileVersionFromFile(tx, f, user)
+		if err2 != nil {
+			return err2
+		}
 
-		return err2
+		details := oldParentId + " -> " + newParent.FileId
+		if err2 := RecordActivity(tx, f.FileId, user, ActivityMove, details); err2 != nil {
+			return err2
+		}
+		return queueFileEvent(tx, f, user, WebhookEventMoved, details, oldParentId)
 
 	})
 
@@ -1056,35 +1165,45 @@ func (f *File) Move(tx *gorm.DB, newParent *File, user *User) error {
 
 // Copy copies the file to a new folder
 func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) error {
+	_, err := f.CopyAs(tx, newParent, f.FileName, user, server)
+	return err
+}
 
-	// Checking that the user has read permissions on the file and the new parent folder
-	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
-	if err != nil {
-		return err
-	} else if !hasPermissions {
-		return ErrFileNotFound
+// CopyAs copies the file to a new folder under the name given, and returns
+// the new file. Folders are copied with everything in them the user can read.
+func (f *File) CopyAs(tx *gorm.DB, newParent *File, newName string, user *User, server string) (*File, error) {
+
+	if err := f.checkCopy(tx, newParent, user); err != nil {
+		return nil, err
 	}
 
-	hasPermissions, err = user.HasPermission(tx, newParent, &PermissionNeeded{Read: true})
+	newFile, err := f.copyEntry(tx, newParent, newName, user, server)
 	if err != nil {
-		return err
-	} else if !hasPermissions {
-		return ErrFileNotFound
+		return nil, err
 	}
 
-	// Check that the user has write permissions on the new parent folder
-	hasPermissions, err = user.HasPermission(tx, newParent, &PermissionNeeded{Write: true})
-	if err != nil {
-		return err
-	} else if !hasPermissions {
-		return ErrNoPermission
+	// Recursively go through and copy all items visible to user
+	if f.EntryType == IsFolder {
+		err = copyContents(tx, f, newFile, user, server, nil)
+		if err != nil {
+			return nil, err
+		}
 	}
 
+	return newFile, nil
+
+}
+
+// copyEntry copies a single file or folder, without its contents, into the
+// new parent. The copy gets the permissions of the new parent and shares the
+// data of the original. Permissions are not checked.
+func (f *File) copyEntry(tx *gorm.DB, newParent *File, newName string, user *User, server string) (*File, error) {
+
 	// Create a new file
 
 	newFile := File{
 		FileId:             uuid.New().String(),
-		FileName:           f.FileName,
+		FileName:           newName,
 		MIMEType:           f.MIMEType,
 		EntryType:          f.EntryType,
 		ParentFolderFileId: &newParent.FileId,
@@ -1105,16 +1224,20 @@ func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) err
 		PasswordProtected:  f.PasswordProtected,
 		EncryptionKey:      f.EncryptionKey,
 		EncryptionIv:       f.EncryptionIv,
+		LinkFileFileId:     f.LinkFileFileId,
 		LastChecked:        time.Now(),
 		Status:             FileStatusGood,
 		HandledServer:      server,
 	}
+	if f.EntryType == IsFile {
+		newFile.OwnerUserId = &user.UserId
+	}
 
 	// Find the original passwordProtect and duplicate it
 	var ogPP PasswordProtect
-	err = tx.Model(&PasswordProtect{}).Where("file_id = ?", f.FileId).Find(&ogPP).Error
+	err := tx.Model(&PasswordProtect{}).Where("file_id = ?", f.FileId).Find(&ogPP).Error
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	newPasswordProtect := PasswordProtect{
@@ -1129,6 +1252,18 @@ func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) err
 
 	err = tx.Transaction(func(tx2 *gorm.DB) error {
 
+		// The user making the copy is charged for it
+		if newFile.OwnerUserId != nil {
+			err2 := CheckQuota(tx2, user.UserId, newFile.Size, newFile.ActualSize)
+			if err2 != nil {
+				return err2
+			}
+			err2 = chargeQuota(tx2, user.UserId, newFile.Size, newFile.ActualSize)
+			if err2 != nil {
+				return err2
+			}
+		}
+
 		err2 := tx2.Save(&newFile).Error
 		if err2 != nil {
 			return err2
@@ -1139,6 +1274,11 @@ func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) err
 			return err2
 		}
 
+		err2 = copyFileTags(tx2, f.FileId, newFile.FileId)
+		if err2 != nil {
+			return err2
+		}
+
 		err2 = CreatePermissions(tx2, &newFile)
 		if err2 != nil {
 			return err2
@@ -1148,6 +1288,20 @@ func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) err
 			return err2
 		}
 
+		err2 = RecordActivity(tx2, f.FileId, user, ActivityCopy, newFile.FileId)
+		if err2 != nil {
+			return err2
+		}
+		err2 = queueFileEvent(tx2, &newFile, user, WebhookEventCreated, f.FileId)
+		if err2 != nil {
+			return err2
+		}
+
+		// Folders have no data
+		if newFile.DataId == "" {
+			return nil
+		}
+
 		dc := DataCopies{
 			DataId: newFile.DataId,
 		}
@@ -1156,30 +1310,10 @@ func (f *File) Copy(tx *gorm.DB, newParent *File, user *User, server string) err
 	})
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	// Recursive call if folder
-	fileOrFolder, err := f.IsFileOrEmptyFolder(tx, user)
-	if err != nil {
-		return err
-	}
-
-	// Recursively go through and copy all items visible to user
-	if !fileOrFolder {
-		ls, err := f.ListContents(tx, user)
-		if err != nil {
-			return err
-		}
-		for _, item := range ls {
-			err = item.Copy(tx, &newFile, user, server)
-			if err != nil {
-				return err
-			}
-		}
-	}
-
-	return err
+	return &newFile, nil
 
 }
 
@@ -1201,6 +1335,11 @@ func (f *File) Delete(tx *gorm.DB, user *User, server string) error {
 	} else if err != nil {
 	}
 
+	// Check that no one else holds a lock on the file or its contents
+	if err := f.checkSubtreeLock(tx, user); err != nil {
+		return err
+	}
+
 	// Check if the file is a file or empty folder
 
 	isFileOrEmptyFolder, err := f.IsFileOrEmptyFolder(tx, user)
@@ -1233,41 +1372,67 @@ func (f *File) Delete(tx *gorm.DB, user *User, server string) error {
 		})
 	}
 
+	err = RecordActivity(tx, f.FileId, user, ActivityDelete, f.FileName)
+	if err != nil {
+		return err
+	}
+	err = queueFileEvent(tx, f, user, WebhookEventDeleted, f.FileName)
+	if err != nil {
+		return err
+	}
+
 	// Delete Versions, Permissions, Delete File
+	return deleteFileRecords(tx, f, server)
+}
 
-	err = tx.Transaction(func(tx *gorm.DB) error {
-		err2 := deleteFileVersionFromFile(tx, f, server)
-		if err2 != nil {
-			return err2
+// deleteFileRecords marks the versions of a file as to be deleted, and removes
+// the file along with its permissions, favorites and shares.
+func deleteFileRecords(tx *gorm.DB, f *File, server string) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		// Giving the space back to the owner
+		if f.OwnerUserId != nil && f.Status != FileStatusWriting {
+			err := chargeQuota(tx, *f.OwnerUserId, -f.Size, -f.ActualSize)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := deleteFileVersionFromFile(tx, f, server)
+		if err != nil {
+			return err
 		}
-		err2 = deleteFilePermissions(tx, f)
+		err = deleteFilePermissions(tx, f)
 		if err != nil {
 			return err
 		}
 		// Delete Favorites and Shares
-		err2 = tx.Where("file_id = ?", f.FileId).Delete(&FavoriteFileItems{}).Error
-		if err2 != nil {
-			return err2
+		err = tx.Where("file_id = ?", f.FileId).Delete(&FavoriteFileItems{}).Error
+		if err != nil {
+			return err
 		}
-		err2 = tx.Where("file_id = ?", f.FileId).Delete(&SharedLink{}).Error
-		if err2 != nil {
-			return err2
+		err = tx.Where("file_id = ?", f.FileId).Delete(&SharedLink{}).Error
+		if err != nil {
+			return err
 		}
-		err2 = tx.Where("file_id = ?", f.FileId).Delete(&SharedWithUser{}).Error
-		if err2 != nil {
-			return err2
+		err = tx.Where("file_id = ?", f.FileId).Delete(&SharedWithUser{}).Error
+		if err != nil {
+			return err
 		}
-		err2 = tx.Where("file_id = ?", f.FileId).Delete(&SharedWithGroup{}).Error
-		if err2 != nil {
-			return err2
+		err = tx.Where("file_id = ?", f.FileId).Delete(&SharedWithGroup{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("file_id = ?", f.FileId).Delete(&FileLock{}).Error
+		if err != nil {
+			return err
+		}
+		err = tx.Where("file_id = ?", f.FileId).Delete(&FileTag{}).Error
+		if err != nil {
+			return err
 		}
 
-		err2 = tx.Delete(f).Error
-		return err2
-
+		return tx.Delete(f).Error
 	})
-
-	return err
 }
 
 // AddPermissionUsers adds permissions to a file or folder based on a PermissionNeeded struct given.
@@ -1283,12 +1448,29 @@ func (f *File) AddPermissionUsers(tx *gorm.DB, permission *PermissionNeeded, req
 	if err != nil {
 		return err
 	}
-	if hasPermission {
-		return upsertUsersPermission(tx, f, permission, requestUser, users...)
-	} else {
+	if !hasPermission {
 		return ErrNoPermission
 	}
 
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := upsertUsersPermission(tx, f, permission, requestUser, users...)
+		if err != nil {
+			return err
+		}
+		for _, user := range users {
+			details := "user " + user.UserId + ": " + permissionDetails(permission)
+			err = RecordActivity(tx, f.FileId, requestUser, ActivityPermission, details)
+			if err != nil {
+				return err
+			}
+			err = queueFileEvent(tx, f, requestUser, WebhookEventPermission, details)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
 }
 
 // AddPermissionGroups adds permissions to a file or folder based on a PermissionNeeded struct given.
@@ -1304,12 +1486,29 @@ func (f *File) AddPermissionGroups(tx *gorm.DB, permission *PermissionNeeded, re
 	if err != nil {
 		return err
 	}
-	if hasPermission {
-		return upsertGroupsPermission(tx, f, permission, requestUser, groups...)
-	} else {
+	if !hasPermission {
 		return ErrNoPermission
 	}
 
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := upsertGroupsPermission(tx, f, permission, requestUser, groups...)
+		if err != nil {
+			return err
+		}
+		for _, group := range groups {
+			details := "group " + group.GroupId + ": " + permissionDetails(permission)
+			err = RecordActivity(tx, f.FileId, requestUser, ActivityPermission, details)
+			if err != nil {
+				return err
+			}
+			err = queueFileEvent(tx, f, requestUser, WebhookEventPermission, details)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
 }
 
 // RemovePermission revokes permissions for that user or group.
@@ -1318,16 +1517,27 @@ func (f *File) RemovePermission(tx *gorm.DB, permission *Permission, user *User)
 	var err error
 
 	// Check if it's user or group
+	var details string
 	if permission.UserId != nil {
 		// User
 		err = revokeUsersPermission(tx, f, []User{User{UserId: *permission.UserId}}, user)
+		details = "user " + *permission.UserId + ": revoked"
 
 	} else {
 		// Group
 		err = revokeGroupsPermission(tx, f, []Group{Group{GroupId: *permission.GroupId}})
+		details = "group " + *permission.GroupId + ": revoked"
+	}
+	if err != nil {
+		return err
 	}
 
-	return err
+	err = RecordActivity(tx, f.FileId, user, ActivityPermission, details)
+	if err != nil {
+		return err
+	}
+
+	return queueFileEvent(tx, f, user, WebhookEventPermission, details)
 }
 
 // UpdatePermission calls upsertUsersPermission or upsertGroupsPermission to update permissions
@@ -1359,21 +1569,35 @@ func (f *File) UpdatePermission(tx *gorm.DB, oldPermission *Permission, newPermi
 
 	// User or Group
 
+	var details string
 	if oldPermission.UserId != nil {
 		newUser, err := GetUserById(tx, *newPermission.UserId)
 		if err != nil {
 			return err
 		}
 		err = upsertUsersPermission(tx, f, PermissionNeeded, user, *newUser)
+		if err != nil {
+			return err
+		}
+		details = "user " + newUser.UserId + ": " + permissionDetails(PermissionNeeded)
 	} else {
 		newGroup, err := GetGroupBasedOnGroupId(tx, *newPermission.GroupId)
 		if err != nil {
 			return err
 		}
 		err = upsertGroupsPermission(tx, f, PermissionNeeded, user, *newGroup)
+		if err != nil {
+			return err
+		}
+		details = "group " + newGroup.GroupId + ": " + permissionDetails(PermissionNeeded)
 	}
 
-	return nil
+	err = RecordActivity(tx, f.FileId, user, ActivityPermission, details)
+	if err != nil {
+		return err
+	}
+
+	return queueFileEvent(tx, f, user, WebhookEventPermission, details)
 }
 
 func (f *File) GetPermissions(tx *gorm.DB, user *User) ([]Permission, error) {
@@ -1435,6 +1659,11 @@ func (f *File) UpdateFile(tx *gorm.DB, newSize int64, newActualSize int64, check
 		return ErrNoPermission
 	}
 
+	// Check that no one else holds a lock on the file
+	if err := f.checkLock(tx, user); err != nil {
+		return err
+	}
+
 	// Get the PasswordProtect for the file
 	var passwordProtect PasswordProtect
 	err = tx.Model(&PasswordProtect{}).Where("file_id = ?", f.FileId).First(&passwordProtect).Error
@@ -1492,7 +1721,14 @@ func (f *File) UpdateFile(tx *gorm.DB, newSize int64, newActualSize int64, check
 		}
 		// Create a new FileVersion
 		err2 = CreateFileVersionFromFile(tx, f, user)
-		return err2
+		if err2 != nil {
+			return err2
+		}
+		err2 = RecordActivity(tx, f.FileId, user, ActivityUpdate, strconv.Itoa(f.VersionNo))
+		if err2 != nil {
+			return err2
+		}
+		return queueFileEvent(tx, f, user, WebhookEventUpdated, strconv.Itoa(f.VersionNo))
 	})
 	return err
 }
@@ -1523,6 +1759,24 @@ func (f *File) UpdateFragment(tx *gorm.DB, fragmentId int, fileFragmentPath stri
 func (f *File) FinishUpdateFile(tx *gorm.DB, checksum string) error {
 
 	err := tx.Transaction(func(tx *gorm.DB) error {
+
+		// The owner of the file is charged for the change in size
+		if f.OwnerUserId != nil {
+			var previous FileVersion
+			err2 := tx.Where("file_id = ? AND version_no = ?", f.FileId, f.VersionNo-1).
+				Find(&previous).Error
+			if err2 != nil {
+				return err2
+			}
+			sizeChange, actualSizeChange := f.Size-previous.Size, f.ActualSize-previous.ActualSize
+			if err2 = CheckQuota(tx, *f.OwnerUserId, sizeChange, actualSizeChange); err2 != nil {
+				return err2
+			}
+			if err2 = chargeQuota(tx, *f.OwnerUserId, sizeChange, actualSizeChange); err2 != nil {
+				return err2
+			}
+		}
+
 		f.Status = FileStatusGood
 		f.LastChecked = time.Now()
 		f.Checksum = checksum
@@ -1545,8 +1799,14 @@ func (f *File) FinishUpdateFile(tx *gorm.DB, checksum string) error {
 		fileVersion.Size = f.Size
 		fileVersion.ActualSize = f.ActualSize
 		fileVersion.LastChecked = f.LastChecked
+		fileVersion.Checksum = f.Checksum
 
-		return tx.Save(&fileVersion).Error
+		err2 = tx.Save(&fileVersion).Error
+		if err2 != nil {
+			return err2
+		}
+
+		return deduplicate(tx, f)
 
 	})
 	if err != nil {
@@ -1561,7 +1821,9 @@ func (f *File) FinishUpdateFile(tx *gorm.DB, checksum string) error {
 	} else if f.VersioningMode == VersioningOnVersions {
 		err = nil
 	} else if f.VersioningMode == VersioningOnDeltas {
-		panic("Not implemented")
+		// The previous data is kept as is until it has been rewritten as a
+		// patch against this version (see StorePatch).
+		err = nil
 	}
 
 	return err
@@ -1587,7 +1849,7 @@ func (f *File) ListContents(tx *gorm.DB, user *User) ([]File, error) {
 
 	var files []File
 
-	err = tx.Model(&File{}).Where("parent_folder_file_id = ?", f.FileId).Find(&files).Error
+	err = tx.Model(&File{}).Where("parent_folder_file_id = ? AND trash_id IS NULL", f.FileId).Find(&files).Error
 
 	if err != nil {
 		return nil, err
@@ -1625,9 +1887,10 @@ func (f *File) GetDecryptionKey(tx *gorm.DB, user *User, password string) (strin
 		}
 	} else {
 		// Check if the file is public
-		var count int64
-		tx.Model(&SharedLink{}).Where("file_id = ?", f.FileId).Count(&count)
-		if count == 0 {
+		isShared, err := f.IsShared(tx)
+		if err != nil {
+			return "", "", err
+		} else if !isShared {
 			return "", "", ErrFileNotFound
 		}
 	}
@@ -1723,6 +1986,14 @@ func (f *File) DeleteFileVersion(tx *gorm.DB, user *User, versionNo int) error {
 		return ErrVersionNotFound
 	}
 
+	// The versions stored as patches against it would be lost with it
+	isPatchBase, err := f.isPatchBase(tx, &fileVersion)
+	if err != nil {
+		return err
+	} else if isPatchBase {
+		return ErrVersionIsPatchBase
+	}
+
 	// Mark version for deletion
 	return tx.Model(&FileVersion{}).Where("file_id = ? AND version_no = ?",
 		f.FileId, versionNo).Update("status", FileStatusToBeDeleted).Error
@@ -1827,7 +2098,16 @@ func (f *File) CreateSharedLink(tx *gorm.DB, user *User, link string) (*SharedLi
 		ShortenedLink: link,
 		CreatedTime:   time.Now(),
 	}
-	if tx.Create(&sharedLink).Error != nil {
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&sharedLink).Error; err != nil {
+			return err
+		}
+		if err := RecordActivity(tx, f.FileId, user, ActivityShare, link); err != nil {
+			return err
+		}
+		return queueFileEvent(tx, f, user, WebhookEventShared, link)
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -1917,6 +2197,43 @@ func (f *File) UpdateSharedLink(tx *gorm.DB, user *User, link string, newLink st
 		Update("shortened_link", newLink).Error
 }
 
+// UpdateSharedLinkOptions sets the expiry time, download limit, password and
+// whether a shared link of the file is disabled
+func (f *File) UpdateSharedLinkOptions(tx *gorm.DB, user *User, link string,
+	options *SharedLinkOptions) (*SharedLink, error) {
+
+	// Check if user has shared link permission
+	permission, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true, Share: true})
+	if err != nil {
+		return nil, err
+	}
+	if !permission {
+		return nil, ErrNoPermission
+	}
+
+	var sharedLink SharedLink
+	err = tx.First(&sharedLink, "file_id = ? AND shortened_link = ?", f.FileId, link).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSharedLinkNotFound
+		}
+		return nil, err
+	}
+
+	if err := options.apply(&sharedLink); err != nil {
+		return nil, err
+	}
+
+	// Saving with Select so that cleared fields are written too
+	err = tx.Model(&sharedLink).Select("expiry_time", "max_downloads", "disabled",
+		"password_active", "password_salt", "password_hash").Updates(&sharedLink).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedLink, nil
+}
+
 // AddToFavorites will add the file to a user's favorites
 func (f *File) AddToFavorites(tx *gorm.DB, user *User) error {
 
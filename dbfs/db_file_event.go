@@ -0,0 +1,119 @@
+package dbfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// FileEvent is a change to a file, kept until it has been claimed to be
+// published to the users watching the folders it happened in. Event is one of
+// the webhook events.
+type FileEvent struct {
+	EventId   uint      `gorm:"primaryKey; autoIncrement" json:"event_id"`
+	Event     string    `gorm:"not null" json:"event"`
+	FileId    string    `gorm:"not null" json:"file_id"`
+	FileName  string    `gorm:"not null" json:"file_name"`
+	EntryType int8      `gorm:"not null" json:"entry_type"`
+	Folders   string    `gorm:"not null" json:"-"` // Comma separated
+	FolderIds []string  `gorm:"-" json:"folder_ids"`
+	UserId    *string   `json:"user_id"`
+	Time      time.Time `gorm:"not null" json:"time"`
+}
+
+// queueFileEvent records the event for the users watching the folders of the
+// file, and queues it for the webhooks subscribed to it
+func queueFileEvent(tx *gorm.DB, f *File, user *User, event, details string, otherFolderIds ...string) error {
+	if err := recordFileEvent(tx, f, user, event, otherFolderIds...); err != nil {
+		return err
+	}
+	return queueWebhookEvent(tx, f, user, event, details, otherFolderIds...)
+}
+
+// recordFileEvent adds the event to the ones waiting to be published. It is
+// seen in the parent folder of the file, and in otherFolderIds.
+func recordFileEvent(tx *gorm.DB, f *File, user *User, event string, otherFolderIds ...string) error {
+	var folderIds []string
+	if f.ParentFolderFileId != nil {
+		folderIds = append(folderIds, *f.ParentFolderFileId)
+	}
+	folderIds = append(folderIds, otherFolderIds...)
+
+	fileEvent := &FileEvent{
+		Event:     event,
+		FileId:    f.FileId,
+		FileName:  f.FileName,
+		EntryType: f.EntryType,
+		Folders:   strings.Join(folderIds, ","),
+		Time:      time.Now(),
+	}
+	if user != nil {
+		fileEvent.UserId = &user.UserId
+	}
+	return tx.Create(fileEvent).Error
+}
+
+// ClaimFileEvents removes up to limit of the oldest events waiting to be
+// published and returns them. Each event is only returned to one of the
+// servers claiming them side by side.
+func ClaimFileEvents(tx *gorm.DB, limit int) ([]FileEvent, error) {
+	var waiting []FileEvent
+	if err := tx.Order("event_id").Limit(limit).Find(&waiting).Error; err != nil {
+		return nil, err
+	}
+
+	claimed := make([]FileEvent, 0, len(waiting))
+	for _, event := range waiting {
+		result := tx.Where("event_id = ?", event.EventId).Delete(&FileEvent{})
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		if result.RowsAffected == 1 {
+			if event.Folders != "" {
+				event.FolderIds = strings.Split(event.Folders, ",")
+			}
+			claimed = append(claimed, event)
+		}
+	}
+	return claimed, nil
+}
+
+// InFolder checks if the event happened in the folder, or to the folder itself
+func (e *FileEvent) InFolder(folderId string) bool {
+	if e.FileId == folderId {
+		return true
+	}
+	for _, id := range e.FolderIds {
+		if id == folderId {
+			return true
+		}
+	}
+	return false
+}
+
+// VisibleTo checks if the user can read the file of the event. Once the file
+// is deleted for good, reading one of its folders is enough.
+func (e *FileEvent) VisibleTo(tx *gorm.DB, user *User) (bool, error) {
+	file := &File{FileId: e.FileId}
+	err := tx.First(file).Error
+	if err == nil {
+		return user.HasPermission(tx, file, &PermissionNeeded{Read: true})
+	} else if !errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, err
+	}
+
+	for _, id := range e.FolderIds {
+		folder := &File{FileId: id}
+		if err := tx.First(folder).Error; errors.Is(err, gorm.ErrRecordNotFound) {
+			continue
+		} else if err != nil {
+			return false, err
+		}
+		if ok, err := user.HasPermission(tx, folder, &PermissionNeeded{Read: true}); err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
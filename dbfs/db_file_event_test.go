@@ -0,0 +1,86 @@
+package dbfs_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestFileEvents(t *testing.T) {
+	Assert := assert.New(t)
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+	Assert.NoError(db.Where("email = ?", "superuser").First(&superUser).Error)
+
+	outsider, err := dbfs.CreateNewUser(db, "eventOutsider", "eventOutsider", dbfs.AccountTypeEndUser,
+		"eventOutsider", "refreshToken", "accessToken", "idToken", "ThisServer")
+	Assert.NoError(err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	Assert.NoError(err)
+
+	// Events from setting up the database are not of interest
+	_, err = dbfs.ClaimFileEvents(db, 1000)
+	Assert.NoError(err)
+
+	team, err := rootFolder.CreateSubFolder(db, "eventTeam", &superUser, "ThisServer")
+	Assert.NoError(err)
+	archive, err := rootFolder.CreateSubFolder(db, "eventArchive", &superUser, "ThisServer")
+	Assert.NoError(err)
+	report, err := team.CreateSubFolder(db, "report", &superUser, "ThisServer")
+	Assert.NoError(err)
+	Assert.NoError(report.Move(db, archive, &superUser))
+
+	// Nothing is recorded for changes that were rolled back
+	err = db.Transaction(func(tx *gorm.DB) error {
+		if _, err := team.CreateSubFolder(tx, "rolled back", &superUser, "ThisServer"); err != nil {
+			return err
+		}
+		return errors.New("rollback")
+	})
+	Assert.Error(err)
+
+	events, err := dbfs.ClaimFileEvents(db, 1000)
+	Assert.NoError(err)
+	Assert.Len(events, 4)
+	moved := events[3]
+	Assert.Equal(dbfs.WebhookEventMoved, moved.Event)
+	Assert.Equal(report.FileId, moved.FileId)
+	Assert.Equal([]string{archive.FileId, team.FileId}, moved.FolderIds)
+	Assert.True(moved.InFolder(team.FileId))
+	Assert.True(moved.InFolder(archive.FileId))
+	Assert.False(moved.InFolder(rootFolder.FileId))
+
+	// Events are only claimed once
+	events, err = dbfs.ClaimFileEvents(db, 1000)
+	Assert.NoError(err)
+	Assert.Len(events, 0)
+
+	// Only users who can read the file see the event
+	visible, err := moved.VisibleTo(db, &superUser)
+	Assert.NoError(err)
+	Assert.True(visible)
+	visible, err = moved.VisibleTo(db, outsider)
+	Assert.NoError(err)
+	Assert.False(visible)
+
+	// Once the file is gone, the folders it was in decide
+	Assert.NoError(report.Delete(db, &superUser, "ThisServer"))
+	events, err = dbfs.ClaimFileEvents(db, 1000)
+	Assert.NoError(err)
+	Assert.NotEmpty(events)
+	deleted := events[len(events)-1]
+	Assert.Equal(dbfs.WebhookEventDeleted, deleted.Event)
+	visible, err = deleted.VisibleTo(db, &superUser)
+	Assert.NoError(err)
+	Assert.True(visible)
+	Assert.NoError(archive.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, &superUser, *outsider))
+	visible, err = deleted.VisibleTo(db, outsider)
+	Assert.NoError(err)
+	Assert.True(visible)
+}
@@ -10,6 +10,7 @@ import (
 	"gorm.io/gorm"
 	"strconv"
 	"testing"
+	"time"
 )
 
 const (
@@ -572,6 +573,33 @@ func TestFile(t *testing.T) {
 		Assert.Equal(5, len(pathArray))
 
 	})
+
+	t.Run("Setting the modified time", func(t *testing.T) {
+
+		Assert := assert.New(t)
+
+		rootFolder, err := dbfs.GetRootFolder(db)
+		Assert.Nil(err)
+		file, err := EXAMPLECreateFile(db, &superUser, "modifiedTime", rootFolder.FileId)
+		Assert.Nil(err)
+
+		modified := time.Date(2001, 2, 3, 4, 5, 6, 0, time.UTC)
+		Assert.Nil(file.SetModifiedTime(db, modified, &superUser))
+
+		file, err = dbfs.GetFileById(db, file.FileId, &superUser)
+		Assert.Nil(err)
+		Assert.True(modified.Equal(file.ModifiedTime))
+
+		version, err := file.GetOldVersion(db, &superUser, file.VersionNo)
+		Assert.Nil(err)
+		Assert.True(modified.Equal(version.ModifiedTime))
+
+		// Users without write permission can't change it
+		noPermUser, err := dbfs.CreateNewUser(db, "modifiedTime", "modifiedTime", dbfs.AccountTypeEndUser,
+			"modifiedTime", "modifiedTime", "modifiedTime", "modifiedTime", "testServer")
+		Assert.Nil(err)
+		Assert.ErrorIs(file.SetModifiedTime(db, time.Now(), noPermUser), dbfs.ErrFileNotFound)
+	})
 }
 
 // EXAMPLECreateFile is an example driver for creating a File.
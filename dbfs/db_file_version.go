@@ -8,39 +8,40 @@ import (
 )
 
 type FileVersion struct {
-	FileId                string       `gorm:"primaryKey" json:"file_id"`
-	VersionNo             int          `gorm:"primaryKey" json:"version_no"`
-	FileName              string       `gorm:"not null" json:"file_name"`
-	MIMEType              string       `json:"mime_type"`
-	EntryType             int8         `gorm:"not null" json:"entry_type"`
-	ParentFolder          *FileVersion `gorm:"foreignKey:ParentFolderFileId,ParentFolderVersionNo" json:"'-'"`
-	ParentFolderFileId    *string      `json:"parent_folder_id"`
-	ParentFolderVersionNo *int         `json:"-"`
-	DataId                string       `json:"-"`
-	DataIdVersion         int          `json:"data_version_no"`
-	Size                  int64        `gorm:"not null" json:"size"`
-	ActualSize            int64        `gorm:"not null" json:"actual_size"`
-	CreatedTime           time.Time    `gorm:"not null" json:"created_time"`
-	ModifiedUser          User         `gorm:"foreignKey:ModifiedUserUserId" json:"-"`
-	ModifiedUserUserId    *string      `json:"modified_user_user_id"`
-	ModifiedTime          time.Time    `gorm:"not null" json:"modified_time"`
-	VersioningMode        int8         `gorm:"not null" json:"versioning_mode"`
-	Checksum              string       `json:"checksum"`
-	TotalShards           int          `json:"total_shards"`
-	DataShards            int          `json:"data_shards"`
-	ParityShards          int          `json:"parity_shards"`
-	KeyThreshold          int          `json:"key_threshold"`
-	EncryptionKey         string       `json:"-"`
-	EncryptionIv          string       `json:"-"`
-	PasswordProtected     bool         `json:"password_protected"`
-	LinkFile              *FileVersion `gorm:"foreignKey:LinkFileFileId,LinkFileVersionNo" json:"-"`
-	LinkFileFileId        *string      `json:"link_file_id"`
-	LinkFileVersionNo     *int         `json:"-"`
-	LastChecked           time.Time    `json:"last_checked"`
-	Status                int8         `gorm:"not null" json:"status"`
-	HandledServer         string       `gorm:"not null" json:"-"`
-	Patch                 bool         `json:"-"`
-	PatchBaseVersion      int          `json:"-"`
+	FileId                string            `gorm:"primaryKey" json:"file_id"`
+	VersionNo             int               `gorm:"primaryKey" json:"version_no"`
+	FileName              string            `gorm:"not null" json:"file_name"`
+	MIMEType              string            `json:"mime_type"`
+	EntryType             int8              `gorm:"not null" json:"entry_type"`
+	ParentFolder          *FileVersion      `gorm:"foreignKey:ParentFolderFileId,ParentFolderVersionNo" json:"'-'"`
+	ParentFolderFileId    *string           `json:"parent_folder_id"`
+	ParentFolderVersionNo *int              `json:"-"`
+	DataId                string            `json:"-"`
+	DataIdVersion         int               `json:"data_version_no"`
+	Size                  int64             `gorm:"not null" json:"size"`
+	ActualSize            int64             `gorm:"not null" json:"actual_size"`
+	CreatedTime           time.Time         `gorm:"not null" json:"created_time"`
+	ModifiedUser          User              `gorm:"foreignKey:ModifiedUserUserId" json:"-"`
+	ModifiedUserUserId    *string           `json:"modified_user_user_id"`
+	ModifiedTime          time.Time         `gorm:"not null" json:"modified_time"`
+	VersioningMode        int8              `gorm:"not null" json:"versioning_mode"`
+	Checksum              string            `json:"checksum"`
+	TotalShards           int               `json:"total_shards"`
+	DataShards            int               `json:"data_shards"`
+	ParityShards          int               `json:"parity_shards"`
+	KeyThreshold          int               `json:"key_threshold"`
+	EncryptionKey         string            `json:"-"`
+	EncryptionIv          string            `json:"-"`
+	PasswordProtected     bool              `json:"password_protected"`
+	LinkFile              *FileVersion      `gorm:"foreignKey:LinkFileFileId,LinkFileVersionNo;constraint:-" json:"-"`
+	LinkFileFileId        *string           `json:"link_file_id"`
+	LinkFileVersionNo     *int              `json:"-"`
+	LastChecked           time.Time         `json:"last_checked"`
+	Status                int8              `gorm:"not null" json:"status"`
+	HandledServer         string            `gorm:"not null" json:"-"`
+	Patch                 bool              `json:"-"`
+	PatchBaseVersion      int               `json:"-"`
+	Tags                  map[string]string `gorm:"-" json:"tags,omitempty"`
 }
 
 // CreateFileVersionFromFile creates a FileVersion from a File
@@ -83,14 +84,18 @@ func CreateFileVersionFromFile(tx *gorm.DB, file *File, user *User) error {
 			EncryptionKey:         file.EncryptionKey,
 			EncryptionIv:          file.EncryptionIv,
 			PasswordProtected:     file.PasswordProtected,
-			//LinkFileFileId:        "GET LINKED FOLDER", // NOT READY
-			//LinkFileVersionNo:     0,                   // NOT READY
-			LastChecked:   file.LastChecked,
-			Status:        file.Status,
-			HandledServer: file.HandledServer,
+			LinkFileFileId:        file.LinkFileFileId,
+			LastChecked:           file.LastChecked,
+			Status:                file.Status,
+			HandledServer:         file.HandledServer,
 		}
 
-		return tx.Save(&fileVersion).Error
+		err = tx.Save(&fileVersion).Error
+		if err != nil {
+			return err
+		}
+
+		return snapshotFileTags(tx, file.FileId, file.VersionNo)
 
 	} else if err != nil {
 		return err
@@ -120,14 +125,16 @@ func CreateFileVersionFromFile(tx *gorm.DB, file *File, user *User) error {
 			EncryptionKey:         file.EncryptionKey,
 			EncryptionIv:          file.EncryptionIv,
 			PasswordProtected:     file.PasswordProtected,
-			//LinkFileFileId:        "GET LINKED FOLDER", // NOT READY
-			//LinkFileVersionNo:     0,                   // NOT READY
-			LastChecked:   file.LastChecked,
-			Status:        file.Status,
-			HandledServer: file.HandledServer,
+			LinkFileFileId:        file.LinkFileFileId,
+			LastChecked:           file.LastChecked,
+			Status:                file.Status,
+			HandledServer:         file.HandledServer,
 		}).Error
+	if err != nil {
+		return err
+	}
 
-	return err
+	return snapshotFileTags(tx, file.FileId, file.VersionNo)
 }
 
 // finaliseFileVersionFromFile finalises the status to be done (FileStatusGood)
@@ -137,6 +144,7 @@ func finaliseFileVersionFromFile(tx *gorm.DB, file *File, size, actualSize int64
 			"status":      FileStatusGood,
 			"size":        size,
 			"actual_size": actualSize,
+			"checksum":    file.Checksum,
 		}).Error
 }
 
@@ -257,11 +265,10 @@ func deleteFileVersionFromFile(tx *gorm.DB, file *File, server string) error {
 		KeyThreshold:          file.KeyThreshold,
 		EncryptionKey:         file.EncryptionKey,
 		PasswordProtected:     file.PasswordProtected,
-		//LinkFileFileId:        "GET LINKED FOLDER", // NOT READY
-		//LinkFileVersionNo:     0,                   // NOT READY
-		LastChecked:   file.LastChecked,
-		Status:        status,
-		HandledServer: server,
+		LinkFileFileId:        file.LinkFileFileId,
+		LastChecked:           file.LastChecked,
+		Status:                status,
+		HandledServer:         server,
 	}
 
 	err = tx.Save(&fileVersion).Error
@@ -330,11 +337,19 @@ func (fv *FileVersion) GetDecryptionKey(tx *gorm.DB, user *User, password string
 
 }
 
+// RevertFileToVersion creates a new version of the file with the data and
+// metadata of the version given. Versions stored as patches have to be stored
+// whole with StoreRebuiltVersion first.
 func (f *File) RevertFileToVersion(tx *gorm.DB, versionNo int, user *User) error {
 
 	// Check permissions for the original file
 	perm, err := user.HasPermission(tx, f, &PermissionNeeded{Write: true})
-	if err != nil || !perm {
+	if err != nil {
+		return err
+	} else if !perm {
+		return ErrNoPermission
+	}
+	if err := f.checkLock(tx, user); err != nil {
 		return err
 	}
 
@@ -347,6 +362,27 @@ func (f *File) RevertFileToVersion(tx *gorm.DB, versionNo int, user *User) error
 		return err
 	}
 
+	// The data of a patch version cannot be used by the file as is
+	if oldVersion.Patch {
+		return ErrVersionIsPatch
+	}
+
+	// Charging the owner for the change in size. A version that was never
+	// finished was never charged.
+	if f.OwnerUserId != nil {
+		var current File
+		err = tx.Select("size", "actual_size", "status").First(&current, "file_id = ?", f.FileId).Error
+		if err != nil {
+			return err
+		}
+		if current.Status != FileStatusWriting {
+			err = chargeQuota(tx, *f.OwnerUserId, oldVersion.Size-current.Size, oldVersion.ActualSize-current.ActualSize)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
 	// Setting it as the new version
 	f.FileName = oldVersion.FileName
 	f.MIMEType = oldVersion.MIMEType
@@ -374,6 +410,10 @@ func (f *File) RevertFileToVersion(tx *gorm.DB, versionNo int, user *User) error
 	if err != nil {
 		return err
 	}
+	err = restoreTagsFromVersion(tx, f.FileId, versionNo)
+	if err != nil {
+		return err
+	}
 	// Update the file
 	err = CreateFileVersionFromFile(tx, f, user)
 
@@ -7,6 +7,8 @@ import (
 	"gorm.io/gorm/clause"
 )
 
+var ErrGroupNotFound = errors.New("group not found")
+
 type Group struct {
 	GroupId       string  `gorm:"primaryKey" json:"group_id"`
 	GroupName     string  `gorm:"not null" json:"group_name"`
@@ -14,6 +16,7 @@ type Group struct {
 	MappedGroupId string  `json:"-"`
 	Users         []*User `gorm:"many2many:user_groups;" json:"-"`
 	Roles         []*Role `gorm:"many2many:group_roles;" json:"-"`
+	Quota         *int64  `json:"-"` // In bytes, nil if unlimited
 }
 
 type GroupInterface interface {
@@ -140,7 +143,7 @@ func GetGroupById(tx *gorm.DB, groupId string) (*Group, error) {
 	if err := tx.Preload(clause.Associations).
 		First(&group, "group_id = ?", groupId).Error; err != nil {
 		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, ErrUserNotFound
+			return nil, ErrGroupNotFound
 		}
 	}
 
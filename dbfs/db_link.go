@@ -0,0 +1,159 @@
+package dbfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrNotLink           = errors.New("not a link")
+	ErrInvalidLinkTarget = errors.New("links cannot point to other links")
+)
+
+// CreateLink creates a shortcut to the target file or folder inside this
+// folder. The user needs write permission on the folder and read permission
+// on the target. An empty name uses the name of the target.
+func (f *File) CreateLink(tx *gorm.DB, user *User, name string, target *File, server string) (*File, error) {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	// Check if user has write permission (if not 403)
+	hasPermissions, err = user.HasPermission(tx, f, &PermissionNeeded{Write: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrNoPermission
+	}
+
+	if f.EntryType != IsFolder {
+		return nil, ErrNotFolder
+	}
+
+	// The user has to be able to see the target
+	hasPermissions, err = user.HasPermission(tx, target, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions || target.TrashId != nil {
+		return nil, ErrFileNotFound
+	}
+	if target.EntryType == IsLink {
+		return nil, ErrInvalidLinkTarget
+	}
+
+	if name == "" {
+		name = target.FileName
+	}
+
+	var rows int64
+	err = tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ? AND trash_id IS NULL",
+		name, f.FileId).Count(&rows).Error
+	if err != nil {
+		return nil, err
+	}
+	if rows >= 1 {
+		return nil, ErrFileFolderExists
+	}
+
+	link := &File{
+		FileId:             uuid.New().String(),
+		FileName:           name,
+		MIMEType:           target.MIMEType,
+		EntryType:          IsLink,
+		ParentFolderFileId: &f.FileId,
+		VersionNo:          0,
+		CreatedTime:        time.Now(),
+		ModifiedUserUserId: &user.UserId,
+		ModifiedTime:       time.Now(),
+		VersioningMode:     VersioningOff,
+		LinkFileFileId:     &target.FileId,
+		LastChecked:        time.Now(),
+		Status:             FileStatusGood,
+		HandledServer:      server,
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(link).Error; err != nil {
+			return err
+		}
+
+		if err := CreatePermissions(tx, link); err != nil {
+			return err
+		}
+
+		if err := CreateFileVersionFromFile(tx, link, user); err != nil {
+			return err
+		}
+
+		return queueFileEvent(tx, link, user, WebhookEventCreated, target.FileId)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+
+// ResolveLink returns the file or folder the link points to. Following a
+// link needs read permission on the target, and returns ErrFileNotFound if
+// the target was deleted or trashed.
+func (f *File) ResolveLink(tx *gorm.DB, user *User) (*File, error) {
+
+	// Check if user has read permission on the link (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	if f.EntryType != IsLink || f.LinkFileFileId == nil {
+		return nil, ErrNotLink
+	}
+
+	return GetFileById(tx, *f.LinkFileFileId, user)
+}
+
+// resolveLinkTargets fills in LinkTarget for the links in the list that point
+// to a file or folder the user can read. Dangling links are left without one.
+func resolveLinkTargets(tx *gorm.DB, user *User, files []File) error {
+	var targetIds []string
+	for _, file := range files {
+		if file.EntryType == IsLink && file.LinkFileFileId != nil {
+			targetIds = append(targetIds, *file.LinkFileFileId)
+		}
+	}
+	if len(targetIds) == 0 {
+		return nil
+	}
+
+	readable, err := readableByUser(tx, user)
+	if err != nil {
+		return err
+	}
+	var targets []File
+	err = tx.Model(&File{}).Scopes(readable).
+		Where("files.file_id IN ? AND files.trash_id IS NULL", targetIds).Find(&targets).Error
+	if err != nil {
+		return err
+	}
+
+	targetsById := make(map[string]*File, len(targets))
+	for i := range targets {
+		targetsById[targets[i].FileId] = &targets[i]
+	}
+	for i := range files {
+		if files[i].EntryType == IsLink && files[i].LinkFileFileId != nil {
+			files[i].LinkTarget = targetsById[*files[i].LinkFileFileId]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLinks(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	editor, err := dbfs.CreateNewUser(db, "linkEditor", "linkEditor", dbfs.AccountTypeEndUser,
+		"linkEditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	outsider, err := dbfs.CreateNewUser(db, "linkOutsider", "linkOutsider", dbfs.AccountTypeEndUser,
+		"linkOutsider", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+
+	// The project folder can be changed by the editor and read by the outsider
+	projectFolder, err := rootFolder.CreateSubFolder(db, "linkProject", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, projectFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true},
+		&superUser, *editor))
+	assert.NoError(t, projectFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true},
+		&superUser, *outsider))
+
+	// The document lives elsewhere and is only shared with the editor
+	documentsFolder, err := rootFolder.CreateSubFolder(db, "linkDocuments", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	archiveFolder, err := rootFolder.CreateSubFolder(db, "linkArchive", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	document, err := EXAMPLECreateFile(db, &superUser, "handbook.pdf", documentsFolder.FileId)
+	assert.NoError(t, err)
+	assert.NoError(t, document.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, &superUser, *editor))
+
+	var link *dbfs.File
+
+	listProject := func(user *dbfs.User) []dbfs.File {
+		page, err := projectFolder.ListContentsPage(db, user, &dbfs.ListOptions{})
+		assert.NoError(t, err)
+		return page.Files
+	}
+
+	t.Run("Creating links", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := projectFolder.CreateLink(db, outsider, "", document, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrNoPermission)
+		_, err = documentsFolder.CreateLink(db, editor, "", document, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		link, err = projectFolder.CreateLink(db, editor, "", document, "ThisServer")
+		Assert.NoError(err)
+		Assert.Equal(dbfs.IsLink, link.EntryType)
+		Assert.Equal("handbook.pdf", link.FileName)
+		Assert.Equal(document.FileId, *link.LinkFileFileId)
+
+		_, err = projectFolder.CreateLink(db, editor, "", document, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrFileFolderExists)
+		_, err = projectFolder.CreateLink(db, editor, "link to link", link, "ThisServer")
+		Assert.ErrorIs(err, dbfs.ErrInvalidLinkTarget)
+	})
+
+	t.Run("Following links", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		target, err := link.ResolveLink(db, editor)
+		Assert.NoError(err)
+		Assert.Equal(document.FileId, target.FileId)
+
+		// Following a link needs permission on the target
+		_, err = link.ResolveLink(db, outsider)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		_, err = document.ResolveLink(db, editor)
+		Assert.ErrorIs(err, dbfs.ErrNotLink)
+	})
+
+	t.Run("Listing links", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		files := listProject(editor)
+		Assert.Len(files, 1)
+		Assert.NotNil(files[0].LinkTarget)
+		Assert.Equal(document.FileId, files[0].LinkTarget.FileId)
+
+		files = listProject(outsider)
+		Assert.Len(files, 1)
+		Assert.Nil(files[0].LinkTarget)
+	})
+
+	t.Run("Moving and deleting the target", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		// Foreign keys are only enforced by sqlite when asked to, on the one
+		// connection the in-memory database lives on
+		sqlDB, err := db.DB()
+		Assert.NoError(err)
+		sqlDB.SetMaxOpenConns(1)
+		Assert.NoError(db.Exec("PRAGMA foreign_keys = ON").Error)
+		defer db.Exec("PRAGMA foreign_keys = OFF")
+
+		Assert.NoError(document.Move(db, archiveFolder, &superUser))
+		target, err := link.ResolveLink(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(archiveFolder.FileId, *target.ParentFolderFileId)
+
+		Assert.NoError(document.Delete(db, &superUser, "ThisServer"))
+		_, err = link.ResolveLink(db, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		// The link is left dangling
+		files := listProject(&superUser)
+		Assert.Len(files, 1)
+		Assert.Nil(files[0].LinkTarget)
+		Assert.NoError(link.Delete(db, &superUser, "ThisServer"))
+	})
+}
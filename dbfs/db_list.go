@@ -0,0 +1,224 @@
+package dbfs
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	SortByName         = "name"
+	SortBySize         = "size"
+	SortByModifiedTime = "modified_time"
+	SortByType         = "type"
+
+	MaxListLimit = 1000
+)
+
+var (
+	ErrInvalidListOptions = errors.New("invalid list options")
+	ErrInvalidCursor      = errors.New("invalid cursor")
+)
+
+// ListOptions controls the order and pagination of ListContentsPage
+type ListOptions struct {
+	SortBy       string // One of the SortBy consts, defaults to SortByName
+	Descending   bool
+	FoldersFirst bool
+	Limit        int         // 0 returns every entry
+	Cursor       string      // NextCursor of the previous page
+	Count        bool        // Whether to count the total number of entries
+	Tags         []TagFilter // Only list the entries matching every filter
+}
+
+// ListPage is a page of the contents of a folder
+type ListPage struct {
+	Files      []File `json:"files"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Total      *int64 `json:"total,omitempty"`
+}
+
+// listCursor is the position of the last entry of a page
+type listCursor struct {
+	EntryType int8   `json:"e"`
+	Value     string `json:"v"`
+	FileId    string `json:"id"`
+}
+
+// listSortColumn returns the column to sort on for a sort key
+func listSortColumn(sortBy string) (string, bool) {
+	switch sortBy {
+	case "", SortByName:
+		return "LOWER(files.file_name)", true
+	case SortBySize:
+		return "files.size", true
+	case SortByModifiedTime:
+		return "files.modified_time", true
+	case SortByType:
+		return "files.mime_type", true
+	}
+	return "", false
+}
+
+// cursorValue returns the value of the sort key of a file as stored in a cursor
+func cursorValue(sortBy string, file *File) string {
+	switch sortBy {
+	case SortBySize:
+		return strconv.FormatInt(file.Size, 10)
+	case SortByModifiedTime:
+		return file.ModifiedTime.Format(time.RFC3339Nano)
+	case SortByType:
+		return file.MIMEType
+	default:
+		return strings.ToLower(file.FileName)
+	}
+}
+
+// parseCursorValue converts a cursor value back into its column's type
+func parseCursorValue(sortBy string, value string) (interface{}, error) {
+	switch sortBy {
+	case SortBySize:
+		return strconv.ParseInt(value, 10, 64)
+	case SortByModifiedTime:
+		return time.Parse(time.RFC3339Nano, value)
+	default:
+		return value, nil
+	}
+}
+
+// ListContentsPage returns a sorted page of the contents of a folder that the
+// user can read. Permissions are checked in the query, so entries the user
+// cannot read are left out without affecting the page size.
+func (f *File) ListContentsPage(tx *gorm.DB, user *User, opts *ListOptions) (*ListPage, error) {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	if f.EntryType != IsFolder {
+		return nil, ErrNotFolder
+	}
+
+	sortColumn, ok := listSortColumn(opts.SortBy)
+	if !ok || opts.Limit < 0 || opts.Limit > MaxListLimit {
+		return nil, ErrInvalidListOptions
+	}
+	for _, filter := range opts.Tags {
+		if filter.Key == "" {
+			return nil, ErrInvalidListOptions
+		}
+	}
+
+	readable, err := readableByUser(tx, user)
+	if err != nil {
+		return nil, err
+	}
+	q := tx.Model(&File{}).Scopes(readable).
+		Where("files.parent_folder_file_id = ? AND files.trash_id IS NULL", f.FileId).
+		Scopes(tagFilterScope(opts.Tags))
+
+	page := &ListPage{Files: []File{}}
+	if opts.Count {
+		var total int64
+		if err := q.Session(&gorm.Session{}).Count(&total).Error; err != nil {
+			return nil, err
+		}
+		page.Total = &total
+	}
+
+	// The columns to order by, from most to least significant
+	direction, op := "ASC", ">"
+	if opts.Descending {
+		direction, op = "DESC", "<"
+	}
+	type orderColumn struct {
+		column    string
+		direction string
+		op        string
+	}
+	var columns []orderColumn
+	if opts.FoldersFirst {
+		columns = append(columns, orderColumn{"files.entry_type", "ASC", ">"})
+	}
+	columns = append(columns,
+		orderColumn{sortColumn, direction, op},
+		orderColumn{"files.file_id", direction, op})
+
+	// Continue after the cursor, i.e. (a > x) OR (a = x AND b > y) OR ...
+	if opts.Cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(opts.Cursor)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+		var cursor listCursor
+		if err := json.Unmarshal(raw, &cursor); err != nil {
+			return nil, ErrInvalidCursor
+		}
+		sortValue, err := parseCursorValue(opts.SortBy, cursor.Value)
+		if err != nil {
+			return nil, ErrInvalidCursor
+		}
+
+		values := []interface{}{sortValue, cursor.FileId}
+		if opts.FoldersFirst {
+			values = append([]interface{}{cursor.EntryType}, values...)
+		}
+
+		var conditions []string
+		var args []interface{}
+		for i := range columns {
+			var parts []string
+			for j := 0; j < i; j++ {
+				parts = append(parts, columns[j].column+" = ?")
+				args = append(args, values[j])
+			}
+			parts = append(parts, columns[i].column+" "+columns[i].op+" ?")
+			args = append(args, values[i])
+			conditions = append(conditions, "("+strings.Join(parts, " AND ")+")")
+		}
+		q = q.Where("("+strings.Join(conditions, " OR ")+")", args...)
+	}
+
+	for _, column := range columns {
+		q = q.Order(column.column + " " + column.direction)
+	}
+
+	// Fetch one more entry than needed to know if there is another page
+	if opts.Limit > 0 {
+		q = q.Limit(opts.Limit + 1)
+	}
+
+	if err := q.Find(&page.Files).Error; err != nil {
+		return nil, err
+	}
+
+	// Show what the links point to
+	if err := resolveLinkTargets(tx, user, page.Files); err != nil {
+		return nil, err
+	}
+
+	if opts.Limit > 0 && len(page.Files) > opts.Limit {
+		page.Files = page.Files[:opts.Limit]
+		last := &page.Files[len(page.Files)-1]
+		raw, err := json.Marshal(listCursor{
+			EntryType: last.EntryType,
+			Value:     cursorValue(opts.SortBy, last),
+			FileId:    last.FileId,
+		})
+		if err != nil {
+			return nil, err
+		}
+		page.NextCursor = base64.RawURLEncoding.EncodeToString(raw)
+	}
+
+	return page, nil
+}
@@ -0,0 +1,125 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestListContentsPage(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+	folder, err := rootFolder.CreateSubFolder(db, "listing", &superUser, "ThisServer")
+	assert.NoError(t, err)
+
+	// Files b, d and e with increasing sizes and times, then folders C and a
+	base := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, name := range []string{"b", "d", "e"} {
+		file, err := EXAMPLECreateFile(db, &superUser, name, folder.FileId)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Model(&dbfs.File{}).Where("file_id = ?", file.FileId).
+			UpdateColumn("size", int64(100*(i+1))).Error)
+		assert.NoError(t, file.SetModifiedTime(db, base.Add(time.Duration(i)*time.Hour), &superUser))
+	}
+	for _, name := range []string{"C", "a"} {
+		_, err := folder.CreateSubFolder(db, name, &superUser, "ThisServer")
+		assert.NoError(t, err)
+	}
+
+	names := func(files []dbfs.File) []string {
+		var result []string
+		for _, file := range files {
+			result = append(result, file.FileName)
+		}
+		return result
+	}
+
+	// listAll follows the cursors until the last page
+	listAll := func(opts dbfs.ListOptions) []string {
+		var result []string
+		for {
+			page, err := folder.ListContentsPage(db, &superUser, &opts)
+			assert.NoError(t, err)
+			assert.LessOrEqual(t, len(page.Files), opts.Limit)
+			result = append(result, names(page.Files)...)
+			if page.NextCursor == "" {
+				return result
+			}
+			opts.Cursor = page.NextCursor
+		}
+	}
+
+	t.Run("Sorting", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		page, err := folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{})
+		Assert.NoError(err)
+		Assert.Equal([]string{"a", "b", "C", "d", "e"}, names(page.Files))
+		Assert.Empty(page.NextCursor)
+		Assert.Nil(page.Total)
+
+		page, err = folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{FoldersFirst: true, Descending: true})
+		Assert.NoError(err)
+		Assert.Equal([]string{"C", "a", "e", "d", "b"}, names(page.Files))
+
+		page, err = folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{
+			SortBy: dbfs.SortBySize, FoldersFirst: true, Count: true})
+		Assert.NoError(err)
+		Assert.Equal([]string{"b", "d", "e"}, names(page.Files)[2:])
+		Assert.Equal(int64(5), *page.Total)
+	})
+
+	t.Run("Pagination", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.Equal([]string{"a", "b", "C", "d", "e"}, listAll(dbfs.ListOptions{Limit: 2}))
+		Assert.Equal([]string{"C", "a", "e", "d", "b"},
+			listAll(dbfs.ListOptions{Limit: 2, FoldersFirst: true, Descending: true}))
+		Assert.Equal([]string{"e", "d", "b"},
+			listAll(dbfs.ListOptions{Limit: 1, SortBy: dbfs.SortByModifiedTime, Descending: true})[2:])
+		Assert.Equal([]string{"b", "d", "e"},
+			listAll(dbfs.ListOptions{Limit: 3, SortBy: dbfs.SortBySize})[2:])
+
+		_, err := folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{Cursor: "garbage"})
+		Assert.ErrorIs(err, dbfs.ErrInvalidCursor)
+		_, err = folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{SortBy: "owner"})
+		Assert.ErrorIs(err, dbfs.ErrInvalidListOptions)
+		_, err = folder.ListContentsPage(db, &superUser, &dbfs.ListOptions{Limit: dbfs.MaxListLimit + 1})
+		Assert.ErrorIs(err, dbfs.ErrInvalidListOptions)
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		user, err := dbfs.CreateNewUser(db, "listUser", "listUser", dbfs.AccountTypeEndUser,
+			"listUser", "listUser", "listUser", "listUser", "ThisServer")
+		Assert.NoError(err)
+
+		_, err = folder.ListContentsPage(db, user, &dbfs.ListOptions{})
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		Assert.NoError(folder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true}, &superUser, *user))
+
+		// Only the entries the user can read are listed and counted
+		b, err := dbfs.GetFileByPath(db, "/listing/b", &superUser, false)
+		Assert.NoError(err)
+		Assert.NoError(db.Where("file_id = ? AND user_id = ?", b.FileId, user.UserId).
+			Delete(&dbfs.Permission{}).Error)
+
+		page, err := folder.ListContentsPage(db, user, &dbfs.ListOptions{Limit: 2, Count: true})
+		Assert.NoError(err)
+		Assert.Equal([]string{"a", "C"}, names(page.Files))
+		Assert.Equal(int64(4), *page.Total)
+	})
+}
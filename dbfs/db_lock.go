@@ -0,0 +1,234 @@
+package dbfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	// LockAdvisory tells others the file is being edited, without stopping
+	// them from changing it
+	LockAdvisory = int8(1)
+	// LockExclusive stops other users from changing, moving or deleting the
+	// file until it is unlocked or expires
+	LockExclusive = int8(2)
+
+	DefaultLockDuration = 30 * time.Minute
+	MaxLockDuration     = 24 * time.Hour
+)
+
+var (
+	ErrFileLocked       = errors.New("file is locked by another user")
+	ErrLockNotFound     = errors.New("file is not locked")
+	ErrInvalidLockToken = errors.New("invalid lock token")
+	ErrInvalidLock      = errors.New("invalid lock type or duration")
+)
+
+// FileLock is a lock held by a user on a file. Locks that are past their
+// expiry time are ignored, and replaced when the file is locked again.
+type FileLock struct {
+	FileId      string    `gorm:"primaryKey" json:"file_id"`
+	LockToken   string    `gorm:"not null; unique" json:"lock_token,omitempty"`
+	LockType    int8      `gorm:"not null" json:"lock_type"`
+	OwnerUserId string    `gorm:"not null" json:"owner_user_id"`
+	CreatedTime time.Time `gorm:"not null" json:"created_time"`
+	ExpiryTime  time.Time `gorm:"not null; index" json:"expiry_time"`
+}
+
+// getActiveLock returns the lock on the file, or nil if there is none that has
+// not expired.
+func (f *File) getActiveLock(tx *gorm.DB) (*FileLock, error) {
+	var lock FileLock
+	err := tx.Where("file_id = ? AND expiry_time > ?", f.FileId, time.Now()).First(&lock).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &lock, nil
+}
+
+// checkLock returns ErrFileLocked if another user holds an exclusive lock on
+// the file.
+func (f *File) checkLock(tx *gorm.DB, user *User) error {
+	lock, err := f.getActiveLock(tx)
+	if err != nil {
+		return err
+	}
+	if lock != nil && lock.LockType == LockExclusive && lock.OwnerUserId != user.UserId {
+		return ErrFileLocked
+	}
+	return nil
+}
+
+// checkSubtreeLock returns ErrFileLocked if another user holds an exclusive
+// lock on the file, or on anything in it if it is a folder.
+func (f *File) checkSubtreeLock(tx *gorm.DB, user *User) error {
+	if f.EntryType != IsFolder {
+		return f.checkLock(tx, user)
+	}
+
+	var count int64
+	err := tx.Model(&FileLock{}).
+		Where("file_id IN ("+subtreeQuery+") AND lock_type = ? AND owner_user_id <> ? AND expiry_time > ?",
+			f.FileId, LockExclusive, user.UserId, time.Now()).
+		Count(&count).Error
+	if err != nil {
+		return err
+	} else if count > 0 {
+		return ErrFileLocked
+	}
+	return nil
+}
+
+// checkLockDuration returns the duration of a lock, defaulting it if 0
+func checkLockDuration(duration time.Duration) (time.Duration, error) {
+	if duration == 0 {
+		return DefaultLockDuration, nil
+	}
+	if duration < 0 || duration > MaxLockDuration {
+		return 0, ErrInvalidLock
+	}
+	return duration, nil
+}
+
+// Lock locks the file for the user. The lock token returned is needed to
+// refresh or unlock it. It fails with ErrFileLocked if the file is already
+// locked, even by the same user.
+func (f *File) Lock(tx *gorm.DB, user *User, lockType int8, duration time.Duration) (*FileLock, error) {
+
+	// Check if user has write permission
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Write: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrNoPermission
+	}
+
+	if f.EntryType != IsFile {
+		return nil, ErrNotFile
+	}
+	if lockType != LockAdvisory && lockType != LockExclusive {
+		return nil, ErrInvalidLock
+	}
+	duration, err = checkLockDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+
+	lock := &FileLock{
+		FileId:      f.FileId,
+		LockToken:   uuid.New().String(),
+		LockType:    lockType,
+		OwnerUserId: user.UserId,
+		CreatedTime: time.Now(),
+	}
+	lock.ExpiryTime = lock.CreatedTime.Add(duration)
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		existing, err := f.getActiveLock(tx)
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return ErrFileLocked
+		}
+
+		// Replacing the expired lock, if any
+		err = tx.Where("file_id = ?", f.FileId).Delete(&FileLock{}).Error
+		if err != nil {
+			return err
+		}
+		return tx.Create(lock).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return lock, nil
+}
+
+// GetLock returns the active lock on the file. The lock token is only
+// returned to the owner of the lock.
+func (f *File) GetLock(tx *gorm.DB, user *User) (*FileLock, error) {
+
+	// Check if user has read permission
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	lock, err := f.getActiveLock(tx)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, ErrLockNotFound
+	}
+	if lock.OwnerUserId != user.UserId {
+		lock.LockToken = ""
+	}
+	return lock, nil
+}
+
+// getOwnLock returns the active lock on the file if it belongs to the user
+// and matches the token given.
+func (f *File) getOwnLock(tx *gorm.DB, user *User, token string) (*FileLock, error) {
+	lock, err := f.getActiveLock(tx)
+	if err != nil {
+		return nil, err
+	}
+	if lock == nil {
+		return nil, ErrLockNotFound
+	}
+	if lock.OwnerUserId != user.UserId || lock.LockToken != token {
+		return nil, ErrInvalidLockToken
+	}
+	return lock, nil
+}
+
+// RefreshLock extends the lock held by the user on the file
+func (f *File) RefreshLock(tx *gorm.DB, user *User, token string, duration time.Duration) (*FileLock, error) {
+	duration, err := checkLockDuration(duration)
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := f.getOwnLock(tx, user, token)
+	if err != nil {
+		return nil, err
+	}
+
+	lock.ExpiryTime = time.Now().Add(duration)
+	if err := tx.Model(lock).Update("expiry_time", lock.ExpiryTime).Error; err != nil {
+		return nil, err
+	}
+	return lock, nil
+}
+
+// Unlock releases the lock held by the user on the file
+func (f *File) Unlock(tx *gorm.DB, user *User, token string) error {
+	lock, err := f.getOwnLock(tx, user, token)
+	if err != nil {
+		return err
+	}
+	return tx.Delete(lock).Error
+}
+
+// BreakLock removes the lock on the file, whoever holds it. Only meant for
+// admins.
+func (f *File) BreakLock(tx *gorm.DB) error {
+	result := tx.Where("file_id = ?", f.FileId).Delete(&FileLock{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrLockNotFound
+	}
+	return nil
+}
@@ -0,0 +1,176 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileLocks(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// A second user allowed to write to the files in the folder
+	editor, err := dbfs.CreateNewUser(db, "lockEditor", "lockEditor", dbfs.AccountTypeEndUser,
+		"lockEditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	workFolder, err := rootFolder.CreateSubFolder(db, "lockFolder", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, workFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true},
+		&superUser, *editor))
+
+	otherFolder, err := workFolder.CreateSubFolder(db, "otherFolder", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	file, err := EXAMPLECreateFile(db, &superUser, "spreadsheet.xlsx", workFolder.FileId)
+	assert.NoError(t, err)
+
+	rename := func(user *dbfs.User, name string) error {
+		return file.UpdateMetaData(db, dbfs.FileMetadataModification{
+			FileName: name, MIMEType: file.MIMEType, VersioningMode: file.VersioningMode,
+		}, user)
+	}
+
+	var lock *dbfs.FileLock
+
+	t.Run("Locking a file", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := file.Lock(db, &superUser, 5, 0)
+		Assert.ErrorIs(err, dbfs.ErrInvalidLock)
+		_, err = file.Lock(db, &superUser, dbfs.LockExclusive, 48*time.Hour)
+		Assert.ErrorIs(err, dbfs.ErrInvalidLock)
+		_, err = workFolder.Lock(db, &superUser, dbfs.LockExclusive, 0)
+		Assert.ErrorIs(err, dbfs.ErrNotFile)
+
+		lock, err = file.Lock(db, &superUser, dbfs.LockExclusive, 0)
+		Assert.NoError(err)
+		Assert.NotEmpty(lock.LockToken)
+		Assert.WithinDuration(time.Now().Add(dbfs.DefaultLockDuration), lock.ExpiryTime, time.Minute)
+
+		// Only one lock at a time
+		_, err = file.Lock(db, editor, dbfs.LockAdvisory, 0)
+		Assert.ErrorIs(err, dbfs.ErrFileLocked)
+
+		// The token is only shown to the owner
+		ownLock, err := file.GetLock(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(lock.LockToken, ownLock.LockToken)
+		otherLock, err := file.GetLock(db, editor)
+		Assert.NoError(err)
+		Assert.Empty(otherLock.LockToken)
+		Assert.Equal(superUser.UserId, otherLock.OwnerUserId)
+	})
+
+	t.Run("Respecting exclusive locks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.ErrorIs(rename(editor, "renamed.xlsx"), dbfs.ErrFileLocked)
+		Assert.ErrorIs(file.Move(db, otherFolder, editor), dbfs.ErrFileLocked)
+		_, err := file.Trash(db, editor)
+		Assert.ErrorIs(err, dbfs.ErrFileLocked)
+		Assert.ErrorIs(file.Delete(db, editor, "ThisServer"), dbfs.ErrFileLocked)
+		Assert.ErrorIs(EXAMPLEUpdateFile(db, file, "", editor), dbfs.ErrFileLocked)
+
+		// The owner of the lock can still change it
+		Assert.NoError(rename(&superUser, "renamed.xlsx"))
+	})
+
+	t.Run("Refreshing and unlocking", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := file.RefreshLock(db, editor, lock.LockToken, time.Hour)
+		Assert.ErrorIs(err, dbfs.ErrInvalidLockToken)
+		_, err = file.RefreshLock(db, &superUser, "wrong", time.Hour)
+		Assert.ErrorIs(err, dbfs.ErrInvalidLockToken)
+
+		refreshed, err := file.RefreshLock(db, &superUser, lock.LockToken, time.Hour)
+		Assert.NoError(err)
+		Assert.True(refreshed.ExpiryTime.After(lock.ExpiryTime))
+
+		Assert.ErrorIs(file.Unlock(db, editor, lock.LockToken), dbfs.ErrInvalidLockToken)
+		Assert.NoError(file.Unlock(db, &superUser, lock.LockToken))
+		_, err = file.GetLock(db, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrLockNotFound)
+
+		Assert.NoError(rename(editor, "spreadsheet.xlsx"))
+	})
+
+	t.Run("Advisory locks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		advisory, err := file.Lock(db, &superUser, dbfs.LockAdvisory, 0)
+		Assert.NoError(err)
+
+		// Others are only told about it
+		Assert.NoError(rename(editor, "edited.xlsx"))
+
+		Assert.NoError(file.Unlock(db, &superUser, advisory.LockToken))
+	})
+
+	t.Run("Expired locks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := file.Lock(db, &superUser, dbfs.LockExclusive, 0)
+		Assert.NoError(err)
+		Assert.NoError(db.Model(&dbfs.FileLock{}).Where("file_id = ?", file.FileId).
+			Update("expiry_time", time.Now().Add(-time.Minute)).Error)
+
+		Assert.NoError(rename(editor, "expired.xlsx"))
+		_, err = file.GetLock(db, editor)
+		Assert.ErrorIs(err, dbfs.ErrLockNotFound)
+
+		// And can be replaced
+		_, err = file.Lock(db, editor, dbfs.LockExclusive, 0)
+		Assert.NoError(err)
+	})
+
+	t.Run("Breaking locks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(file.BreakLock(db))
+		Assert.ErrorIs(file.BreakLock(db), dbfs.ErrLockNotFound)
+		Assert.NoError(file.Move(db, otherFolder, &superUser))
+	})
+
+	t.Run("Locked files inside folders", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		// The file is now in otherFolder, under workFolder
+		_, err := file.Lock(db, &superUser, dbfs.LockExclusive, 0)
+		Assert.NoError(err)
+		destFolder, err := workFolder.CreateSubFolder(db, "destFolder", &superUser, "ThisServer")
+		Assert.NoError(err)
+
+		Assert.ErrorIs(otherFolder.Move(db, destFolder, editor), dbfs.ErrFileLocked)
+		_, err = otherFolder.Trash(db, editor)
+		Assert.ErrorIs(err, dbfs.ErrFileLocked)
+		_, err = workFolder.Trash(db, editor)
+		Assert.ErrorIs(err, dbfs.ErrFileLocked)
+		Assert.ErrorIs(otherFolder.Delete(db, editor, "ThisServer"), dbfs.ErrFileLocked)
+
+		// The file is still there
+		_, err = dbfs.GetFileById(db, file.FileId, editor)
+		Assert.NoError(err)
+
+		// The owner of the lock can still move the folder
+		Assert.NoError(otherFolder.Move(db, destFolder, &superUser))
+
+		// Advisory locks do not stop anyone
+		Assert.NoError(file.BreakLock(db))
+		_, err = file.Lock(db, &superUser, dbfs.LockAdvisory, 0)
+		Assert.NoError(err)
+		_, err = otherFolder.Trash(db, editor)
+		Assert.NoError(err)
+	})
+}
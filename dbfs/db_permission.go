@@ -17,9 +17,9 @@ type Permission struct {
 	FileId       string         `gorm:"primaryKey; not_null" json:"file_id"`
 	PermissionId string         `gorm:"primaryKey;" json:"permission_id"`
 	User         User           `gorm:"foreignKey:UserId; references:UserId"`
-	UserId       *string        `json:"user_id"`
+	UserId       *string        `gorm:"index" json:"user_id"`
 	Group        Group          `gorm:"foreignKey:GroupId; references:GroupId"`
-	GroupId      *string        `json:"group_id"`
+	GroupId      *string        `gorm:"index" json:"group_id"`
 	CanRead      bool           `json:"can_read"`
 	CanWrite     bool           `json:"can_write"`
 	CanExecute   bool           `json:"can_execute"`
@@ -890,3 +890,35 @@ func (g *Group) HasPermission(tx *gorm.DB, file *File, needed *PermissionNeeded)
 	return hasPermission, nil
 
 }
+
+// readableByUser returns a scope that limits a query on files to the ones the
+// user can read. It follows the same rules as User.HasPermission: a permission
+// given to the user directly takes precedence over the ones of their groups.
+func readableByUser(tx *gorm.DB, user *User) (func(db *gorm.DB) *gorm.DB, error) {
+
+	if user.AccountType == AccountTypeAdmin {
+		return func(db *gorm.DB) *gorm.DB { return db }, nil
+	}
+
+	groups, err := user.GetGroupsWithUser(tx)
+	if err != nil {
+		return nil, err
+	}
+	groupIds := make([]string, len(groups))
+	for i, group := range groups {
+		groupIds[i] = group.GroupId
+	}
+
+	return func(db *gorm.DB) *gorm.DB {
+		if len(groupIds) == 0 {
+			return db.Where("files.file_id IN (SELECT p.file_id FROM permissions p "+
+				"WHERE p.deleted_at IS NULL AND p.can_read = ? AND p.user_id = ?)",
+				true, user.UserId)
+		}
+		return db.Where("files.file_id IN (SELECT p.file_id FROM permissions p "+
+			"WHERE p.deleted_at IS NULL AND p.can_read = ? AND (p.user_id = ? OR "+
+			"(p.group_id IN ? AND NOT EXISTS (SELECT 1 FROM permissions u "+
+			"WHERE u.file_id = p.file_id AND u.user_id = ? AND u.deleted_at IS NULL))))",
+			true, user.UserId, groupIds, user.UserId)
+	}, nil
+}
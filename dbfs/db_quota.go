@@ -0,0 +1,242 @@
+package dbfs
+
+import (
+	"errors"
+	"fmt"
+
+	"gorm.io/gorm"
+)
+
+// Key: QuotaCountReplicas
+// Value (int): 1 if the parity shards of a file count towards the quotas,
+// i.e. quotas are checked against the actual size instead of the size.
+const QuotaCountReplicas = "QuotaCountReplicas"
+
+var (
+	ErrQuotaExceeded = errors.New("storage quota exceeded")
+	ErrInvalidQuota  = errors.New("quota cannot be negative")
+)
+
+// QuotaUsage is the storage used by a user or group against their quota.
+// The usage of a group is the total usage of its members.
+type QuotaUsage struct {
+	UserId        string `json:"user_id,omitempty"`
+	GroupId       string `json:"group_id,omitempty"`
+	Name          string `json:"name"`
+	Quota         *int64 `json:"quota"`
+	UsedSize      int64  `json:"used_size"`
+	UsedActual    int64  `json:"used_actual_size"`
+	Used          int64  `json:"used"` // The one checked against the quota
+	CountReplicas bool   `json:"count_replicas"`
+}
+
+// newQuotaUsage fills in which of the sizes is checked against the quota
+func newQuotaUsage(usage QuotaUsage, countReplicas bool) QuotaUsage {
+	usage.CountReplicas = countReplicas
+	usage.Used = usage.UsedSize
+	if countReplicas {
+		usage.Used = usage.UsedActual
+	}
+	return usage
+}
+
+// GetQuotaCountReplicas returns whether parity shards count towards the quotas
+func GetQuotaCountReplicas(tx *gorm.DB) (bool, error) {
+	var pair KeyValueDBPair
+	err := tx.First(&pair, "key = ?", QuotaCountReplicas).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	return pair.ValueInt == 1, nil
+}
+
+// SetQuotaCountReplicas sets whether parity shards count towards the quotas
+func SetQuotaCountReplicas(tx *gorm.DB, countReplicas bool) error {
+	pair := KeyValueDBPair{Key: QuotaCountReplicas}
+	if countReplicas {
+		pair.ValueInt = 1
+	}
+	return tx.Save(&pair).Error
+}
+
+// SetQuota sets the quota of the user in bytes. A nil quota is unlimited.
+func (user *User) SetQuota(tx *gorm.DB, quota *int64) error {
+	if quota != nil && *quota < 0 {
+		return ErrInvalidQuota
+	}
+	if err := tx.Model(&User{}).Where("user_id = ?", user.UserId).
+		UpdateColumn("quota", quota).Error; err != nil {
+		return err
+	}
+	user.Quota = quota
+	return nil
+}
+
+// SetQuota sets the quota of the group in bytes. A nil quota is unlimited.
+func (g *Group) SetQuota(tx *gorm.DB, quota *int64) error {
+	if quota != nil && *quota < 0 {
+		return ErrInvalidQuota
+	}
+	if err := tx.Model(&Group{}).Where("group_id = ?", g.GroupId).
+		UpdateColumn("quota", quota).Error; err != nil {
+		return err
+	}
+	g.Quota = quota
+	return nil
+}
+
+// GetUsersQuotaUsage returns the usage of every user, or only of the users
+// with the ids given.
+func GetUsersQuotaUsage(tx *gorm.DB, userIds ...string) ([]QuotaUsage, error) {
+	countReplicas, err := GetQuotaCountReplicas(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := tx.Model(&User{}).
+		Select("user_id, name, quota, used_size, used_actual").Order("name")
+	if len(userIds) > 0 {
+		q = q.Where("user_id IN ?", userIds)
+	}
+
+	var usages []QuotaUsage
+	if err := q.Scan(&usages).Error; err != nil {
+		return nil, err
+	}
+	for i := range usages {
+		usages[i] = newQuotaUsage(usages[i], countReplicas)
+	}
+	return usages, nil
+}
+
+// GetGroupsQuotaUsage returns the usage of every group, or only of the groups
+// with the ids given.
+func GetGroupsQuotaUsage(tx *gorm.DB, groupIds ...string) ([]QuotaUsage, error) {
+	countReplicas, err := GetQuotaCountReplicas(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	q := tx.Model(&Group{}).
+		Select("groups.group_id, groups.group_name AS name, groups.quota, " +
+			"COALESCE(SUM(users.used_size), 0) AS used_size, " +
+			"COALESCE(SUM(users.used_actual), 0) AS used_actual").
+		Joins("LEFT JOIN user_groups ON user_groups.group_group_id = groups.group_id").
+		Joins("LEFT JOIN users ON users.user_id = user_groups.user_user_id AND users.deleted_at IS NULL").
+		Group("groups.group_id, groups.group_name, groups.quota").Order("groups.group_name")
+	if len(groupIds) > 0 {
+		q = q.Where("groups.group_id IN ?", groupIds)
+	}
+
+	var usages []QuotaUsage
+	if err := q.Scan(&usages).Error; err != nil {
+		return nil, err
+	}
+	for i := range usages {
+		usages[i] = newQuotaUsage(usages[i], countReplicas)
+	}
+	return usages, nil
+}
+
+// GetQuotaUsage returns the usage of the user against their quota
+func (user *User) GetQuotaUsage(tx *gorm.DB) (*QuotaUsage, error) {
+	usages, err := GetUsersQuotaUsage(tx, user.UserId)
+	if err != nil {
+		return nil, err
+	} else if len(usages) == 0 {
+		return nil, ErrUserNotFound
+	}
+	return &usages[0], nil
+}
+
+// GetQuotaUsage returns the usage of the group against its quota
+func (g *Group) GetQuotaUsage(tx *gorm.DB) (*QuotaUsage, error) {
+	usages, err := GetGroupsQuotaUsage(tx, g.GroupId)
+	if err != nil {
+		return nil, err
+	} else if len(usages) == 0 {
+		return nil, ErrGroupNotFound
+	}
+	return &usages[0], nil
+}
+
+// CheckQuota returns ErrQuotaExceeded if adding the sizes given to the usage
+// of the user would go over the quota of the user, or of any of their groups.
+func CheckQuota(tx *gorm.DB, userId string, size, actualSize int64) error {
+	usages, err := GetUsersQuotaUsage(tx, userId)
+	if err != nil {
+		return err
+	}
+
+	var groupIds []string
+	err = tx.Table("user_groups").Where("user_user_id = ?", userId).
+		Pluck("group_group_id", &groupIds).Error
+	if err != nil {
+		return err
+	}
+	if len(groupIds) > 0 {
+		groupUsages, err := GetGroupsQuotaUsage(tx, groupIds...)
+		if err != nil {
+			return err
+		}
+		usages = append(usages, groupUsages...)
+	}
+
+	for _, usage := range usages {
+		if usage.Quota == nil {
+			continue
+		}
+		added := size
+		if usage.CountReplicas {
+			added = actualSize
+		}
+		// Writes that don't add anything are always allowed
+		if added > 0 && usage.Used+added > *usage.Quota {
+			owner := "user"
+			if usage.GroupId != "" {
+				owner = "group"
+			}
+			return fmt.Errorf("%w: %s %q is using %d of %d bytes", ErrQuotaExceeded,
+				owner, usage.Name, usage.Used, *usage.Quota)
+		}
+	}
+
+	return nil
+}
+
+// CheckQuotaLeft returns ErrQuotaExceeded if the user, or any of their
+// groups, has already used up their quota.
+func CheckQuotaLeft(tx *gorm.DB, userId string) error {
+	return CheckQuota(tx, userId, 1, 1)
+}
+
+// chargeQuota adds the sizes given (which can be negative) to the usage of
+// the user.
+func chargeQuota(tx *gorm.DB, userId string, size, actualSize int64) error {
+	if size == 0 && actualSize == 0 {
+		return nil
+	}
+	return tx.Model(&User{}).Where("user_id = ?", userId).UpdateColumns(map[string]interface{}{
+		"used_size":   gorm.Expr("used_size + ?", size),
+		"used_actual": gorm.Expr("used_actual + ?", actualSize),
+	}).Error
+}
+
+// RecalculateQuotaUsage recalculates the usage of every user from the files
+// that they own, in case it has drifted. Files created before quotas existed
+// are given to the user that last modified them.
+func RecalculateQuotaUsage(tx *gorm.DB) error {
+	err := tx.Model(&File{}).Where("owner_user_id IS NULL AND entry_type = ?", IsFile).
+		UpdateColumn("owner_user_id", gorm.Expr("modified_user_user_id")).Error
+	if err != nil {
+		return err
+	}
+
+	owned := "FROM files WHERE files.owner_user_id = users.user_id AND files.entry_type = ? AND files.status <> ?"
+	return tx.Model(&User{}).Where("1 = 1").UpdateColumns(map[string]interface{}{
+		"used_size":   gorm.Expr("(SELECT COALESCE(SUM(files.size), 0) "+owned+")", IsFile, FileStatusWriting),
+		"used_actual": gorm.Expr("(SELECT COALESCE(SUM(files.actual_size), 0) "+owned+")", IsFile, FileStatusWriting),
+	}).Error
+}
@@ -0,0 +1,127 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	user, err := dbfs.CreateNewUser(db, "quotaUser", "quotaUser", dbfs.AccountTypeEndUser,
+		"quotaUser", "quotaUser", "quotaUser", "quotaUser", "ThisServer")
+	assert.NoError(t, err)
+	group, err := dbfs.CreateNewGroup(db, "quotaGroup", "quotaGroup")
+	assert.NoError(t, err)
+	assert.NoError(t, user.AddToGroup(db, group))
+
+	folder, err := rootFolder.CreateSubFolder(db, "quota", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, folder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true},
+		&superUser, *user))
+
+	getUsage := func(t *testing.T) *dbfs.QuotaUsage {
+		usage, err := user.GetQuotaUsage(db)
+		assert.NoError(t, err)
+		return usage
+	}
+
+	var file *dbfs.File
+
+	t.Run("Charging the owner", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		file, err = EXAMPLECreateFile(db, user, "a.txt", folder.FileId)
+		Assert.NoError(err)
+		Assert.Equal(user.UserId, *file.OwnerUserId)
+
+		usage := getUsage(t)
+		Assert.Equal(int64(412), usage.UsedSize)
+		Assert.Equal(int64(412), usage.Used)
+		Assert.Nil(usage.Quota)
+
+		// Copies are charged to the user making them
+		Assert.NoError(file.Copy(db, folder, &superUser, "ThisServer"))
+		Assert.Equal(int64(412), getUsage(t).UsedSize)
+		superUsage, err := superUser.GetQuotaUsage(db)
+		Assert.NoError(err)
+		Assert.Equal(int64(412), superUsage.UsedSize)
+
+		// The group is charged for its members
+		groupUsage, err := group.GetQuotaUsage(db)
+		Assert.NoError(err)
+		Assert.Equal(int64(412), groupUsage.UsedSize)
+		Assert.Equal("quotaGroup", groupUsage.Name)
+	})
+
+	t.Run("Enforcing quotas", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		quota := int64(500)
+		Assert.ErrorIs(user.SetQuota(db, &[]int64{-1}[0]), dbfs.ErrInvalidQuota)
+		Assert.NoError(user.SetQuota(db, &quota))
+		Assert.NoError(dbfs.CheckQuotaLeft(db, user.UserId))
+		Assert.ErrorIs(dbfs.CheckQuota(db, user.UserId, 100, 100), dbfs.ErrQuotaExceeded)
+
+		// Replicas counting towards the quota
+		Assert.NoError(db.Model(&dbfs.User{}).Where("user_id = ?", user.UserId).
+			Update("used_actual", 1000).Error)
+		Assert.NoError(dbfs.SetQuotaCountReplicas(db, true))
+		Assert.Equal(int64(1000), getUsage(t).Used)
+		Assert.ErrorIs(dbfs.CheckQuotaLeft(db, user.UserId), dbfs.ErrQuotaExceeded)
+		Assert.NoError(dbfs.SetQuotaCountReplicas(db, false))
+		Assert.NoError(db.Model(&dbfs.User{}).Where("user_id = ?", user.UserId).
+			Update("used_actual", 412).Error)
+
+		// Group quotas apply to every member
+		Assert.NoError(user.SetQuota(db, nil))
+		groupQuota := int64(412)
+		Assert.NoError(group.SetQuota(db, &groupQuota))
+		Assert.ErrorIs(dbfs.CheckQuotaLeft(db, user.UserId), dbfs.ErrQuotaExceeded)
+		Assert.NoError(dbfs.CheckQuotaLeft(db, superUser.UserId))
+
+		// Copying is rejected too
+		Assert.ErrorIs(file.Copy(db, folder, user, "ThisServer"), dbfs.ErrQuotaExceeded)
+		Assert.Equal(int64(412), getUsage(t).UsedSize)
+		Assert.NoError(group.SetQuota(db, nil))
+	})
+
+	t.Run("Freeing space", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		// Trashed files still count until they are purged
+		item, err := file.Trash(db, user)
+		Assert.NoError(err)
+		Assert.Equal(int64(412), getUsage(t).UsedSize)
+
+		Assert.NoError(item.Purge(db, "ThisServer"))
+		Assert.Equal(int64(0), getUsage(t).UsedSize)
+		Assert.Equal(int64(0), getUsage(t).UsedActual)
+	})
+
+	t.Run("Recalculating", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(db.Model(&dbfs.User{}).Where("1 = 1").
+			Updates(map[string]interface{}{"used_size": 12345, "used_actual": 12345}).Error)
+		Assert.NoError(dbfs.RecalculateQuotaUsage(db))
+
+		Assert.Equal(int64(0), getUsage(t).UsedSize)
+		superUsage, err := superUser.GetQuotaUsage(db)
+		Assert.NoError(err)
+		Assert.Equal(int64(412), superUsage.UsedSize)
+		Assert.Equal(int64(412), superUsage.UsedActual)
+	})
+}
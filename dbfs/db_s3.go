@@ -0,0 +1,215 @@
+package dbfs
+
+import (
+	"crypto/rand"
+	"errors"
+	"math/big"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	S3AccessKeyIdLength     = 20
+	S3SecretAccessKeyLength = 40
+	s3AccessKeyIdChars      = "ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+	s3SecretAccessKeyChars  = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+)
+
+var (
+	ErrS3AccessKeyNotFound = errors.New("access key not found")
+	ErrS3UploadNotFound    = errors.New("multipart upload not found")
+)
+
+// S3AccessKey is a key pair used to sign requests to the S3 gateway on behalf
+// of a user. The secret has to be kept as-is, as SigV4 signatures are
+// verified by recomputing them.
+type S3AccessKey struct {
+	AccessKeyId     string    `gorm:"primaryKey" json:"access_key_id"`
+	SecretAccessKey string    `gorm:"not null" json:"secret_access_key,omitempty"`
+	UserId          string    `gorm:"not null; index" json:"user_id"`
+	User            *User     `gorm:"-" json:"-"`
+	CreatedTime     time.Time `gorm:"not null" json:"created_time"`
+	LastUsed        time.Time `json:"last_used"`
+}
+
+// S3MultipartUpload keeps track of a multipart upload started through the S3
+// gateway. The parts are buffered, encrypted, on the server handling the upload
+// until it is completed.
+type S3MultipartUpload struct {
+	UploadId      string    `gorm:"primaryKey" json:"upload_id"`
+	UserId        string    `gorm:"not null; index" json:"user_id"`
+	Bucket        string    `gorm:"not null" json:"bucket"`
+	Key           string    `gorm:"not null" json:"key"`
+	ContentType   string    `json:"content_type"`
+	HandledServer string    `gorm:"not null" json:"handled_server"`
+	CreatedTime   time.Time `gorm:"not null" json:"created_time"`
+}
+
+// S3MultipartPart is a part of a S3MultipartUpload.
+type S3MultipartPart struct {
+	UploadId   string `gorm:"primaryKey"`
+	PartNumber int    `gorm:"primaryKey; autoIncrement:false"`
+	ETag       string `gorm:"not null"`
+	Size       int64  `gorm:"not null"`
+}
+
+// randomString returns a random string of the length given using the chars given
+func randomString(length int, chars string) (string, error) {
+	b := make([]byte, length)
+	max := big.NewInt(int64(len(chars)))
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = chars[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// CreateS3AccessKey creates a new access key for the user given. This is the
+// only time the secret is returned to the caller.
+func CreateS3AccessKey(tx *gorm.DB, user *User) (*S3AccessKey, error) {
+	accessKeyId, err := randomString(S3AccessKeyIdLength, s3AccessKeyIdChars)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomString(S3SecretAccessKeyLength, s3SecretAccessKeyChars)
+	if err != nil {
+		return nil, err
+	}
+
+	key := &S3AccessKey{
+		AccessKeyId:     accessKeyId,
+		SecretAccessKey: secret,
+		UserId:          user.UserId,
+		CreatedTime:     time.Now(),
+	}
+	if err := tx.Create(key).Error; err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// GetS3AccessKeys returns the access keys of a user, without their secrets.
+func GetS3AccessKeys(tx *gorm.DB, user *User) ([]S3AccessKey, error) {
+	var keys []S3AccessKey
+	err := tx.Where("user_id = ?", user.UserId).Find(&keys).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range keys {
+		keys[i].SecretAccessKey = ""
+	}
+	return keys, nil
+}
+
+// GetS3AccessKey returns the access key with the given id, including its
+// secret and owner. Used to verify request signatures.
+func GetS3AccessKey(tx *gorm.DB, accessKeyId string) (*S3AccessKey, error) {
+	var key S3AccessKey
+	err := tx.Where("access_key_id = ?", accessKeyId).First(&key).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrS3AccessKeyNotFound
+		}
+		return nil, err
+	}
+
+	key.User, err = GetUserById(tx, key.UserId)
+	if err != nil {
+		return nil, err
+	}
+	return &key, nil
+}
+
+// DeleteS3AccessKey deletes an access key belonging to the user given.
+func DeleteS3AccessKey(tx *gorm.DB, user *User, accessKeyId string) error {
+	result := tx.Where("access_key_id = ? AND user_id = ?", accessKeyId, user.UserId).
+		Delete(&S3AccessKey{})
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrS3AccessKeyNotFound
+	}
+	return nil
+}
+
+// MarkUsed updates the time that the access key was last used.
+func (k *S3AccessKey) MarkUsed(tx *gorm.DB) error {
+	k.LastUsed = time.Now()
+	return tx.Model(&S3AccessKey{}).Where("access_key_id = ?", k.AccessKeyId).
+		Update("last_used", k.LastUsed).Error
+}
+
+// CreateS3MultipartUpload records the start of a multipart upload.
+func CreateS3MultipartUpload(tx *gorm.DB, user *User, bucket, key, contentType, server string,
+) (*S3MultipartUpload, error) {
+	upload := &S3MultipartUpload{
+		UploadId:      uuid.New().String(),
+		UserId:        user.UserId,
+		Bucket:        bucket,
+		Key:           key,
+		ContentType:   contentType,
+		HandledServer: server,
+		CreatedTime:   time.Now(),
+	}
+	if err := tx.Create(upload).Error; err != nil {
+		return nil, err
+	}
+	return upload, nil
+}
+
+// GetS3MultipartUpload returns a multipart upload of the user given.
+func GetS3MultipartUpload(tx *gorm.DB, user *User, uploadId string) (*S3MultipartUpload, error) {
+	var upload S3MultipartUpload
+	err := tx.Where("upload_id = ? AND user_id = ?", uploadId, user.UserId).First(&upload).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrS3UploadNotFound
+		}
+		return nil, err
+	}
+	return &upload, nil
+}
+
+// GetStaleS3MultipartUploads returns the multipart uploads handled by the
+// server given that were started before the time given.
+func GetStaleS3MultipartUploads(tx *gorm.DB, server string, before time.Time) ([]S3MultipartUpload, error) {
+	var uploads []S3MultipartUpload
+	err := tx.Where("handled_server = ? AND created_time < ?", server, before).Find(&uploads).Error
+	return uploads, err
+}
+
+// PutPart records a part of the upload, replacing any previous part with the
+// same number.
+func (u *S3MultipartUpload) PutPart(tx *gorm.DB, partNumber int, etag string, size int64) error {
+	part := S3MultipartPart{
+		UploadId:   u.UploadId,
+		PartNumber: partNumber,
+		ETag:       etag,
+		Size:       size,
+	}
+	return tx.Save(&part).Error
+}
+
+// GetParts returns the parts uploaded so far, ordered by part number.
+func (u *S3MultipartUpload) GetParts(tx *gorm.DB) ([]S3MultipartPart, error) {
+	var parts []S3MultipartPart
+	err := tx.Where("upload_id = ?", u.UploadId).Order("part_number").Find(&parts).Error
+	return parts, err
+}
+
+// Delete removes the upload and its parts from the database.
+func (u *S3MultipartUpload) Delete(tx *gorm.DB) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("upload_id = ?", u.UploadId).Delete(&S3MultipartPart{}).Error; err != nil {
+			return err
+		}
+		return tx.Delete(u).Error
+	})
+}
@@ -0,0 +1,102 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestS3(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	otherUser, err := dbfs.CreateNewUser(db, "s3user", "s3user", dbfs.AccountTypeEndUser,
+		"s3user", "s3user", "s3user", "s3user", "ThisServer")
+	assert.NoError(t, err)
+
+	t.Run("Access keys", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		key, err := dbfs.CreateS3AccessKey(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(key.AccessKeyId, dbfs.S3AccessKeyIdLength)
+		Assert.Len(key.SecretAccessKey, dbfs.S3SecretAccessKeyLength)
+
+		// Listing keys doesn't return the secret
+		keys, err := dbfs.GetS3AccessKeys(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(keys, 1)
+		Assert.Equal(key.AccessKeyId, keys[0].AccessKeyId)
+		Assert.Empty(keys[0].SecretAccessKey)
+
+		// Getting a key for signature verification does
+		retrieved, err := dbfs.GetS3AccessKey(db, key.AccessKeyId)
+		Assert.NoError(err)
+		Assert.Equal(key.SecretAccessKey, retrieved.SecretAccessKey)
+		Assert.Equal(superUser.UserId, retrieved.User.UserId)
+
+		Assert.NoError(retrieved.MarkUsed(db))
+		retrieved, err = dbfs.GetS3AccessKey(db, key.AccessKeyId)
+		Assert.NoError(err)
+		Assert.False(retrieved.LastUsed.IsZero())
+
+		// Other users can't delete the key
+		err = dbfs.DeleteS3AccessKey(db, otherUser, key.AccessKeyId)
+		Assert.ErrorIs(err, dbfs.ErrS3AccessKeyNotFound)
+
+		Assert.NoError(dbfs.DeleteS3AccessKey(db, &superUser, key.AccessKeyId))
+		_, err = dbfs.GetS3AccessKey(db, key.AccessKeyId)
+		Assert.ErrorIs(err, dbfs.ErrS3AccessKeyNotFound)
+	})
+
+	t.Run("Multipart uploads", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		upload, err := dbfs.CreateS3MultipartUpload(db, &superUser, "bucket", "a/b.txt",
+			"text/plain", "ThisServer")
+		Assert.NoError(err)
+
+		// Only the owner can get the upload
+		_, err = dbfs.GetS3MultipartUpload(db, otherUser, upload.UploadId)
+		Assert.ErrorIs(err, dbfs.ErrS3UploadNotFound)
+
+		retrieved, err := dbfs.GetS3MultipartUpload(db, &superUser, upload.UploadId)
+		Assert.NoError(err)
+		Assert.Equal("a/b.txt", retrieved.Key)
+
+		// Parts are replaced and returned in order
+		Assert.NoError(upload.PutPart(db, 2, "etag2", 20))
+		Assert.NoError(upload.PutPart(db, 1, "etag1", 10))
+		Assert.NoError(upload.PutPart(db, 2, "etag2b", 21))
+
+		parts, err := upload.GetParts(db)
+		Assert.NoError(err)
+		Assert.Len(parts, 2)
+		Assert.Equal(1, parts[0].PartNumber)
+		Assert.Equal("etag2b", parts[1].ETag)
+		Assert.Equal(int64(21), parts[1].Size)
+
+		// Stale uploads
+		stale, err := dbfs.GetStaleS3MultipartUploads(db, "ThisServer", time.Now().Add(time.Minute))
+		Assert.NoError(err)
+		Assert.Len(stale, 1)
+		stale, err = dbfs.GetStaleS3MultipartUploads(db, "OtherServer", time.Now().Add(time.Minute))
+		Assert.NoError(err)
+		Assert.Len(stale, 0)
+
+		Assert.NoError(upload.Delete(db))
+		_, err = dbfs.GetS3MultipartUpload(db, &superUser, upload.UploadId)
+		Assert.ErrorIs(err, dbfs.ErrS3UploadNotFound)
+		parts, err = upload.GetParts(db)
+		Assert.NoError(err)
+		Assert.Len(parts, 0)
+	})
+}
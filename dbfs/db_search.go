@@ -0,0 +1,148 @@
+package dbfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+const (
+	DefaultSearchLimit = 100
+	MaxSearchLimit     = 1000
+)
+
+var ErrInvalidSearch = errors.New("invalid search query")
+
+// SearchQuery holds the filters of a metadata search. Zero values are ignored.
+type SearchQuery struct {
+	Name           string     // Case-insensitive substring of the file name
+	Glob           string     // Case-insensitive glob (* and ?) matching the whole file name
+	MIMEType       string     // Exact MIME type, or a prefix such as "image/*"
+	EntryType      int8       // IsFile or IsFolder
+	MinSize        *int64     // Inclusive
+	MaxSize        *int64     // Inclusive
+	ModifiedAfter  *time.Time // Inclusive
+	ModifiedBefore *time.Time // Exclusive
+	CreatedAfter   *time.Time // Inclusive
+	CreatedBefore  *time.Time // Exclusive
+	ModifiedUserId string
+	RootFolderId   string // Only search below this folder
+	Limit          int
+	Offset         int
+}
+
+// escapeLike escapes the wildcards of a LIKE pattern
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// globToLike converts a glob pattern into a LIKE pattern
+func globToLike(glob string) string {
+	return strings.NewReplacer("*", "%", "?", "_").Replace(escapeLike(glob))
+}
+
+// SearchFiles returns the files and folders matching the query that the user
+// can read, most recently modified first.
+func SearchFiles(tx *gorm.DB, user *User, query *SearchQuery) ([]File, error) {
+
+	if query.Limit < 0 || query.Offset < 0 || query.Limit > MaxSearchLimit {
+		return nil, ErrInvalidSearch
+	}
+	if query.EntryType != 0 && query.EntryType != IsFile && query.EntryType != IsFolder {
+		return nil, ErrInvalidSearch
+	}
+	limit := query.Limit
+	if limit == 0 {
+		limit = DefaultSearchLimit
+	}
+
+	readable, err := readableByUser(tx, user)
+	if err != nil {
+		return nil, err
+	}
+
+	q := tx.Model(&File{}).Scopes(readable).
+		Where("files.status NOT IN ?", []int8{FileStatusWriting, FileStatusToBeDeleted, FileStatusDeleted}).
+		Where("files.trash_id IS NULL")
+
+	if query.Name != "" {
+		q = q.Where(`LOWER(files.file_name) LIKE ? ESCAPE '\'`,
+			"%"+escapeLike(strings.ToLower(query.Name))+"%")
+	}
+	if query.Glob != "" {
+		q = q.Where(`LOWER(files.file_name) LIKE ? ESCAPE '\'`, globToLike(strings.ToLower(query.Glob)))
+	}
+	if query.MIMEType != "" {
+		if strings.HasSuffix(query.MIMEType, "/*") {
+			q = q.Where(`files.mime_type LIKE ? ESCAPE '\'`,
+				escapeLike(strings.TrimSuffix(query.MIMEType, "*"))+"%")
+		} else {
+			q = q.Where("files.mime_type = ?", query.MIMEType)
+		}
+	}
+	if query.EntryType != 0 {
+		q = q.Where("files.entry_type = ?", query.EntryType)
+	}
+	if query.MinSize != nil {
+		q = q.Where("files.size >= ?", *query.MinSize)
+	}
+	if query.MaxSize != nil {
+		q = q.Where("files.size <= ?", *query.MaxSize)
+	}
+	if query.ModifiedAfter != nil {
+		q = q.Where("files.modified_time >= ?", *query.ModifiedAfter)
+	}
+	if query.ModifiedBefore != nil {
+		q = q.Where("files.modified_time < ?", *query.ModifiedBefore)
+	}
+	if query.CreatedAfter != nil {
+		q = q.Where("files.created_time >= ?", *query.CreatedAfter)
+	}
+	if query.CreatedBefore != nil {
+		q = q.Where("files.created_time < ?", *query.CreatedBefore)
+	}
+	if query.ModifiedUserId != "" {
+		q = q.Where("files.modified_user_user_id = ?", query.ModifiedUserId)
+	}
+	if query.RootFolderId != "" {
+		root, err := GetFileById(tx, query.RootFolderId, user)
+		if err != nil {
+			return nil, err
+		}
+		if root.EntryType != IsFolder {
+			return nil, ErrNotFolder
+		}
+		q = q.Where("files.file_id IN (WITH RECURSIVE subtree(file_id) AS ("+
+			"SELECT file_id FROM files WHERE parent_folder_file_id = ? "+
+			"UNION ALL SELECT f.file_id FROM files f JOIN subtree s ON f.parent_folder_file_id = s.file_id"+
+			") SELECT file_id FROM subtree)", root.FileId)
+	}
+
+	var files []File
+	err = q.Order("files.modified_time DESC").Order("files.file_id").
+		Limit(limit).Offset(query.Offset).Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// createSearchIndexes creates the indexes used by SearchFiles that can't be
+// declared through struct tags. On PostgreSQL, a trigram index lets substring
+// and glob searches on file names avoid scanning the whole table. It is
+// skipped if the pg_trgm extension isn't available.
+func createSearchIndexes(db *gorm.DB) error {
+	if db.Dialector.Name() != "postgres" {
+		return nil
+	}
+
+	if err := db.Exec("CREATE EXTENSION IF NOT EXISTS pg_trgm").Error; err != nil {
+		return nil
+	}
+
+	return db.Exec("CREATE INDEX IF NOT EXISTS idx_files_file_name_trgm ON files " +
+		"USING gin (LOWER(file_name) gin_trgm_ops)").Error
+}
@@ -0,0 +1,154 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSearchFiles(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// Setting up a tree:
+	// /search/report_2021.pdf, /search/photos/cat.jpg, /search/photos/dog.png, /other/report.txt
+	searchFolder, err := rootFolder.CreateSubFolder(db, "search", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	photosFolder, err := searchFolder.CreateSubFolder(db, "photos", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	otherFolder, err := rootFolder.CreateSubFolder(db, "other", &superUser, "ThisServer")
+	assert.NoError(t, err)
+
+	old := time.Date(2010, 1, 1, 0, 0, 0, 0, time.UTC)
+	createFile := func(name, parentId, mimeType string, size int64, modified time.Time) *dbfs.File {
+		file, err := EXAMPLECreateFile(db, &superUser, name, parentId)
+		assert.NoError(t, err)
+		assert.NoError(t, db.Model(&dbfs.File{}).Where("file_id = ?", file.FileId).
+			UpdateColumns(map[string]interface{}{"mime_type": mimeType, "size": size}).Error)
+		assert.NoError(t, file.SetModifiedTime(db, modified, &superUser))
+		return file
+	}
+	report := createFile("report_2021.pdf", searchFolder.FileId, "application/pdf", 1000, time.Now())
+	cat := createFile("cat.jpg", photosFolder.FileId, "image/jpeg", 5000, old)
+	dog := createFile("dog.png", photosFolder.FileId, "image/png", 20000, time.Now())
+	otherReport := createFile("Report.txt", otherFolder.FileId, "text/plain", 10, time.Now())
+
+	ids := func(files []dbfs.File) []string {
+		var result []string
+		for _, file := range files {
+			result = append(result, file.FileId)
+		}
+		return result
+	}
+
+	t.Run("Name", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		files, err := dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{Name: "REPORT"})
+		Assert.NoError(err)
+		Assert.ElementsMatch([]string{report.FileId, otherReport.FileId}, ids(files))
+
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{Glob: "report_*.pdf"})
+		Assert.NoError(err)
+		Assert.Equal([]string{report.FileId}, ids(files))
+
+		// Underscores are literal in substring searches
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{Name: "t_2"})
+		Assert.NoError(err)
+		Assert.Equal([]string{report.FileId}, ids(files))
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{Name: "t_t"})
+		Assert.NoError(err)
+		Assert.Empty(files)
+	})
+
+	t.Run("Filters", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		files, err := dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{MIMEType: "image/*"})
+		Assert.NoError(err)
+		Assert.ElementsMatch([]string{cat.FileId, dog.FileId}, ids(files))
+
+		minSize, maxSize := int64(1000), int64(5000)
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{MinSize: &minSize, MaxSize: &maxSize})
+		Assert.NoError(err)
+		Assert.ElementsMatch([]string{report.FileId, cat.FileId}, ids(files))
+
+		before := old.Add(time.Hour)
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{ModifiedBefore: &before})
+		Assert.NoError(err)
+		Assert.Equal([]string{cat.FileId}, ids(files))
+
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{
+			EntryType: dbfs.IsFolder, Name: "photos"})
+		Assert.NoError(err)
+		Assert.Equal([]string{photosFolder.FileId}, ids(files))
+
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{RootFolderId: searchFolder.FileId})
+		Assert.NoError(err)
+		Assert.ElementsMatch([]string{report.FileId, photosFolder.FileId, cat.FileId, dog.FileId}, ids(files))
+
+		// Most recently modified first, with limits and offsets
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{
+			RootFolderId: photosFolder.FileId, Limit: 1})
+		Assert.NoError(err)
+		Assert.Equal([]string{dog.FileId}, ids(files))
+		files, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{
+			RootFolderId: photosFolder.FileId, Limit: 1, Offset: 1})
+		Assert.NoError(err)
+		Assert.Equal([]string{cat.FileId}, ids(files))
+
+		_, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{Limit: dbfs.MaxSearchLimit + 1})
+		Assert.ErrorIs(err, dbfs.ErrInvalidSearch)
+		_, err = dbfs.SearchFiles(db, &superUser, &dbfs.SearchQuery{RootFolderId: report.FileId})
+		Assert.ErrorIs(err, dbfs.ErrNotFolder)
+	})
+
+	t.Run("Permissions", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		user, err := dbfs.CreateNewUser(db, "searchUser", "searchUser", dbfs.AccountTypeEndUser,
+			"searchUser", "searchUser", "searchUser", "searchUser", "ThisServer")
+		Assert.NoError(err)
+
+		files, err := dbfs.SearchFiles(db, user, &dbfs.SearchQuery{Name: "report"})
+		Assert.NoError(err)
+		Assert.Empty(files)
+
+		_, err = dbfs.SearchFiles(db, user, &dbfs.SearchQuery{RootFolderId: searchFolder.FileId})
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		// Permissions given through a group
+		group, err := dbfs.CreateNewGroup(db, "searchGroup", "searchGroup")
+		Assert.NoError(err)
+		Assert.NoError(user.AddToGroup(db, group))
+		Assert.NoError(otherFolder.AddPermissionGroups(db, &dbfs.PermissionNeeded{Read: true},
+			&superUser, *group))
+
+		files, err = dbfs.SearchFiles(db, user, &dbfs.SearchQuery{Name: "report"})
+		Assert.NoError(err)
+		Assert.Equal([]string{otherReport.FileId}, ids(files))
+
+		// Permissions given to the user directly
+		Assert.NoError(searchFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true},
+			&superUser, *user))
+
+		files, err = dbfs.SearchFiles(db, user, &dbfs.SearchQuery{Name: "report"})
+		Assert.NoError(err)
+		Assert.ElementsMatch([]string{report.FileId, otherReport.FileId}, ids(files))
+
+		files, err = dbfs.SearchFiles(db, user, &dbfs.SearchQuery{RootFolderId: searchFolder.FileId})
+		Assert.NoError(err)
+		Assert.Len(files, 4)
+	})
+}
@@ -1,15 +1,194 @@
 package dbfs
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
 	"errors"
-	"gorm.io/gorm"
+	"strings"
 	"time"
+
+	"golang.org/x/crypto/scrypt"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrSharedLinkDisabled       = errors.New("shared link is disabled")
+	ErrSharedLinkExpired        = errors.New("shared link has expired")
+	ErrSharedLinkLimitReached   = errors.New("shared link has reached its download limit")
+	ErrLinkPasswordRequired     = errors.New("shared link password required")
+	ErrIncorrectLinkPassword    = errors.New("incorrect shared link password")
+	ErrInvalidSharedLinkOptions = errors.New("max downloads cannot be negative")
 )
 
 type SharedLink struct {
-	ShortenedLink string    `gorm:"primary_key; unique" json:"shortened_link"`
-	FileId        string    `gorm:"primary_key" json:"file_id"`
-	CreatedTime   time.Time `json:"created_time"`
+	ShortenedLink  string     `gorm:"primary_key; unique" json:"shortened_link"`
+	FileId         string     `gorm:"primary_key" json:"file_id"`
+	CreatedTime    time.Time  `json:"created_time"`
+	ExpiryTime     *time.Time `json:"expiry_time"`
+	MaxDownloads   *int       `json:"max_downloads"`
+	DownloadCount  int        `gorm:"not null; default:0" json:"download_count"`
+	Disabled       bool       `gorm:"not null; default:false" json:"disabled"`
+	PasswordActive bool       `gorm:"not null; default:false" json:"password_active"`
+	PasswordSalt   string     `json:"-"`
+	PasswordHash   string     `json:"-"`
+}
+
+// SharedLinkOptions are the restrictions placed on a shared link. Nil fields
+// are left as they are. A zero ExpiryTime, a MaxDownloads of 0 and an empty
+// Password remove the restriction.
+type SharedLinkOptions struct {
+	ExpiryTime   *time.Time
+	MaxDownloads *int
+	Password     *string
+	Disabled     *bool
+}
+
+// usableSharedLinks scopes a query to the links that can currently be used,
+// ignoring their passwords.
+func usableSharedLinks(tx *gorm.DB) *gorm.DB {
+	return tx.Where("disabled = ? AND (expiry_time IS NULL OR expiry_time > ?) "+
+		"AND (max_downloads IS NULL OR download_count < max_downloads)", false, time.Now())
+}
+
+// GetSharedLink returns the shared link, without checking if it can be used
+func GetSharedLink(tx *gorm.DB, shortenedLink string) (*SharedLink, error) {
+	var sharedLink SharedLink
+	err := tx.First(&sharedLink, "shortened_link = ?", shortenedLink).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrSharedLinkNotFound
+		}
+		return nil, err
+	}
+	return &sharedLink, nil
+}
+
+// OpenSharedLink returns the shared link and the file behind it, if the link
+// is enabled, has not expired or run out of downloads, and the password given
+// matches the one of the link (if any).
+func OpenSharedLink(tx *gorm.DB, shortenedLink, password string) (*SharedLink, *File, error) {
+	sharedLink, err := GetSharedLink(tx, shortenedLink)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := sharedLink.Check(password); err != nil {
+		return nil, nil, err
+	}
+
+	file, err := GetFileFromShortenedLink(tx, shortenedLink)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sharedLink, file, nil
+}
+
+// Check returns an error if the shared link cannot be used with the password
+// given.
+func (l *SharedLink) Check(password string) error {
+	if l.Disabled {
+		return ErrSharedLinkDisabled
+	}
+	if l.ExpiryTime != nil && !time.Now().Before(*l.ExpiryTime) {
+		return ErrSharedLinkExpired
+	}
+	if l.MaxDownloads != nil && l.DownloadCount >= *l.MaxDownloads {
+		return ErrSharedLinkLimitReached
+	}
+	if !l.PasswordActive {
+		return nil
+	}
+	if password == "" {
+		return ErrLinkPasswordRequired
+	}
+
+	hash, err := hashLinkPassword(password, l.PasswordSalt)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare([]byte(hash), []byte(l.PasswordHash)) != 1 {
+		return ErrIncorrectLinkPassword
+	}
+	return nil
+}
+
+// RecordDownload counts a download of the shared link. It fails if the link
+// ran out of downloads in the meantime.
+func (l *SharedLink) RecordDownload(tx *gorm.DB) error {
+	result := tx.Model(&SharedLink{}).
+		Where("shortened_link = ? AND (max_downloads IS NULL OR download_count < max_downloads)",
+			l.ShortenedLink).
+		Update("download_count", gorm.Expr("download_count + 1"))
+	if result.Error != nil {
+		return result.Error
+	}
+	if result.RowsAffected == 0 {
+		return ErrSharedLinkLimitReached
+	}
+	l.DownloadCount++
+	return nil
+}
+
+// apply sets the options given on the shared link
+func (o *SharedLinkOptions) apply(l *SharedLink) error {
+	if o.ExpiryTime != nil {
+		if o.ExpiryTime.IsZero() {
+			l.ExpiryTime = nil
+		} else {
+			expiryTime := *o.ExpiryTime
+			l.ExpiryTime = &expiryTime
+		}
+	}
+
+	if o.MaxDownloads != nil {
+		if *o.MaxDownloads < 0 {
+			return ErrInvalidSharedLinkOptions
+		} else if *o.MaxDownloads == 0 {
+			l.MaxDownloads = nil
+		} else {
+			maxDownloads := *o.MaxDownloads
+			l.MaxDownloads = &maxDownloads
+		}
+	}
+
+	if o.Password != nil {
+		if *o.Password == "" {
+			l.PasswordActive = false
+			l.PasswordSalt = ""
+			l.PasswordHash = ""
+		} else {
+			salt := make([]byte, 32)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+			l.PasswordSalt = hex.EncodeToString(salt)
+			hash, err := hashLinkPassword(*o.Password, l.PasswordSalt)
+			if err != nil {
+				return err
+			}
+			l.PasswordActive = true
+			l.PasswordHash = hash
+		}
+	}
+
+	if o.Disabled != nil {
+		l.Disabled = *o.Disabled
+	}
+
+	return nil
+}
+
+// hashLinkPassword derives the hash stored for the password of a shared link
+func hashLinkPassword(password, salt string) (string, error) {
+	saltBytes, err := hex.DecodeString(salt)
+	if err != nil {
+		return "", err
+	}
+	key, err := scrypt.Key([]byte(password), saltBytes, 16384, 8, 1, 32)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(key), nil
 }
 
 // GetFileFromShortenedLink Provides the File when given a shortened link
@@ -32,6 +211,104 @@ func GetFileFromShortenedLink(db *gorm.DB, shortenedLink string) (*File, error)
 		}
 		return nil, err
 	}
+	if file.TrashId != nil {
+		return nil, ErrFileNotFound
+	}
 
 	return &file, nil
 }
+
+// IsShared returns true if the file, or any folder above it, has a shared link
+// that can be used. Files inside a shared folder are readable through the
+// folder's link.
+func (f *File) IsShared(tx *gorm.DB) (bool, error) {
+	fileId := f.FileId
+	for {
+		var count int64
+		err := tx.Model(&SharedLink{}).Scopes(usableSharedLinks).Where("file_id = ?", fileId).
+			Count(&count).Error
+		if err != nil {
+			return false, err
+		}
+		if count > 0 {
+			return true, nil
+		}
+
+		var file File
+		err = tx.Select("parent_folder_file_id", "trash_id").First(&file, "file_id = ?", fileId).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return false, nil
+			}
+			return false, err
+		}
+		if file.TrashId != nil {
+			return false, nil
+		}
+		if file.ParentFolderFileId == nil || *file.ParentFolderFileId == "" {
+			return false, nil
+		}
+		fileId = *file.ParentFolderFileId
+	}
+}
+
+// ListSharedContents returns the contents of a folder that is accessible
+// through a shared link.
+func (f *File) ListSharedContents(tx *gorm.DB) ([]File, error) {
+	isShared, err := f.IsShared(tx)
+	if err != nil {
+		return nil, err
+	} else if !isShared {
+		return nil, ErrFileNotFound
+	}
+
+	if f.EntryType != IsFolder {
+		return nil, ErrNotFolder
+	}
+
+	var files []File
+	err = tx.Model(&File{}).Where("parent_folder_file_id = ? AND trash_id IS NULL", f.FileId).Find(&files).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return files, nil
+}
+
+// GetSharedDescendant returns the file or folder at the path given, relative
+// to the shared folder. Only entries inside the folder can be reached: "." and
+// ".." are not resolved. An empty path returns the folder itself.
+func (f *File) GetSharedDescendant(tx *gorm.DB, path string) (*File, error) {
+	isShared, err := f.IsShared(tx)
+	if err != nil {
+		return nil, err
+	} else if !isShared {
+		return nil, ErrFileNotFound
+	}
+
+	current := f
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		if name == "." || name == ".." {
+			return nil, ErrFileNotFound
+		}
+		if current.EntryType != IsFolder {
+			return nil, ErrNotFolder
+		}
+
+		var child File
+		err := tx.Where("parent_folder_file_id = ? AND file_name = ? AND trash_id IS NULL",
+			current.FileId, name).First(&child).Error
+		if err != nil {
+			if errors.Is(err, gorm.ErrRecordNotFound) {
+				return nil, ErrFileNotFound
+			}
+			return nil, err
+		}
+		current = &child
+	}
+
+	return current, nil
+}
@@ -0,0 +1,147 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSharedLinkOptions(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+	file, err := EXAMPLECreateFile(db, &superUser, "limited", rootFolder.FileId)
+	assert.NoError(t, err)
+
+	_, err = file.CreateSharedLink(db, &superUser, "limited")
+	assert.NoError(t, err)
+
+	t.Run("Unrestricted by default", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		sharedLink, openedFile, err := dbfs.OpenSharedLink(db, "limited", "")
+		Assert.NoError(err)
+		Assert.Equal(file.FileId, openedFile.FileId)
+		Assert.Nil(sharedLink.ExpiryTime)
+		Assert.Nil(sharedLink.MaxDownloads)
+		Assert.False(sharedLink.PasswordActive)
+		Assert.False(sharedLink.Disabled)
+	})
+
+	t.Run("Disabling the link", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		disabled := true
+		_, err := file.UpdateSharedLinkOptions(db, &superUser, "limited", &dbfs.SharedLinkOptions{Disabled: &disabled})
+		Assert.NoError(err)
+
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.ErrorIs(err, dbfs.ErrSharedLinkDisabled)
+		isShared, err := file.IsShared(db)
+		Assert.NoError(err)
+		Assert.False(isShared)
+
+		disabled = false
+		_, err = file.UpdateSharedLinkOptions(db, &superUser, "limited", &dbfs.SharedLinkOptions{Disabled: &disabled})
+		Assert.NoError(err)
+		isShared, err = file.IsShared(db)
+		Assert.NoError(err)
+		Assert.True(isShared)
+	})
+
+	t.Run("Expiring the link", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		past := time.Now().Add(-time.Minute)
+		sharedLink, err := file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{ExpiryTime: &past})
+		Assert.NoError(err)
+		Assert.NotNil(sharedLink.ExpiryTime)
+
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.ErrorIs(err, dbfs.ErrSharedLinkExpired)
+
+		// Removing the expiry time
+		sharedLink, err = file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{ExpiryTime: &time.Time{}})
+		Assert.NoError(err)
+		Assert.Nil(sharedLink.ExpiryTime)
+
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.NoError(err)
+	})
+
+	t.Run("Protecting the link with a password", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		password := "linkpassword"
+		sharedLink, err := file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{Password: &password})
+		Assert.NoError(err)
+		Assert.True(sharedLink.PasswordActive)
+		Assert.NotEqual(password, sharedLink.PasswordHash)
+
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.ErrorIs(err, dbfs.ErrLinkPasswordRequired)
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "wrong")
+		Assert.ErrorIs(err, dbfs.ErrIncorrectLinkPassword)
+		_, _, err = dbfs.OpenSharedLink(db, "limited", password)
+		Assert.NoError(err)
+
+		// Removing the password
+		password = ""
+		_, err = file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{Password: &password})
+		Assert.NoError(err)
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.NoError(err)
+	})
+
+	t.Run("Limiting downloads", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		invalid := -1
+		_, err := file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{MaxDownloads: &invalid})
+		Assert.ErrorIs(err, dbfs.ErrInvalidSharedLinkOptions)
+
+		maxDownloads := 2
+		_, err = file.UpdateSharedLinkOptions(db, &superUser, "limited",
+			&dbfs.SharedLinkOptions{MaxDownloads: &maxDownloads})
+		Assert.NoError(err)
+
+		for i := 0; i < maxDownloads; i++ {
+			sharedLink, _, err := dbfs.OpenSharedLink(db, "limited", "")
+			Assert.NoError(err)
+			Assert.NoError(sharedLink.RecordDownload(db))
+		}
+
+		_, _, err = dbfs.OpenSharedLink(db, "limited", "")
+		Assert.ErrorIs(err, dbfs.ErrSharedLinkLimitReached)
+
+		// A download that raced past the check is still refused
+		sharedLink, err := dbfs.GetSharedLink(db, "limited")
+		Assert.NoError(err)
+		Assert.Equal(maxDownloads, sharedLink.DownloadCount)
+		Assert.ErrorIs(sharedLink.RecordDownload(db), dbfs.ErrSharedLinkLimitReached)
+
+		isShared, err := file.IsShared(db)
+		Assert.NoError(err)
+		Assert.False(isShared)
+	})
+
+	t.Run("Unknown links", func(t *testing.T) {
+		_, err := file.UpdateSharedLinkOptions(db, &superUser, "unknown", &dbfs.SharedLinkOptions{})
+		assert.ErrorIs(t, err, dbfs.ErrSharedLinkNotFound)
+	})
+}
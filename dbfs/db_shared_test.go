@@ -86,4 +86,71 @@ func TestCreateSharedLinks(t *testing.T) {
 
 	})
 
+	t.Run("Files inside a shared folder", func(t *testing.T) {
+
+		Assert := assert.New(t)
+
+		sharedFolder, err := rootFolder.CreateSubFolder(db, "sharedFolder", &superUser, "ThisServer")
+		Assert.NoError(err)
+		subFolder, err := sharedFolder.CreateSubFolder(db, "subFolder", &superUser, "ThisServer")
+		Assert.NoError(err)
+		innerFile, err := EXAMPLECreateFile(db, &superUser, "inner", subFolder.FileId)
+		Assert.NoError(err)
+
+		isShared, err := innerFile.IsShared(db)
+		Assert.NoError(err)
+		Assert.False(isShared)
+		_, err = sharedFolder.ListSharedContents(db)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		_, err = sharedFolder.CreateSharedLink(db, &superUser, "sharedfolder")
+		Assert.NoError(err)
+
+		isShared, err = innerFile.IsShared(db)
+		Assert.NoError(err)
+		Assert.True(isShared)
+
+		contents, err := subFolder.ListSharedContents(db)
+		Assert.NoError(err)
+		Assert.Len(contents, 1)
+		Assert.Equal(innerFile.FileId, contents[0].FileId)
+
+		_, err = innerFile.ListSharedContents(db)
+		Assert.ErrorIs(err, dbfs.ErrNotFolder)
+
+		// Files outside the shared folder are still not public
+		isShared, err = rootFolder.IsShared(db)
+		Assert.NoError(err)
+		Assert.False(isShared)
+	})
+
+	t.Run("Resolving paths inside a shared folder", func(t *testing.T) {
+
+		Assert := assert.New(t)
+
+		sharedFolder, err := dbfs.GetFileFromShortenedLink(db, "sharedfolder")
+		Assert.NoError(err)
+
+		self, err := sharedFolder.GetSharedDescendant(db, "")
+		Assert.NoError(err)
+		Assert.Equal(sharedFolder.FileId, self.FileId)
+
+		inner, err := sharedFolder.GetSharedDescendant(db, "/subFolder/inner")
+		Assert.NoError(err)
+		Assert.Equal("inner", inner.FileName)
+
+		_, err = sharedFolder.GetSharedDescendant(db, "subFolder/missing")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+		_, err = sharedFolder.GetSharedDescendant(db, "subFolder/inner/deeper")
+		Assert.ErrorIs(err, dbfs.ErrNotFolder)
+
+		// Nothing outside the folder can be reached
+		_, err = sharedFolder.GetSharedDescendant(db, "../blahblah")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+		_, err = sharedFolder.GetSharedDescendant(db, "subFolder/../../blahblah")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+		_, err = rootFolder.GetSharedDescendant(db, "blahblah")
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+	})
+
 }
@@ -0,0 +1,271 @@
+package dbfs
+
+import (
+	"errors"
+	"strings"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+const (
+	MaxTagKeyLength   = 64
+	MaxTagValueLength = 1024
+	MaxTagsPerFile    = 64
+)
+
+var (
+	ErrTagNotFound = errors.New("tag not found")
+	ErrInvalidTag  = errors.New("invalid tag")
+)
+
+// FileTag is a user-defined key/value pair on a file or folder. Plain tags
+// such as "reviewed" are stored with an empty value.
+type FileTag struct {
+	FileId string `gorm:"primaryKey" json:"-"`
+	Key    string `gorm:"primaryKey; index" json:"key"`
+	Value  string `gorm:"not null" json:"value"`
+}
+
+// FileVersionTag is the copy of a tag kept with a version of a file
+type FileVersionTag struct {
+	FileId    string `gorm:"primaryKey"`
+	VersionNo int    `gorm:"primaryKey"`
+	Key       string `gorm:"primaryKey"`
+	Value     string `gorm:"not null"`
+}
+
+// TagFilter matches the files that have a tag. A nil Value matches any value.
+type TagFilter struct {
+	Key   string
+	Value *string
+}
+
+// checkTag returns ErrInvalidTag if the key or value of a tag cannot be stored
+func checkTag(key, value string) error {
+	if key == "" || len(key) > MaxTagKeyLength || len(value) > MaxTagValueLength ||
+		key != strings.TrimSpace(key) || strings.ContainsAny(key, "=/") {
+		return ErrInvalidTag
+	}
+	return nil
+}
+
+// tagsToMap converts a list of tags into a map of key to value
+func tagsToMap(tags []FileTag) map[string]string {
+	tagMap := make(map[string]string, len(tags))
+	for _, tag := range tags {
+		tagMap[tag.Key] = tag.Value
+	}
+	return tagMap
+}
+
+// getFileTags returns the current tags of a file, without checking permissions
+func getFileTags(tx *gorm.DB, fileId string) (map[string]string, error) {
+	var tags []FileTag
+	if err := tx.Where("file_id = ?", fileId).Find(&tags).Error; err != nil {
+		return nil, err
+	}
+	return tagsToMap(tags), nil
+}
+
+// snapshotFileTags copies the current tags of a file to one of its versions,
+// replacing the tags the version had.
+func snapshotFileTags(tx *gorm.DB, fileId string, versionNo int) error {
+	err := tx.Where("file_id = ? AND version_no = ?", fileId, versionNo).Delete(&FileVersionTag{}).Error
+	if err != nil {
+		return err
+	}
+
+	var tags []FileTag
+	if err := tx.Where("file_id = ?", fileId).Find(&tags).Error; err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	versionTags := make([]FileVersionTag, len(tags))
+	for i, tag := range tags {
+		versionTags[i] = FileVersionTag{FileId: fileId, VersionNo: versionNo, Key: tag.Key, Value: tag.Value}
+	}
+	return tx.Create(&versionTags).Error
+}
+
+// copyFileTags gives a file the same tags as another
+func copyFileTags(tx *gorm.DB, fromFileId, toFileId string) error {
+	var tags []FileTag
+	if err := tx.Where("file_id = ?", fromFileId).Find(&tags).Error; err != nil {
+		return err
+	}
+	if len(tags) == 0 {
+		return nil
+	}
+
+	for i := range tags {
+		tags[i].FileId = toFileId
+	}
+	return tx.Create(&tags).Error
+}
+
+// tagFilterScope limits a query on files to the ones matching every filter
+func tagFilterScope(filters []TagFilter) func(*gorm.DB) *gorm.DB {
+	return func(db *gorm.DB) *gorm.DB {
+		for _, filter := range filters {
+			if filter.Value == nil {
+				db = db.Where("EXISTS (SELECT 1 FROM file_tags WHERE file_tags.file_id = files.file_id "+
+					"AND file_tags.key = ?)", filter.Key)
+			} else {
+				db = db.Where("EXISTS (SELECT 1 FROM file_tags WHERE file_tags.file_id = files.file_id "+
+					"AND file_tags.key = ? AND file_tags.value = ?)", filter.Key, *filter.Value)
+			}
+		}
+		return db
+	}
+}
+
+// checkTagWrite checks that the user can change the tags of the file
+func (f *File) checkTagWrite(tx *gorm.DB, user *User) error {
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrFileNotFound
+	}
+
+	hasPermissions, err = user.HasPermission(tx, f, &PermissionNeeded{Write: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrNoPermission
+	}
+
+	return f.checkLock(tx, user)
+}
+
+// GetTags returns the tags of the file as a map of key to value
+func (f *File) GetTags(tx *gorm.DB, user *User) (map[string]string, error) {
+
+	// Check if user has read permission
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrFileNotFound
+	}
+
+	return getFileTags(tx, f.FileId)
+}
+
+// SetTag adds a tag to the file, or changes its value if it already exists
+func (f *File) SetTag(tx *gorm.DB, user *User, key, value string) error {
+	if err := checkTag(key, value); err != nil {
+		return err
+	}
+	if err := f.checkTagWrite(tx, user); err != nil {
+		return err
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		var count int64
+		err := tx.Model(&FileTag{}).Where("file_id = ? AND key <> ?", f.FileId, key).Count(&count).Error
+		if err != nil {
+			return err
+		}
+		if count >= MaxTagsPerFile {
+			return ErrInvalidTag
+		}
+
+		err = tx.Clauses(clause.OnConflict{UpdateAll: true}).
+			Create(&FileTag{FileId: f.FileId, Key: key, Value: value}).Error
+		if err != nil {
+			return err
+		}
+		return snapshotFileTags(tx, f.FileId, f.VersionNo)
+	})
+}
+
+// SetTags replaces all the tags of the file
+func (f *File) SetTags(tx *gorm.DB, user *User, tags map[string]string) error {
+	if len(tags) > MaxTagsPerFile {
+		return ErrInvalidTag
+	}
+	for key, value := range tags {
+		if err := checkTag(key, value); err != nil {
+			return err
+		}
+	}
+	if err := f.checkTagWrite(tx, user); err != nil {
+		return err
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		err := tx.Where("file_id = ?", f.FileId).Delete(&FileTag{}).Error
+		if err != nil {
+			return err
+		}
+		for key, value := range tags {
+			err = tx.Create(&FileTag{FileId: f.FileId, Key: key, Value: value}).Error
+			if err != nil {
+				return err
+			}
+		}
+		return snapshotFileTags(tx, f.FileId, f.VersionNo)
+	})
+}
+
+// DeleteTag removes a tag from the file
+func (f *File) DeleteTag(tx *gorm.DB, user *User, key string) error {
+	if err := f.checkTagWrite(tx, user); err != nil {
+		return err
+	}
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		result := tx.Where("file_id = ? AND key = ?", f.FileId, key).Delete(&FileTag{})
+		if result.Error != nil {
+			return result.Error
+		}
+		if result.RowsAffected == 0 {
+			return ErrTagNotFound
+		}
+		return snapshotFileTags(tx, f.FileId, f.VersionNo)
+	})
+}
+
+// loadTags fills in the tags the file had at this version
+func (fv *FileVersion) loadTags(tx *gorm.DB) error {
+	var versionTags []FileVersionTag
+	err := tx.Where("file_id = ? AND version_no = ?", fv.FileId, fv.VersionNo).Find(&versionTags).Error
+	if err != nil {
+		return err
+	}
+
+	fv.Tags = make(map[string]string, len(versionTags))
+	for _, tag := range versionTags {
+		fv.Tags[tag.Key] = tag.Value
+	}
+	return nil
+}
+
+// restoreTagsFromVersion replaces the current tags of a file with the ones it
+// had at a version
+func restoreTagsFromVersion(tx *gorm.DB, fileId string, versionNo int) error {
+	err := tx.Where("file_id = ?", fileId).Delete(&FileTag{}).Error
+	if err != nil {
+		return err
+	}
+
+	var versionTags []FileVersionTag
+	err = tx.Where("file_id = ? AND version_no = ?", fileId, versionNo).Find(&versionTags).Error
+	if err != nil {
+		return err
+	}
+	if len(versionTags) == 0 {
+		return nil
+	}
+
+	tags := make([]FileTag, len(versionTags))
+	for i, tag := range versionTags {
+		tags[i] = FileTag{FileId: fileId, Key: tag.Key, Value: tag.Value}
+	}
+	return tx.Create(&tags).Error
+}
@@ -0,0 +1,129 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileTags(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// A second user that can only read the files in the folder
+	reader, err := dbfs.CreateNewUser(db, "tagReader", "tagReader", dbfs.AccountTypeEndUser,
+		"tagReader", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	workFolder, err := rootFolder.CreateSubFolder(db, "tagFolder", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, workFolder.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true},
+		&superUser, *reader))
+
+	contract, err := EXAMPLECreateFile(db, &superUser, "contract.pdf", workFolder.FileId)
+	assert.NoError(t, err)
+	invoice, err := EXAMPLECreateFile(db, &superUser, "invoice.pdf", workFolder.FileId)
+	assert.NoError(t, err)
+
+	t.Run("Setting tags", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.ErrorIs(contract.SetTag(db, &superUser, "", "x"), dbfs.ErrInvalidTag)
+		Assert.ErrorIs(contract.SetTag(db, &superUser, "a=b", ""), dbfs.ErrInvalidTag)
+		Assert.ErrorIs(contract.SetTag(db, reader, "reviewed", ""), dbfs.ErrNoPermission)
+
+		Assert.NoError(contract.SetTag(db, &superUser, "contract", ""))
+		Assert.NoError(contract.SetTag(db, &superUser, "project", "ABC"))
+		Assert.NoError(contract.SetTag(db, &superUser, "project", "XYZ"))
+		Assert.NoError(invoice.SetTags(db, &superUser, map[string]string{"project": "ABC"}))
+		Assert.NoError(workFolder.SetTag(db, &superUser, "team", "legal"))
+
+		tags, err := contract.GetTags(db, reader)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"contract": "", "project": "XYZ"}, tags)
+
+		tags, err = workFolder.GetTags(db, reader)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"team": "legal"}, tags)
+	})
+
+	t.Run("Deleting tags", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.ErrorIs(workFolder.DeleteTag(db, reader, "team"), dbfs.ErrNoPermission)
+		Assert.NoError(workFolder.DeleteTag(db, &superUser, "team"))
+		Assert.ErrorIs(workFolder.DeleteTag(db, &superUser, "team"), dbfs.ErrTagNotFound)
+	})
+
+	t.Run("Filtering listings", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		abc := "ABC"
+		page, err := workFolder.ListContentsPage(db, reader, &dbfs.ListOptions{
+			Tags: []dbfs.TagFilter{{Key: "project"}},
+		})
+		Assert.NoError(err)
+		Assert.Len(page.Files, 2)
+
+		page, err = workFolder.ListContentsPage(db, reader, &dbfs.ListOptions{
+			Tags: []dbfs.TagFilter{{Key: "project", Value: &abc}},
+		})
+		Assert.NoError(err)
+		Assert.Len(page.Files, 1)
+		Assert.Equal(invoice.FileId, page.Files[0].FileId)
+
+		page, err = workFolder.ListContentsPage(db, reader, &dbfs.ListOptions{
+			Tags: []dbfs.TagFilter{{Key: "project"}, {Key: "contract"}},
+		})
+		Assert.NoError(err)
+		Assert.Len(page.Files, 1)
+		Assert.Equal(contract.FileId, page.Files[0].FileId)
+	})
+
+	t.Run("Keeping tags per version", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		firstVersion := contract.VersionNo
+		Assert.NoError(EXAMPLEUpdateFile(db, contract, "", &superUser))
+		Assert.NoError(contract.SetTag(db, &superUser, "reviewed", ""))
+
+		old, err := contract.GetOldVersion(db, &superUser, firstVersion)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"contract": "", "project": "XYZ"}, old.Tags)
+
+		current, err := contract.GetOldVersion(db, &superUser, contract.VersionNo)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"contract": "", "project": "XYZ", "reviewed": ""}, current.Tags)
+
+		// Reverting brings back the tags of the version
+		Assert.NoError(contract.RevertFileToVersion(db, firstVersion, &superUser))
+		tags, err := contract.GetTags(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"contract": "", "project": "XYZ"}, tags)
+	})
+
+	t.Run("Copying tags", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		copied, err := invoice.CopyAs(db, workFolder, "invoice copy.pdf", &superUser, "ThisServer")
+		Assert.NoError(err)
+		tags, err := copied.GetTags(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"project": "ABC"}, tags)
+
+		// The copy has its own tags
+		Assert.NoError(copied.SetTag(db, &superUser, "copy", ""))
+		tags, err = invoice.GetTags(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(map[string]string{"project": "ABC"}, tags)
+	})
+}
@@ -0,0 +1,179 @@
+package dbfs
+
+import (
+	"errors"
+	"mime"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// ThumbnailSizes are the sizes (in pixels, of the longest side) that
+// thumbnails are generated in. The first one is the default.
+var ThumbnailSizes = []int{128, 512}
+
+var (
+	ErrThumbnailNotFound    = errors.New("thumbnail not found")
+	ErrInvalidThumbnailSize = errors.New("invalid thumbnail size")
+	ErrNotThumbnailable     = errors.New("thumbnails are not supported for this file type")
+)
+
+// thumbnailMIMETypes are the image types that thumbnails can be generated for
+var thumbnailMIMETypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// Thumbnail is a smaller copy of an image, derived from the data of a file
+// version. Like the file itself, it is encrypted and stored as shards, which
+// are recorded as Fragments of the version that it was generated from.
+//
+// Thumbnails belong to the data rather than the version number, so that
+// versions that only change metadata (and copies of the file) share them.
+// Their key is encrypted with the key of the data, so reading them needs the
+// same permissions (and password) as reading the file.
+type Thumbnail struct {
+	DataId          string    `gorm:"primaryKey" json:"-"`
+	Size            int       `gorm:"primaryKey" json:"size"`
+	ThumbnailDataId string    `gorm:"not null; uniqueIndex" json:"-"`
+	FileId          string    `gorm:"not null; index" json:"file_id"`
+	VersionNo       int       `gorm:"not null" json:"version_no"`
+	MIMEType        string    `gorm:"not null" json:"mime_type"`
+	Width           int       `gorm:"not null" json:"width"`
+	Height          int       `gorm:"not null" json:"height"`
+	Length          int64     `gorm:"not null" json:"length"`
+	TotalShards     int       `json:"-"`
+	DataShards      int       `json:"-"`
+	ParityShards    int       `json:"-"`
+	KeyThreshold    int       `json:"-"`
+	EncryptionKey   string    `json:"-"`
+	EncryptionIv    string    `json:"-"`
+	CreatedTime     time.Time `gorm:"not null" json:"created_time"`
+}
+
+// IsValidThumbnailSize returns whether thumbnails are generated in the size
+// given
+func IsValidThumbnailSize(size int) bool {
+	for _, s := range ThumbnailSizes {
+		if s == size {
+			return true
+		}
+	}
+	return false
+}
+
+// CanHaveThumbnails returns whether thumbnails can be generated for the file.
+// Files without a useful MIME type are matched on their extension.
+func (f *File) CanHaveThumbnails() bool {
+	if f.EntryType != IsFile {
+		return false
+	}
+	mimeType := f.MIMEType
+	if mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType = mime.TypeByExtension(strings.ToLower(filepath.Ext(f.FileName)))
+	}
+	mimeType, _, _ = strings.Cut(mimeType, ";")
+	return thumbnailMIMETypes[strings.TrimSpace(mimeType)]
+}
+
+// GetThumbnail returns the thumbnail of the current data of the file, in the
+// size given.
+func (f *File) GetThumbnail(tx *gorm.DB, size int) (*Thumbnail, error) {
+	if !IsValidThumbnailSize(size) {
+		return nil, ErrInvalidThumbnailSize
+	}
+
+	var thumbnail Thumbnail
+	err := tx.First(&thumbnail, "data_id = ? AND size = ?", f.DataId, size).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrThumbnailNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &thumbnail, nil
+}
+
+// HasAllThumbnails returns whether every size of thumbnail has been generated
+// for the current data of the file.
+func (f *File) HasAllThumbnails(tx *gorm.DB) (bool, error) {
+	var count int64
+	err := tx.Model(&Thumbnail{}).Where("data_id = ?", f.DataId).Count(&count).Error
+	return count >= int64(len(ThumbnailSizes)), err
+}
+
+// CreateThumbnail records a thumbnail whose shards have been written.
+// dataKey and dataIv are the plain key and iv that the thumbnail was encrypted
+// with, and are stored encrypted with the key of the file data (sourceKey and
+// sourceIv). servers and shardPaths hold the location of each shard.
+func CreateThumbnail(tx *gorm.DB, thumbnail *Thumbnail, dataKey, dataIv, sourceKey, sourceIv string,
+	servers, shardPaths []string) error {
+
+	var err error
+	thumbnail.EncryptionKey, err = EncryptWithKeyIV(dataKey, sourceKey, sourceIv)
+	if err != nil {
+		return err
+	}
+	thumbnail.EncryptionIv, err = EncryptWithKeyIV(dataIv, sourceKey, sourceIv)
+	if err != nil {
+		return err
+	}
+	thumbnail.CreatedTime = time.Now()
+
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(thumbnail).Error; err != nil {
+			return err
+		}
+		for i := range shardPaths {
+			fragment := Fragment{
+				FileVersionFileId:    thumbnail.FileId,
+				FileVersionDataId:    thumbnail.ThumbnailDataId,
+				FileVersionVersionNo: thumbnail.VersionNo,
+				FragId:               i + 1,
+				ServerName:           servers[i],
+				FileFragmentPath:     shardPaths[i],
+				LastChecked:          time.Now(),
+				TotalShards:          thumbnail.TotalShards,
+				Status:               FragmentStatusGood,
+			}
+			if err := tx.Create(&fragment).Error; err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// GetDecryptionKey returns the key and iv of the thumbnail, given the key and
+// iv of the data that it was generated from.
+func (t *Thumbnail) GetDecryptionKey(sourceKey, sourceIv string) (string, string, error) {
+	key, err := DecryptWithKeyIV(t.EncryptionKey, sourceKey, sourceIv)
+	if err != nil {
+		return "", "", err
+	}
+	iv, err := DecryptWithKeyIV(t.EncryptionIv, sourceKey, sourceIv)
+	if err != nil {
+		return "", "", err
+	}
+	return key, iv, nil
+}
+
+// GetFragments returns the fragments holding the shards of the thumbnail
+func (t *Thumbnail) GetFragments(tx *gorm.DB) ([]Fragment, error) {
+	var fragments []Fragment
+	err := tx.Where("file_version_data_id = ?", t.ThumbnailDataId).
+		Order("frag_id").Find(&fragments).Error
+	return fragments, err
+}
+
+// getThumbnailFragments returns the fragments of all the thumbnails of the
+// data given, so that they are deleted along with it.
+func getThumbnailFragments(tx *gorm.DB, dataId string) ([]Fragment, error) {
+	var fragments []Fragment
+	err := tx.Where("file_version_data_id IN (?)",
+		tx.Model(&Thumbnail{}).Select("thumbnail_data_id").Where("data_id = ?", dataId)).
+		Find(&fragments).Error
+	return fragments, err
+}
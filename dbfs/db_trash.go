@@ -0,0 +1,348 @@
+package dbfs
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+// Key: CronJobTrashRetentionDays
+// Value (int): Number of days to keep items in the trash before purging them.
+// Defaults to DefaultTrashRetentionDays if not set.
+const (
+	CronJobTrashRetentionDays = "CronJobTrashRetentionDays"
+	DefaultTrashRetentionDays = 30
+)
+
+var (
+	ErrTrashItemNotFound = errors.New("trash item not found")
+	ErrRestoreFolderGone = errors.New("original folder no longer exists")
+	ErrCannotTrashRoot   = errors.New("cannot move the root folder to the trash")
+)
+
+// TrashItem is a file or folder that has been moved to the trash. The entries
+// stay in the files table, marked with the TrashId, until they are restored or
+// purged.
+type TrashItem struct {
+	TrashId                    string    `gorm:"primaryKey" json:"trash_id"`
+	FileId                     string    `gorm:"not null; index" json:"file_id"`
+	FileName                   string    `gorm:"not null" json:"file_name"`
+	EntryType                  int8      `gorm:"not null" json:"entry_type"`
+	Size                       int64     `gorm:"not null" json:"size"`
+	OriginalParentFolderFileId string    `gorm:"not null; index" json:"original_parent_folder_id"`
+	OriginalPath               string    `json:"original_path"`
+	UserId                     string    `gorm:"not null; index" json:"user_id"`
+	DeletedTime                time.Time `gorm:"not null; index" json:"deleted_time"`
+	ExpiryTime                 time.Time `gorm:"-" json:"expiry_time"`
+}
+
+// subtreeQuery selects the file_id of a file and everything under it that is
+// not already in the trash.
+const subtreeQuery = "WITH RECURSIVE subtree(file_id) AS (" +
+	"SELECT file_id FROM files WHERE file_id = ? " +
+	"UNION ALL SELECT f.file_id FROM files f JOIN subtree s ON f.parent_folder_file_id = s.file_id " +
+	"WHERE f.trash_id IS NULL) SELECT file_id FROM subtree"
+
+// GetTrashRetentionDays returns the number of days items are kept in the trash.
+func GetTrashRetentionDays(tx *gorm.DB) (int, error) {
+	var days KeyValueDBPair
+	err := tx.First(&days, "key = ?", CronJobTrashRetentionDays).Error
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return 0, err
+	}
+	if days.ValueInt <= 0 {
+		return DefaultTrashRetentionDays, nil
+	}
+	return days.ValueInt, nil
+}
+
+// SetTrashRetentionDays sets the number of days items are kept in the trash.
+func SetTrashRetentionDays(tx *gorm.DB, days int) error {
+	if days < 1 {
+		return ErrInvalidCronJobProperty
+	}
+	return tx.Save(&KeyValueDBPair{Key: CronJobTrashRetentionDays, ValueInt: days}).Error
+}
+
+// Trash moves a file or folder, along with all of its contents, to the trash of
+// the user.
+func (f *File) Trash(tx *gorm.DB, user *User) (*TrashItem, error) {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, f, &PermissionNeeded{Read: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions || f.TrashId != nil {
+		return nil, ErrFileNotFound
+	}
+
+	// Check if user has write permission (if not 403)
+	hasPermissions, err = user.HasPermission(tx, f, &PermissionNeeded{Write: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrNoPermission
+	}
+
+	if f.ParentFolderFileId == nil {
+		return nil, ErrCannotTrashRoot
+	}
+
+	// Check that no one else holds a lock on the file or its contents
+	if err := f.checkSubtreeLock(tx, user); err != nil {
+		return nil, err
+	}
+
+	// Remember where the file was, from the highest folder the user can see
+	path, err := f.GetPath(tx, user)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for i := len(path) - 1; i >= 0; i-- {
+		if path[i].ParentFolderFileId != nil {
+			names = append(names, path[i].FileName)
+		}
+	}
+
+	item := &TrashItem{
+		TrashId:                    uuid.New().String(),
+		FileId:                     f.FileId,
+		FileName:                   f.FileName,
+		EntryType:                  f.EntryType,
+		OriginalParentFolderFileId: *f.ParentFolderFileId,
+		OriginalPath:               "/" + strings.Join(names, "/"),
+		UserId:                     user.UserId,
+		DeletedTime:                time.Now(),
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Model(&File{}).Where("file_id IN ("+subtreeQuery+")", f.FileId).
+			UpdateColumn("trash_id", item.TrashId).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(&File{}).Select("COALESCE(SUM(size), 0)").
+			Where("trash_id = ?", item.TrashId).Scan(&item.Size).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Create(item).Error; err != nil {
+			return err
+		}
+
+		if err := RecordActivity(tx, f.FileId, user, ActivityTrash, item.OriginalPath); err != nil {
+			return err
+		}
+		return queueFileEvent(tx, f, user, WebhookEventDeleted, item.OriginalPath)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	f.TrashId = &item.TrashId
+	return item, nil
+}
+
+// GetTrashItems returns the items that the user has moved to the trash, most
+// recently deleted first.
+func GetTrashItems(tx *gorm.DB, user *User) ([]TrashItem, error) {
+	days, err := GetTrashRetentionDays(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	items := []TrashItem{}
+	err = tx.Where("user_id = ?", user.UserId).Order("deleted_time DESC").Find(&items).Error
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		items[i].ExpiryTime = items[i].DeletedTime.AddDate(0, 0, days)
+	}
+	return items, nil
+}
+
+// GetTrashItem returns an item in the trash. Only the user that deleted it, or
+// an admin, can see it.
+func GetTrashItem(tx *gorm.DB, user *User, trashId string) (*TrashItem, error) {
+	var item TrashItem
+	err := tx.First(&item, "trash_id = ?", trashId).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrTrashItemNotFound
+		}
+		return nil, err
+	}
+
+	if item.UserId != user.UserId && user.AccountType != AccountTypeAdmin {
+		return nil, ErrTrashItemNotFound
+	}
+
+	days, err := GetTrashRetentionDays(tx)
+	if err != nil {
+		return nil, err
+	}
+	item.ExpiryTime = item.DeletedTime.AddDate(0, 0, days)
+
+	return &item, nil
+}
+
+// Restore moves the item out of the trash, back into its original folder.
+func (t *TrashItem) Restore(tx *gorm.DB, user *User) (*File, error) {
+
+	var file File
+	err := tx.First(&file, "file_id = ?", t.FileId).Error
+	if err != nil {
+		return nil, err
+	}
+
+	// The original folder must still exist outside of the trash
+	var parent File
+	err = tx.First(&parent, "file_id = ?", t.OriginalParentFolderFileId).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && parent.TrashId != nil) {
+		return nil, ErrRestoreFolderGone
+	} else if err != nil {
+		return nil, err
+	}
+
+	// Check if user has write permission on the folder (if not 403)
+	hasPermissions, err := user.HasPermission(tx, &parent, &PermissionNeeded{Write: true})
+	if err != nil {
+		return nil, err
+	} else if !hasPermissions {
+		return nil, ErrNoPermission
+	}
+
+	err = tx.Transaction(func(tx *gorm.DB) error {
+		var rows int64
+		err := tx.Model(&File{}).Where("file_name = ? AND parent_folder_file_id = ? AND trash_id IS NULL",
+			file.FileName, parent.FileId).Count(&rows).Error
+		if err != nil {
+			return err
+		}
+		if rows >= 1 {
+			return ErrFileFolderExists
+		}
+
+		err = tx.Model(&File{}).Where("trash_id = ?", t.TrashId).UpdateColumn("trash_id", nil).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Delete(t).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	file.TrashId = nil
+	return &file, nil
+}
+
+// Purge permanently deletes the item. Its file versions are marked as to be
+// deleted, so that the fragments are cleared by CronJobDeleteShards.
+func (t *TrashItem) Purge(tx *gorm.DB, server string) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+
+		// Items that were trashed from inside this item go first, as they
+		// need their original folder to still exist
+		var nested []TrashItem
+		err := tx.Where("original_parent_folder_file_id IN (?)",
+			tx.Model(&File{}).Select("file_id").Where("trash_id = ?", t.TrashId)).
+			Find(&nested).Error
+		if err != nil {
+			return err
+		}
+		for i := range nested {
+			if err := nested[i].Purge(tx, server); err != nil {
+				return err
+			}
+		}
+
+		var root File
+		err = tx.First(&root, "file_id = ?", t.FileId).Error
+		if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+			return err
+		} else if err == nil {
+			if err := t.purgeFile(tx, &root, server); err != nil {
+				return err
+			}
+		}
+
+		return tx.Delete(t).Error
+	})
+}
+
+// purgeFile deletes a file and, if it is a folder, its contents in the trash
+// item, deepest first.
+func (t *TrashItem) purgeFile(tx *gorm.DB, file *File, server string) error {
+	if file.EntryType == IsFolder {
+		var children []File
+		err := tx.Where("parent_folder_file_id = ? AND trash_id = ?", file.FileId, t.TrashId).
+			Find(&children).Error
+		if err != nil {
+			return err
+		}
+		for i := range children {
+			if err := t.purgeFile(tx, &children[i], server); err != nil {
+				return err
+			}
+		}
+	}
+
+	return deleteFileRecords(tx, file, server)
+}
+
+// EmptyTrash purges all the items in the trash of the user.
+func EmptyTrash(tx *gorm.DB, user *User, server string) (int, error) {
+	var items []TrashItem
+	err := tx.Where("user_id = ?", user.UserId).Order("deleted_time").Find(&items).Error
+	if err != nil {
+		return 0, err
+	}
+	return purgeTrashItems(tx, items, server)
+}
+
+// PurgeExpiredTrash purges the items that have been in the trash for longer
+// than the retention period.
+func PurgeExpiredTrash(tx *gorm.DB, server string) (int, error) {
+	days, err := GetTrashRetentionDays(tx)
+	if err != nil {
+		return 0, err
+	}
+
+	var items []TrashItem
+	err = tx.Where("deleted_time < ?", time.Now().AddDate(0, 0, -days)).
+		Order("deleted_time").Find(&items).Error
+	if err != nil {
+		return 0, err
+	}
+	return purgeTrashItems(tx, items, server)
+}
+
+// purgeTrashItems purges the items one by one, skipping the ones that were
+// already purged along with the item they were in.
+func purgeTrashItems(tx *gorm.DB, items []TrashItem, server string) (int, error) {
+	purged := 0
+	for i := range items {
+		var count int64
+		err := tx.Model(&TrashItem{}).Where("trash_id = ?", items[i].TrashId).Count(&count).Error
+		if err != nil {
+			return purged, err
+		}
+		if count == 0 {
+			continue
+		}
+
+		if err := items[i].Purge(tx, server); err != nil {
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
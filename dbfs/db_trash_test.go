@@ -0,0 +1,146 @@
+package dbfs_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrash(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// Setting up /trash/docs/report.txt and /trash/notes.txt
+	trashFolder, err := rootFolder.CreateSubFolder(db, "trash", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	docsFolder, err := trashFolder.CreateSubFolder(db, "docs", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	report, err := EXAMPLECreateFile(db, &superUser, "report.txt", docsFolder.FileId)
+	assert.NoError(t, err)
+	notes, err := EXAMPLECreateFile(db, &superUser, "notes.txt", trashFolder.FileId)
+	assert.NoError(t, err)
+
+	t.Run("Moving to the trash", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		item, err := docsFolder.Trash(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal("/trash/docs", item.OriginalPath)
+		Assert.Equal(trashFolder.FileId, item.OriginalParentFolderFileId)
+		Assert.Equal(report.Size, item.Size)
+
+		// Gone from listings, lookups and paths
+		ls, err := trashFolder.ListContents(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(ls, 1)
+		_, err = dbfs.GetFileById(db, report.FileId, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+		_, err = dbfs.GetFileByPath(db, "/trash/docs", &superUser, false)
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+
+		items, err := dbfs.GetTrashItems(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(items, 1)
+		Assert.Equal(docsFolder.FileId, items[0].FileId)
+		Assert.Equal(items[0].DeletedTime.AddDate(0, 0, dbfs.DefaultTrashRetentionDays), items[0].ExpiryTime)
+
+		_, err = rootFolder.Trash(db, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrCannotTrashRoot)
+	})
+
+	t.Run("Restoring", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		items, err := dbfs.GetTrashItems(db, &superUser)
+		Assert.NoError(err)
+		item := items[0]
+
+		// Other users cannot see the item
+		user, err := dbfs.CreateNewUser(db, "trashUser", "trashUser", dbfs.AccountTypeEndUser,
+			"trashUser", "trashUser", "trashUser", "trashUser", "ThisServer")
+		Assert.NoError(err)
+		_, err = dbfs.GetTrashItem(db, user, item.TrashId)
+		Assert.ErrorIs(err, dbfs.ErrTrashItemNotFound)
+
+		// A new folder took its name in the meantime
+		newDocs, err := trashFolder.CreateSubFolder(db, "docs", &superUser, "ThisServer")
+		Assert.NoError(err)
+		_, err = item.Restore(db, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrFileFolderExists)
+
+		_, err = newDocs.Trash(db, &superUser)
+		Assert.NoError(err)
+		file, err := item.Restore(db, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(docsFolder.FileId, file.FileId)
+
+		restored, err := dbfs.GetFileByPath(db, "/trash/docs/report.txt", &superUser, false)
+		Assert.NoError(err)
+		Assert.Equal(report.FileId, restored.FileId)
+
+		items, err = dbfs.GetTrashItems(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(items, 1)
+		Assert.NotEqual(item.TrashId, items[0].TrashId)
+	})
+
+	t.Run("Purging", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		// Emptying the trash from the previous test
+		purged, err := dbfs.EmptyTrash(db, &superUser, "ThisServer")
+		Assert.NoError(err)
+		Assert.Equal(1, purged)
+
+		// Trashing a file, then the folder that it was in
+		notesItem, err := notes.Trash(db, &superUser)
+		Assert.NoError(err)
+		folderItem, err := trashFolder.Trash(db, &superUser)
+		Assert.NoError(err)
+
+		// Nothing is old enough to be purged
+		purged, err = dbfs.PurgeExpiredTrash(db, "ThisServer")
+		Assert.NoError(err)
+		Assert.Equal(0, purged)
+
+		fragments, err := dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Empty(fragments)
+
+		Assert.NoError(dbfs.SetTrashRetentionDays(db, 7))
+		days, err := dbfs.GetTrashRetentionDays(db)
+		Assert.NoError(err)
+		Assert.Equal(7, days)
+		Assert.ErrorIs(dbfs.SetTrashRetentionDays(db, 0), dbfs.ErrInvalidCronJobProperty)
+
+		// Purging the folder also purges the file that was trashed from inside it
+		Assert.NoError(db.Model(&dbfs.TrashItem{}).Where("trash_id = ?", folderItem.TrashId).
+			Update("deleted_time", time.Now().AddDate(0, 0, -8)).Error)
+		purged, err = dbfs.PurgeExpiredTrash(db, "ThisServer")
+		Assert.NoError(err)
+		Assert.Equal(1, purged)
+
+		_, err = dbfs.GetTrashItem(db, &superUser, notesItem.TrashId)
+		Assert.ErrorIs(err, dbfs.ErrTrashItemNotFound)
+		var count int64
+		Assert.NoError(db.Model(&dbfs.File{}).Where("file_id IN ?",
+			[]string{trashFolder.FileId, docsFolder.FileId, report.FileId, notes.FileId}).Count(&count).Error)
+		Assert.Equal(int64(0), count)
+
+		// The fragments are left for the cron job
+		fragments, err = dbfs.GetToBeDeletedFragments(db)
+		Assert.NoError(err)
+		Assert.Equal(ExampleTotalShards*2, len(fragments))
+	})
+}
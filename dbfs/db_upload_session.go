@@ -0,0 +1,163 @@
+package dbfs
+
+import (
+	"errors"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	UploadSessionActive   = int8(1)
+	UploadSessionFinished = int8(2)
+	UploadSessionAborted  = int8(3)
+	UploadSessionFailed   = int8(4)
+
+	// MaxUploadChunkSize is the largest chunk accepted by a resumable upload.
+	MaxUploadChunkSize = 32 * 1024 * 1024
+	// UploadSessionTimeout is how long an upload session can stay idle before
+	// it is aborted by the cleanup job.
+	UploadSessionTimeout = 24 * time.Hour
+)
+
+var (
+	ErrUploadSessionNotFound = errors.New("upload session not found")
+	ErrUploadSessionClosed   = errors.New("upload session is no longer active")
+	ErrUploadChunkOutOfOrder = errors.New("chunk received out of order")
+	ErrUploadWrongServer     = errors.New("upload session is handled by another server")
+)
+
+// UploadSession keeps track of a resumable upload. Chunks must be sent in
+// order, and the session records how many chunks and bytes have been fed into
+// the encoder so far so that the client can resume after a dropped connection.
+type UploadSession struct {
+	UploadId       string    `gorm:"primaryKey" json:"upload_id"`
+	FileId         string    `gorm:"not null" json:"file_id"`
+	UserId         string    `gorm:"not null; index" json:"user_id"`
+	ChunksReceived int       `gorm:"not null" json:"chunks_received"`
+	BytesReceived  int64     `gorm:"not null" json:"bytes_received"`
+	TotalSize      int64     `json:"total_size"`
+	MaxChunkSize   int64     `gorm:"not null" json:"max_chunk_size"`
+	Status         int8      `gorm:"not null" json:"status"`
+	HandledServer  string    `gorm:"not null" json:"handled_server"`
+	CreatedTime    time.Time `gorm:"not null" json:"created_time"`
+	LastActivity   time.Time `gorm:"not null" json:"last_activity"`
+}
+
+// CreateUploadSession creates a new upload session for a file that has been
+// created with CreateInitialFile and is still in FileStatusWriting.
+func CreateUploadSession(tx *gorm.DB, file *File, user *User, totalSize int64, server string) (*UploadSession, error) {
+
+	if file.Status != FileStatusWriting {
+		return nil, ErrInvalidAction
+	}
+	if totalSize < 0 {
+		return nil, ErrInvalidAction
+	}
+
+	session := &UploadSession{
+		UploadId:       uuid.New().String(),
+		FileId:         file.FileId,
+		UserId:         user.UserId,
+		ChunksReceived: 0,
+		BytesReceived:  0,
+		TotalSize:      totalSize,
+		MaxChunkSize:   MaxUploadChunkSize,
+		Status:         UploadSessionActive,
+		HandledServer:  server,
+		CreatedTime:    time.Now(),
+		LastActivity:   time.Now(),
+	}
+
+	if err := tx.Create(session).Error; err != nil {
+		return nil, err
+	}
+
+	return session, nil
+}
+
+// GetUploadSession returns the upload session with the given id. Only the user
+// that created the session can access it.
+func GetUploadSession(tx *gorm.DB, uploadId string, user *User) (*UploadSession, error) {
+	var session UploadSession
+	err := tx.Where("upload_id = ? AND user_id = ?", uploadId, user.UserId).First(&session).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrUploadSessionNotFound
+		}
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// GetActiveUploadSessions returns all the active upload sessions handled by the server given.
+func GetActiveUploadSessions(tx *gorm.DB, server string) ([]UploadSession, error) {
+	var sessions []UploadSession
+	err := tx.Where("status = ? AND handled_server = ?", UploadSessionActive, server).
+		Find(&sessions).Error
+	return sessions, err
+}
+
+// CheckChunk verifies that the chunk number given is the next chunk expected
+// by the session. It returns true if the chunk has already been received, in
+// which case the client can safely skip it.
+func (s *UploadSession) CheckChunk(chunkNo int) (bool, error) {
+	if s.Status != UploadSessionActive {
+		return false, ErrUploadSessionClosed
+	}
+	if chunkNo < 0 || chunkNo > s.ChunksReceived {
+		return false, ErrUploadChunkOutOfOrder
+	}
+	return chunkNo < s.ChunksReceived, nil
+}
+
+// RecordChunk records that the next chunk has been fed into the encoder.
+func (s *UploadSession) RecordChunk(tx *gorm.DB, size int64) error {
+	if s.Status != UploadSessionActive {
+		return ErrUploadSessionClosed
+	}
+
+	s.ChunksReceived = s.ChunksReceived + 1
+	s.BytesReceived = s.BytesReceived + size
+	s.LastActivity = time.Now()
+
+	return tx.Model(s).Updates(map[string]interface{}{
+		"chunks_received": s.ChunksReceived,
+		"bytes_received":  s.BytesReceived,
+		"last_activity":   s.LastActivity,
+	}).Error
+}
+
+// Finish marks the upload session as finished.
+func (s *UploadSession) Finish(tx *gorm.DB) error {
+	return s.updateStatus(tx, UploadSessionFinished)
+}
+
+// Fail marks the upload session as failed. The file created for the session
+// should be deleted by the caller.
+func (s *UploadSession) Fail(tx *gorm.DB) error {
+	return s.updateStatus(tx, UploadSessionFailed)
+}
+
+// Abort marks the upload session as aborted. The file created for the session
+// should be deleted by the caller.
+func (s *UploadSession) Abort(tx *gorm.DB) error {
+	return s.updateStatus(tx, UploadSessionAborted)
+}
+
+// updateStatus is a helper function to close an upload session
+func (s *UploadSession) updateStatus(tx *gorm.DB, status int8) error {
+	if s.Status != UploadSessionActive {
+		return ErrUploadSessionClosed
+	}
+
+	s.Status = status
+	s.LastActivity = time.Now()
+
+	return tx.Model(s).Updates(map[string]interface{}{
+		"status":        s.Status,
+		"last_activity": s.LastActivity,
+	}).Error
+}
@@ -0,0 +1,111 @@
+package dbfs_test
+
+import (
+	"testing"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUploadSession(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	// Creating a file that is still being written
+	fileKey, fileIv, err := dbfs.GenerateKeyIV()
+	assert.NoError(t, err)
+	dataKey, dataIv, err := dbfs.GenerateKeyIV()
+	assert.NoError(t, err)
+
+	file := dbfs.File{
+		FileId:             uuid.New().String(),
+		FileName:           "upload",
+		ParentFolderFileId: &rootFolder.FileId,
+		Size:               512,
+		VersioningMode:     dbfs.VersioningOff,
+		TotalShards:        ExampleTotalShards,
+		DataShards:         ExampleDataShards,
+		ParityShards:       ExampleParityShards,
+		KeyThreshold:       ExampleKeyThreshold,
+		HandledServer:      "ThisServer",
+	}
+	assert.NoError(t, dbfs.CreateInitialFile(db, &file, fileKey, fileIv, dataKey, dataIv, &superUser))
+
+	session, err := dbfs.CreateUploadSession(db, &file, &superUser, 10, "ThisServer")
+	assert.NoError(t, err)
+	assert.NotEmpty(t, session.UploadId)
+
+	t.Run("Creating a session for a finished file", func(t *testing.T) {
+		finishedFile, err := EXAMPLECreateFile(db, &superUser, "finished", rootFolder.FileId)
+		assert.NoError(t, err)
+
+		_, err = dbfs.CreateUploadSession(db, finishedFile, &superUser, 10, "ThisServer")
+		assert.ErrorIs(t, err, dbfs.ErrInvalidAction)
+	})
+
+	t.Run("Getting the session", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		retrieved, err := dbfs.GetUploadSession(db, session.UploadId, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(file.FileId, retrieved.FileId)
+		Assert.Equal(dbfs.UploadSessionActive, retrieved.Status)
+
+		otherUser := dbfs.User{UserId: uuid.New().String()}
+		_, err = dbfs.GetUploadSession(db, session.UploadId, &otherUser)
+		Assert.ErrorIs(err, dbfs.ErrUploadSessionNotFound)
+	})
+
+	t.Run("Recording chunks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		received, err := session.CheckChunk(0)
+		Assert.NoError(err)
+		Assert.False(received)
+		Assert.NoError(session.RecordChunk(db, 6))
+
+		// Resending the first chunk
+		received, err = session.CheckChunk(0)
+		Assert.NoError(err)
+		Assert.True(received)
+
+		// Skipping a chunk
+		_, err = session.CheckChunk(2)
+		Assert.ErrorIs(err, dbfs.ErrUploadChunkOutOfOrder)
+
+		Assert.NoError(session.RecordChunk(db, 4))
+
+		retrieved, err := dbfs.GetUploadSession(db, session.UploadId, &superUser)
+		Assert.NoError(err)
+		Assert.Equal(2, retrieved.ChunksReceived)
+		Assert.Equal(int64(10), retrieved.BytesReceived)
+	})
+
+	t.Run("Finishing the session", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		sessions, err := dbfs.GetActiveUploadSessions(db, "ThisServer")
+		Assert.NoError(err)
+		Assert.Len(sessions, 1)
+
+		Assert.NoError(session.Finish(db))
+		Assert.ErrorIs(session.Abort(db), dbfs.ErrUploadSessionClosed)
+
+		_, err = session.CheckChunk(2)
+		Assert.ErrorIs(err, dbfs.ErrUploadSessionClosed)
+
+		sessions, err = dbfs.GetActiveUploadSessions(db, "ThisServer")
+		Assert.NoError(err)
+		Assert.Len(sessions, 0)
+	})
+}
@@ -38,6 +38,9 @@ type User struct {
 	DeletedAt    gorm.DeletedAt `gorm:"index" json:"-"`
 	Groups       []*Group       `gorm:"many2many:user_groups;" json:"-"`
 	HomeFolderId string         `json:"home_folder_id"`
+	Quota        *int64         `json:"-"` // In bytes, nil if unlimited
+	UsedSize     int64          `gorm:"not null; default: 0" json:"-"`
+	UsedActual   int64          `gorm:"not null; default: 0" json:"-"` // Including parity shards
 	//Roles        []*Role        `gorm:"many2many:user_roles;" json:"-"`
 }
 
@@ -353,9 +356,12 @@ func (user *User) GetFavoriteFiles(tx *gorm.DB, start uint) ([]File, error) {
 		Offset(int(start)).Limit(50).Error; err != nil {
 		return nil, err
 	}
-	files := make([]File, len(FavoriteFileItems))
-	for i, item := range FavoriteFileItems {
-		files[i] = item.File
+	files := make([]File, 0, len(FavoriteFileItems))
+	for _, item := range FavoriteFileItems {
+		// Files in the trash are hidden until they are restored
+		if item.File.TrashId == nil {
+			files = append(files, item.File)
+		}
 	}
 	return files, nil
 }
@@ -372,6 +378,9 @@ func (user *User) GetFavoriteFileByFileId(tx *gorm.DB, fileId string) (*File, er
 		}
 		return nil, err
 	}
+	if favItem.File.TrashId != nil {
+		return nil, ErrFileNotFound
+	}
 	return &favItem.File, nil
 
 }
@@ -434,13 +443,15 @@ func (user *User) GetSharedWithUser(tx *gorm.DB) ([]File, error) {
 
 	// keys is now sorted
 
-	files := make([]File, len(keys))
-	for i, key := range keys {
+	files := make([]File, 0, len(keys))
+	for _, key := range keys {
 		var tempFile File
 		if err := tx.Where("file_id = ?", key).First(&tempFile).Error; err != nil {
 			return nil, err
 		}
-		files[i] = tempFile
+		if tempFile.TrashId == nil {
+			files = append(files, tempFile)
+		}
 	}
 
 	return files, nil
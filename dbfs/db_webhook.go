@@ -0,0 +1,445 @@
+package dbfs
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"gorm.io/gorm"
+)
+
+const (
+	WebhookEventCreated    = "created"
+	WebhookEventUpdated    = "updated"
+	WebhookEventDeleted    = "deleted"
+	WebhookEventMoved      = "moved"
+	WebhookEventShared     = "shared"
+	WebhookEventPermission = "permission_changed"
+
+	DeliveryStatusPending   = int8(1)
+	DeliveryStatusDelivered = int8(2)
+	DeliveryStatusFailed    = int8(3)
+
+	// MaxWebhookAttempts is the number of times a delivery is tried before
+	// it is given up on
+	MaxWebhookAttempts = 8
+	// webhookRetryDelay is the delay before the first retry. It doubles with
+	// every attempt, up to webhookMaxRetryDelay.
+	webhookRetryDelay    = 30 * time.Second
+	webhookMaxRetryDelay = time.Hour
+)
+
+var (
+	ErrWebhookNotFound = errors.New("webhook not found")
+	ErrInvalidWebhook  = errors.New("invalid webhook, it needs an http(s) URL and known event types")
+)
+
+// webhookEvents are the events that can be subscribed to
+var webhookEvents = map[string]bool{
+	WebhookEventCreated:    true,
+	WebhookEventUpdated:    true,
+	WebhookEventDeleted:    true,
+	WebhookEventMoved:      true,
+	WebhookEventShared:     true,
+	WebhookEventPermission: true,
+}
+
+// ancestorsQuery selects the file with the ID given and all of the folders
+// above it
+const ancestorsQuery = "WITH RECURSIVE ancestors(file_id, parent_folder_file_id) AS (" +
+	"SELECT file_id, parent_folder_file_id FROM files WHERE file_id = ? " +
+	"UNION ALL SELECT f.file_id, f.parent_folder_file_id FROM files f " +
+	"JOIN ancestors a ON f.file_id = a.parent_folder_file_id) SELECT file_id FROM ancestors"
+
+// Webhook is a subscription to the events of a folder and everything in it.
+// Events are only sent for files the user who created the webhook can read.
+// The secret is used to sign deliveries, and is only shown when the webhook
+// is created.
+type Webhook struct {
+	WebhookId   string    `gorm:"primaryKey" json:"webhook_id"`
+	FolderId    string    `gorm:"not null; index" json:"folder_id"`
+	UserId      string    `gorm:"not null; index" json:"user_id"`
+	Url         string    `gorm:"not null" json:"url"`
+	Secret      string    `gorm:"not null" json:"secret,omitempty"`
+	Events      string    `gorm:"not null" json:"-"` // Comma separated
+	EventTypes  []string  `gorm:"-" json:"events"`
+	Active      bool      `gorm:"not null" json:"active"`
+	CreatedTime time.Time `gorm:"not null" json:"created_time"`
+}
+
+// WebhookDelivery is an event queued for a webhook, and the log of the
+// attempts to deliver it
+type WebhookDelivery struct {
+	DeliveryId     string     `gorm:"primaryKey" json:"delivery_id"`
+	WebhookId      string     `gorm:"not null; index" json:"webhook_id"`
+	Webhook        *Webhook   `gorm:"-" json:"-"` // Set by ClaimWebhookDeliveries
+	Event          string     `gorm:"not null" json:"event"`
+	FileId         string     `gorm:"not null" json:"file_id"`
+	Payload        string     `gorm:"not null" json:"payload"`
+	Status         int8       `gorm:"not null; index" json:"status"`
+	Attempts       int        `gorm:"not null" json:"attempts"`
+	NextAttempt    time.Time  `gorm:"not null; index" json:"next_attempt"`
+	LastStatusCode int        `json:"last_status_code"`
+	LastError      string     `json:"last_error,omitempty"`
+	CreatedTime    time.Time  `gorm:"not null; index" json:"created_time"`
+	DeliveredTime  *time.Time `json:"delivered_time"`
+}
+
+// WebhookPayload is the JSON body sent for an event
+type WebhookPayload struct {
+	DeliveryId     string    `json:"delivery_id"`
+	WebhookId      string    `json:"webhook_id"`
+	Event          string    `json:"event"`
+	FileId         string    `json:"file_id"`
+	FileName       string    `json:"file_name"`
+	EntryType      int8      `json:"entry_type"`
+	ParentFolderId *string   `json:"parent_folder_id"`
+	UserId         *string   `json:"user_id"`
+	Details        string    `json:"details"`
+	Time           time.Time `json:"time"`
+}
+
+func (w *Webhook) loadEventTypes() {
+	w.EventTypes = strings.Split(w.Events, ",")
+}
+
+func (w *Webhook) hasEvent(event string) bool {
+	for _, e := range strings.Split(w.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// checkWebhookShare checks that the user can manage the webhooks of the folder
+func checkWebhookShare(tx *gorm.DB, folder *File, user *User) error {
+
+	// Check if user has read permission (if not 404)
+	hasPermissions, err := user.HasPermission(tx, folder, &PermissionNeeded{Read: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrFileNotFound
+	}
+
+	// Check if user has share permission (if not 403)
+	hasPermissions, err = user.HasPermission(tx, folder, &PermissionNeeded{Share: true})
+	if err != nil {
+		return err
+	} else if !hasPermissions {
+		return ErrNoPermission
+	}
+
+	return nil
+}
+
+// CreateWebhook subscribes the URL to the events given for this folder and
+// everything in it. Requires the share permission on the folder.
+func (f *File) CreateWebhook(tx *gorm.DB, user *User, webhookUrl string, events []string) (*Webhook, error) {
+
+	if err := checkWebhookShare(tx, f, user); err != nil {
+		return nil, err
+	}
+	if f.EntryType != IsFolder {
+		return nil, ErrNotFolder
+	}
+
+	u, err := url.Parse(webhookUrl)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, ErrInvalidWebhook
+	}
+	if len(events) == 0 {
+		return nil, ErrInvalidWebhook
+	}
+	for _, event := range events {
+		if !webhookEvents[event] {
+			return nil, ErrInvalidWebhook
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+
+	webhook := &Webhook{
+		WebhookId:   uuid.New().String(),
+		FolderId:    f.FileId,
+		UserId:      user.UserId,
+		Url:         webhookUrl,
+		Secret:      hex.EncodeToString(secret),
+		Events:      strings.Join(events, ","),
+		Active:      true,
+		CreatedTime: time.Now(),
+	}
+	if err := tx.Create(webhook).Error; err != nil {
+		return nil, err
+	}
+
+	webhook.loadEventTypes()
+	return webhook, nil
+}
+
+// GetWebhooks returns the webhooks of this folder. Requires the share
+// permission on the folder.
+func (f *File) GetWebhooks(tx *gorm.DB, user *User) ([]Webhook, error) {
+
+	if err := checkWebhookShare(tx, f, user); err != nil {
+		return nil, err
+	}
+
+	webhooks := []Webhook{}
+	err := tx.Where("folder_id = ?", f.FileId).Order("created_time").Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+		webhooks[i].loadEventTypes()
+	}
+	return webhooks, nil
+}
+
+// GetUserWebhooks returns the webhooks created by the user
+func GetUserWebhooks(tx *gorm.DB, user *User) ([]Webhook, error) {
+	webhooks := []Webhook{}
+	err := tx.Where("user_id = ?", user.UserId).Order("created_time").Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+		webhooks[i].loadEventTypes()
+	}
+	return webhooks, nil
+}
+
+// GetWebhookById returns a webhook the user can manage, which needs the share
+// permission on its folder
+func GetWebhookById(tx *gorm.DB, webhookId string, user *User) (*Webhook, error) {
+	var webhook Webhook
+	err := tx.Where("webhook_id = ?", webhookId).First(&webhook).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrWebhookNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = checkWebhookShare(tx, &File{FileId: webhook.FolderId}, user)
+	if errors.Is(err, ErrFileNotFound) {
+		return nil, ErrWebhookNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	webhook.Secret = ""
+	webhook.loadEventTypes()
+	return &webhook, nil
+}
+
+// SetActive pauses or resumes the webhook. Events are not queued while the
+// webhook is paused.
+func (w *Webhook) SetActive(tx *gorm.DB, active bool) error {
+	w.Active = active
+	return tx.Model(&Webhook{}).Where("webhook_id = ?", w.WebhookId).Update("active", active).Error
+}
+
+// Delete removes the webhook along with its deliveries
+func (w *Webhook) Delete(tx *gorm.DB) error {
+	return tx.Transaction(func(tx *gorm.DB) error {
+		if err := tx.Where("webhook_id = ?", w.WebhookId).Delete(&WebhookDelivery{}).Error; err != nil {
+			return err
+		}
+		return tx.Where("webhook_id = ?", w.WebhookId).Delete(&Webhook{}).Error
+	})
+}
+
+// GetDeliveries returns the delivery log of the webhook, newest first
+func (w *Webhook) GetDeliveries(tx *gorm.DB, limit int) ([]WebhookDelivery, error) {
+	if limit < 0 || limit > MaxListLimit {
+		return nil, ErrInvalidListOptions
+	}
+
+	q := tx.Where("webhook_id = ?", w.WebhookId).Order("created_time DESC")
+	if limit > 0 {
+		q = q.Limit(limit)
+	}
+
+	deliveries := []WebhookDelivery{}
+	if err := q.Find(&deliveries).Error; err != nil {
+		return nil, err
+	}
+	return deliveries, nil
+}
+
+// queueWebhookEvent queues a delivery of the event for every active webhook
+// of the folders above the file that subscribed to it. Folders above the
+// ones in otherFolderIds are included as well, e.g. where a file was moved
+// from.
+func queueWebhookEvent(tx *gorm.DB, f *File, user *User, event, details string, otherFolderIds ...string) error {
+
+	// Most of the time there are none to look through
+	var active int64
+	if err := tx.Model(&Webhook{}).Where("active = ?", true).Count(&active).Error; err != nil {
+		return err
+	} else if active == 0 {
+		return nil
+	}
+
+	var webhooks []Webhook
+	for _, id := range append([]string{f.FileId}, otherFolderIds...) {
+		var found []Webhook
+		err := tx.Where("active = ? AND folder_id IN ("+ancestorsQuery+")", true, id).Find(&found).Error
+		if err != nil {
+			return err
+		}
+		webhooks = append(webhooks, found...)
+	}
+
+	queued := make(map[string]bool)
+	for _, webhook := range webhooks {
+		if queued[webhook.WebhookId] || !webhook.hasEvent(event) {
+			continue
+		}
+		queued[webhook.WebhookId] = true
+
+		// Only send events for files the subscriber can see
+		owner, err := GetUserById(tx, webhook.UserId)
+		if errors.Is(err, ErrUserNotFound) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		hasPermissions, err := owner.HasPermission(tx, f, &PermissionNeeded{Read: true})
+		if err != nil {
+			return err
+		} else if !hasPermissions {
+			continue
+		}
+
+		now := time.Now()
+		payload := WebhookPayload{
+			DeliveryId:     uuid.New().String(),
+			WebhookId:      webhook.WebhookId,
+			Event:          event,
+			FileId:         f.FileId,
+			FileName:       f.FileName,
+			EntryType:      f.EntryType,
+			ParentFolderId: f.ParentFolderFileId,
+			Details:        details,
+			Time:           now,
+		}
+		if user != nil {
+			payload.UserId = &user.UserId
+		}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		err = tx.Create(&WebhookDelivery{
+			DeliveryId:  payload.DeliveryId,
+			WebhookId:   webhook.WebhookId,
+			Event:       event,
+			FileId:      f.FileId,
+			Payload:     string(body),
+			Status:      DeliveryStatusPending,
+			NextAttempt: now,
+			CreatedTime: now,
+		}).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// ClaimWebhookDeliveries returns up to limit deliveries of active webhooks
+// that are due, with their webhook. They are not handed out again until lease
+// has passed, so that servers running side by side do not send the same
+// delivery.
+func ClaimWebhookDeliveries(tx *gorm.DB, limit int, lease time.Duration) ([]WebhookDelivery, error) {
+	now := time.Now()
+	dueQuery := "status = ? AND next_attempt <= ? AND " +
+		"webhook_id IN (SELECT webhook_id FROM webhooks WHERE active = ?)"
+
+	var due []WebhookDelivery
+	err := tx.Where(dueQuery, DeliveryStatusPending, now, true).
+		Order("next_attempt").Limit(limit).Find(&due).Error
+	if err != nil || len(due) == 0 {
+		return nil, err
+	}
+
+	webhookIds := make([]string, len(due))
+	for i := range due {
+		webhookIds[i] = due[i].WebhookId
+	}
+	var webhooks []Webhook
+	if err := tx.Where("webhook_id IN ?", webhookIds).Find(&webhooks).Error; err != nil {
+		return nil, err
+	}
+	webhooksById := make(map[string]*Webhook, len(webhooks))
+	for i := range webhooks {
+		webhooksById[webhooks[i].WebhookId] = &webhooks[i]
+	}
+
+	claimed := make([]WebhookDelivery, 0, len(due))
+	for _, delivery := range due {
+		delivery.NextAttempt = now.Add(lease)
+		result := tx.Model(&WebhookDelivery{}).
+			Where("delivery_id = ? AND "+dueQuery, delivery.DeliveryId, DeliveryStatusPending, now, true).
+			Update("next_attempt", delivery.NextAttempt)
+		if result.Error != nil {
+			return nil, result.Error
+		}
+		delivery.Webhook = webhooksById[delivery.WebhookId]
+		if result.RowsAffected == 1 && delivery.Webhook != nil {
+			claimed = append(claimed, delivery)
+		}
+	}
+	return claimed, nil
+}
+
+// RecordAttempt logs an attempt to send the delivery. A 2xx status code
+// marks it delivered, anything else schedules a retry with exponential
+// backoff, until MaxWebhookAttempts is reached.
+func (d *WebhookDelivery) RecordAttempt(tx *gorm.DB, statusCode int, sendErr error) error {
+	now := time.Now()
+	d.Attempts++
+	d.LastStatusCode = statusCode
+	d.LastError = ""
+	if sendErr != nil {
+		d.LastError = sendErr.Error()
+	}
+
+	switch {
+	case sendErr == nil && statusCode >= 200 && statusCode < 300:
+		d.Status = DeliveryStatusDelivered
+		d.DeliveredTime = &now
+	case d.Attempts >= MaxWebhookAttempts:
+		d.Status = DeliveryStatusFailed
+	default:
+		delay := webhookRetryDelay << (d.Attempts - 1)
+		if delay > webhookMaxRetryDelay || delay <= 0 {
+			delay = webhookMaxRetryDelay
+		}
+		d.NextAttempt = now.Add(delay)
+	}
+
+	return tx.Model(&WebhookDelivery{}).Where("delivery_id = ?", d.DeliveryId).
+		Updates(map[string]interface{}{
+			"status":           d.Status,
+			"attempts":         d.Attempts,
+			"next_attempt":     d.NextAttempt,
+			"last_status_code": d.LastStatusCode,
+			"last_error":       d.LastError,
+			"delivered_time":   d.DeliveredTime,
+		}).Error
+}
@@ -0,0 +1,172 @@
+package dbfs_test
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/OhanaFS/ohana/dbfs"
+	"github.com/OhanaFS/ohana/util/testutil"
+	"github.com/stretchr/testify/assert"
+	"gorm.io/gorm"
+)
+
+func TestWebhooks(t *testing.T) {
+	db := testutil.NewMockDB(t)
+
+	superUser := dbfs.User{}
+
+	// Getting superuser account
+	err := db.Where("email = ?", "superuser").First(&superUser).Error
+	assert.NoError(t, err)
+
+	rootFolder, err := dbfs.GetRootFolder(db)
+	assert.NoError(t, err)
+
+	editor, err := dbfs.CreateNewUser(db, "hookEditor", "hookEditor", dbfs.AccountTypeEndUser,
+		"hookEditor", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+	outsider, err := dbfs.CreateNewUser(db, "hookOutsider", "hookOutsider", dbfs.AccountTypeEndUser,
+		"hookOutsider", "refreshToken", "accessToken", "idToken", "ThisServer")
+	assert.NoError(t, err)
+
+	// The editor can change the releases folder, the outsider cannot see it
+	releases, err := rootFolder.CreateSubFolder(db, "hookReleases", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	assert.NoError(t, releases.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true},
+		&superUser, *editor))
+	nightly, err := releases.CreateSubFolder(db, "nightly", &superUser, "ThisServer")
+	assert.NoError(t, err)
+	elsewhere, err := rootFolder.CreateSubFolder(db, "hookElsewhere", &superUser, "ThisServer")
+	assert.NoError(t, err)
+
+	var webhook *dbfs.Webhook
+
+	deliveries := func() []dbfs.WebhookDelivery {
+		log, err := webhook.GetDeliveries(db, 0)
+		assert.NoError(t, err)
+		return log
+	}
+
+	t.Run("Creating webhooks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		_, err := releases.CreateWebhook(db, outsider, "https://ci.example.com/hook",
+			[]string{dbfs.WebhookEventCreated})
+		Assert.ErrorIs(err, dbfs.ErrFileNotFound)
+		_, err = releases.CreateWebhook(db, &superUser, "ftp://ci.example.com/hook",
+			[]string{dbfs.WebhookEventCreated})
+		Assert.ErrorIs(err, dbfs.ErrInvalidWebhook)
+		_, err = releases.CreateWebhook(db, &superUser, "https://ci.example.com/hook",
+			[]string{"renamed"})
+		Assert.ErrorIs(err, dbfs.ErrInvalidWebhook)
+
+		webhook, err = releases.CreateWebhook(db, &superUser, "https://ci.example.com/hook",
+			[]string{dbfs.WebhookEventCreated, dbfs.WebhookEventMoved})
+		Assert.NoError(err)
+		Assert.NotEmpty(webhook.Secret)
+		Assert.Equal([]string{dbfs.WebhookEventCreated, dbfs.WebhookEventMoved}, webhook.EventTypes)
+
+		// The secret is not shown again
+		webhooks, err := releases.GetWebhooks(db, &superUser)
+		Assert.NoError(err)
+		Assert.Len(webhooks, 1)
+		Assert.Empty(webhooks[0].Secret)
+		_, err = dbfs.GetWebhookById(db, webhook.WebhookId, outsider)
+		Assert.ErrorIs(err, dbfs.ErrWebhookNotFound)
+	})
+
+	t.Run("Queueing events", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		build, err := EXAMPLECreateFile(db, editor, "build.zip", nightly.FileId)
+		Assert.NoError(err)
+		_, err = EXAMPLECreateFile(db, &superUser, "notes.txt", elsewhere.FileId)
+		Assert.NoError(err)
+
+		log := deliveries()
+		Assert.Len(log, 1)
+		Assert.Equal(dbfs.WebhookEventCreated, log[0].Event)
+		Assert.Equal(build.FileId, log[0].FileId)
+		Assert.Equal(dbfs.DeliveryStatusPending, log[0].Status)
+
+		var payload dbfs.WebhookPayload
+		Assert.NoError(json.Unmarshal([]byte(log[0].Payload), &payload))
+		Assert.Equal("build.zip", payload.FileName)
+		Assert.Equal(editor.UserId, *payload.UserId)
+
+		// Not subscribed to
+		Assert.NoError(build.AddPermissionUsers(db, &dbfs.PermissionNeeded{Read: true, Write: true}, &superUser, *editor))
+		Assert.Len(deliveries(), 1)
+
+		// Moving out of the folder is still seen
+		Assert.NoError(build.Move(db, elsewhere, &superUser))
+		log = deliveries()
+		Assert.Len(log, 2)
+		Assert.Equal(dbfs.WebhookEventMoved, log[0].Event)
+
+		// Nothing is sent for changes that were rolled back
+		err = db.Transaction(func(tx *gorm.DB) error {
+			if _, err := nightly.CreateSubFolder(tx, "rolled back", &superUser, "ThisServer"); err != nil {
+				return err
+			}
+			return errors.New("rollback")
+		})
+		Assert.Error(err)
+		Assert.Len(deliveries(), 2)
+
+		// Paused webhooks queue nothing
+		Assert.NoError(webhook.SetActive(db, false))
+		_, err = nightly.CreateSubFolder(db, "paused", &superUser, "ThisServer")
+		Assert.NoError(err)
+		Assert.Len(deliveries(), 2)
+		Assert.NoError(webhook.SetActive(db, true))
+	})
+
+	t.Run("Delivering", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		claimed, err := dbfs.ClaimWebhookDeliveries(db, 10, time.Minute)
+		Assert.NoError(err)
+		Assert.Len(claimed, 2)
+		Assert.NotNil(claimed[0].Webhook)
+		Assert.Equal(webhook.Secret, claimed[0].Webhook.Secret)
+
+		// They are not handed out twice
+		again, err := dbfs.ClaimWebhookDeliveries(db, 10, time.Minute)
+		Assert.NoError(err)
+		Assert.Len(again, 0)
+
+		Assert.NoError(claimed[0].RecordAttempt(db, 200, nil))
+		Assert.NoError(claimed[1].RecordAttempt(db, 503, nil))
+
+		statuses := map[string]dbfs.WebhookDelivery{}
+		for _, delivery := range deliveries() {
+			statuses[delivery.DeliveryId] = delivery
+		}
+		delivered := statuses[claimed[0].DeliveryId]
+		Assert.Equal(dbfs.DeliveryStatusDelivered, delivered.Status)
+		Assert.NotNil(delivered.DeliveredTime)
+		retrying := statuses[claimed[1].DeliveryId]
+		Assert.Equal(dbfs.DeliveryStatusPending, retrying.Status)
+		Assert.Equal(1, retrying.Attempts)
+		Assert.Equal(503, retrying.LastStatusCode)
+		Assert.True(retrying.NextAttempt.After(time.Now()))
+
+		// Until it gives up
+		for i := 1; i < dbfs.MaxWebhookAttempts; i++ {
+			Assert.NoError(claimed[1].RecordAttempt(db, 0, errors.New("connection refused")))
+		}
+		Assert.Equal(dbfs.DeliveryStatusFailed, claimed[1].Status)
+	})
+
+	t.Run("Deleting webhooks", func(t *testing.T) {
+		Assert := assert.New(t)
+
+		Assert.NoError(webhook.Delete(db))
+		_, err := dbfs.GetWebhookById(db, webhook.WebhookId, &superUser)
+		Assert.ErrorIs(err, dbfs.ErrWebhookNotFound)
+		Assert.Len(deliveries(), 0)
+	})
+}
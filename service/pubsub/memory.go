@@ -0,0 +1,53 @@
+package pubsub
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryPubSub only reaches the subscribers of the same process
+type MemoryPubSub struct {
+	subscribers map[string]map[chan string]bool
+	lock        sync.Mutex
+}
+
+func NewMemoryPubSub() PubSub {
+	return &MemoryPubSub{
+		subscribers: make(map[string]map[chan string]bool),
+	}
+}
+
+func (ps *MemoryPubSub) Publish(ctx context.Context, channel, message string) error {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+
+	for subscriber := range ps.subscribers[channel] {
+		select {
+		case subscriber <- message:
+		default:
+		}
+	}
+	return nil
+}
+
+func (ps *MemoryPubSub) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	subscriber := make(chan string, bufferSize)
+
+	ps.lock.Lock()
+	if ps.subscribers[channel] == nil {
+		ps.subscribers[channel] = make(map[chan string]bool)
+	}
+	ps.subscribers[channel][subscriber] = true
+	ps.lock.Unlock()
+
+	go func() {
+		<-ctx.Done()
+
+		ps.lock.Lock()
+		defer ps.lock.Unlock()
+		delete(ps.subscribers[channel], subscriber)
+		close(subscriber)
+	}()
+
+	return subscriber, nil
+}
@@ -0,0 +1,28 @@
+package pubsub_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/OhanaFS/ohana/service/pubsub"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	assert := assert.New(t)
+	ps := pubsub.NewMemoryPubSub()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := ps.Subscribe(ctx, "foo")
+	assert.Nil(err)
+
+	assert.Nil(ps.Publish(context.Background(), "bar", "not for foo"))
+	assert.Nil(ps.Publish(context.Background(), "foo", "hello"))
+	assert.Equal("hello", <-messages)
+
+	// The channel is closed once unsubscribed
+	cancel()
+	_, ok := <-messages
+	assert.False(ok)
+	assert.Nil(ps.Publish(context.Background(), "foo", "nobody listening"))
+}
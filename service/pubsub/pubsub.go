@@ -0,0 +1,14 @@
+package pubsub
+
+import "context"
+
+// bufferSize is the number of messages a subscriber can fall behind by
+// before the ones after are dropped
+const bufferSize = 64
+
+type PubSub interface {
+	Publish(ctx context.Context, channel, message string) error
+	// Subscribe returns the messages published to the channel, until ctx is
+	// done and the channel is closed
+	Subscribe(ctx context.Context, channel string) (<-chan string, error)
+}
@@ -0,0 +1,56 @@
+package pubsub
+
+import (
+	"context"
+
+	"github.com/OhanaFS/ohana/config"
+	"github.com/go-redis/redis/v9"
+)
+
+// Redis reaches the subscribers of every server using the same Redis
+type Redis struct {
+	rdb *redis.Client
+}
+
+func NewRedis(cfg *config.Config) PubSub {
+	rdb, _ := config.NewRedis(cfg)
+	return &Redis{rdb}
+}
+
+func (r *Redis) Publish(ctx context.Context, channel, message string) error {
+	return r.rdb.Publish(ctx, channel, message).Err()
+}
+
+func (r *Redis) Subscribe(ctx context.Context, channel string) (<-chan string, error) {
+	sub := r.rdb.Subscribe(ctx, channel)
+
+	// Wait for the subscription to be confirmed
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
+		return nil, err
+	}
+
+	messages := make(chan string, bufferSize)
+	go func() {
+		defer close(messages)
+		defer sub.Close()
+
+		received := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-received:
+				if !ok {
+					return
+				}
+				select {
+				case messages <- msg.Payload:
+				default:
+				}
+			}
+		}
+	}()
+
+	return messages, nil
+}
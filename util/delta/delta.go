@@ -0,0 +1,379 @@
+// Package delta computes binary patches between two versions of some data,
+// and applies them.
+//
+// Diff works like rsync: the base is split into blocks that are indexed by a
+// weak rolling checksum and a strong hash, and the target is scanned for those
+// blocks. The patch is made of copies from the base and literal bytes from the
+// target, ending with the size and SHA-256 of the target so that Apply can
+// check what it rebuilt.
+//
+// Only the block index of the base is held in memory, so both sides can be
+// much larger than the available memory.
+package delta
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"math"
+)
+
+const magic = "OHDELTA1"
+
+const (
+	opCopy   = 'C'
+	opInsert = 'I'
+	opEnd    = 'E'
+)
+
+const (
+	minBlockSize = 512
+	maxBlockSize = 64 * 1024
+
+	// maxLiteral is the largest run of literal bytes written as one insert
+	maxLiteral = 64 * 1024
+)
+
+var (
+	ErrInvalidPatch  = errors.New("invalid patch")
+	ErrPatchMismatch = errors.New("patched data does not match the patch checksum")
+)
+
+// BlockSize returns the size of the blocks that a base of the size given is
+// split into, which is around its square root.
+func BlockSize(baseSize int64) int {
+	size := int(math.Sqrt(float64(baseSize)))
+	if size < minBlockSize {
+		return minBlockSize
+	}
+	if size > maxBlockSize {
+		return maxBlockSize
+	}
+	return size
+}
+
+type block struct {
+	offset int64
+	strong [md5.Size]byte
+}
+
+// Diff writes a patch to patch that rebuilds target from base. baseSize is
+// used to pick the block size, and does not need to be exact.
+func Diff(base io.Reader, baseSize int64, target io.Reader, patch io.Writer) error {
+	blockSize := BlockSize(baseSize)
+
+	index, err := indexBase(base, blockSize)
+	if err != nil {
+		return fmt.Errorf("failed to read base: %w", err)
+	}
+
+	w := &patchWriter{w: bufio.NewWriter(patch)}
+	if _, err := w.w.WriteString(magic); err != nil {
+		return err
+	}
+
+	hasher := sha256.New()
+	counter := &countingReader{r: target}
+	s := &scanner{
+		r:         bufio.NewReader(io.TeeReader(counter, hasher)),
+		blockSize: blockSize,
+		buf:       make([]byte, 0, 2*blockSize),
+	}
+
+	if err := s.scan(index, w); err != nil {
+		return err
+	}
+
+	if err := w.end(counter.n, hasher.Sum(nil)); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// indexBase returns the full blocks of the base, by their weak checksum
+func indexBase(base io.Reader, blockSize int) (map[uint32][]block, error) {
+	index := make(map[uint32][]block)
+	buf := make([]byte, blockSize)
+	var offset int64
+	for {
+		_, err := io.ReadFull(base, buf)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return index, nil
+		} else if err != nil {
+			return nil, err
+		}
+
+		a, b := weakSum(buf)
+		weak := a | b<<16
+		index[weak] = append(index[weak], block{offset: offset, strong: md5.Sum(buf)})
+		offset += int64(blockSize)
+	}
+}
+
+// weakSum returns the two halves of the rolling checksum of the data
+func weakSum(data []byte) (uint32, uint32) {
+	var a, b uint32
+	n := uint32(len(data))
+	for i, c := range data {
+		a += uint32(c)
+		b += (n - uint32(i)) * uint32(c)
+	}
+	return a & 0xffff, b & 0xffff
+}
+
+// scanner looks for the blocks of the base in the target, keeping a window of
+// blockSize bytes at the end of buf.
+type scanner struct {
+	r         *bufio.Reader
+	blockSize int
+	buf       []byte
+	start     int
+	literal   []byte
+}
+
+// fill reads a whole window after the current one. It returns false if the
+// target ended first, leaving what was read in the window.
+func (s *scanner) fill() (bool, error) {
+	s.buf = s.buf[:0]
+	s.start = 0
+	for len(s.buf) < s.blockSize {
+		c, err := s.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			return false, nil
+		} else if err != nil {
+			return false, err
+		}
+		s.buf = append(s.buf, c)
+	}
+	return true, nil
+}
+
+func (s *scanner) window() []byte {
+	return s.buf[s.start:]
+}
+
+func (s *scanner) scan(index map[uint32][]block, w *patchWriter) error {
+	full, err := s.fill()
+	if err != nil {
+		return err
+	}
+	if !full {
+		return w.insert(s.window())
+	}
+
+	a, b := weakSum(s.window())
+	n := uint32(s.blockSize)
+	for {
+		if candidates, ok := index[a|b<<16]; ok {
+			strong := md5.Sum(s.window())
+			matched := false
+			for _, candidate := range candidates {
+				if candidate.strong == strong {
+					if err := w.insert(s.literal); err != nil {
+						return err
+					}
+					s.literal = s.literal[:0]
+					if err := w.copy(candidate.offset, int64(s.blockSize)); err != nil {
+						return err
+					}
+					matched = true
+					break
+				}
+			}
+
+			if matched {
+				full, err := s.fill()
+				if err != nil {
+					return err
+				}
+				if !full {
+					return w.insert(s.window())
+				}
+				a, b = weakSum(s.window())
+				continue
+			}
+		}
+
+		// No match, so the first byte of the window is a literal
+		out := s.buf[s.start]
+		s.literal = append(s.literal, out)
+		if len(s.literal) >= maxLiteral {
+			if err := w.insert(s.literal); err != nil {
+				return err
+			}
+			s.literal = s.literal[:0]
+		}
+
+		in, err := s.r.ReadByte()
+		if errors.Is(err, io.EOF) {
+			s.literal = append(s.literal, s.buf[s.start+1:]...)
+			return w.insert(s.literal)
+		} else if err != nil {
+			return err
+		}
+
+		// Keep the window contiguous, moving it to the front when full
+		if len(s.buf) == cap(s.buf) {
+			copy(s.buf, s.buf[s.start:])
+			s.buf = s.buf[:s.blockSize]
+			s.start = 0
+		}
+		s.buf = append(s.buf, in)
+		s.start++
+
+		a = (a - uint32(out) + uint32(in)) & 0xffff
+		b = (b - n*uint32(out) + a) & 0xffff
+	}
+}
+
+// patchWriter writes the operations of a patch, merging adjacent copies
+type patchWriter struct {
+	w          *bufio.Writer
+	copyOffset int64
+	copyLength int64
+}
+
+func (p *patchWriter) copy(offset, length int64) error {
+	if p.copyLength > 0 && p.copyOffset+p.copyLength == offset {
+		p.copyLength += length
+		return nil
+	}
+	if err := p.flushCopy(); err != nil {
+		return err
+	}
+	p.copyOffset, p.copyLength = offset, length
+	return nil
+}
+
+func (p *patchWriter) flushCopy() error {
+	if p.copyLength == 0 {
+		return nil
+	}
+	err := p.op(opCopy, uint64(p.copyOffset), uint64(p.copyLength))
+	p.copyLength = 0
+	return err
+}
+
+func (p *patchWriter) insert(data []byte) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if err := p.flushCopy(); err != nil {
+		return err
+	}
+	if err := p.op(opInsert, uint64(len(data))); err != nil {
+		return err
+	}
+	_, err := p.w.Write(data)
+	return err
+}
+
+func (p *patchWriter) end(size int64, checksum []byte) error {
+	if err := p.flushCopy(); err != nil {
+		return err
+	}
+	if err := p.op(opEnd, uint64(size)); err != nil {
+		return err
+	}
+	_, err := p.w.Write(checksum)
+	return err
+}
+
+func (p *patchWriter) op(op byte, args ...uint64) error {
+	if err := p.w.WriteByte(op); err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	for _, arg := range args {
+		n := binary.PutUvarint(buf[:], arg)
+		if _, err := p.w.Write(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply rebuilds the target of a patch from its base, writing it to out
+func Apply(base io.ReadSeeker, patch io.Reader, out io.Writer) error {
+	r := bufio.NewReader(patch)
+
+	header := make([]byte, len(magic))
+	if _, err := io.ReadFull(r, header); err != nil || string(header) != magic {
+		return ErrInvalidPatch
+	}
+
+	hasher := sha256.New()
+	w := io.MultiWriter(out, hasher)
+	var written int64
+
+	for {
+		op, err := r.ReadByte()
+		if err != nil {
+			return ErrInvalidPatch
+		}
+
+		switch op {
+		case opCopy:
+			offset, err1 := binary.ReadUvarint(r)
+			length, err2 := binary.ReadUvarint(r)
+			if err1 != nil || err2 != nil || offset > math.MaxInt64 || length > math.MaxInt64 {
+				return ErrInvalidPatch
+			}
+			if _, err := base.Seek(int64(offset), io.SeekStart); err != nil {
+				return err
+			}
+			if _, err := io.CopyN(w, base, int64(length)); err != nil {
+				return fmt.Errorf("failed to copy from base: %w", err)
+			}
+			written += int64(length)
+
+		case opInsert:
+			length, err := binary.ReadUvarint(r)
+			if err != nil || length > math.MaxInt64 {
+				return ErrInvalidPatch
+			}
+			if _, err := io.CopyN(w, r, int64(length)); err != nil {
+				return ErrInvalidPatch
+			}
+			written += int64(length)
+
+		case opEnd:
+			return checkEnd(r, written, hasher)
+
+		default:
+			return ErrInvalidPatch
+		}
+	}
+}
+
+func checkEnd(r *bufio.Reader, written int64, hasher hash.Hash) error {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return ErrInvalidPatch
+	}
+	checksum := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(r, checksum); err != nil {
+		return ErrInvalidPatch
+	}
+	if uint64(written) != size || !bytes.Equal(checksum, hasher.Sum(nil)) {
+		return ErrPatchMismatch
+	}
+	return nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,74 @@
+package delta_test
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/OhanaFS/ohana/util/delta"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDelta(t *testing.T) {
+	assert := assert.New(t)
+
+	random := func(seed int64, size int) []byte {
+		data := make([]byte, size)
+		rand.New(rand.NewSource(seed)).Read(data)
+		return data
+	}
+
+	roundTrip := func(base, target []byte) []byte {
+		var patch bytes.Buffer
+		assert.NoError(delta.Diff(bytes.NewReader(base), int64(len(base)), bytes.NewReader(target), &patch))
+
+		var out bytes.Buffer
+		assert.NoError(delta.Apply(bytes.NewReader(base), bytes.NewReader(patch.Bytes()), &out))
+		assert.True(bytes.Equal(target, out.Bytes()))
+		return patch.Bytes()
+	}
+
+	base := random(1, 1<<20)
+
+	t.Run("Similar data", func(t *testing.T) {
+		// Bytes changed, inserted and removed
+		target := append([]byte{}, base[:100_000]...)
+		target = append(target, random(2, 5000)...)
+		target = append(target, base[100_000:500_000]...)
+		target = append(target, base[520_000:]...)
+		target[700_000] ^= 0xff
+
+		patch := roundTrip(base, target)
+		assert.Less(len(patch), 20_000)
+
+		// Identical data is mostly copies
+		assert.Less(len(roundTrip(base, base)), 100)
+	})
+
+	t.Run("Unrelated and small data", func(t *testing.T) {
+		roundTrip(base, random(3, 300_000))
+		roundTrip(base, []byte("short"))
+		roundTrip(base, nil)
+		roundTrip(nil, base[:10_000])
+		roundTrip([]byte("tiny base"), []byte("tiny target"))
+	})
+
+	t.Run("Invalid patches", func(t *testing.T) {
+		target := append(append([]byte{}, base[:300_000]...), "changed"...)
+		var patch bytes.Buffer
+		assert.NoError(delta.Diff(bytes.NewReader(base), int64(len(base)), bytes.NewReader(target), &patch))
+
+		var out bytes.Buffer
+		err := delta.Apply(bytes.NewReader(base), bytes.NewReader([]byte("garbage")), &out)
+		assert.ErrorIs(err, delta.ErrInvalidPatch)
+
+		// Applied to the wrong base
+		out.Reset()
+		err = delta.Apply(bytes.NewReader(random(4, len(base))), bytes.NewReader(patch.Bytes()), &out)
+		assert.ErrorIs(err, delta.ErrPatchMismatch)
+
+		out.Reset()
+		err = delta.Apply(bytes.NewReader(base), bytes.NewReader(patch.Bytes()[:patch.Len()-10]), &out)
+		assert.ErrorIs(err, delta.ErrInvalidPatch)
+	})
+}
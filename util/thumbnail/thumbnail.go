@@ -0,0 +1,114 @@
+// Package thumbnail decodes images and scales them down into thumbnails.
+package thumbnail
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"io"
+
+	// Registering the decoders for image.Decode
+	_ "image/gif"
+	_ "image/png"
+)
+
+// MIMEType is the type of the thumbnails produced by Encode
+const MIMEType = "image/jpeg"
+
+// MaxPixels is the largest image (in width * height) that will be decoded, as
+// decoding holds the whole image in memory.
+const MaxPixels = 40_000_000
+
+var ErrImageTooLarge = errors.New("image is too large to make a thumbnail of")
+
+// Decode decodes a JPEG, PNG or GIF image, refusing images larger than
+// MaxPixels. Transparent areas are flattened onto white.
+func Decode(r io.ReadSeeker) (*image.RGBA, error) {
+	config, _, err := image.DecodeConfig(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image header: %w", err)
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width*config.Height > MaxPixels {
+		return nil, ErrImageTooLarge
+	}
+
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image: %w", err)
+	}
+
+	bounds := img.Bounds()
+	flat := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flat, flat.Bounds(), img, bounds.Min, draw.Over)
+	return flat, nil
+}
+
+// Resize scales the image down so that its longest side is at most size
+// pixels, keeping its aspect ratio. Each pixel of the result is the average of
+// the pixels that it covers. Images that are already small enough are
+// returned as is.
+func Resize(src *image.RGBA, size int) *image.RGBA {
+	sw, sh := src.Bounds().Dx(), src.Bounds().Dy()
+	if sw <= size && sh <= size {
+		return src
+	}
+
+	dw, dh := size, size
+	if sw > sh {
+		dh = max(1, sh*size/sw)
+	} else {
+		dw = max(1, sw*size/sh)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for dy := 0; dy < dh; dy++ {
+		y0, y1 := dy*sh/dh, max((dy+1)*sh/dh, dy*sh/dh+1)
+		for dx := 0; dx < dw; dx++ {
+			x0, x1 := dx*sw/dw, max((dx+1)*sw/dw, dx*sw/dw+1)
+
+			var r, g, b, a, n int
+			for y := y0; y < y1; y++ {
+				row := src.Pix[y*src.Stride:]
+				for x := x0; x < x1; x++ {
+					p := row[x*4 : x*4+4]
+					r += int(p[0])
+					g += int(p[1])
+					b += int(p[2])
+					a += int(p[3])
+					n++
+				}
+			}
+
+			i := dst.PixOffset(dx, dy)
+			dst.Pix[i+0] = uint8(r / n)
+			dst.Pix[i+1] = uint8(g / n)
+			dst.Pix[i+2] = uint8(b / n)
+			dst.Pix[i+3] = uint8(a / n)
+		}
+	}
+	return dst
+}
+
+// Encode encodes a thumbnail as a JPEG
+func Encode(img image.Image) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
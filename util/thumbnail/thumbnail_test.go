@@ -0,0 +1,49 @@
+package thumbnail_test
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+
+	"github.com/OhanaFS/ohana/util/thumbnail"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestThumbnail(t *testing.T) {
+	assert := assert.New(t)
+
+	// A 400x200 image, red on the left half and transparent on the right
+	src := image.NewNRGBA(image.Rect(0, 0, 400, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 200; x++ {
+			src.Set(x, y, color.NRGBA{R: 255, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	assert.NoError(png.Encode(&buf, src))
+
+	img, err := thumbnail.Decode(bytes.NewReader(buf.Bytes()))
+	assert.NoError(err)
+	assert.Equal(image.Rect(0, 0, 400, 200), img.Bounds())
+
+	// Scaled down, keeping the aspect ratio
+	small := thumbnail.Resize(img, 100)
+	assert.Equal(image.Rect(0, 0, 100, 50), small.Bounds())
+	assert.Equal(color.RGBA{R: 255, A: 255}, small.RGBAAt(10, 10))
+	assert.Equal(color.RGBA{R: 255, G: 255, B: 255, A: 255}, small.RGBAAt(90, 10))
+
+	// Never scaled up
+	assert.Same(img, thumbnail.Resize(img, 512))
+
+	data, err := thumbnail.Encode(small)
+	assert.NoError(err)
+	decoded, err := jpeg.Decode(bytes.NewReader(data))
+	assert.NoError(err)
+	assert.Equal(small.Bounds(), decoded.Bounds())
+
+	_, err = thumbnail.Decode(bytes.NewReader([]byte("not an image")))
+	assert.Error(err)
+}